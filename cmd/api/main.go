@@ -1,34 +1,106 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
+	"net/http"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
 	"otp/internal/api"
+	"otp/internal/backupcodes"
 	"otp/internal/config"
 	"otp/internal/crypto"
 	"otp/internal/db"
+	"otp/internal/keys"
+	"otp/internal/members"
 	"otp/internal/middleware"
+	"otp/internal/ratelimit"
+	"otp/internal/rekey"
+	"otp/internal/tenantkeys"
+	"otp/internal/tiers"
+	"otp/internal/usage"
 )
 
 func main() {
 	// Load configuration
 	cfg := config.Load()
-
-	// Configure encryption key
-	if err := crypto.SetKey(cfg.EncryptionKey); err != nil {
-		log.Fatalf("invalid ENCRYPTION_KEY: %v", err)
+	if err := cfg.Validate(); err != nil {
+		log.Fatalf("invalid configuration: %v", err)
+	}
+	if cfg.TierCatalogFile != "" {
+		if err := tiers.LoadFile(cfg.TierCatalogFile); err != nil {
+			log.Fatalf("tier catalog: %v", err)
+		}
+	}
+	if cfg.UsesDevEncryptionKey() {
+		log.Println("WARNING: using the development ENCRYPTION_KEY; set your own key before storing real secrets")
 	}
 
-	// Initialize database
+	// Initialize database (before the keyring: passphrase-derived keys use salts stored there)
 	if err := db.Init(cfg.DatabaseURL); err != nil {
 		log.Fatalf("database init failed: %v", err)
 	}
 	defer db.DB.Close()
 
+	// Configure encryption: the keyring decrypts data written before envelope encryption (and
+	// is the KEK source for the env provider); the provider wraps customer data keys, which
+	// live in Postgres.
+	if cfg.EncryptionKey != "" || cfg.EncryptionKeys != "" {
+		if err := crypto.LoadKeyring(cfg.EncryptionKey, cfg.EncryptionKeys, cfg.EncryptionKeyVersion, db.KeySalt); err != nil {
+			log.Fatalf("invalid encryption keys: %v", err)
+		}
+	}
+	provider, err := keyProvider(cfg)
+	if err != nil {
+		log.Fatalf("key provider init failed: %v", err)
+	}
+	crypto.SetProvider(provider, time.Duration(cfg.DEKCacheTTLSeconds)*time.Second, cfg.DEKCacheSize)
+	crypto.SetTenantKeyStore(tenantkeys.Store{})
+	if !crypto.HasTenantKeys() {
+		log.Println("WARNING: no per-customer keys (TENANT_KEY_DIR or VAULT_TENANT_KEYS); customer erasure is refused")
+	}
+
+	// Fail fast if the key can't read what earlier runs wrote
+	if err := rekey.SelfTest(); err != nil {
+		log.Fatalf("encryption self-test failed: %v", err)
+	}
+
+	// Re-seal ciphertexts in older formats with customer data keys, bound to their rows;
+	// unbound ones are rejected
+	if err := rekey.SealUnbound(); err != nil {
+		log.Fatalf("sealing encrypted fields failed: %v", err)
+	}
+
+	// Hash any backup codes still stored in the legacy encrypted form
+	go backupcodes.UpgradeLegacy()
+	// Continue any re-encryption job interrupted by a restart
+	rekey.ResumeRunning()
+	// Deactivate expired API keys and warn about expiring ones
+	keys.StartSweeper()
+	// Delete printable backup code sheets nobody fetched in time
+	go func() {
+		for {
+			if _, err := backupcodes.PurgeExpired(); err != nil {
+				log.Printf("backup code sheet purge failed: %v", err)
+			}
+			time.Sleep(time.Minute)
+		}
+	}()
+	// Keep authenticated keys in memory and write usage in batches; the batch still buffered
+	// is flushed on shutdown
+	middleware.SetAPIKeyCache(time.Duration(cfg.APIKeyCacheTTLSeconds)*time.Second, cfg.APIKeyCacheSize)
+	if cfg.UsageFlushIntervalMs > 0 {
+		usage.Start(time.Duration(cfg.UsageFlushIntervalMs)*time.Millisecond, cfg.UsageFlushBatchSize)
+	}
+
 	// Gin setup
 	r := gin.New()
 	r.Use(gin.Recovery())
@@ -45,12 +117,19 @@ func main() {
 	r.Use(cors.New(cors.Config{
 		AllowOrigins:     cfg.CORSAllowedOrigins,
 		AllowMethods:     []string{"GET", "POST"},
-		AllowHeaders:     []string{"Authorization", "Content-Type", "X-Bootstrap-Token", "X-Session-Token", "X-Request-ID"},
-		ExposeHeaders:    []string{"X-Request-ID"},
+		AllowHeaders:     []string{"Authorization", "Content-Type", "X-Bootstrap-Token", "X-Session-Token", "X-Request-ID", keys.TimestampHeader, keys.NonceHeader, keys.ClientTokenHeader},
+		ExposeHeaders:    []string{"X-Request-ID", "RateLimit-Policy", "RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "Retry-After"},
 		AllowCredentials: false,
+		// browser enrollment routes also accept the origins of publishable keys
+		AllowOriginWithContextFunc: middleware.PublishableKeyOrigin,
 	}))
 
-	// Rate limiting: apply per-IP globally
+	// Rate limiting: counters live in the configured store; apply per-IP globally
+	limits, err := rateLimitStore(cfg)
+	if err != nil {
+		log.Fatalf("rate limit store init failed: %v", err)
+	}
+	middleware.SetRateLimiter(&ratelimit.Limiter{Store: limits, Algorithm: ratelimit.Algorithm(cfg.RateLimitAlgorithm), Burst: cfg.RateLimitBurst})
 	if cfg.RateLimitPerIP > 0 {
 		r.Use(middleware.RateLimiter(cfg.RateLimitPerIP, 0))
 	}
@@ -71,74 +150,144 @@ func main() {
 			auth.POST("/register", api.Register)
 			auth.POST("/verify_email", api.VerifyEmail)
 			auth.POST("/login", api.Login)
+			// second factor for logins with MFA, exchanging the interim token for a session
+			auth.POST("/mfa/enroll", api.EnrollLoginMFA)
+			auth.POST("/mfa/verify", api.VerifyLoginMFA)
 			// logout requires session
 			auth.POST("/logout", middleware.SessionAuth(), api.Logout)
 			// password reset flows
 			auth.POST("/password/request_reset", api.RequestPasswordReset)
 			auth.POST("/password/reset", api.ResetPassword)
+			auth.POST("/invitations/accept", api.AcceptInvitation)
 		}
 
 		mfa := v1.Group("/mfa")
-		mfa.Use(middleware.APIKeyAuth())
-		if cfg.RateLimitPerAPIKey > 0 {
-			mfa.Use(middleware.RateLimiter(0, cfg.RateLimitPerAPIKey))
+		mfa.Use(middleware.APIKeyAuth(), middleware.APIKeyRateLimiter())
+		{
+			register := middleware.RequireScope(keys.ScopeMFARegister)
+			validate := middleware.RequireScope(keys.ScopeMFAValidate)
+			manage := middleware.RequireScope(keys.ScopeMFAManage)
+			mfa.POST("/register", register, api.RegisterMFA)
+			mfa.POST("/rename", manage, api.BulkRenameMFAUsers)
+			mfa.GET("/:id/qr", register, api.GetQRCode)
+			mfa.POST("/:id", validate, api.ValidateOTP)
+			mfa.POST("/:id/disable", manage, api.DisableMFA)
+			mfa.POST("/:id/reset", manage, api.ResetMFA)
+			mfa.POST("/:id/rename", manage, api.RenameMFAUser)
+			mfa.POST("/:id/metadata", manage, api.UpdateMFAUserMetadata)
+			mfa.POST("/:id/backup_codes/regenerate", manage, api.RegenerateBackupCodes)
+			mfa.POST("/:id/backup_codes/consume", validate, api.ConsumeBackupCode)
+			mfa.GET("/:id/backup_codes/sheet", register, api.GetBackupCodeSheet)
+			mfa.POST("/:id/client_token", register, api.CreateClientToken)
 		}
+
+		// Browser enrollment with a publishable key and a client token
+		client := v1.Group("/client")
+		client.Use(middleware.PublishableKeyAuth(), middleware.APIKeyRateLimiter(), middleware.RequirePendingEnrollment())
 		{
-			mfa.POST("/register", api.RegisterMFA)
-			mfa.GET("/:id/qr", api.GetQRCode)
-			mfa.POST("/:id", api.ValidateOTP)
-			mfa.POST("/:id/disable", api.DisableMFA)
-			mfa.POST("/:id/reset", api.ResetMFA)
-			mfa.POST("/:id/backup_codes/regenerate", api.RegenerateBackupCodes)
-			mfa.POST("/:id/backup_codes/consume", api.ConsumeBackupCode)
+			client.GET("/mfa/:id/qr", api.GetQRCode)
+			client.POST("/mfa/:id/confirm", api.ValidateOTP)
 		}
 
 		// API key management
-		keys := v1.Group("/keys")
-		keys.Use(middleware.APIKeyAuth())
-		if cfg.RateLimitPerAPIKey > 0 {
-			keys.Use(middleware.RateLimiter(0, cfg.RateLimitPerAPIKey))
-		}
+		k := v1.Group("/keys")
+		k.Use(middleware.APIKeyAuth(), middleware.APIKeyRateLimiter())
 		{
-			keys.POST("/", api.CreateAPIKey)
-			keys.GET("/", api.ListAPIKeys)
-			keys.GET("/:id/usage", api.GetAPIKeyUsage)
-			keys.POST("/:id/disable", api.DisableAPIKey)
-			keys.POST("/:id/rotate", api.RotateAPIKey)
+			manage := middleware.RequireScope(keys.ScopeKeysManage)
+			k.POST("/", manage, api.CreateAPIKey)
+			k.GET("/", manage, api.ListAPIKeys)
+			k.GET("/:id", manage, api.GetAPIKey)
+			k.POST("/:id", manage, api.UpdateAPIKey)
+			k.GET("/:id/usage", middleware.RequireScope(keys.ScopeUsageRead), api.GetAPIKeyUsage)
+			k.POST("/:id/disable", manage, api.DisableAPIKey)
+			k.POST("/:id/enable", manage, api.EnableAPIKey)
+			k.POST("/:id/rotate", manage, api.RotateAPIKey)
+			k.POST("/:id/scopes", manage, api.UpdateAPIKeyScopes)
+			k.POST("/:id/rate_limits", manage, api.UpdateAPIKeyRateLimits)
+			k.POST("/:id/allowed_cidrs", manage, api.UpdateAPIKeyAllowedCIDRs)
+			k.POST("/:id/auth_mode", manage, api.UpdateAPIKeyAuthMode)
+			k.POST("/:id/allowed_origins", manage, api.UpdateAPIKeyAllowedOrigins)
 		}
 
-		// Console (session) routes for API key management
+		// Console (session) routes for API key management. Each route needs a permission of
+		// the member's role (see internal/members); their own login's MFA needs none.
 		console := v1.Group("/console")
 		console.Use(middleware.SessionAuth())
 		{
 			// Customer-level usage summary
-			console.GET("/usage/summary", api.GetCustomerUsageSummary)
+			console.GET("/usage/summary", middleware.RequirePermission(members.PermUsage), api.GetCustomerUsageSummary)
+
+			// Account
+			console.POST("/account/erase", middleware.RequirePermission(members.PermAccount), api.EraseAccount)
+			console.GET("/account/mfa", api.GetConsoleMFA)
+			console.POST("/account/mfa/enroll", api.EnrollConsoleMFA)
+			console.POST("/account/mfa/confirm", api.ConfirmConsoleMFA)
+			console.POST("/account/mfa/disable", api.DisableConsoleMFA)
+			console.POST("/account/mfa/backup_codes/regenerate", api.RegenerateConsoleBackupCodes)
+
+			// Members and invitations
+			console.GET("/me", api.GetCurrentMember)
+			console.GET("/members", api.ListMembers)
+			cmem := console.Group("/members")
+			cmem.Use(middleware.RequirePermission(members.PermMembers))
+			{
+				cmem.POST("/invitations", api.InviteMember)
+				cmem.GET("/invitations", api.ListInvitations)
+				cmem.POST("/invitations/:id/revoke", api.RevokeInvitation)
+				cmem.POST("/:id/role", api.UpdateMemberRole)
+				cmem.POST("/:id/remove", api.RemoveMember)
+				cmem.POST("/:id/mfa/reset", api.ResetMemberMFA)
+			}
+
+			// Settings
+			settings := middleware.RequirePermission(members.PermSettings)
+			console.GET("/settings/backup_codes", settings, api.GetBackupCodePolicy)
+			console.POST("/settings/backup_codes", settings, api.UpdateBackupCodePolicy)
 
 			// Billing
-			console.GET("/billing/events", api.ListBillingEvents)
-			console.GET("/billing/summary", api.GetBillingSummary)
+			billing := middleware.RequirePermission(members.PermBilling)
+			console.GET("/billing/events", billing, api.ListBillingEvents)
+			console.GET("/billing/summary", billing, api.GetBillingSummary)
 
 			ck := console.Group("/keys")
+			ck.Use(middleware.RequirePermission(members.PermKeys))
 			{
 				ck.POST("/", api.CreateAPIKey)
 				ck.GET("/", api.ListAPIKeys)
+				ck.GET("/:id", api.GetAPIKey)
+				ck.POST("/:id", api.UpdateAPIKey)
 				ck.GET("/:id/usage", api.GetAPIKeyUsage)
 				ck.POST("/:id/disable", api.DisableAPIKey)
+				ck.POST("/:id/enable", api.EnableAPIKey)
 				ck.POST("/:id/rotate", api.RotateAPIKey)
+				ck.POST("/:id/scopes", api.UpdateAPIKeyScopes)
+				ck.POST("/:id/rate_limits", api.UpdateAPIKeyRateLimits)
+				ck.POST("/:id/allowed_cidrs", api.UpdateAPIKeyAllowedCIDRs)
+				ck.POST("/:id/auth_mode", api.UpdateAPIKeyAuthMode)
+				ck.POST("/:id/allowed_origins", api.UpdateAPIKeyAllowedOrigins)
 			}
 
 			cm := console.Group("/mfa")
+			cm.Use(middleware.ConsoleEnvironment())
 			{
-				cm.GET("/", api.ListMFAUsers)
-				cm.GET("/:id/qr", api.GetQRCode)
-				cm.POST("/:id/disable", api.DisableMFA)
-				cm.POST("/:id/reset", api.ResetMFA)
-				cm.POST("/:id/backup_codes/regenerate", api.RegenerateBackupCodes)
+				read := middleware.RequirePermission(members.PermMFAUsersRead)
+				write := middleware.RequirePermission(members.PermMFAUsersWrite)
+				cm.GET("/", read, api.ListMFAUsers)
+				cm.GET("/:id", read, api.GetMFAUser)
+				cm.GET("/:id/timeline", read, api.MFAUserTimeline)
+				cm.POST("/rename", write, api.BulkRenameMFAUsers)
+				cm.GET("/:id/qr", write, api.GetQRCode)
+				cm.POST("/:id/disable", write, api.DisableMFA)
+				cm.POST("/:id/reset", write, api.ResetMFA)
+				cm.POST("/:id/rename", write, api.RenameMFAUser)
+				cm.POST("/:id/metadata", write, api.UpdateMFAUserMetadata)
+				cm.POST("/:id/backup_codes/regenerate", write, api.RegenerateBackupCodes)
+				cm.GET("/:id/backup_codes/sheet", write, api.GetBackupCodeSheet)
 			}
 		}
 
 		// Realtime analytics stream (SSE) - use QS auth to support EventSource
-		v1.GET("/console/analytics/stream", middleware.SessionAuthQS(), api.AnalyticsStream)
+		v1.GET("/console/analytics/stream", middleware.SessionAuthQS(), middleware.RequirePermission(members.PermUsage), api.AnalyticsStream)
 
 		// Customer management (admin protected)
 		customers := v1.Group("/customers")
@@ -148,10 +297,25 @@ func main() {
 			customers.GET("/", api.ListCustomers)
 			customers.POST("/:id", api.UpdateCustomer)
 			customers.POST("/:id/disable", api.DisableCustomer)
+			customers.POST("/:id/mfa/reset", api.ResetCustomerMFA)
+			customers.POST("/:id/erase", api.EraseCustomer)
+		}
+
+		// Operator endpoints (admin protected)
+		admin := v1.Group("/admin")
+		admin.Use(middleware.AdminTokenAuth())
+		{
+			admin.GET("/rekey", api.GetRekeyStatus)
+			admin.POST("/rekey", api.StartRekey)
+			admin.POST("/rekey/:id/pause", api.PauseRekey)
+			admin.POST("/rekey/:id/resume", api.ResumeRekey)
 		}
 
 		// Billing webhooks
 		v1.POST("/billing/webhook", api.BillingWebhook)
+
+		// Leaked key reports from secret-scanning partners
+		v1.POST("/secret_scanning/reports", middleware.SecretScanningAuth(), api.ReportLeakedKeys)
 	}
 
 	// Static test page
@@ -161,9 +325,76 @@ func main() {
 	r.GET("/", func(c *gin.Context) { c.File("./index.html") })
 
 	port := cfg.Port
-	if port == "" { port = "8080" }
-	log.Printf("Server starting on port %s", port)
-	if err := r.Run(":" + port); err != nil {
-		log.Fatal(err)
+	if port == "" {
+		port = "8080"
+	}
+	srv := &http.Server{Addr: ":" + port, Handler: r}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		log.Printf("Server starting on port %s", port)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+	<-ctx.Done()
+
+	// finish in-flight requests, then write the usage they recorded
+	log.Println("Shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("server shutdown: %v", err)
+	}
+	if err := usage.Stop(); err != nil {
+		log.Printf("final usage flush failed: %v", err)
+	}
+}
+
+// rateLimitStore builds the counter store selected by RATE_LIMIT_STORE.
+func rateLimitStore(cfg *config.Config) (ratelimit.Store, error) {
+	switch cfg.RateLimitStore {
+	case "memory":
+		return ratelimit.NewMemoryStore(cfg.RateLimitMemoryMaxKeys), nil
+	case "postgres":
+		return ratelimit.NewPostgresStore(db.DB), nil
+	case "redis":
+		return ratelimit.NewRedisStore(cfg.RateLimitRedisURL, cfg.RateLimitRedisPoolSize)
+	}
+	return nil, fmt.Errorf("unknown RATE_LIMIT_STORE %q (want memory, postgres or redis)", cfg.RateLimitStore)
+}
+
+// keyProvider builds the KEK provider selected by KEY_PROVIDER.
+func keyProvider(cfg *config.Config) (crypto.KeyProvider, error) {
+	var p crypto.KeyProvider
+	switch cfg.KeyProvider {
+	case "env":
+		if len(crypto.Versions()) == 0 {
+			return nil, fmt.Errorf("KEY_PROVIDER=env requires ENCRYPTION_KEY or ENCRYPTION_KEYS")
+		}
+		p = crypto.KeyringProvider{}
+	case "file":
+		if cfg.KeystorePath == "" {
+			return nil, fmt.Errorf("KEY_PROVIDER=file requires KEYSTORE_PATH")
+		}
+		fp, err := crypto.NewFileProvider(cfg.KeystorePath)
+		if err != nil {
+			return nil, err
+		}
+		p = fp
+	case "vault":
+		if cfg.VaultAddr == "" || cfg.VaultToken == "" {
+			return nil, fmt.Errorf("KEY_PROVIDER=vault requires VAULT_ADDR and VAULT_TOKEN")
+		}
+		if cfg.VaultTenantKeys {
+			return crypto.NewVaultTenantProvider(cfg.VaultAddr, cfg.VaultToken, cfg.VaultTransitMount, cfg.VaultTransitKey), nil
+		}
+		return crypto.NewVaultTransitProvider(cfg.VaultAddr, cfg.VaultToken, cfg.VaultTransitMount, cfg.VaultTransitKey), nil
+	default:
+		return nil, fmt.Errorf("unknown KEY_PROVIDER %q (want env, file or vault)", cfg.KeyProvider)
+	}
+	if cfg.TenantKeyDir == "" {
+		return p, nil
 	}
+	return crypto.NewDirTenantProvider(p, cfg.TenantKeyDir)
 }
@@ -5,6 +5,8 @@ export interface MfaUserItem {
   account_name: string
   issuer: string
   is_active: boolean
+  metadata: Record<string, unknown>
+  tags: string[]
   created_at: string
   updated_at: string
 }
@@ -16,7 +18,7 @@ export interface ResetMfaResponse {
 
 export type CreateMfaResponse = ResetMfaResponse
 
-export async function listMfaUsers(params?: { q?: string; status?: 'active'|'disabled'|'all' }): Promise<MfaUserItem[]> {
+export async function listMfaUsers(params?: { q?: string; status?: 'active'|'disabled'|'all'; tag?: string; meta_key?: string; meta_value?: string }): Promise<MfaUserItem[]> {
   const { data } = await api.get('/console/mfa/', { params })
   return data.data as MfaUserItem[]
 }
@@ -14,6 +14,7 @@ import (
 	"otp/internal/config"
 	"otp/internal/db"
 	"otp/internal/keys"
+	"otp/internal/members"
 )
 
 // Register
@@ -37,9 +38,14 @@ func Register(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to hash password"})
 		return
 	}
+	// the customer and its first member, the owner, who shares its id
 	var customerID string
-	err = db.DB.QueryRow(`INSERT INTO customers (company_name, email, password_hash, subscription_tier, is_active)
-		VALUES ($1, $2, $3, 'starter', true) RETURNING id`, req.CompanyName, email, string(pwHash)).Scan(&customerID)
+	err = db.DB.QueryRow(`WITH c AS (
+			INSERT INTO customers (company_name, email, password_hash, subscription_tier, is_active)
+			VALUES ($1, $2, $3, 'starter', true) RETURNING id
+		)
+		INSERT INTO members (id, customer_id, email, password_hash, role) SELECT id, id, $2, $3, $4 FROM c RETURNING id`,
+		req.CompanyName, email, string(pwHash), members.RoleOwner).Scan(&customerID)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "could not create customer (duplicate email?)"})
 		return
@@ -90,7 +96,7 @@ func VerifyEmail(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"status": "verified"})
 }
 
-// Login
+// Login signs a member in with their own email and password.
 // POST /api/v1/auth/login
 // { email, password }
 type loginRequest struct { Email string `json:"email" binding:"required"`; Password string `json:"password" binding:"required"` }
@@ -99,21 +105,29 @@ func Login(c *gin.Context) {
 	var req loginRequest
 	if err := c.ShouldBindJSON(&req); err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
 	email := strings.TrimSpace(strings.ToLower(req.Email))
-	var customerID string
+	var customerID, memberID string
 	var pwHash string
 	var isActive sql.NullBool
-	err := db.DB.QueryRow(`SELECT id, password_hash, COALESCE(is_active, true) FROM customers WHERE email = $1`, email).Scan(&customerID, &pwHash, &isActive)
+	err := db.DB.QueryRow(`SELECT m.customer_id, m.id, m.password_hash, m.is_active AND COALESCE(c.is_active, true)
+		FROM members m JOIN customers c ON c.id = m.customer_id WHERE m.email = $1`, email).Scan(&customerID, &memberID, &pwHash, &isActive)
 	if err == sql.ErrNoRows { c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid credentials"}); return }
 	if err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"}); return }
 	if !isActive.Bool { c.JSON(http.StatusForbidden, gin.H{"error": "account disabled"}); return }
 	if bcrypt.CompareHashAndPassword([]byte(pwHash), []byte(req.Password)) != nil { c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid credentials"}); return }
+	// with MFA enabled, or required by an operator, the password only earns an interim token
+	mfa, err := loadConsoleMFAStatus(customerID, memberID)
+	if err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"}); return }
+	if mfa.Enabled || mfa.Required {
+		tok, exp, err := createLoginChallenge(customerID, memberID)
+		if err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create mfa token"}); return }
+		audit.Record(customerID, "member", memberID, "customer.login.mfa_challenge", c.ClientIP(), map[string]any{"customer_id": customerID})
+		c.JSON(http.StatusOK, gin.H{"mfa_required": true, "mfa_token": tok, "expires_at": exp, "enrollment_required": !mfa.Enabled})
+		return
+	}
 	// create session 30d
-	tok, err := keys.RandomHex(32)
-	if err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create session"}); return }
-	exp := time.Now().Add(30 * 24 * time.Hour)
-	_, err = db.DB.Exec(`INSERT INTO sessions (customer_id, token, expires_at) VALUES ($1, $2, $3)`, customerID, tok, exp)
+	tok, exp, err := createSession(customerID, memberID, false)
 	if err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to persist session"}); return }
-	audit.Log(c, "customer.login", map[string]any{"customer_id": customerID})
+	audit.Record(customerID, "member", memberID, "customer.login", c.ClientIP(), map[string]any{"customer_id": customerID})
 	c.JSON(http.StatusOK, gin.H{"session_token": tok, "expires_at": exp})
 }
 
@@ -135,8 +149,8 @@ func RequestPasswordReset(c *gin.Context) {
 	var req requestReset
 	if err := c.ShouldBindJSON(&req); err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
 	email := strings.TrimSpace(strings.ToLower(req.Email))
-	var customerID string
-	if err := db.DB.QueryRow(`SELECT id FROM customers WHERE email = $1`, email).Scan(&customerID); err != nil {
+	var customerID, memberID string
+	if err := db.DB.QueryRow(`SELECT customer_id, id FROM members WHERE email = $1 AND is_active`, email).Scan(&customerID, &memberID); err != nil {
 		// do not reveal existence
 		c.JSON(http.StatusOK, gin.H{"status": "ok"})
 		return
@@ -144,8 +158,8 @@ func RequestPasswordReset(c *gin.Context) {
 	tok, err := keys.RandomHex(24)
 	if err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create token"}); return }
 	exp := time.Now().Add(1 * time.Hour)
-	_, _ = db.DB.Exec(`INSERT INTO password_reset_tokens (customer_id, token, expires_at) VALUES ($1, $2, $3)`, customerID, tok, exp)
-	audit.Log(c, "customer.request_password_reset", map[string]any{"customer_id": customerID})
+	_, _ = db.DB.Exec(`INSERT INTO password_reset_tokens (customer_id, member_id, token, expires_at) VALUES ($1, $2, $3, $4)`, customerID, memberID, tok, exp)
+	audit.Record(customerID, "member", memberID, "customer.request_password_reset", c.ClientIP(), map[string]any{"customer_id": customerID})
 	// Dev-mode: return the token
 	c.JSON(http.StatusOK, gin.H{"status": "ok", "reset_token": tok})
 }
@@ -158,20 +172,21 @@ type resetPasswordReq struct { Token string `json:"token" binding:"required"`; N
 func ResetPassword(c *gin.Context) {
 	var req resetPasswordReq
 	if err := c.ShouldBindJSON(&req); err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
-	var customerID string
+	var customerID, memberID string
 	var expiresAt time.Time
 	var usedAt sql.NullTime
-	err := db.DB.QueryRow(`SELECT customer_id, expires_at, used_at FROM password_reset_tokens WHERE token = $1`, req.Token).Scan(&customerID, &expiresAt, &usedAt)
+	err := db.DB.QueryRow(`SELECT customer_id, member_id, expires_at, used_at FROM password_reset_tokens WHERE token = $1`, req.Token).Scan(&customerID, &memberID, &expiresAt, &usedAt)
 	if err == sql.ErrNoRows { c.JSON(http.StatusBadRequest, gin.H{"error": "invalid token"}); return }
 	if err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"}); return }
 	if usedAt.Valid || time.Now().After(expiresAt) { c.JSON(http.StatusBadRequest, gin.H{"error": "token expired or used"}); return }
 	pwHash, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
 	if err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": "hashing failed"}); return }
-	_, err = db.DB.Exec(`UPDATE customers SET password_hash = $1, updated_at = NOW() WHERE id = $2`, string(pwHash), customerID)
+	_, err = db.DB.Exec(`UPDATE members SET password_hash = $1, updated_at = NOW() WHERE id = $2`, string(pwHash), memberID)
 	if err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": "update failed"}); return }
 	_, _ = db.DB.Exec(`UPDATE password_reset_tokens SET used_at = NOW() WHERE token = $1`, req.Token)
-	// revoke existing sessions
-	_, _ = db.DB.Exec(`UPDATE sessions SET revoked_at = NOW() WHERE customer_id = $1 AND revoked_at IS NULL`, customerID)
-	audit.Log(c, "customer.reset_password", map[string]any{"customer_id": customerID})
+	// revoke the member's existing sessions
+	_, _ = db.DB.Exec(`UPDATE sessions SET revoked_at = NOW() WHERE member_id = $1 AND revoked_at IS NULL`, memberID)
+	_, _ = db.DB.Exec(`UPDATE login_challenges SET used_at = NOW() WHERE member_id = $1 AND used_at IS NULL`, memberID)
+	audit.Record(customerID, "member", memberID, "customer.reset_password", c.ClientIP(), map[string]any{"customer_id": customerID})
 	c.JSON(http.StatusOK, gin.H{"status": "password_updated"})
 }
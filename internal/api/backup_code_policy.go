@@ -0,0 +1,67 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"otp/internal/audit"
+	"otp/internal/backupcodes"
+)
+
+type updateBackupCodePolicyRequest struct {
+	Count     *int    `json:"count"`
+	Length    *int    `json:"length"`
+	Alphabet  *string `json:"alphabet"`
+	GroupSize *int    `json:"group_size"`
+	WarnBelow *int    `json:"warn_below"`
+}
+
+// GetBackupCodePolicy returns the authenticated customer's backup code policy.
+func GetBackupCodePolicy(c *gin.Context) {
+	p, err := backupcodes.PolicyFor(c.GetString("customer_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+		return
+	}
+	c.JSON(http.StatusOK, p)
+}
+
+// UpdateBackupCodePolicy changes how future backup codes are generated. Existing codes are untouched.
+func UpdateBackupCodePolicy(c *gin.Context) {
+	customerID := c.GetString("customer_id")
+	var req updateBackupCodePolicyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	p, err := backupcodes.PolicyFor(customerID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+		return
+	}
+	if req.Count != nil {
+		p.Count = *req.Count
+	}
+	if req.Length != nil {
+		p.Length = *req.Length
+	}
+	if req.Alphabet != nil {
+		p.Alphabet = *req.Alphabet
+	}
+	if req.GroupSize != nil {
+		p.GroupSize = *req.GroupSize
+	}
+	if req.WarnBelow != nil {
+		p.WarnBelow = *req.WarnBelow
+	}
+	if err := p.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := backupcodes.SavePolicy(customerID, p); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save policy"})
+		return
+	}
+	audit.Log(c, "settings.backup_codes.update", map[string]any{"policy": p})
+	c.JSON(http.StatusOK, p)
+}
@@ -0,0 +1,102 @@
+package api
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"otp/internal/audit"
+	"otp/internal/backupcodes"
+	"otp/internal/config"
+	"otp/internal/crypto"
+	"otp/internal/db"
+)
+
+// storeBackupCodeSheet keeps an encrypted copy of freshly generated codes so they can be
+// rendered once as a printable sheet. It returns the sheet URL, or "" if it could not be stored
+// (the codes are still returned in the API response, so this is not fatal).
+func storeBackupCodeSheet(c *gin.Context, customerID, env, userID string, codes []string) string {
+	ttl := time.Duration(config.Get().BackupCodeSheetTTLMinutes) * time.Minute
+	if ttl <= 0 {
+		return ""
+	}
+	enc, err := crypto.EncryptFor(crypto.Binding{CustomerID: customerID, UserID: userID, Field: crypto.FieldBackupCodeSheet, Environment: env}, strings.Join(codes, "\n"))
+	if err != nil {
+		return ""
+	}
+	_, err = db.DB.Exec(`INSERT INTO backup_code_sheets (customer_id, environment, user_id, codes_encrypted, generated_at, expires_at)
+		VALUES ($1, $2, $3, $4, NOW(), NOW() + make_interval(secs => $5))
+		ON CONFLICT (customer_id, environment, user_id) DO UPDATE SET codes_encrypted = EXCLUDED.codes_encrypted,
+		generated_at = EXCLUDED.generated_at, expires_at = EXCLUDED.expires_at`,
+		customerID, env, userID, enc, ttl.Seconds())
+	if err != nil {
+		return ""
+	}
+	if strings.TrimSpace(c.GetString("api_key_id")) == "" {
+		return "/api/v1/console/mfa/" + userID + "/backup_codes/sheet" + consoleEnvQuery(env)
+	}
+	return "/api/v1/mfa/" + userID + "/backup_codes/sheet"
+}
+
+// discardBackupCodeSheet drops any pending sheet, e.g. once a code from it has been consumed.
+func discardBackupCodeSheet(customerID, env, userID string) {
+	_, _ = db.DB.Exec(`DELETE FROM backup_code_sheets WHERE customer_id = $1 AND environment = $2 AND user_id = $3`, customerID, env, userID)
+}
+
+// GetBackupCodeSheet renders the most recently generated backup codes as a PDF (default) or
+// plain text (?format=txt). The sheet can be fetched once, only within
+// BACKUP_CODE_SHEET_TTL_MINUTES of generation and only while none of its codes has been used.
+func GetBackupCodeSheet(c *gin.Context) {
+	userID := c.Param("id")
+	customerID := c.GetString("customer_id")
+	env := mfaEnvironment(c)
+	format := strings.ToLower(strings.TrimSpace(c.DefaultQuery("format", "pdf")))
+	if format != "pdf" && format != "txt" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be pdf or txt"})
+		return
+	}
+
+	// Deleting while reading makes retrieval one-time even under concurrent requests.
+	var enc, accountName, issuer string
+	var generatedAt, expiresAt time.Time
+	var used int
+	var active bool
+	err := db.DB.QueryRow(`DELETE FROM backup_code_sheets s USING mfa_users m
+		WHERE s.customer_id = $1 AND s.environment = $2 AND s.user_id = $3
+			AND m.customer_id = s.customer_id AND m.environment = s.environment AND m.user_id = s.user_id
+		RETURNING s.codes_encrypted, s.generated_at, s.expires_at, COALESCE(m.account_name, ''), COALESCE(m.issuer, ''), m.backup_codes_used, m.is_active`,
+		customerID, env, userID).Scan(&enc, &generatedAt, &expiresAt, &accountName, &issuer, &used, &active)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No backup code sheet available"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if !active || used > 0 || time.Now().After(expiresAt) {
+		c.JSON(http.StatusGone, gin.H{"error": "Backup code sheet is no longer available"})
+		return
+	}
+	plain, err := crypto.DecryptFor(crypto.Binding{CustomerID: customerID, UserID: userID, Field: crypto.FieldBackupCodeSheet, Environment: env}, enc)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decrypt backup codes"})
+		return
+	}
+	if strings.TrimSpace(issuer) == "" {
+		issuer = config.Get().Issuer
+	}
+	sheet := backupcodes.Sheet{Issuer: issuer, AccountName: accountName, GeneratedAt: generatedAt, Codes: strings.Split(plain, "\n")}
+
+	audit.Log(c, "mfa.backup_codes.sheet", map[string]any{"user_id": userID, "format": format})
+	c.Header("Cache-Control", "no-store")
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="backup-codes.%s"`, format))
+	if format == "txt" {
+		c.Data(http.StatusOK, "text/plain; charset=utf-8", sheet.Text())
+		return
+	}
+	c.Data(http.StatusOK, "application/pdf", sheet.PDF())
+}
@@ -62,6 +62,8 @@ func ensureTestCustomer(t *testing.T, email, password, company, stripeID string)
 		t.Fatalf("select customer: %v", err)
 	}
 	_, _ = db.DB.Exec(`UPDATE customers SET stripe_customer_id = $1, updated_at = NOW() WHERE id = $2`, stripeID, id)
+	// the owner member logs in with the customer's email and password
+	_, _ = db.DB.Exec(`INSERT INTO members (id, customer_id, email, password_hash, role) SELECT id, id, email, password_hash, 'owner' FROM customers WHERE id = $1 ON CONFLICT DO NOTHING`, id)
 	return id
 }
 
@@ -72,7 +74,7 @@ func ensureTestSession(t *testing.T, customerID string) string {
 
 	tok = "tok_itest_" + time.Now().Format("150405")
 	exp := time.Now().Add(24 * time.Hour)
-	if _, err := db.DB.Exec(`INSERT INTO sessions (customer_id, token, expires_at) VALUES ($1,$2,$3)`, customerID, tok, exp); err != nil {
+	if _, err := db.DB.Exec(`INSERT INTO sessions (customer_id, member_id, token, expires_at) VALUES ($1,$1,$2,$3)`, customerID, tok, exp); err != nil {
 		t.Fatalf("insert session: %v", err)
 	}
 	return tok
@@ -4,6 +4,7 @@ import (
 	"net/http"
 
 	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
 	"otp/internal/config"
 	"otp/internal/db"
 	"otp/internal/keys"
@@ -35,14 +36,18 @@ func BootstrapSeed(c *gin.Context) {
 	}
 	env := req.Environment
 	if env == "" {
-		env = "test"
+		env = keys.EnvTest
+	}
+	if !keys.ValidEnvironment(env) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "environment must be test or live"})
+		return
 	}
-	prefix := "sk_" + env + "_"
 
-	// Create customer
+	// Create customer, and its owner member (who sets a password with a password reset)
 	var customerID string
 	err := db.DB.QueryRow(
-		"INSERT INTO customers (company_name, email, password_hash) VALUES ($1, $2, $3) RETURNING id",
+		`WITH c AS (INSERT INTO customers (company_name, email, password_hash) VALUES ($1, $2, $3) RETURNING id)
+		 INSERT INTO members (id, customer_id, email, password_hash, role) SELECT id, id, $2, $3, 'owner' FROM c RETURNING id`,
 		req.CompanyName, req.Email, "-",
 	).Scan(&customerID)
 	if err != nil {
@@ -51,23 +56,20 @@ func BootstrapSeed(c *gin.Context) {
 	}
 
 	// Create API key
-	randHex, err := keys.RandomHex(24)
+	plainKey, prefix, err := keys.NewAPIKey(keys.KindSecret, env)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate key"})
 		return
 	}
-	plainKey := prefix + randHex
 	keyHash := keys.HashAPIKey(plainKey)
-	last4 := ""
-	if len(plainKey) >= 4 {
-		last4 = plainKey[len(plainKey)-4:]
-	}
+	last4 := keys.LastFour(plainKey)
 
+	// the bootstrap key is the customer's first, so it gets every scope
 	var apiKeyID string
 	err = db.DB.QueryRow(
-		`INSERT INTO api_keys (customer_id, key_name, key_prefix, key_hash, key_last_four, environment) 
-		 VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`,
-		customerID, req.KeyName, prefix, keyHash, last4, env,
+		`INSERT INTO api_keys (customer_id, key_name, key_prefix, key_hash, key_last_four, environment, scopes) 
+		 VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id`,
+		customerID, req.KeyName, prefix, keyHash, last4, env, pq.Array(keys.AllScopes),
 	).Scan(&apiKeyID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create api key"})
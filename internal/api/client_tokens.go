@@ -0,0 +1,42 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"otp/internal/audit"
+	"otp/internal/config"
+	"otp/internal/db"
+	"otp/internal/keys"
+)
+
+// CreateClientToken mints a short-lived token (CLIENT_TOKEN_TTL_SECONDS) that lets a publishable
+// key fetch this user's enrollment QR code and confirm the first code from the browser.
+func CreateClientToken(c *gin.Context) {
+	userID := c.Param("id")
+	c.Set("mfa_user_id", userID)
+	customerID := c.GetString("customer_id")
+	env := mfaEnvironment(c)
+
+	token, err := keys.NewClientToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate client token"})
+		return
+	}
+	expiresAt := time.Now().Add(time.Duration(config.Get().ClientTokenTTLSeconds) * time.Second)
+	res, err := db.DB.Exec(`INSERT INTO client_tokens (token_hash, customer_id, environment, user_id, api_key_id, expires_at)
+		SELECT $1, customer_id, environment, user_id, NULLIF($5, '')::uuid, $6 FROM mfa_users
+		WHERE customer_id = $2 AND environment = $3 AND user_id = $4 AND is_active = true`,
+		keys.HashAPIKey(token), customerID, env, userID, c.GetString("api_key_id"), expiresAt)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store client token"})
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	audit.Log(c, "mfa.client_token.create", map[string]any{"user_id": userID, "expires_at": expiresAt})
+	c.JSON(http.StatusCreated, gin.H{"client_token": token, "expires_at": expiresAt})
+}
@@ -0,0 +1,497 @@
+package api
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+	"otp/internal/audit"
+	"otp/internal/backupcodes"
+	"otp/internal/config"
+	"otp/internal/crypto"
+	"otp/internal/db"
+	"otp/internal/keys"
+)
+
+// consoleMFAEnvironment is the mfa_users namespace holding the TOTP secrets and backup codes
+// of console logins, apart from the live and test users customers manage. The row's user id
+// is the member's id.
+const consoleMFAEnvironment = "console"
+
+// consoleTOTPPeriod is the TOTP step of console logins, in seconds (the authenticator default).
+const consoleTOTPPeriod = 30
+
+// maxLoginChallengeAttempts is how many wrong codes an interim login token survives.
+const maxLoginChallengeAttempts = 5
+
+var errInvalidMFACode = errors.New("invalid code")
+
+type consoleMFAStatus struct {
+	Enabled bool `json:"enabled"`
+	// An enrollment was started but no code confirmed yet
+	Pending bool `json:"pending"`
+	// Set by an operator; the login can't turn MFA off
+	Required             bool       `json:"required"`
+	LastUsedAt           *time.Time `json:"last_used_at,omitempty"`
+	BackupCodesRemaining int        `json:"backup_codes_remaining"`
+}
+
+func loadConsoleMFAStatus(customerID, memberID string) (consoleMFAStatus, error) {
+	var s consoleMFAStatus
+	var exists bool
+	var confirmed sql.NullTime
+	err := db.DB.QueryRow(`SELECT c.mfa_required, m.user_id IS NOT NULL, m.last_success_at, COALESCE(cardinality(m.backup_code_hashes), 0)
+		FROM customers c LEFT JOIN mfa_users m ON m.customer_id = c.id AND m.environment = $2 AND m.user_id = $3 AND m.is_active = true
+		WHERE c.id = $1`, customerID, consoleMFAEnvironment, memberID).Scan(&s.Required, &exists, &confirmed, &s.BackupCodesRemaining)
+	if err != nil {
+		return s, err
+	}
+	s.Enabled = confirmed.Valid
+	s.Pending = exists && !confirmed.Valid
+	if confirmed.Valid {
+		s.LastUsedAt = &confirmed.Time
+	}
+	return s, nil
+}
+
+func consoleMFABinding(customerID, memberID string) crypto.Binding {
+	return crypto.Binding{CustomerID: customerID, UserID: memberID, Field: crypto.FieldMFASecret, Environment: consoleMFAEnvironment}
+}
+
+// startConsoleMFAEnrollment generates a TOTP secret and backup codes for a member's login and
+// answers with them. A pending enrollment is replaced; a confirmed one is left alone (409).
+// MFA is on once a first code is confirmed.
+func startConsoleMFAEnrollment(c *gin.Context, customerID, memberID string) {
+	var email string
+	if err := db.DB.QueryRow(`SELECT email FROM members WHERE id = $1`, memberID).Scan(&email); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
+		return
+	}
+	issuer := config.Get().Issuer
+	key, err := totp.Generate(totp.GenerateOpts{Issuer: issuer, AccountName: email, SecretSize: 32})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate totp secret"})
+		return
+	}
+	encSecret, err := crypto.EncryptFor(consoleMFABinding(customerID, memberID), key.Secret())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to encrypt secret"})
+		return
+	}
+	codes, hashes, err := newBackupCodes(customerID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate backup codes"})
+		return
+	}
+	res, err := db.DB.Exec(`INSERT INTO mfa_users (customer_id, environment, user_id, secret_key_encrypted, backup_code_hashes, backup_codes_generated_at, account_name, issuer)
+		VALUES ($1, $2, $7, $3, $4, NOW(), $5, $6)
+		ON CONFLICT (customer_id, environment, user_id) DO UPDATE SET secret_key_encrypted = EXCLUDED.secret_key_encrypted,
+			backup_code_hashes = EXCLUDED.backup_code_hashes, backup_codes_used = 0, backup_codes_generated_at = NOW(),
+			account_name = EXCLUDED.account_name, issuer = EXCLUDED.issuer, is_active = true, failed_attempts = 0, updated_at = NOW()
+		WHERE mfa_users.last_success_at IS NULL`,
+		customerID, consoleMFAEnvironment, encSecret, pq.Array(hashes), email, issuer, memberID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to store mfa enrollment"})
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "mfa is already enabled"})
+		return
+	}
+	audit.Record(customerID, "member", memberID, "console.mfa.enroll", c.ClientIP(), nil)
+	c.JSON(http.StatusCreated, gin.H{"secret": key.Secret(), "otpauth_url": key.URL(), "backup_codes": codes})
+}
+
+// consoleMFALockedError rejects codes for a login that had too many wrong ones in a row.
+type consoleMFALockedError struct{ until time.Time }
+
+func (e *consoleMFALockedError) Error() string {
+	return "mfa locked until " + e.until.Format(time.RFC3339)
+}
+
+// checkConsoleMFACode checks a TOTP code, or with allowBackup a backup code (which is spent),
+// against a member's login. It returns "totp" or "backup_code". A correct TOTP code also
+// confirms a pending enrollment. Wrong codes count towards the same lockout as MFA users'
+// validations, and a TOTP code is accepted only once.
+func checkConsoleMFACode(c *gin.Context, customerID, memberID, code string, allowBackup bool) (string, error) {
+	var encSecret string
+	var hashes []string
+	var lockedUntil sql.NullTime
+	err := db.DB.QueryRow(`SELECT secret_key_encrypted, backup_code_hashes, locked_until FROM mfa_users
+		WHERE customer_id = $1 AND environment = $2 AND user_id = $3 AND is_active = true`,
+		customerID, consoleMFAEnvironment, memberID).Scan(&encSecret, pq.Array(&hashes), &lockedUntil)
+	if err == sql.ErrNoRows {
+		return "", errInvalidMFACode
+	}
+	if err != nil {
+		return "", err
+	}
+	if lockedUntil.Valid && time.Now().Before(lockedUntil.Time) {
+		return "", &consoleMFALockedError{until: lockedUntil.Time}
+	}
+	method, err := matchConsoleMFACode(customerID, memberID, code, encSecret, hashes, allowBackup)
+	if errors.Is(err, errInvalidMFACode) {
+		attempts, lockedUntil, lerr := countMFAFailure(customerID, consoleMFAEnvironment, memberID)
+		if lerr != nil {
+			return "", lerr
+		}
+		if lockedUntil.Valid && lockedUntil.Time.After(time.Now()) {
+			audit.Record(customerID, "member", memberID, "console.mfa.lockout", c.ClientIP(), map[string]any{"failed_attempts": attempts, "locked_until": lockedUntil.Time})
+		}
+	}
+	return method, err
+}
+
+func matchConsoleMFACode(customerID, memberID, code, encSecret string, hashes []string, allowBackup bool) (string, error) {
+	secret, err := crypto.DecryptFor(consoleMFABinding(customerID, memberID), encSecret)
+	if err != nil {
+		return "", err
+	}
+	if step, ok := totpStep(code, secret, time.Now()); ok {
+		// only a step after the last accepted one counts, so a seen code can't be replayed
+		res, err := db.DB.Exec(`UPDATE mfa_users SET last_success_at = NOW(), last_totp_step = $4, failed_attempts = 0, locked_until = NULL, updated_at = NOW()
+			WHERE customer_id = $1 AND environment = $2 AND user_id = $3 AND (last_totp_step IS NULL OR last_totp_step < $4)`,
+			customerID, consoleMFAEnvironment, memberID, step)
+		if err != nil {
+			return "", err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return "", errInvalidMFACode
+		}
+		return "totp", nil
+	}
+	if !allowBackup {
+		return "", errInvalidMFACode
+	}
+	pepper, err := crypto.TenantSecret(customerID, backupcodes.PepperPurpose)
+	if err != nil {
+		return "", err
+	}
+	i := backupcodes.Match(code, hashes, pepper)
+	if i == -1 {
+		return "", errInvalidMFACode
+	}
+	// remove the code only if it is still there, so concurrent requests can't both spend it
+	res, err := db.DB.Exec(`UPDATE mfa_users SET backup_code_hashes = array_remove(backup_code_hashes, $4), backup_codes_used = backup_codes_used + 1,
+		failed_attempts = 0, locked_until = NULL, updated_at = NOW()
+		WHERE customer_id = $1 AND environment = $2 AND user_id = $3 AND last_success_at IS NOT NULL AND $4 = ANY(backup_code_hashes)`,
+		customerID, consoleMFAEnvironment, memberID, hashes[i])
+	if err != nil {
+		return "", err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return "", errInvalidMFACode
+	}
+	return "backup_code", nil
+}
+
+// totpStep reports the time step a TOTP code is valid for, allowing one step of clock skew
+// either way like totp.Validate.
+func totpStep(code, secret string, now time.Time) (int64, bool) {
+	cur := now.Unix() / consoleTOTPPeriod
+	for _, step := range []int64{cur - 1, cur, cur + 1} {
+		want, err := totp.GenerateCodeCustom(secret, time.Unix(step*consoleTOTPPeriod, 0), totp.ValidateOpts{
+			Period: consoleTOTPPeriod, Digits: otp.DigitsSix, Algorithm: otp.AlgorithmSHA1,
+		})
+		if err == nil && subtle.ConstantTimeCompare([]byte(want), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// writeConsoleMFACodeError answers a failed checkConsoleMFACode.
+func writeConsoleMFACodeError(c *gin.Context, err error) {
+	var locked *consoleMFALockedError
+	switch {
+	case errors.As(err, &locked):
+		c.JSON(http.StatusLocked, gin.H{"error": "too many wrong codes, try again later", "code": "mfa_locked", "locked_until": locked.until})
+	case errors.Is(err, errInvalidMFACode):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid code"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to check code"})
+	}
+}
+
+// createSession issues a 30 day console session for a member; mfa marks it as issued after a
+// second factor. It also records the member's last login.
+func createSession(customerID, memberID string, mfa bool) (string, time.Time, error) {
+	tok, err := keys.RandomHex(32)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	exp := time.Now().Add(30 * 24 * time.Hour)
+	_, err = db.DB.Exec(`INSERT INTO sessions (customer_id, member_id, token, expires_at, mfa_at) VALUES ($1, $2, $3, $4, CASE WHEN $5 THEN NOW() END)`,
+		customerID, memberID, tok, exp, mfa)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	_, _ = db.DB.Exec(`UPDATE members SET last_login_at = NOW() WHERE id = $1`, memberID)
+	return tok, exp, nil
+}
+
+// createLoginChallenge issues the interim token a password login returns when a second factor
+// is due. It is exchanged for a session at /auth/mfa/verify.
+func createLoginChallenge(customerID, memberID string) (string, time.Time, error) {
+	tok, err := keys.RandomHex(32)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	exp := time.Now().Add(time.Duration(config.Get().ConsoleMFATokenTTLSeconds) * time.Second)
+	_, err = db.DB.Exec(`INSERT INTO login_challenges (token_hash, customer_id, member_id, expires_at) VALUES ($1, $2, $3, $4)`, keys.HashAPIKey(tok), customerID, memberID, exp)
+	return tok, exp, err
+}
+
+// loginChallengeMember resolves a live interim token to its customer and member, answering
+// 401 when there is none.
+func loginChallengeMember(c *gin.Context, tok string) (string, string, bool) {
+	var customerID, memberID string
+	err := db.DB.QueryRow(`SELECT l.customer_id, l.member_id FROM login_challenges l JOIN customers c ON c.id = l.customer_id
+		JOIN members m ON m.id = l.member_id AND m.is_active
+		WHERE l.token_hash = $1 AND l.used_at IS NULL AND l.expires_at > NOW() AND l.attempts < $2 AND COALESCE(c.is_active, true)`,
+		keys.HashAPIKey(tok), maxLoginChallengeAttempts).Scan(&customerID, &memberID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid or expired mfa token", "code": "invalid_mfa_token"})
+		return "", "", false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
+		return "", "", false
+	}
+	return customerID, memberID, true
+}
+
+// EnrollLoginMFA starts MFA enrollment with an interim login token, for logins that must use
+// MFA (see mfa_required) but have none yet.
+// POST /api/v1/auth/mfa/enroll
+// { mfa_token }
+type enrollLoginMFARequest struct {
+	MFAToken string `json:"mfa_token" binding:"required"`
+}
+
+func EnrollLoginMFA(c *gin.Context) {
+	var req enrollLoginMFARequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	customerID, memberID, ok := loginChallengeMember(c, req.MFAToken)
+	if !ok {
+		return
+	}
+	startConsoleMFAEnrollment(c, customerID, memberID)
+}
+
+// VerifyLoginMFA exchanges an interim login token and a TOTP or backup code for a session. For
+// a login enrolling at sign-in, the TOTP code also confirms the enrollment.
+// POST /api/v1/auth/mfa/verify
+// { mfa_token, code }
+type verifyLoginMFARequest struct {
+	MFAToken string `json:"mfa_token" binding:"required"`
+	Code     string `json:"code" binding:"required"`
+}
+
+func VerifyLoginMFA(c *gin.Context) {
+	var req verifyLoginMFARequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	customerID, memberID, ok := loginChallengeMember(c, req.MFAToken)
+	if !ok {
+		return
+	}
+	status, err := loadConsoleMFAStatus(customerID, memberID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
+		return
+	}
+	if !status.Enabled && !status.Pending {
+		c.JSON(http.StatusConflict, gin.H{"error": "mfa enrollment required, start it with /api/v1/auth/mfa/enroll", "code": "mfa_enrollment_required"})
+		return
+	}
+	method, err := checkConsoleMFACode(c, customerID, memberID, req.Code, status.Enabled)
+	if errors.Is(err, errInvalidMFACode) {
+		_, _ = db.DB.Exec(`UPDATE login_challenges SET attempts = attempts + 1 WHERE token_hash = $1`, keys.HashAPIKey(req.MFAToken))
+		audit.Record(customerID, "member", memberID, "customer.login.mfa_failure", c.ClientIP(), nil)
+	}
+	if err != nil {
+		writeConsoleMFACodeError(c, err)
+		return
+	}
+	// the token is spent once, so a concurrent exchange with another code gets nothing
+	res, err := db.DB.Exec(`UPDATE login_challenges SET used_at = NOW() WHERE token_hash = $1 AND used_at IS NULL`, keys.HashAPIKey(req.MFAToken))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid or expired mfa token", "code": "invalid_mfa_token"})
+		return
+	}
+	tok, exp, err := createSession(customerID, memberID, true)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to persist session"})
+		return
+	}
+	c.Set("customer_id", customerID)
+	c.Set("member_id", memberID)
+	if !status.Enabled {
+		audit.Log(c, "console.mfa.enable", nil)
+	}
+	audit.Log(c, "customer.login", map[string]any{"customer_id": customerID, "mfa_method": method})
+	c.JSON(http.StatusOK, gin.H{"session_token": tok, "expires_at": exp})
+}
+
+// GetConsoleMFA reports the MFA state of the session's member.
+func GetConsoleMFA(c *gin.Context) {
+	status, err := loadConsoleMFAStatus(c.GetString("customer_id"), c.GetString("member_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
+		return
+	}
+	c.JSON(http.StatusOK, status)
+}
+
+// EnrollConsoleMFA starts (or restarts) MFA enrollment for the session's member.
+func EnrollConsoleMFA(c *gin.Context) {
+	startConsoleMFAEnrollment(c, c.GetString("customer_id"), c.GetString("member_id"))
+}
+
+type consoleMFACodeRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+// ConfirmConsoleMFA turns MFA on with a first TOTP code. The current session counts as
+// verified from then on; the member's other sessions and pending logins, which only had the
+// password behind them, are revoked.
+func ConfirmConsoleMFA(c *gin.Context) {
+	var req consoleMFACodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	customerID, memberID := c.GetString("customer_id"), c.GetString("member_id")
+	status, err := loadConsoleMFAStatus(customerID, memberID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
+		return
+	}
+	if !status.Pending {
+		c.JSON(http.StatusConflict, gin.H{"error": "no mfa enrollment in progress"})
+		return
+	}
+	if _, err := checkConsoleMFACode(c, customerID, memberID, req.Code, false); err != nil {
+		writeConsoleMFACodeError(c, err)
+		return
+	}
+	tok := c.GetHeader("X-Session-Token")
+	_, _ = db.DB.Exec(`UPDATE sessions SET mfa_at = NOW() WHERE token = $1`, tok)
+	_, _ = db.DB.Exec(`UPDATE sessions SET revoked_at = NOW() WHERE member_id = $1 AND token <> $2 AND revoked_at IS NULL`, memberID, tok)
+	_, _ = db.DB.Exec(`UPDATE login_challenges SET used_at = NOW() WHERE member_id = $1 AND used_at IS NULL`, memberID)
+	audit.Log(c, "console.mfa.enable", nil)
+	c.JSON(http.StatusOK, gin.H{"status": "enabled"})
+}
+
+// requireConsoleMFACode checks a code for the session's member before a change to its MFA,
+// answering 401 for a wrong one.
+func requireConsoleMFACode(c *gin.Context) bool {
+	var req consoleMFACodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return false
+	}
+	if _, err := checkConsoleMFACode(c, c.GetString("customer_id"), c.GetString("member_id"), req.Code, true); err != nil {
+		writeConsoleMFACodeError(c, err)
+		return false
+	}
+	return true
+}
+
+// DisableConsoleMFA turns MFA off for the session's member, given a current code. Members of
+// customers an operator requires MFA for can't.
+func DisableConsoleMFA(c *gin.Context) {
+	customerID, memberID := c.GetString("customer_id"), c.GetString("member_id")
+	status, err := loadConsoleMFAStatus(customerID, memberID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
+		return
+	}
+	if status.Required {
+		c.JSON(http.StatusConflict, gin.H{"error": "mfa is required for this account", "code": "mfa_required"})
+		return
+	}
+	if !status.Enabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "mfa is not enabled"})
+		return
+	}
+	if !requireConsoleMFACode(c) {
+		return
+	}
+	if _, err := db.DB.Exec(`DELETE FROM mfa_users WHERE customer_id = $1 AND environment = $2 AND user_id = $3`, customerID, consoleMFAEnvironment, memberID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to disable mfa"})
+		return
+	}
+	audit.Log(c, "console.mfa.disable", nil)
+	c.JSON(http.StatusOK, gin.H{"status": "disabled"})
+}
+
+// RegenerateConsoleBackupCodes replaces the member's backup codes, given a current code.
+func RegenerateConsoleBackupCodes(c *gin.Context) {
+	customerID, memberID := c.GetString("customer_id"), c.GetString("member_id")
+	if !requireConsoleMFACode(c) {
+		return
+	}
+	codes, hashes, err := newBackupCodes(customerID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate backup codes"})
+		return
+	}
+	_, err = db.DB.Exec(`UPDATE mfa_users SET backup_code_hashes = $4, backup_codes_used = 0, backup_codes_generated_at = NOW(), updated_at = NOW()
+		WHERE customer_id = $1 AND environment = $2 AND user_id = $3`, customerID, consoleMFAEnvironment, memberID, pq.Array(hashes))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to store backup codes"})
+		return
+	}
+	audit.Log(c, "console.mfa.backup_codes.regenerate", nil)
+	c.JSON(http.StatusOK, gin.H{"backup_codes": codes})
+}
+
+// resetMemberMFA removes a member's console MFA and ends their sessions, reporting whether
+// there was any.
+func resetMemberMFA(customerID, memberID string) (bool, error) {
+	res, err := db.DB.Exec(`DELETE FROM mfa_users WHERE customer_id = $1 AND environment = $2 AND user_id = $3`, customerID, consoleMFAEnvironment, memberID)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return false, nil
+	}
+	_, err = db.DB.Exec(`UPDATE sessions SET revoked_at = NOW() WHERE member_id = $1 AND revoked_at IS NULL`, memberID)
+	return true, err
+}
+
+// ResetCustomerMFA removes a member's console MFA, e.g. after a lost device, and ends their
+// sessions. If MFA is required they enroll again at the next login. ?member_id= picks the
+// member; without it the account's original owner (whose id is the customer's) is reset.
+func ResetCustomerMFA(c *gin.Context) {
+	id := c.Param("id")
+	memberID := c.DefaultQuery("member_id", id)
+	found, err := resetMemberMFA(id, memberID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "reset failed"})
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "member not found or mfa not enrolled"})
+		return
+	}
+	audit.Record(id, "admin", "", "console.mfa.reset", c.ClientIP(), map[string]any{"member_id": memberID})
+	c.JSON(http.StatusOK, gin.H{"status": "reset"})
+}
@@ -0,0 +1,147 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pquerna/otp/totp"
+	"otp/internal/config"
+	"otp/internal/crypto"
+	"otp/internal/db"
+	"otp/internal/middleware"
+	"otp/internal/tenantkeys"
+)
+
+func TestConsoleLoginMFA(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	cfg := config.Load()
+	if v := os.Getenv("TEST_DATABASE_URL"); v != "" {
+		cfg.DatabaseURL = v
+	}
+	if err := db.Init(cfg.DatabaseURL); err != nil {
+		t.Skipf("skipping integration test; DB unavailable: %v (set TEST_DATABASE_URL)", err)
+	}
+	if err := crypto.LoadKeyring(cfg.EncryptionKey, cfg.EncryptionKeys, cfg.EncryptionKeyVersion, db.KeySalt); err != nil {
+		t.Fatal(err)
+	}
+	crypto.SetProvider(crypto.KeyringProvider{}, time.Minute, 16)
+	crypto.SetTenantKeyStore(tenantkeys.Store{})
+
+	stamp := time.Now().Format("150405.000")
+	email := "mfa-itest-" + stamp + "@example.com"
+	custID := ensureTestCustomer(t, email, "itestpass", "MFA ITest Co", "cus_mfa_"+stamp)
+
+	r := gin.New()
+	auth := r.Group("/auth")
+	auth.POST("/login", Login)
+	auth.POST("/mfa/enroll", EnrollLoginMFA)
+	auth.POST("/mfa/verify", VerifyLoginMFA)
+	console := r.Group("/console", middleware.SessionAuth())
+	console.GET("/account/mfa", GetConsoleMFA)
+	console.POST("/account/mfa/enroll", EnrollConsoleMFA)
+	console.POST("/account/mfa/confirm", ConfirmConsoleMFA)
+
+	do := func(path, session string, body any) (int, map[string]any) {
+		b, _ := json.Marshal(body)
+		req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(b))
+		if body == nil {
+			req = httptest.NewRequest(http.MethodGet, path, nil)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Session-Token", session)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		var out map[string]any
+		_ = json.Unmarshal(w.Body.Bytes(), &out)
+		return w.Code, out
+	}
+	login := map[string]any{"email": email, "password": "itestpass"}
+
+	// without MFA the password alone earns a session
+	code, out := do("/auth/login", "", login)
+	session, _ := out["session_token"].(string)
+	if code != http.StatusOK || session == "" {
+		t.Fatalf("login: %d %v", code, out)
+	}
+	_, out = do("/auth/login", "", login)
+	otherSession, _ := out["session_token"].(string)
+	code, out = do("/console/account/mfa/enroll", session, map[string]any{})
+	secret, _ := out["secret"].(string)
+	backupCodes, _ := out["backup_codes"].([]any)
+	if code != http.StatusCreated || secret == "" || len(backupCodes) == 0 {
+		t.Fatalf("enroll: %d %v", code, out)
+	}
+	otp, _ := totp.GenerateCode(secret, time.Now())
+	if code, out = do("/console/account/mfa/confirm", session, map[string]any{"code": otp}); code != http.StatusOK {
+		t.Fatalf("confirm: %d %v", code, out)
+	}
+	// the member's other session had only the password behind it
+	if code, _ = do("/console/account/mfa", otherSession, nil); code != http.StatusUnauthorized {
+		t.Fatalf("other session after confirming mfa: %d", code)
+	}
+
+	// the code that confirmed the enrollment can't be used again to sign in
+	_, out = do("/auth/login", "", login)
+	replayToken, _ := out["mfa_token"].(string)
+	if code, _ = do("/auth/mfa/verify", "", map[string]any{"mfa_token": replayToken, "code": otp}); code != http.StatusUnauthorized {
+		t.Fatalf("replayed totp code: %d", code)
+	}
+
+	// now login returns an interim token, exchanged with a backup code (spent once)
+	code, out = do("/auth/login", "", login)
+	mfaToken, _ := out["mfa_token"].(string)
+	if code != http.StatusOK || mfaToken == "" || out["session_token"] != nil {
+		t.Fatalf("login with mfa: %d %v", code, out)
+	}
+	if code, _ = do("/auth/mfa/verify", "", map[string]any{"mfa_token": mfaToken, "code": "000000"}); code != http.StatusUnauthorized {
+		t.Fatalf("wrong code: %d", code)
+	}
+	code, out = do("/auth/mfa/verify", "", map[string]any{"mfa_token": mfaToken, "code": backupCodes[0]})
+	if code != http.StatusOK || out["session_token"] == nil {
+		t.Fatalf("verify: %d %v", code, out)
+	}
+	if code, _ = do("/auth/mfa/verify", "", map[string]any{"mfa_token": mfaToken, "code": backupCodes[1]}); code != http.StatusUnauthorized {
+		t.Fatalf("a spent mfa token must not work again: %d", code)
+	}
+
+	// wrong codes lock the login across interim tokens, even for a right code
+	defer func(prev int) { cfg.MFALockoutThreshold = prev }(cfg.MFALockoutThreshold)
+	cfg.MFALockoutThreshold = 2
+	_, out = do("/auth/login", "", login)
+	lockToken, _ := out["mfa_token"].(string)
+	for i := 0; i < 2; i++ {
+		if code, _ = do("/auth/mfa/verify", "", map[string]any{"mfa_token": lockToken, "code": "000000"}); code != http.StatusUnauthorized {
+			t.Fatalf("wrong code %d: %d", i, code)
+		}
+	}
+	_, out = do("/auth/login", "", login)
+	lockToken, _ = out["mfa_token"].(string)
+	if code, out = do("/auth/mfa/verify", "", map[string]any{"mfa_token": lockToken, "code": backupCodes[1]}); code != http.StatusLocked || out["code"] != "mfa_locked" {
+		t.Fatalf("locked login: %d %v", code, out)
+	}
+	if _, err := db.DB.Exec(`UPDATE mfa_users SET locked_until = NULL, failed_attempts = 0 WHERE customer_id = $1 AND environment = $2`, custID, consoleMFAEnvironment); err != nil {
+		t.Fatal(err)
+	}
+
+	// once MFA is required, a session issued without a second factor stops working, while the
+	// one that confirmed the enrollment keeps going
+	noMFASession := "tok_mfa_itest_" + stamp
+	if _, err := db.DB.Exec(`INSERT INTO sessions (customer_id, member_id, token, expires_at) VALUES ($1, $1, $2, $3)`, custID, noMFASession, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.DB.Exec(`UPDATE customers SET mfa_required = true WHERE id = $1`, custID); err != nil {
+		t.Fatal(err)
+	}
+	if code, out = do("/console/account/mfa", noMFASession, nil); code != http.StatusUnauthorized || out["code"] != "mfa_required" {
+		t.Fatalf("session without mfa: %d %v", code, out)
+	}
+	if code, out = do("/console/account/mfa", session, nil); code != http.StatusOK || out["enabled"] != true || out["required"] != true {
+		t.Fatalf("mfa status: %d %v", code, out)
+	}
+}
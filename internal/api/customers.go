@@ -2,23 +2,33 @@ package api
 
 import (
 	"database/sql"
+	"errors"
+	"fmt"
 	"net/http"
 	"strings"
 
 	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"otp/internal/audit"
 	"otp/internal/db"
+	"otp/internal/members"
+	"otp/internal/middleware"
+	"otp/internal/tiers"
 )
 
 type createCustomerRequest struct {
 	CompanyName     string `json:"company_name" binding:"required"`
 	Email           string `json:"email" binding:"required"`
 	SubscriptionTier string `json:"subscription_tier"`
+	// Require a second factor for console logins
+	MFARequired bool `json:"mfa_required"`
 }
 
 type updateCustomerRequest struct {
 	CompanyName      *string `json:"company_name"`
 	Email            *string `json:"email"`
 	SubscriptionTier *string `json:"subscription_tier"`
+	MFARequired      *bool   `json:"mfa_required"`
 }
 
 type customerItem struct {
@@ -27,6 +37,7 @@ type customerItem struct {
 	Email            string `json:"email"`
 	SubscriptionTier string `json:"subscription_tier"`
 	IsActive         bool   `json:"is_active"`
+	MFARequired      bool   `json:"mfa_required"`
 }
 
 func CreateCustomer(c *gin.Context) {
@@ -36,9 +47,17 @@ func CreateCustomer(c *gin.Context) {
 		return
 	}
 	if strings.TrimSpace(req.SubscriptionTier) == "" { req.SubscriptionTier = "starter" }
+	if _, ok := tiers.Get(req.SubscriptionTier); !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": unknownTierMessage(req.SubscriptionTier)})
+		return
+	}
 	var id string
-	err := db.DB.QueryRow(`INSERT INTO customers (company_name, email, password_hash, subscription_tier, is_active) VALUES ($1, $2, $3, $4, true) RETURNING id`,
-		req.CompanyName, req.Email, "-", req.SubscriptionTier,
+	// the owner member has no password yet; they set one with a password reset
+	err := db.DB.QueryRow(`WITH c AS (
+			INSERT INTO customers (company_name, email, password_hash, subscription_tier, is_active, mfa_required) VALUES ($1, $2, $3, $4, true, $5) RETURNING id
+		)
+		INSERT INTO members (id, customer_id, email, password_hash, role) SELECT id, id, $2, $3, $6 FROM c RETURNING id`,
+		req.CompanyName, req.Email, "-", req.SubscriptionTier, req.MFARequired, members.RoleOwner,
 	).Scan(&id)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create customer"})
@@ -51,7 +70,7 @@ func ListCustomers(c *gin.Context) {
 	// simple pagination
 	limit := 50
 	offset := 0
-	rows, err := db.DB.Query(`SELECT id, company_name, email, subscription_tier, COALESCE(is_active, true) FROM customers ORDER BY created_at DESC LIMIT $1 OFFSET $2`, limit, offset)
+	rows, err := db.DB.Query(`SELECT id, company_name, email, subscription_tier, COALESCE(is_active, true), mfa_required FROM customers ORDER BY created_at DESC LIMIT $1 OFFSET $2`, limit, offset)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed"})
 		return
@@ -60,7 +79,7 @@ func ListCustomers(c *gin.Context) {
 	items := []customerItem{}
 	for rows.Next() {
 		var it customerItem
-		if err := rows.Scan(&it.ID, &it.CompanyName, &it.Email, &it.SubscriptionTier, &it.IsActive); err != nil {
+		if err := rows.Scan(&it.ID, &it.CompanyName, &it.Email, &it.SubscriptionTier, &it.IsActive, &it.MFARequired); err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "scan failed"})
 			return
 		}
@@ -78,7 +97,7 @@ func UpdateCustomer(c *gin.Context) {
 	}
 	// fetch current
 	var current createCustomerRequest
-	err := db.DB.QueryRow(`SELECT company_name, email, subscription_tier FROM customers WHERE id = $1`, id).Scan(&current.CompanyName, &current.Email, &current.SubscriptionTier)
+	err := db.DB.QueryRow(`SELECT company_name, email, subscription_tier, mfa_required FROM customers WHERE id = $1`, id).Scan(&current.CompanyName, &current.Email, &current.SubscriptionTier, &current.MFARequired)
 	if err == sql.ErrNoRows {
 		c.JSON(http.StatusNotFound, gin.H{"error": "customer not found"})
 		return
@@ -88,13 +107,44 @@ func UpdateCustomer(c *gin.Context) {
 		return
 	}
 	if req.CompanyName != nil { current.CompanyName = *req.CompanyName }
-	if req.Email != nil { current.Email = *req.Email }
-	if req.SubscriptionTier != nil { current.SubscriptionTier = *req.SubscriptionTier }
-	_, err = db.DB.Exec(`UPDATE customers SET company_name = $1, email = $2, subscription_tier = $3, updated_at = NOW() WHERE id = $4`, current.CompanyName, current.Email, current.SubscriptionTier, id)
+	if req.Email != nil { current.Email = strings.TrimSpace(strings.ToLower(*req.Email)) }
+	if req.SubscriptionTier != nil {
+		if _, ok := tiers.Get(*req.SubscriptionTier); !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": unknownTierMessage(*req.SubscriptionTier)})
+			return
+		}
+		current.SubscriptionTier = *req.SubscriptionTier
+	}
+	mfaChanged := req.MFARequired != nil && *req.MFARequired != current.MFARequired
+	if req.MFARequired != nil { current.MFARequired = *req.MFARequired }
+	tx, err := db.DB.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "update failed"})
+		return
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`UPDATE customers SET company_name = $1, email = $2, subscription_tier = $3, mfa_required = $4, updated_at = NOW() WHERE id = $5`, current.CompanyName, current.Email, current.SubscriptionTier, current.MFARequired, id)
+	if err == nil && req.Email != nil {
+		// the owner who registered the account signs in with its email
+		_, err = tx.Exec(`UPDATE members SET email = $1, updated_at = NOW() WHERE id = $2 AND customer_id = $2`, current.Email, id)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		c.JSON(http.StatusConflict, gin.H{"error": "email already in use"})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "update failed"})
 		return
 	}
+	// cached keys carry the tier their rate limits and plan checks derive from
+	middleware.ForgetCustomerAPIKeys(id)
+	if mfaChanged {
+		audit.Record(id, "admin", "", "customer.mfa_required", c.ClientIP(), map[string]any{"mfa_required": current.MFARequired})
+	}
 	c.JSON(http.StatusOK, gin.H{"status": "updated"})
 }
 
@@ -109,3 +159,7 @@ func DisableCustomer(c *gin.Context) {
 	if n == 0 { c.JSON(http.StatusNotFound, gin.H{"error": "customer not found or already disabled"}); return }
 	c.JSON(http.StatusOK, gin.H{"status": "disabled"})
 }
+
+func unknownTierMessage(tier string) string {
+	return fmt.Sprintf("unknown subscription tier %q, expected one of %s", tier, strings.Join(tiers.Names(), ", "))
+}
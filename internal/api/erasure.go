@@ -0,0 +1,88 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"otp/internal/audit"
+	"otp/internal/crypto"
+	"otp/internal/db"
+	"otp/internal/middleware"
+	"otp/internal/tenantkeys"
+)
+
+func erasureAuditMeta(p tenantkeys.ErasureProof) map[string]any {
+	return map[string]any{
+		"key_id":               p.KeyID,
+		"key_fingerprint":      p.KeyFingerprint,
+		"already_erased":       p.AlreadyErased,
+		"mfa_users_deleted":    p.MFAUsersDeleted,
+		"api_keys_disabled":    p.APIKeysDisabled,
+		"sessions_revoked":     p.SessionsRevoked,
+		"members_deactivated":  p.MembersDeactivated,
+		"tenant_key_destroyed": p.TenantKeyDestroyed,
+		"destroyed_at":         p.DestroyedAt,
+	}
+}
+
+// writeEraseError answers a failed erasure. A data key wrapped with the shared KEK is refused,
+// since database backups would keep it recoverable.
+func writeEraseError(c *gin.Context, err error) {
+	if errors.Is(err, crypto.ErrTenantKeyShared) {
+		c.JSON(http.StatusConflict, gin.H{"error": "the customer's data key is wrapped with the shared KEK; configure per-customer keys (TENANT_KEY_DIR or VAULT_TENANT_KEYS) and run a re-encryption job first", "code": "tenant_key_shared"})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": "erase failed"})
+}
+
+// EraseCustomer crypto-shreds a customer's data (admin).
+func EraseCustomer(c *gin.Context) {
+	id := c.Param("id")
+	proof, err := tenantkeys.Erase(id)
+	if errors.Is(err, tenantkeys.ErrCustomerNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "customer not found"})
+		return
+	}
+	if err != nil {
+		writeEraseError(c, err)
+		return
+	}
+	middleware.ForgetCustomerAPIKeys(id)
+	audit.Record(id, "admin", "", "customer.erased", c.ClientIP(), erasureAuditMeta(proof))
+	c.JSON(http.StatusOK, proof)
+}
+
+type eraseAccountRequest struct {
+	// Confirm must repeat the acting member's email, to guard against accidental erasure.
+	Confirm string `json:"confirm" binding:"required"`
+}
+
+// EraseAccount lets a customer erase its own data from the console. The session is revoked
+// as part of the erasure.
+func EraseAccount(c *gin.Context) {
+	customerID := c.GetString("customer_id")
+	var req eraseAccountRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var email string
+	if err := db.DB.QueryRow(`SELECT email FROM members WHERE id = $1 AND customer_id = $2`, c.GetString("member_id"), customerID).Scan(&email); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed"})
+		return
+	}
+	if !strings.EqualFold(strings.TrimSpace(req.Confirm), email) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "confirm must match your email"})
+		return
+	}
+	proof, err := tenantkeys.Erase(customerID)
+	if err != nil {
+		writeEraseError(c, err)
+		return
+	}
+	middleware.ForgetCustomerAPIKeys(customerID)
+	audit.Log(c, "customer.erased", erasureAuditMeta(proof))
+	c.JSON(http.StatusOK, proof)
+}
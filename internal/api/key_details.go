@@ -0,0 +1,225 @@
+package api
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"otp/internal/audit"
+	"otp/internal/db"
+	"otp/internal/keys"
+	"otp/internal/middleware"
+)
+
+// keyMetadata holds the descriptive fields of a key. Nil fields are left unchanged on update.
+type keyMetadata struct {
+	KeyName     *string  `json:"key_name"`
+	Description *string  `json:"description"`
+	OwnerEmail  *string  `json:"owner_email"`
+	Labels      []string `json:"labels"`
+}
+
+// normalize trims and validates the fields that are set.
+func (m *keyMetadata) normalize() error {
+	if m.KeyName != nil {
+		name := strings.TrimSpace(*m.KeyName)
+		if name == "" || utf8.RuneCountInString(name) > keys.MaxKeyNameLength {
+			return fmt.Errorf("key_name must be 1 to %d characters", keys.MaxKeyNameLength)
+		}
+		m.KeyName = &name
+	}
+	if m.Description != nil {
+		d := strings.TrimSpace(*m.Description)
+		if utf8.RuneCountInString(d) > keys.MaxDescriptionLength {
+			return fmt.Errorf("description must be at most %d characters", keys.MaxDescriptionLength)
+		}
+		m.Description = &d
+	}
+	if m.OwnerEmail != nil {
+		email, err := keys.NormalizeOwnerEmail(*m.OwnerEmail)
+		if err != nil {
+			return err
+		}
+		m.OwnerEmail = &email
+	}
+	if m.Labels != nil {
+		labels, err := keys.NormalizeLabels(m.Labels)
+		if err != nil {
+			return err
+		}
+		m.Labels = labels
+	}
+	return nil
+}
+
+// apiKeyDetail is the single-key view: the list item plus where the key was last used from.
+type apiKeyDetail struct {
+	apiKeyItem
+	LastUsedIP        *string   `json:"last_used_ip"`
+	LastUsedUserAgent *string   `json:"last_used_user_agent"`
+	UpdatedAt         time.Time `json:"updated_at"`
+}
+
+// GetAPIKey returns one of the customer's keys, including its last client IP and user agent.
+// Usage is written in batches, so the last use can trail by USAGE_FLUSH_INTERVAL_MS.
+func GetAPIKey(c *gin.Context) {
+	var ip, agent sql.NullString
+	var d apiKeyDetail
+	var err error
+	d.apiKeyItem, err = scanAPIKeyItem(db.DB.QueryRow(`SELECT `+apiKeyItemColumns+`, k.last_used_ip, k.last_used_user_agent, k.updated_at
+		FROM api_keys k JOIN customers cu ON cu.id = k.customer_id WHERE k.id = $1 AND k.customer_id = $2`,
+		c.Param("id"), c.GetString("customer_id")), &ip, &agent, &d.UpdatedAt)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "api key not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "query error"})
+		return
+	}
+	if ip.Valid {
+		d.LastUsedIP = &ip.String
+	}
+	if agent.Valid {
+		d.LastUsedUserAgent = &agent.String
+	}
+	c.JSON(http.StatusOK, d)
+}
+
+// UpdateAPIKey edits a key's name, description, owner email and labels. Omitted fields are kept;
+// the audit entry records the old and new value of each changed field.
+func UpdateAPIKey(c *gin.Context) {
+	customerID := c.GetString("customer_id")
+	id := c.Param("id")
+	var req keyMetadata
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := req.normalize(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.KeyName == nil && req.Description == nil && req.OwnerEmail == nil && req.Labels == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "nothing to update"})
+		return
+	}
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update api key"})
+		return
+	}
+	defer tx.Rollback()
+	var old keyMetadata
+	var labels []string
+	err = tx.QueryRow(`SELECT key_name, description, owner_email, labels FROM api_keys WHERE id = $1 AND customer_id = $2 FOR UPDATE`, id, customerID).
+		Scan(&old.KeyName, &old.Description, &old.OwnerEmail, pq.Array(&labels))
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "api key not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update api key"})
+		return
+	}
+	old.Labels = labels
+	if _, err := tx.Exec(`UPDATE api_keys SET key_name = COALESCE($1, key_name), description = COALESCE($2, description),
+		owner_email = COALESCE($3, owner_email), labels = COALESCE($4, labels), updated_at = NOW() WHERE id = $5`,
+		req.KeyName, req.Description, req.OwnerEmail, labelsParam(req.Labels), id); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update api key"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update api key"})
+		return
+	}
+
+	changes := map[string]any{}
+	if req.KeyName != nil && *req.KeyName != *old.KeyName {
+		changes["key_name"] = map[string]any{"old": *old.KeyName, "new": *req.KeyName}
+	}
+	if req.Description != nil && *req.Description != *old.Description {
+		changes["description"] = map[string]any{"old": *old.Description, "new": *req.Description}
+	}
+	if req.OwnerEmail != nil && *req.OwnerEmail != *old.OwnerEmail {
+		changes["owner_email"] = map[string]any{"old": *old.OwnerEmail, "new": *req.OwnerEmail}
+	}
+	if req.Labels != nil && strings.Join(req.Labels, "\x00") != strings.Join(old.Labels, "\x00") {
+		changes["labels"] = map[string]any{"old": old.Labels, "new": req.Labels}
+	}
+	if len(changes) > 0 {
+		audit.Log(c, "api_key.update", map[string]any{"api_key_id": id, "changes": changes})
+	}
+	c.JSON(http.StatusOK, gin.H{"id": id, "changes": changes})
+}
+
+// labelsParam passes nil through as NULL, so COALESCE keeps the stored labels.
+func labelsParam(labels []string) any {
+	if labels == nil {
+		return nil
+	}
+	return pq.Array(labels)
+}
+
+// EnableAPIKey re-activates a disabled key. Keys that were rotated, reported as leaked or have
+// expired stay disabled: their replacement or a new key should be used instead.
+func EnableAPIKey(c *gin.Context) {
+	customerID := c.GetString("customer_id")
+	id := c.Param("id")
+	var active bool
+	var replacedBy sql.NullString
+	var leaked, expires sql.NullTime
+	err := db.DB.QueryRow(`SELECT is_active, replaced_by, leaked_at, expires_at FROM api_keys WHERE id = $1 AND customer_id = $2`, id, customerID).
+		Scan(&active, &replacedBy, &leaked, &expires)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "api key not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to enable api key"})
+		return
+	}
+	switch {
+	case active:
+		c.JSON(http.StatusConflict, gin.H{"error": "api key is already enabled"})
+		return
+	case leaked.Valid:
+		c.JSON(http.StatusConflict, gin.H{"error": "api key was reported as leaked and can't be re-enabled"})
+		return
+	case replacedBy.Valid:
+		c.JSON(http.StatusConflict, gin.H{"error": "api key was rotated, use its replacement", "replaced_by": replacedBy.String})
+		return
+	case expires.Valid && !expires.Time.After(time.Now()):
+		c.JSON(http.StatusConflict, gin.H{"error": "api key has expired"})
+		return
+	}
+	tx := requireAPIKeyRoom(c)
+	if tx == nil {
+		return
+	}
+	defer tx.Rollback()
+	// the conditions are repeated so a concurrent rotation or leak report wins
+	res, err := tx.Exec(`UPDATE api_keys SET is_active = true, updated_at = NOW() WHERE id = $1 AND customer_id = $2 AND is_active = false
+		AND leaked_at IS NULL AND replaced_by IS NULL AND (expires_at IS NULL OR expires_at > NOW())`, id, customerID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to enable api key"})
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "api key changed, try again"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to enable api key"})
+		return
+	}
+	middleware.ForgetAPIKey(id)
+	audit.Log(c, "api_key.enable", map[string]any{"api_key_id": id})
+	c.JSON(http.StatusOK, gin.H{"status": "enabled"})
+}
@@ -2,20 +2,142 @@ package api
 
 import (
 	"database/sql"
+	"errors"
+	"io"
 	"net/http"
 	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
 	"otp/internal/config"
+	"otp/internal/crypto"
 	"otp/internal/db"
 	"otp/internal/audit"
 	"otp/internal/keys"
+	"otp/internal/tiers"
+	"otp/internal/middleware"
+	"otp/internal/usage"
 )
 
 type createKeyRequest struct {
 	KeyName     string `json:"key_name" binding:"required"`
 	Environment string `json:"environment"` // test|live
+	// Scopes granted to the key; omitted means keys.DefaultScopes
+	Scopes []string `json:"scopes"`
+	// Optional limits below the subscription tier's (nil keeps the tier's)
+	RateLimitPerMinute *int `json:"rate_limit_per_minute"`
+	RateLimitPerHour   *int `json:"rate_limit_per_hour"`
+	// Optional expiry, after which the key stops authenticating
+	ExpiresAt *time.Time `json:"expires_at"`
+	// Optional IP allowlist (addresses or CIDR ranges); empty allows every address
+	AllowedCIDRs []string `json:"allowed_cidrs"`
+	// bearer (default) or signed
+	AuthMode string `json:"auth_mode"`
+	// secret (default) or publishable
+	Kind string `json:"kind"`
+	// Origins a publishable key may be used from, e.g. https://app.example.com
+	AllowedOrigins []string `json:"allowed_origins"`
+	// Optional details, editable later with POST /keys/:id
+	Description string   `json:"description"`
+	OwnerEmail  string   `json:"owner_email"`
+	Labels      []string `json:"labels"`
+}
+
+type updateKeyAllowedOriginsRequest struct {
+	AllowedOrigins []string `json:"allowed_origins" binding:"required"`
+}
+
+type updateKeyAuthModeRequest struct {
+	AuthMode string `json:"auth_mode" binding:"required"`
+}
+
+// authMode validates a requested authentication mode; empty means bearer.
+func authMode(m string) (string, bool) {
+	switch m = strings.ToLower(strings.TrimSpace(m)); m {
+	case "":
+		return keys.AuthModeBearer, true
+	case keys.AuthModeBearer, keys.AuthModeSigned:
+		return m, true
+	}
+	return "", false
+}
+
+// newSigningSecret generates a signing secret for a key and seals it bound to the key's row.
+func newSigningSecret(customerID, keyID string) (plain, sealed string, err error) {
+	plain, err = keys.NewSigningSecret()
+	if err != nil {
+		return "", "", err
+	}
+	sealed, err = crypto.EncryptFor(crypto.Binding{CustomerID: customerID, UserID: keyID, Field: crypto.FieldSigningSecret}, plain)
+	return plain, sealed, err
+}
+
+type updateKeyAllowedCIDRsRequest struct {
+	// An empty list removes the restriction
+	AllowedCIDRs []string `json:"allowed_cidrs"`
+}
+
+type rotateKeyRequest struct {
+	// How long the old key keeps working; nil uses API_KEY_ROTATION_GRACE_MINUTES
+	GracePeriodMinutes *int `json:"grace_period_minutes"`
+	// Optional expiry for the new key
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+const maxRotationGraceMinutes = 30 * 24 * 60
+
+type updateKeyRateLimitsRequest struct {
+	// null clears a limit, so the subscription tier's applies
+	RateLimitPerMinute *int `json:"rate_limit_per_minute"`
+	RateLimitPerHour   *int `json:"rate_limit_per_hour"`
+}
+
+// keyRateLimits reports a key's own limits (null when unset) and the limits in force.
+type keyRateLimits struct {
+	PerMinute          *int64 `json:"per_minute"`
+	PerHour            *int64 `json:"per_hour"`
+	EffectivePerMinute int    `json:"effective_per_minute"`
+	EffectivePerHour   int    `json:"effective_per_hour"`
+}
+
+func newKeyRateLimits(tier string, perMinute, perHour sql.NullInt64) keyRateLimits {
+	eff := middleware.EffectiveKeyRateLimit(tier, perMinute, perHour)
+	rl := keyRateLimits{EffectivePerMinute: eff.PerMinute, EffectivePerHour: eff.PerHour}
+	if perMinute.Valid {
+		rl.PerMinute = &perMinute.Int64
+	}
+	if perHour.Valid {
+		rl.PerHour = &perHour.Int64
+	}
+	return rl
+}
+
+func validRateLimit(n *int) bool { return n == nil || *n >= 1 }
+
+type updateKeyScopesRequest struct {
+	Scopes []string `json:"scopes" binding:"required"`
+}
+
+// grantableScopes validates requested scopes. A request made with an API key can only grant
+// scopes that key holds itself; console sessions can grant any scope.
+func grantableScopes(c *gin.Context, requested []string) ([]string, string) {
+	scopes, err := keys.NormalizeScopes(requested)
+	if err != nil {
+		return nil, err.Error()
+	}
+	if len(scopes) == 0 {
+		return nil, "at least one scope is required"
+	}
+	if c.GetString("api_key_id") != "" {
+		held := c.GetStringSlice("api_key_scopes")
+		for _, s := range scopes {
+			if !keys.HasScope(held, s) {
+				return nil, "cannot grant scope " + s + " that the calling key lacks"
+			}
+		}
+	}
+	return scopes, ""
 }
 
 type usagePoint struct {
@@ -34,11 +156,17 @@ type usageSummary struct {
     Total      int64              `json:"total"`
     Success    int64              `json:"success"`
     Failed     int64              `json:"failed"`
+    // Requests rejected by a rate limit; counted as failed, never billed
+    RateLimited int64             `json:"rate_limited"`
+    // Billable excludes test key usage, which is free, and rate-limited requests
+    Billable   int64              `json:"billable"`
     EstimatedCostUSD float64      `json:"estimated_cost_usd"`
     FirstEvent *time.Time         `json:"first_event,omitempty"`
     LastEvent  *time.Time         `json:"last_event,omitempty"`
     ByDay      []usagePoint       `json:"by_day"`
     ByEndpoint []usageByEndpoint  `json:"by_endpoint"`
+    // The customer's plan and this month's consumption; customer summaries only
+    Quota      *quotaSummary      `json:"quota,omitempty"`
 }
 
 // GetAPIKeyUsage returns usage summary for an API key with optional period filter (?period=24h|7d|30d|90d|all)
@@ -79,10 +207,10 @@ func GetAPIKeyUsage(c *gin.Context) {
         where += " AND created_at >= NOW() - INTERVAL '" + interval + "'"
     }
 
-    var total, success, failed int64
+    var total, success, failed, rateLimited, billable int64
     var first, last sql.NullTime
-    sumQ := "SELECT COUNT(*), COUNT(*) FILTER (WHERE success), COUNT(*) FILTER (WHERE NOT success), MIN(created_at), MAX(created_at) FROM usage_events " + where
-    if err := db.DB.QueryRow(sumQ, id).Scan(&total, &success, &failed, &first, &last); err != nil {
+    sumQ := "SELECT COUNT(*), COUNT(*) FILTER (WHERE success), COUNT(*) FILTER (WHERE NOT success), COUNT(*) FILTER (WHERE endpoint = '" + usage.RateLimitedEndpoint + "'), COUNT(*) FILTER (WHERE environment <> 'test' AND endpoint <> '" + usage.RateLimitedEndpoint + "'), MIN(created_at), MAX(created_at) FROM usage_events " + where
+    if err := db.DB.QueryRow(sumQ, id).Scan(&total, &success, &failed, &rateLimited, &billable, &first, &last); err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "query error"})
         return
     }
@@ -123,12 +251,12 @@ func GetAPIKeyUsage(c *gin.Context) {
         byEp = append(byEp, e)
     }
 
-    resp := usageSummary{Total: total, Success: success, Failed: failed, ByDay: byDay, ByEndpoint: byEp}
+    resp := usageSummary{Total: total, Success: success, Failed: failed, RateLimited: rateLimited, Billable: billable, ByDay: byDay, ByEndpoint: byEp}
     if first.Valid { resp.FirstEvent = &first.Time }
     if last.Valid { resp.LastEvent = &last.Time }
     // estimated cost
     price := config.Get().PricePerRequestUSD
-    resp.EstimatedCostUSD = float64(total) * price
+    resp.EstimatedCostUSD = float64(billable) * price
     c.JSON(http.StatusOK, resp)
 }
 
@@ -138,11 +266,65 @@ type apiKeyItem struct {
 	KeyPrefix  string    `json:"key_prefix"`
 	LastFour   string    `json:"key_last_four"`
 	Environment string   `json:"environment"`
+	Scopes     []string  `json:"scopes"`
+	RateLimits keyRateLimits `json:"rate_limits"`
 	IsActive   bool      `json:"is_active"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	// Set when the key expires within API_KEY_EXPIRY_WARNING_DAYS
+	ExpiringSoon bool    `json:"expiring_soon"`
+	AllowedCIDRs []string `json:"allowed_cidrs"`
+	AuthMode   string    `json:"auth_mode"`
+	// secret or publishable; only publishable keys have allowed origins
+	Kind       string    `json:"kind"`
+	AllowedOrigins []string `json:"allowed_origins"`
+	ReplacedBy *string   `json:"replaced_by,omitempty"`
+	// Set when a secret-scanning partner reported the key as leaked and it was revoked
+	LeakedAt   *time.Time `json:"leaked_at,omitempty"`
+	Description string   `json:"description"`
+	OwnerEmail string    `json:"owner_email"`
+	Labels     []string  `json:"labels"`
 	UsageCount int64     `json:"usage_count"`
+	LastUsedAt *time.Time `json:"last_used_at"`
 	CreatedAt  time.Time `json:"created_at"`
 }
 
+// apiKeyItemColumns are the columns scanAPIKeyItem reads, from api_keys k joined with customers cu.
+const apiKeyItemColumns = `k.id, k.key_name, k.key_prefix, k.key_last_four, k.environment, k.scopes, k.rate_limit_per_minute, k.rate_limit_per_hour,
+	COALESCE(cu.subscription_tier, ''), k.is_active, k.usage_count, k.created_at, k.expires_at, k.replaced_by, k.allowed_cidrs, k.auth_mode, k.leaked_at, k.kind, k.allowed_origins,
+	k.description, k.owner_email, k.labels, k.last_used_at`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanAPIKeyItem(row rowScanner, extra ...any) (apiKeyItem, error) {
+	var it apiKeyItem
+	var perMinute, perHour sql.NullInt64
+	var tier string
+	var expires, leaked, lastUsed sql.NullTime
+	var replacedBy sql.NullString
+	dest := []any{&it.ID, &it.KeyName, &it.KeyPrefix, &it.LastFour, &it.Environment, pq.Array(&it.Scopes), &perMinute, &perHour, &tier, &it.IsActive, &it.UsageCount, &it.CreatedAt, &expires, &replacedBy, pq.Array(&it.AllowedCIDRs), &it.AuthMode, &leaked, &it.Kind, pq.Array(&it.AllowedOrigins),
+		&it.Description, &it.OwnerEmail, pq.Array(&it.Labels), &lastUsed}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return it, err
+	}
+	it.RateLimits = newKeyRateLimits(tier, perMinute, perHour)
+	if expires.Valid {
+		it.ExpiresAt = &expires.Time
+		it.ExpiringSoon = it.IsActive && keys.ExpiringSoon(expires.Time)
+	}
+	if replacedBy.Valid {
+		it.ReplacedBy = &replacedBy.String
+	}
+	if leaked.Valid {
+		it.LeakedAt = &leaked.Time
+	}
+	if lastUsed.Valid {
+		it.LastUsedAt = &lastUsed.Time
+	}
+	return it, nil
+}
+
 // CreateAPIKey creates a new API key for the authenticated customer and returns the plaintext key once.
 func CreateAPIKey(c *gin.Context) {
 	customerID := c.GetString("customer_id")
@@ -151,46 +333,340 @@ func CreateAPIKey(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	meta := keyMetadata{KeyName: &req.KeyName, Description: &req.Description, OwnerEmail: &req.OwnerEmail, Labels: req.Labels}
+	if meta.Labels == nil {
+		meta.Labels = []string{}
+	}
+	if err := meta.normalize(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 	env := strings.TrimSpace(req.Environment)
 	if env == "" {
-		env = "test"
+		env = keys.EnvTest
 	}
-	prefix := "sk_" + env + "_"
-
-	randHex, err := keys.RandomHex(24)
+	if !keys.ValidEnvironment(env) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "environment must be test or live"})
+		return
+	}
+	kind := strings.ToLower(strings.TrimSpace(req.Kind))
+	if kind == "" {
+		kind = keys.KindSecret
+	}
+	if !keys.ValidKind(kind) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "kind must be secret or publishable"})
+		return
+	}
+	origins, err := keys.NormalizeOrigins(req.AllowedOrigins)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	// publishable keys never reach scoped routes, so they hold no scopes
+	scopes := []string{}
+	if kind == keys.KindPublishable {
+		if req.Scopes != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "scopes do not apply to publishable keys"})
+			return
+		}
+		if len(origins) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "publishable keys need at least one allowed origin"})
+			return
+		}
+	} else {
+		if len(origins) > 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "allowed_origins only apply to publishable keys"})
+			return
+		}
+		requested := req.Scopes
+		if requested == nil {
+			requested = keys.DefaultScopes
+		}
+		var msg string
+		if scopes, msg = grantableScopes(c, requested); msg != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+			return
+		}
+	}
+	if !validRateLimit(req.RateLimitPerMinute) || !validRateLimit(req.RateLimitPerHour) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "rate limits must be at least 1"})
+		return
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "expires_at must be in the future"})
+		return
+	}
+	cidrs, err := keys.NormalizeCIDRs(req.AllowedCIDRs)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	mode, ok := authMode(req.AuthMode)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "auth_mode must be bearer or signed"})
+		return
+	}
+	if kind == keys.KindPublishable && mode == keys.AuthModeSigned {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "publishable keys can't use signed requests"})
+		return
+	}
+	// plan checks come after validation, so a malformed request isn't answered with an upsell
+	if kind == keys.KindPublishable && !requireFeature(c, tiers.FeaturePublishableKeys) {
+		return
+	}
+	if mode == keys.AuthModeSigned && !requireFeature(c, tiers.FeatureSignedRequests) {
+		return
+	}
+	if len(cidrs) > 0 && !requireFeature(c, tiers.FeatureIPAllowlists) {
+		return
+	}
+	tx := requireAPIKeyRoom(c)
+	if tx == nil {
+		return
+	}
+	defer tx.Rollback()
+	// the id is generated up front because the signing secret is bound to it
+	id, err := keys.NewID()
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate key"})
 		return
 	}
-	plainKey := prefix + randHex
-	keyHash := keys.HashAPIKey(plainKey)
-	last4 := ""
-	if len(plainKey) >= 4 {
-		last4 = plainKey[len(plainKey)-4:]
+	var secret string
+	var sealed sql.NullString
+	if mode == keys.AuthModeSigned {
+		if secret, sealed.String, err = newSigningSecret(customerID, id); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate signing secret"})
+			return
+		}
+		sealed.Valid = true
+	}
+	plainKey, prefix, err := keys.NewAPIKey(kind, env)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate key"})
+		return
 	}
+	keyHash := keys.HashAPIKey(plainKey)
+	last4 := keys.LastFour(plainKey)
 
-	var id string
-	err = db.DB.QueryRow(
-		`INSERT INTO api_keys (customer_id, key_name, key_prefix, key_hash, key_last_four, environment)
-		 VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`,
-		customerID, req.KeyName, prefix, keyHash, last4, env,
-	).Scan(&id)
+	_, err = tx.Exec(
+		`INSERT INTO api_keys (id, customer_id, key_name, key_prefix, key_hash, key_last_four, environment, scopes, rate_limit_per_minute, rate_limit_per_hour, expires_at, allowed_cidrs, auth_mode, signing_secret_encrypted, kind, allowed_origins,
+		 description, owner_email, labels)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19)`,
+		id, customerID, *meta.KeyName, prefix, keyHash, last4, env, pq.Array(scopes), req.RateLimitPerMinute, req.RateLimitPerHour, req.ExpiresAt, pq.Array(cidrs), mode, sealed, kind, pq.Array(origins),
+		*meta.Description, *meta.OwnerEmail, pq.Array(meta.Labels),
+	)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create api key"})
 		return
 	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create api key"})
+		return
+	}
+	if kind == keys.KindPublishable {
+		middleware.ForgetPublishableOrigins()
+	}
+
+	audit.Log(c, "api_key.create", map[string]any{"api_key_id": id, "env": env, "key_name": *meta.KeyName, "kind": kind, "scopes": scopes, "expires_at": req.ExpiresAt, "allowed_cidrs": cidrs, "allowed_origins": origins, "auth_mode": mode})
+	resp := gin.H{
+		"id":              id,
+		"api_key":         plainKey,
+		"kind":            kind,
+		"scopes":          scopes,
+		"expires_at":      req.ExpiresAt,
+		"allowed_cidrs":   cidrs,
+		"allowed_origins": origins,
+		"auth_mode":       mode,
+	}
+	if secret != "" {
+		resp["signing_secret"] = secret
+	}
+	c.JSON(http.StatusCreated, resp)
+}
+
+// UpdateAPIKeyAuthMode switches an active API key between bearer and signed authentication.
+// Switching to signed (again) issues a new signing secret, returned once; switching to bearer
+// discards it.
+func UpdateAPIKeyAuthMode(c *gin.Context) {
+	customerID := c.GetString("customer_id")
+	id := c.Param("id")
+	var req updateKeyAuthModeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	mode, ok := authMode(req.AuthMode)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "auth_mode must be bearer or signed"})
+		return
+	}
+	if mode == keys.AuthModeSigned && !requireFeature(c, tiers.FeatureSignedRequests) {
+		return
+	}
+	var secret string
+	var sealed sql.NullString
+	if mode == keys.AuthModeSigned {
+		var err error
+		if secret, sealed.String, err = newSigningSecret(customerID, id); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate signing secret"})
+			return
+		}
+		sealed.Valid = true
+	}
+	res, err := db.DB.Exec(`UPDATE api_keys SET auth_mode = $1, signing_secret_encrypted = $2, updated_at = NOW()
+		WHERE id = $3 AND customer_id = $4 AND is_active = true AND kind = 'secret'`, mode, sealed, id, customerID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update api key auth mode"})
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "secret api key not found or disabled"})
+		return
+	}
+	middleware.ForgetAPIKey(id)
+	audit.Log(c, "api_key.auth_mode_update", map[string]any{"api_key_id": id, "auth_mode": mode, "secret_issued": secret != ""})
+	resp := gin.H{"id": id, "auth_mode": mode}
+	if secret != "" {
+		resp["signing_secret"] = secret
+	}
+	c.JSON(http.StatusOK, resp)
+}
 
-	audit.Log(c, "api_key.create", map[string]any{"api_key_id": id, "env": env, "key_name": req.KeyName})
-	c.JSON(http.StatusCreated, gin.H{
-		"id":      id,
-		"api_key": plainKey,
-	})
+// UpdateAPIKeyScopes replaces the scopes of an active API key.
+func UpdateAPIKeyScopes(c *gin.Context) {
+	customerID := c.GetString("customer_id")
+	id := c.Param("id")
+	var req updateKeyScopesRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	scopes, msg := grantableScopes(c, req.Scopes)
+	if msg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return
+	}
+	var old []string
+	err := db.DB.QueryRow(`UPDATE api_keys k SET scopes = $1, updated_at = NOW()
+		FROM (SELECT id, scopes FROM api_keys WHERE id = $2 AND customer_id = $3 AND is_active = true AND kind = 'secret' FOR UPDATE) prev
+		WHERE k.id = prev.id RETURNING prev.scopes`, pq.Array(scopes), id, customerID).Scan(pq.Array(&old))
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "secret api key not found or disabled"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update api key scopes"})
+		return
+	}
+	middleware.ForgetAPIKey(id)
+	audit.Log(c, "api_key.scopes_update", map[string]any{"api_key_id": id, "old_scopes": old, "scopes": scopes})
+	c.JSON(http.StatusOK, gin.H{"id": id, "scopes": scopes})
+}
+
+// UpdateAPIKeyAllowedCIDRs replaces an active API key's IP allowlist.
+func UpdateAPIKeyAllowedCIDRs(c *gin.Context) {
+	customerID := c.GetString("customer_id")
+	id := c.Param("id")
+	var req updateKeyAllowedCIDRsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	cidrs, err := keys.NormalizeCIDRs(req.AllowedCIDRs)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	// clearing an allowlist is always allowed, so a downgraded customer can drop it
+	if len(cidrs) > 0 && !requireFeature(c, tiers.FeatureIPAllowlists) {
+		return
+	}
+	res, err := db.DB.Exec(`UPDATE api_keys SET allowed_cidrs = $1, updated_at = NOW() WHERE id = $2 AND customer_id = $3 AND is_active = true`,
+		pq.Array(cidrs), id, customerID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update api key allowlist"})
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "api key not found or disabled"})
+		return
+	}
+	middleware.ForgetAPIKey(id)
+	audit.Log(c, "api_key.allowed_cidrs_update", map[string]any{"api_key_id": id, "allowed_cidrs": cidrs})
+	c.JSON(http.StatusOK, gin.H{"id": id, "allowed_cidrs": cidrs})
+}
+
+// UpdateAPIKeyAllowedOrigins replaces the origins an active publishable key may be used from.
+func UpdateAPIKeyAllowedOrigins(c *gin.Context) {
+	customerID := c.GetString("customer_id")
+	id := c.Param("id")
+	var req updateKeyAllowedOriginsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	origins, err := keys.NormalizeOrigins(req.AllowedOrigins)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(origins) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "publishable keys need at least one allowed origin"})
+		return
+	}
+	res, err := db.DB.Exec(`UPDATE api_keys SET allowed_origins = $1, updated_at = NOW() WHERE id = $2 AND customer_id = $3 AND is_active = true AND kind = 'publishable'`,
+		pq.Array(origins), id, customerID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update api key origins"})
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "publishable api key not found or disabled"})
+		return
+	}
+	middleware.ForgetAPIKey(id)
+	audit.Log(c, "api_key.allowed_origins_update", map[string]any{"api_key_id": id, "allowed_origins": origins})
+	c.JSON(http.StatusOK, gin.H{"id": id, "allowed_origins": origins})
+}
+
+// UpdateAPIKeyRateLimits sets or clears an active API key's own rate limits. Limits above the
+// subscription tier's are accepted but capped at the tier's when enforced.
+func UpdateAPIKeyRateLimits(c *gin.Context) {
+	customerID := c.GetString("customer_id")
+	id := c.Param("id")
+	var req updateKeyRateLimitsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !validRateLimit(req.RateLimitPerMinute) || !validRateLimit(req.RateLimitPerHour) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "rate limits must be at least 1"})
+		return
+	}
+	var perMinute, perHour sql.NullInt64
+	var tier string
+	err := db.DB.QueryRow(`UPDATE api_keys k SET rate_limit_per_minute = $1, rate_limit_per_hour = $2, updated_at = NOW()
+		FROM customers cu WHERE k.id = $3 AND k.customer_id = $4 AND k.is_active = true AND cu.id = k.customer_id
+		RETURNING k.rate_limit_per_minute, k.rate_limit_per_hour, COALESCE(cu.subscription_tier, '')`,
+		req.RateLimitPerMinute, req.RateLimitPerHour, id, customerID).Scan(&perMinute, &perHour, &tier)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "api key not found or disabled"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update api key rate limits"})
+		return
+	}
+	middleware.ForgetAPIKey(id)
+	audit.Log(c, "api_key.rate_limits_update", map[string]any{"api_key_id": id, "rate_limit_per_minute": req.RateLimitPerMinute, "rate_limit_per_hour": req.RateLimitPerHour})
+	c.JSON(http.StatusOK, gin.H{"id": id, "rate_limits": newKeyRateLimits(tier, perMinute, perHour)})
 }
 
 // ListAPIKeys lists API keys for the authenticated customer.
 func ListAPIKeys(c *gin.Context) {
 	customerID := c.GetString("customer_id")
-	rows, err := db.DB.Query(`SELECT id, key_name, key_prefix, key_last_four, environment, is_active, usage_count, created_at FROM api_keys WHERE customer_id = $1 ORDER BY created_at DESC`, customerID)
+	rows, err := db.DB.Query(`SELECT `+apiKeyItemColumns+`
+		FROM api_keys k JOIN customers cu ON cu.id = k.customer_id WHERE k.customer_id = $1 ORDER BY k.created_at DESC`, customerID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to query api keys"})
 		return
@@ -198,8 +674,8 @@ func ListAPIKeys(c *gin.Context) {
 	defer rows.Close()
 	items := []apiKeyItem{}
 	for rows.Next() {
-		var it apiKeyItem
-		if err := rows.Scan(&it.ID, &it.KeyName, &it.KeyPrefix, &it.LastFour, &it.Environment, &it.IsActive, &it.UsageCount, &it.CreatedAt); err != nil {
+		it, err := scanAPIKeyItem(rows)
+		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "scan error"})
 			return
 		}
@@ -222,16 +698,56 @@ func DisableAPIKey(c *gin.Context) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "api key not found or already disabled"})
 		return
 	}
+	middleware.ForgetAPIKey(id)
 	audit.Log(c, "api_key.disable", map[string]any{"api_key_id": id})
 	c.JSON(http.StatusOK, gin.H{"status": "disabled"})
 }
 
-// RotateAPIKey disables the specified key and creates a new one with same env and name.
+// RotateAPIKey creates a new key with the same env, kind, name, scopes, rate limits, IP and
+// origin allowlists and auth mode (with a new signing secret for signed keys). The old key stays
+// valid for a grace period (API_KEY_ROTATION_GRACE_MINUTES unless the request sets
+// grace_period_minutes), so deployments can switch over without an outage.
 func RotateAPIKey(c *gin.Context) {
 	customerID := c.GetString("customer_id")
 	id := c.Param("id")
+	var req rotateKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	grace := config.Get().APIKeyRotationGraceMinutes
+	if req.GracePeriodMinutes != nil {
+		grace = *req.GracePeriodMinutes
+	}
+	if grace < 0 || grace > maxRotationGraceMinutes {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "grace_period_minutes must be between 0 and 43200"})
+		return
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "expires_at must be in the future"})
+		return
+	}
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to rotate api key"})
+		return
+	}
+	defer tx.Rollback()
+
 	var keyName, env string
-	err := db.DB.QueryRow(`SELECT key_name, environment FROM api_keys WHERE id = $1 AND customer_id = $2`, id, customerID).Scan(&keyName, &env)
+	var scopes []string
+	var perMinute, perHour sql.NullInt64
+	var replacedBy sql.NullString
+	var cidrs, origins []string
+	var mode, kind, description, ownerEmail string
+	var labels []string
+	var active bool
+	err = tx.QueryRow(`SELECT key_name, environment, scopes, rate_limit_per_minute, rate_limit_per_hour, replaced_by, allowed_cidrs, auth_mode, kind, allowed_origins,
+		description, owner_email, labels, is_active FROM api_keys
+		WHERE id = $1 AND customer_id = $2 FOR UPDATE`, id, customerID).
+		Scan(&keyName, &env, pq.Array(&scopes), &perMinute, &perHour, &replacedBy, pq.Array(&cidrs), &mode, &kind, pq.Array(&origins),
+			&description, &ownerEmail, pq.Array(&labels), &active)
 	if err == sql.ErrNoRows {
 		c.JSON(http.StatusNotFound, gin.H{"error": "api key not found"})
 		return
@@ -240,32 +756,88 @@ func RotateAPIKey(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch api key"})
 		return
 	}
-	// disable old key
-	_, _ = db.DB.Exec(`UPDATE api_keys SET is_active = false, updated_at = NOW() WHERE id = $1 AND customer_id = $2`, id, customerID)
+	if replacedBy.Valid {
+		c.JSON(http.StatusConflict, gin.H{"error": "api key was already rotated", "replaced_by": replacedBy.String})
+		return
+	}
+	// the replacement takes the old key's place under the plan's key limit, which a disabled
+	// key doesn't hold
+	if !active {
+		c.JSON(http.StatusConflict, gin.H{"error": "api key is disabled, enable it before rotating"})
+		return
+	}
+	// an API key can't rotate its way into scopes it lacks
+	if kind == keys.KindSecret {
+		if _, msg := grantableScopes(c, scopes); msg != "" {
+			c.JSON(http.StatusForbidden, gin.H{"error": msg})
+			return
+		}
+	}
 
 	// create new key
-	randHex, err := keys.RandomHex(24)
+	plainKey, prefix, err := keys.NewAPIKey(kind, env)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate key"})
 		return
 	}
-	prefix := "sk_" + env + "_"
-	plainKey := prefix + randHex
 	keyHash := keys.HashAPIKey(plainKey)
-	last4 := ""
-	if len(plainKey) >= 4 {
-		last4 = plainKey[len(plainKey)-4:]
-	}
-	var newID string
-	err = db.DB.QueryRow(
-		`INSERT INTO api_keys (customer_id, key_name, key_prefix, key_hash, key_last_four, environment)
-		 VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`,
-		customerID, keyName, prefix, keyHash, last4, env,
-	).Scan(&newID)
+	last4 := keys.LastFour(plainKey)
+	newID, err := keys.NewID()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate key"})
+		return
+	}
+	// a signed key gets a new signing secret along with the new key
+	var secret string
+	var sealed sql.NullString
+	if mode == keys.AuthModeSigned {
+		if secret, sealed.String, err = newSigningSecret(customerID, newID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate signing secret"})
+			return
+		}
+		sealed.Valid = true
+	}
+	_, err = tx.Exec(
+		`INSERT INTO api_keys (id, customer_id, key_name, key_prefix, key_hash, key_last_four, environment, scopes, rate_limit_per_minute, rate_limit_per_hour, expires_at, allowed_cidrs, auth_mode, signing_secret_encrypted, kind, allowed_origins,
+		 description, owner_email, labels)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19)`,
+		newID, customerID, keyName, prefix, keyHash, last4, env, pq.Array(scopes), perMinute, perHour, req.ExpiresAt, pq.Array(cidrs), mode, sealed, kind, pq.Array(origins),
+		description, ownerEmail, pq.Array(labels),
+	)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create rotated key"})
 		return
 	}
-	audit.Log(c, "api_key.rotate", map[string]any{"old_api_key_id": id, "new_api_key_id": newID})
-	c.JSON(http.StatusCreated, gin.H{"id": newID, "api_key": plainKey})
+
+	// retire the old key: immediately without a grace period, otherwise by moving its expiry
+	// forward (never back)
+	var oldExpires sql.NullTime
+	if grace == 0 {
+		err = tx.QueryRow(`UPDATE api_keys SET is_active = false, replaced_by = $1, updated_at = NOW() WHERE id = $2 RETURNING expires_at`, newID, id).Scan(&oldExpires)
+	} else {
+		err = tx.QueryRow(`UPDATE api_keys SET replaced_by = $1, updated_at = NOW(),
+			expires_at = LEAST(COALESCE(expires_at, 'infinity'), NOW() + make_interval(mins => $2))
+			WHERE id = $3 RETURNING expires_at`, newID, grace, id).Scan(&oldExpires)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to retire old key"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to rotate api key"})
+		return
+	}
+
+	resp := gin.H{"id": newID, "api_key": plainKey, "kind": kind, "scopes": scopes, "expires_at": req.ExpiresAt, "auth_mode": mode}
+	if secret != "" {
+		resp["signing_secret"] = secret
+	}
+	meta := map[string]any{"old_api_key_id": id, "new_api_key_id": newID, "grace_period_minutes": grace}
+	if grace > 0 && oldExpires.Valid {
+		resp["old_key_expires_at"] = oldExpires.Time
+		meta["old_key_expires_at"] = oldExpires.Time
+	}
+	middleware.ForgetAPIKey(id)
+	audit.Log(c, "api_key.rotate", meta)
+	c.JSON(http.StatusCreated, resp)
 }
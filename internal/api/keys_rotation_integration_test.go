@@ -0,0 +1,90 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"otp/internal/config"
+	"otp/internal/db"
+)
+
+func TestRotateAPIKeyGrace(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	cfg := config.Load()
+	if v := os.Getenv("TEST_DATABASE_URL"); v != "" {
+		cfg.DatabaseURL = v
+	}
+	if err := db.Init(cfg.DatabaseURL); err != nil {
+		t.Skipf("skipping integration test; DB unavailable: %v (set TEST_DATABASE_URL)", err)
+	}
+
+	stamp := time.Now().Format("150405.000")
+	custID := ensureTestCustomer(t, "rotate-itest-"+stamp+"@example.com", "itestpass", "Rotate ITest Co", "cus_rot_"+stamp)
+
+	r := gin.New()
+	r.Use(func(c *gin.Context) { c.Set("customer_id", custID); c.Next() })
+	r.POST("/keys", CreateAPIKey)
+	r.POST("/keys/:id/rotate", RotateAPIKey)
+
+	do := func(path string, body any) (int, map[string]any) {
+		b, _ := json.Marshal(body)
+		req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(b))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		var out map[string]any
+		_ = json.Unmarshal(w.Body.Bytes(), &out)
+		return w.Code, out
+	}
+	create := func(expiresAt *time.Time) string {
+		t.Helper()
+		code, out := do("/keys", map[string]any{"key_name": "rotate-itest", "expires_at": expiresAt})
+		id, _ := out["id"].(string)
+		if code != http.StatusCreated || id == "" {
+			t.Fatalf("create: %d %v", code, out)
+		}
+		return id
+	}
+	oldKey := func(id string) (active bool, expires *time.Time) {
+		t.Helper()
+		if err := db.DB.QueryRow(`SELECT is_active, expires_at FROM api_keys WHERE id = $1`, id).Scan(&active, &expires); err != nil {
+			t.Fatal(err)
+		}
+		return active, expires
+	}
+
+	// the grace period moves a later expiry forward
+	id := create(nil)
+	if code, out := do("/keys/"+id+"/rotate", map[string]any{"grace_period_minutes": 60}); code != http.StatusCreated {
+		t.Fatalf("rotate: %d %v", code, out)
+	}
+	if active, exp := oldKey(id); !active || exp == nil || exp.Before(time.Now().Add(59*time.Minute)) || exp.After(time.Now().Add(61*time.Minute)) {
+		t.Fatalf("old key after a 60 minute grace: active=%v expires=%v", active, exp)
+	}
+
+	// but never pushes an earlier one back
+	soon := time.Now().Add(10 * time.Minute).Truncate(time.Second)
+	id = create(&soon)
+	if code, out := do("/keys/"+id+"/rotate", map[string]any{"grace_period_minutes": 60}); code != http.StatusCreated {
+		t.Fatalf("rotate: %d %v", code, out)
+	}
+	if _, exp := oldKey(id); exp == nil || !exp.Equal(soon) {
+		t.Fatalf("old key expiry moved from %v to %v", soon, exp)
+	}
+
+	// no grace disables the old key at once
+	id = create(nil)
+	code, out := do("/keys/"+id+"/rotate", map[string]any{"grace_period_minutes": 0})
+	if code != http.StatusCreated || out["old_key_expires_at"] != nil {
+		t.Fatalf("rotate without grace: %d %v", code, out)
+	}
+	if active, _ := oldKey(id); active {
+		t.Fatal("old key still active after a rotation without grace")
+	}
+}
@@ -0,0 +1,434 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"golang.org/x/crypto/bcrypt"
+	"otp/internal/audit"
+	"otp/internal/db"
+	"otp/internal/keys"
+	"otp/internal/members"
+)
+
+// invitationTTL is how long an invitation can be accepted.
+const invitationTTL = 7 * 24 * time.Hour
+
+type memberItem struct {
+	ID          string     `json:"id"`
+	Email       string     `json:"email"`
+	Name        string     `json:"name"`
+	Role        string     `json:"role"`
+	IsActive    bool       `json:"is_active"`
+	MFAEnabled  bool       `json:"mfa_enabled"`
+	LastLoginAt *time.Time `json:"last_login_at,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+const memberColumns = `m.id, m.email, m.name, m.role, m.is_active, mu.last_success_at IS NOT NULL, m.last_login_at, m.created_at
+	FROM members m LEFT JOIN mfa_users mu ON mu.customer_id = m.customer_id AND mu.environment = $2 AND mu.user_id = m.id::text AND mu.is_active = true`
+
+func scanMember(row interface{ Scan(...any) error }) (memberItem, error) {
+	var m memberItem
+	var lastLogin sql.NullTime
+	if err := row.Scan(&m.ID, &m.Email, &m.Name, &m.Role, &m.IsActive, &m.MFAEnabled, &lastLogin, &m.CreatedAt); err != nil {
+		return m, err
+	}
+	if lastLogin.Valid {
+		m.LastLoginAt = &lastLogin.Time
+	}
+	return m, nil
+}
+
+// loadMember returns a member of the session's customer, answering 404 when there is none.
+func loadMember(c *gin.Context, id string) (memberItem, bool) {
+	m, err := scanMember(db.DB.QueryRow(`SELECT `+memberColumns+` WHERE m.customer_id = $1 AND m.id::text = $3`,
+		c.GetString("customer_id"), consoleMFAEnvironment, id))
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "member not found"})
+		return m, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed"})
+		return m, false
+	}
+	return m, true
+}
+
+// requireManageable answers 403 and returns false unless the session's member may manage
+// members holding role (see members.CanManage).
+func requireManageable(c *gin.Context, role string) bool {
+	if !members.CanManage(c.GetString("member_role"), role) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "only owners can manage owners", "code": "permission_denied"})
+		return false
+	}
+	return true
+}
+
+// GetCurrentMember reports the session's member and what their role allows.
+// GET /api/v1/console/me
+func GetCurrentMember(c *gin.Context) {
+	m, ok := loadMember(c, c.GetString("member_id"))
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"member": m, "customer_id": c.GetString("customer_id"), "permissions": members.Permissions(m.Role)})
+}
+
+// ListMembers lists the organization's members, removed ones included.
+// GET /api/v1/console/members
+func ListMembers(c *gin.Context) {
+	rows, err := db.DB.Query(`SELECT `+memberColumns+` WHERE m.customer_id = $1 ORDER BY m.created_at`, c.GetString("customer_id"), consoleMFAEnvironment)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed"})
+		return
+	}
+	defer rows.Close()
+	items := []memberItem{}
+	for rows.Next() {
+		m, err := scanMember(rows)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "scan failed"})
+			return
+		}
+		items = append(items, m)
+	}
+	c.JSON(http.StatusOK, gin.H{"data": items})
+}
+
+type inviteMemberRequest struct {
+	Email string `json:"email" binding:"required"`
+	Role  string `json:"role" binding:"required"`
+}
+
+// InviteMember invites someone to the organization with a role. Only owners invite owners.
+// An earlier pending invitation for the same email is revoked.
+// POST /api/v1/console/members/invitations
+// Dev-mode: returns invitation_token, which is otherwise sent by email.
+func InviteMember(c *gin.Context) {
+	var req inviteMemberRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	email := strings.TrimSpace(strings.ToLower(req.Email))
+	if !members.ValidRole(req.Role) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "unknown role, expected one of " + strings.Join(members.Roles, ", ")})
+		return
+	}
+	if !requireManageable(c, req.Role) {
+		return
+	}
+	customerID := c.GetString("customer_id")
+	// a removed member of this organization can be invited back; anyone else with a login can't
+	var taken bool
+	err := db.DB.QueryRow(`SELECT EXISTS(SELECT 1 FROM members WHERE email = $1 AND (is_active OR customer_id <> $2))`, email, customerID).Scan(&taken)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed"})
+		return
+	}
+	if taken {
+		c.JSON(http.StatusConflict, gin.H{"error": "a member with this email already exists"})
+		return
+	}
+	tok, err := keys.RandomHex(24)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create invitation token"})
+		return
+	}
+	exp := time.Now().Add(invitationTTL)
+	_, _ = db.DB.Exec(`UPDATE member_invitations SET revoked_at = NOW() WHERE customer_id = $1 AND email = $2 AND accepted_at IS NULL AND revoked_at IS NULL`, customerID, email)
+	var id string
+	err = db.DB.QueryRow(`INSERT INTO member_invitations (customer_id, email, role, token_hash, invited_by, expires_at) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`,
+		customerID, email, req.Role, keys.HashAPIKey(tok), c.GetString("member_id"), exp).Scan(&id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create invitation"})
+		return
+	}
+	audit.Log(c, "member.invite", map[string]any{"invitation_id": id, "email": email, "role": req.Role})
+	c.JSON(http.StatusCreated, gin.H{"id": id, "email": email, "role": req.Role, "expires_at": exp, "invitation_token": tok})
+}
+
+type invitationItem struct {
+	ID         string     `json:"id"`
+	Email      string     `json:"email"`
+	Role       string     `json:"role"`
+	InvitedBy  *string    `json:"invited_by,omitempty"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	AcceptedAt *time.Time `json:"accepted_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// ListInvitations lists the organization's invitations, newest first. ?status=pending keeps
+// those that can still be accepted.
+// GET /api/v1/console/members/invitations
+func ListInvitations(c *gin.Context) {
+	q := `SELECT id, email, role, invited_by, expires_at, accepted_at, revoked_at, created_at FROM member_invitations WHERE customer_id = $1`
+	if c.Query("status") == "pending" {
+		q += ` AND accepted_at IS NULL AND revoked_at IS NULL AND expires_at > NOW()`
+	}
+	rows, err := db.DB.Query(q+` ORDER BY created_at DESC LIMIT 200`, c.GetString("customer_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed"})
+		return
+	}
+	defer rows.Close()
+	items := []invitationItem{}
+	for rows.Next() {
+		var it invitationItem
+		var invitedBy sql.NullString
+		var acceptedAt, revokedAt sql.NullTime
+		if err := rows.Scan(&it.ID, &it.Email, &it.Role, &invitedBy, &it.ExpiresAt, &acceptedAt, &revokedAt, &it.CreatedAt); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "scan failed"})
+			return
+		}
+		if invitedBy.Valid {
+			it.InvitedBy = &invitedBy.String
+		}
+		if acceptedAt.Valid {
+			it.AcceptedAt = &acceptedAt.Time
+		}
+		if revokedAt.Valid {
+			it.RevokedAt = &revokedAt.Time
+		}
+		items = append(items, it)
+	}
+	c.JSON(http.StatusOK, gin.H{"data": items})
+}
+
+// RevokeInvitation withdraws a pending invitation.
+// POST /api/v1/console/members/invitations/:id/revoke
+func RevokeInvitation(c *gin.Context) {
+	id := c.Param("id")
+	var role string
+	err := db.DB.QueryRow(`SELECT role FROM member_invitations WHERE id::text = $1 AND customer_id = $2 AND accepted_at IS NULL AND revoked_at IS NULL`,
+		id, c.GetString("customer_id")).Scan(&role)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "invitation not found or no longer pending"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed"})
+		return
+	}
+	if !requireManageable(c, role) {
+		return
+	}
+	if _, err := db.DB.Exec(`UPDATE member_invitations SET revoked_at = NOW() WHERE id = $1 AND accepted_at IS NULL`, id); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "revoke failed"})
+		return
+	}
+	audit.Log(c, "member.invitation.revoke", map[string]any{"invitation_id": id})
+	c.JSON(http.StatusOK, gin.H{"status": "revoked"})
+}
+
+// AcceptInvitation
+// POST /api/v1/auth/invitations/accept
+// { token, name, password }
+// Creates the member's login; they then sign in at /auth/login. A removed member invited back
+// keeps their id, so their audit history stays theirs.
+type acceptInvitationRequest struct {
+	Token    string `json:"token" binding:"required"`
+	Name     string `json:"name"`
+	Password string `json:"password" binding:"required"`
+}
+
+func AcceptInvitation(c *gin.Context) {
+	var req acceptInvitationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	pwHash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to hash password"})
+		return
+	}
+	tx, err := db.DB.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
+		return
+	}
+	defer tx.Rollback()
+	// the invitation is spent once, so concurrent accepts can't both create a member
+	var invitationID, customerID, email, role string
+	err = tx.QueryRow(`UPDATE member_invitations i SET accepted_at = NOW() FROM customers c
+		WHERE c.id = i.customer_id AND COALESCE(c.is_active, true) AND i.token_hash = $1 AND i.accepted_at IS NULL AND i.revoked_at IS NULL AND i.expires_at > NOW()
+		RETURNING i.id, i.customer_id, i.email, i.role`, keys.HashAPIKey(req.Token)).Scan(&invitationID, &customerID, &email, &role)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid or expired invitation"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
+		return
+	}
+	var memberID string
+	err = tx.QueryRow(`INSERT INTO members (customer_id, email, name, password_hash, role) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (email) DO UPDATE SET name = EXCLUDED.name, password_hash = EXCLUDED.password_hash, role = EXCLUDED.role, is_active = true, updated_at = NOW()
+		WHERE members.customer_id = EXCLUDED.customer_id AND NOT members.is_active
+		RETURNING id`, customerID, email, strings.TrimSpace(req.Name), string(pwHash), role).Scan(&memberID)
+	var pqErr *pq.Error
+	if err == sql.ErrNoRows || errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		c.JSON(http.StatusConflict, gin.H{"error": "a member with this email already exists"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create member"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
+		return
+	}
+	audit.Record(customerID, "member", memberID, "member.join", c.ClientIP(), map[string]any{"invitation_id": invitationID, "email": email, "role": role})
+	c.JSON(http.StatusCreated, gin.H{"id": memberID, "customer_id": customerID, "email": email, "role": role})
+}
+
+// lastOwnerGuard is appended to updates that take a member's owner role away, so an
+// organization always keeps an active owner. They run under beginOwnerChange.
+const lastOwnerGuard = ` AND (role <> 'owner' OR (SELECT COUNT(*) FROM members o WHERE o.customer_id = $2 AND o.role = 'owner' AND o.is_active) > 1)`
+
+// beginOwnerChange starts a transaction holding the customer's lock on role changes and
+// removals, so two of them can't each count the other owner and leave none.
+func beginOwnerChange(ctx context.Context, customerID string) (*sql.Tx, error) {
+	tx, err := db.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext('members'), hashtext($1))`, customerID); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return tx, nil
+}
+
+type updateMemberRoleRequest struct {
+	Role string `json:"role" binding:"required"`
+}
+
+// UpdateMemberRole changes a member's role. Only owners grant or take away the owner role, and
+// the last owner keeps it. The member's sessions pick the new role up on their next request.
+// POST /api/v1/console/members/:id/role
+func UpdateMemberRole(c *gin.Context) {
+	var req updateMemberRoleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !members.ValidRole(req.Role) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "unknown role, expected one of " + strings.Join(members.Roles, ", ")})
+		return
+	}
+	m, ok := loadMember(c, c.Param("id"))
+	if !ok {
+		return
+	}
+	if !requireManageable(c, m.Role) || !requireManageable(c, req.Role) {
+		return
+	}
+	if !m.IsActive {
+		c.JSON(http.StatusConflict, gin.H{"error": "member was removed"})
+		return
+	}
+	if m.Role == req.Role {
+		c.JSON(http.StatusOK, gin.H{"status": "unchanged"})
+		return
+	}
+	tx, err := beginOwnerChange(c.Request.Context(), c.GetString("customer_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "update failed"})
+		return
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(`UPDATE members SET role = $3, updated_at = NOW() WHERE id = $1 AND customer_id = $2`+lastOwnerGuard,
+		m.ID, c.GetString("customer_id"), req.Role)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "update failed"})
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "the organization needs at least one owner", "code": "last_owner"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "update failed"})
+		return
+	}
+	audit.Log(c, "member.role_change", map[string]any{"member_id": m.ID, "from": m.Role, "to": req.Role})
+	c.JSON(http.StatusOK, gin.H{"status": "updated"})
+}
+
+// RemoveMember deactivates a member, ends their sessions and deletes their console MFA. The
+// last owner can't be removed.
+// POST /api/v1/console/members/:id/remove
+func RemoveMember(c *gin.Context) {
+	m, ok := loadMember(c, c.Param("id"))
+	if !ok {
+		return
+	}
+	if !requireManageable(c, m.Role) {
+		return
+	}
+	customerID := c.GetString("customer_id")
+	tx, err := beginOwnerChange(c.Request.Context(), customerID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "remove failed"})
+		return
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(`UPDATE members SET is_active = false, updated_at = NOW() WHERE id = $1 AND customer_id = $2 AND is_active`+lastOwnerGuard,
+		m.ID, customerID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "remove failed"})
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		if !m.IsActive {
+			c.JSON(http.StatusNotFound, gin.H{"error": "member already removed"})
+			return
+		}
+		c.JSON(http.StatusConflict, gin.H{"error": "the organization needs at least one owner", "code": "last_owner"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "remove failed"})
+		return
+	}
+	_, _ = db.DB.Exec(`UPDATE sessions SET revoked_at = NOW() WHERE member_id = $1 AND revoked_at IS NULL`, m.ID)
+	_, _ = db.DB.Exec(`UPDATE login_challenges SET used_at = NOW() WHERE member_id = $1 AND used_at IS NULL`, m.ID)
+	_, _ = db.DB.Exec(`DELETE FROM mfa_users WHERE customer_id = $1 AND environment = $2 AND user_id = $3`, customerID, consoleMFAEnvironment, m.ID)
+	audit.Log(c, "member.remove", map[string]any{"member_id": m.ID, "email": m.Email, "role": m.Role})
+	c.JSON(http.StatusOK, gin.H{"status": "removed"})
+}
+
+// ResetMemberMFA removes another member's console MFA, e.g. after a lost device, and ends
+// their sessions.
+// POST /api/v1/console/members/:id/mfa/reset
+func ResetMemberMFA(c *gin.Context) {
+	m, ok := loadMember(c, c.Param("id"))
+	if !ok {
+		return
+	}
+	if !requireManageable(c, m.Role) {
+		return
+	}
+	found, err := resetMemberMFA(c.GetString("customer_id"), m.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "reset failed"})
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "mfa not enrolled"})
+		return
+	}
+	audit.Log(c, "console.mfa.reset", map[string]any{"member_id": m.ID})
+	c.JSON(http.StatusOK, gin.H{"status": "reset"})
+}
@@ -0,0 +1,142 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"otp/internal/config"
+	"otp/internal/db"
+	"otp/internal/members"
+	"otp/internal/middleware"
+)
+
+func TestMembersAndRoles(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	cfg := config.Load()
+	if v := os.Getenv("TEST_DATABASE_URL"); v != "" {
+		cfg.DatabaseURL = v
+	}
+	if err := db.Init(cfg.DatabaseURL); err != nil {
+		t.Skipf("skipping integration test; DB unavailable: %v (set TEST_DATABASE_URL)", err)
+	}
+
+	stamp := time.Now().Format("150405.000")
+	ownerEmail := "members-itest-" + stamp + "@example.com"
+	devEmail := "members-dev-" + stamp + "@example.com"
+	custID := ensureTestCustomer(t, ownerEmail, "itestpass", "Members ITest Co", "cus_mem_"+stamp)
+
+	r := gin.New()
+	r.POST("/customers/:id", UpdateCustomer)
+	r.POST("/auth/login", Login)
+	r.POST("/auth/invitations/accept", AcceptInvitation)
+	console := r.Group("/console", middleware.SessionAuth())
+	console.GET("/me", GetCurrentMember)
+	console.GET("/billing/summary", middleware.RequirePermission(members.PermBilling), func(c *gin.Context) { c.JSON(http.StatusOK, gin.H{}) })
+	cmem := console.Group("/members", middleware.RequirePermission(members.PermMembers))
+	cmem.POST("/invitations", InviteMember)
+	cmem.POST("/:id/role", UpdateMemberRole)
+	cmem.POST("/:id/remove", RemoveMember)
+
+	do := func(method, path, session string, body any) (int, map[string]any) {
+		b, _ := json.Marshal(body)
+		req := httptest.NewRequest(method, path, bytes.NewReader(b))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Session-Token", session)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		var out map[string]any
+		_ = json.Unmarshal(w.Body.Bytes(), &out)
+		return w.Code, out
+	}
+	login := func(email string) string {
+		code, out := do(http.MethodPost, "/auth/login", "", map[string]any{"email": email, "password": "itestpass"})
+		tok, _ := out["session_token"].(string)
+		if code != http.StatusOK || tok == "" {
+			t.Fatalf("login %s: %d %v", email, code, out)
+		}
+		return tok
+	}
+
+	owner := login(ownerEmail)
+	code, out := do(http.MethodGet, "/console/me", owner, nil)
+	me, _ := out["member"].(map[string]any)
+	if code != http.StatusOK || me["role"] != members.RoleOwner {
+		t.Fatalf("me: %d %v", code, out)
+	}
+	ownerID, _ := me["id"].(string)
+
+	// invite a developer, who accepts and signs in with their own login
+	code, out = do(http.MethodPost, "/console/members/invitations", owner, map[string]any{"email": devEmail, "role": members.RoleDeveloper})
+	invite, _ := out["invitation_token"].(string)
+	if code != http.StatusCreated || invite == "" {
+		t.Fatalf("invite: %d %v", code, out)
+	}
+	code, out = do(http.MethodPost, "/auth/invitations/accept", "", map[string]any{"token": invite, "name": "Dev", "password": "itestpass"})
+	if code != http.StatusCreated {
+		t.Fatalf("accept: %d %v", code, out)
+	}
+	if code, _ = do(http.MethodPost, "/auth/invitations/accept", "", map[string]any{"token": invite, "password": "x"}); code != http.StatusBadRequest {
+		t.Fatalf("an accepted invitation must not work again: %d", code)
+	}
+	dev := login(devEmail)
+
+	// the developer's role doesn't reach billing or members
+	if code, out = do(http.MethodGet, "/console/billing/summary", dev, nil); code != http.StatusForbidden || out["required_permission"] != members.PermBilling {
+		t.Fatalf("developer billing: %d %v", code, out)
+	}
+	if code, _ = do(http.MethodPost, "/console/members/"+ownerID+"/remove", dev, nil); code != http.StatusForbidden {
+		t.Fatalf("developer removing a member: %d", code)
+	}
+
+	// the only owner can't step down
+	if code, out = do(http.MethodPost, "/console/members/"+ownerID+"/role", owner, map[string]any{"role": members.RoleAdmin}); code != http.StatusConflict || out["code"] != "last_owner" {
+		t.Fatalf("demote last owner: %d %v", code, out)
+	}
+
+	// two owners demoting each other at once leave one owner
+	devID := memberIDByEmail(t, devEmail)
+	if code, out = do(http.MethodPost, "/console/members/"+devID+"/role", owner, map[string]any{"role": members.RoleOwner}); code != http.StatusOK {
+		t.Fatalf("promote: %d %v", code, out)
+	}
+	var wg sync.WaitGroup
+	codes := make([]int, 2)
+	for i, pair := range [][2]string{{owner, devID}, {dev, ownerID}} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes[i], _ = do(http.MethodPost, "/console/members/"+pair[1]+"/role", pair[0], map[string]any{"role": members.RoleAdmin})
+		}()
+	}
+	wg.Wait()
+	var owners int
+	db.DB.QueryRow(`SELECT COUNT(*) FROM members WHERE email IN ($1, $2) AND role = 'owner' AND is_active`, ownerEmail, devEmail).Scan(&owners)
+	if owners != 1 {
+		t.Fatalf("concurrent demotions left %d owners: %v", owners, codes)
+	}
+
+	// an operator changing the account email moves the original owner's login with it
+	if code, _ = do(http.MethodPost, "/customers/"+custID, "", map[string]any{"email": devEmail}); code != http.StatusConflict {
+		t.Fatalf("email of another member: %d", code)
+	}
+	newEmail := "members-new-" + stamp + "@example.com"
+	if code, out = do(http.MethodPost, "/customers/"+custID, "", map[string]any{"email": newEmail}); code != http.StatusOK {
+		t.Fatalf("change email: %d %v", code, out)
+	}
+	login(newEmail)
+}
+
+func memberIDByEmail(t *testing.T, email string) string {
+	t.Helper()
+	var id string
+	if err := db.DB.QueryRow(`SELECT id FROM members WHERE email = $1`, email).Scan(&id); err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
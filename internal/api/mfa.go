@@ -1,8 +1,8 @@
 package api
 
 import (
-	"crypto/rand"
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"image/png"
 	"net/http"
@@ -16,24 +16,33 @@ import (
 	"github.com/lib/pq"
 	"github.com/pquerna/otp/totp"
 	"otp/internal/audit"
+	"otp/internal/backupcodes"
 	"otp/internal/config"
 	"otp/internal/crypto"
 	"otp/internal/db"
+	"otp/internal/keys"
 	"otp/internal/usage"
 )
 
 type RegisterRequest struct {
-	ID          string `json:"id" binding:"required"`
-	AccountName string `json:"account_name"`
-	Issuer      string `json:"issuer" binding:"required"`
+	ID          string         `json:"id" binding:"required"`
+	AccountName string         `json:"account_name"`
+	Issuer      string         `json:"issuer" binding:"required"`
+	Metadata    map[string]any `json:"metadata"`
+	Tags        []string       `json:"tags"`
+	// Base32 TOTP secret to use instead of a random one; test environment only
+	Secret string `json:"secret"`
 }
 
 // CreateConsoleMFAUser creates an MFA user under the authenticated customer (session auth),
 // generating a new secret and backup codes. Intended for console/testing use.
 type createConsoleMFARequest struct {
-    ID          string `json:"id" binding:"required"`
-    AccountName string `json:"account_name"`
-    Issuer      string `json:"issuer"`
+    ID          string         `json:"id" binding:"required"`
+    AccountName string         `json:"account_name"`
+    Issuer      string         `json:"issuer"`
+    Metadata    map[string]any `json:"metadata"`
+    Tags        []string       `json:"tags"`
+    Secret      string         `json:"secret"` // test environment only
 }
 
 func CreateConsoleMFAUser(c *gin.Context) {
@@ -43,10 +52,17 @@ func CreateConsoleMFAUser(c *gin.Context) {
         return
     }
     customerID := c.GetString("customer_id")
+    env := mfaEnvironment(c)
+    metaJSON, err := encodeUserMetadata(req.Metadata)
+    if err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
+    tags, err := normalizeTags(req.Tags)
+    if err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
+    fixedSecret, err := sandboxSecret(env, req.Secret)
+    if err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
 
     // Check if user already exists
     var exists bool
-    if err := db.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM mfa_users WHERE customer_id = $1 AND user_id = $2)", customerID, req.ID).Scan(&exists); err != nil {
+    if err := db.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM mfa_users WHERE customer_id = $1 AND environment = $2 AND user_id = $3)", customerID, env, req.ID).Scan(&exists); err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
         return
     }
@@ -54,51 +70,61 @@ func CreateConsoleMFAUser(c *gin.Context) {
         c.JSON(http.StatusConflict, gin.H{"error": "User already registered for MFA"})
         return
     }
+    tx := requireMFAUserRoom(c, env)
+    if tx == nil {
+        return
+    }
+    defer tx.Rollback()
 
     issuer := strings.TrimSpace(req.Issuer)
     if issuer == "" { issuer = config.Get().Issuer }
     accountName := strings.TrimSpace(req.AccountName)
     if accountName == "" { accountName = fmt.Sprintf("User_%s", req.ID) }
 
-    key, err := totp.Generate(totp.GenerateOpts{Issuer: issuer, AccountName: accountName, SecretSize: 32})
+    key, err := totp.Generate(totp.GenerateOpts{Issuer: issuer, AccountName: accountName, SecretSize: 32, Secret: fixedSecret})
     if err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate TOTP secret"}); return }
-    encSecret, err := crypto.Encrypt(key.Secret())
+    encSecret, err := crypto.EncryptFor(crypto.Binding{CustomerID: customerID, UserID: req.ID, Field: crypto.FieldMFASecret, Environment: env}, key.Secret())
     if err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encrypt secret"}); return }
 
     // backup codes
-    backupCodes, err := generateBackupCodes()
+    backupCodes, codeHashes, err := newBackupCodes(customerID)
     if err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate backup codes"}); return }
-    encCodes := make([]string, len(backupCodes))
-    for i, bc := range backupCodes { encCodes[i], err = crypto.Encrypt(bc); if err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encrypt backup codes"}); return } }
 
     // Insert without api_key_id (console created)
-    _, err = db.DB.Exec(`INSERT INTO mfa_users (customer_id, user_id, secret_key_encrypted, backup_codes_encrypted, account_name, issuer)
-        VALUES ($1, $2, $3, $4, $5, $6)`, customerID, req.ID, encSecret, pq.Array(encCodes), accountName, issuer)
+    _, err = tx.Exec(`INSERT INTO mfa_users (customer_id, user_id, secret_key_encrypted, backup_code_hashes, backup_codes_generated_at, account_name, issuer, metadata, tags, environment)
+        VALUES ($1, $2, $3, $4, NOW(), $5, $6, $7::jsonb, $8, $9)`, customerID, req.ID, encSecret, pq.Array(codeHashes), accountName, issuer, metaJSON, pq.Array(tags), env)
     if err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store MFA data"}); return }
+    if err := tx.Commit(); err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store MFA data"}); return }
 
-    audit.Log(c, "mfa.register.console", map[string]any{"user_id": req.ID, "issuer": issuer, "account_name": accountName})
+    audit.Log(c, "mfa.register.console", mfaAuditMeta(req.ID, []byte(metaJSON), map[string]any{"issuer": issuer, "account_name": accountName, "tags": tags}))
+    c.Set("mfa_user_id", req.ID)
     usage.Record(c, "mfa.register.console", true)
-    c.JSON(http.StatusCreated, gin.H{"qr_code_url": fmt.Sprintf("/api/v1/console/mfa/%s/qr", req.ID), "backup_codes": backupCodes})
+    resp := gin.H{"qr_code_url": fmt.Sprintf("/api/v1/console/mfa/%s/qr%s", req.ID, consoleEnvQuery(env)), "backup_codes": backupCodes}
+    if sheetURL := storeBackupCodeSheet(c, customerID, env, req.ID, backupCodes); sheetURL != "" { resp["backup_codes_sheet_url"] = sheetURL }
+    c.JSON(http.StatusCreated, resp)
 }
 
 type mfaUserItem struct {
-    UserID      string    `json:"user_id"`
-    AccountName string    `json:"account_name"`
-    Issuer      string    `json:"issuer"`
-    IsActive    bool      `json:"is_active"`
-    CreatedAt   time.Time `json:"created_at"`
-    UpdatedAt   time.Time `json:"updated_at"`
+    UserID      string          `json:"user_id"`
+    AccountName string          `json:"account_name"`
+    Issuer      string          `json:"issuer"`
+    IsActive    bool            `json:"is_active"`
+    Metadata    json.RawMessage `json:"metadata"`
+    Tags        []string        `json:"tags"`
+    CreatedAt   time.Time       `json:"created_at"`
+    UpdatedAt   time.Time       `json:"updated_at"`
 }
 
 // ListMFAUsers lists MFA users for the authenticated customer with optional search and status filter.
+// Additional filters: ?tag= (repeatable, all must match), ?meta_key= and optionally ?meta_value=.
 func ListMFAUsers(c *gin.Context) {
     customerID := c.GetString("customer_id")
     q := strings.TrimSpace(c.Query("q"))
     status := strings.TrimSpace(strings.ToLower(c.Query("status"))) // active|disabled|all
 
-    where := "WHERE customer_id = $1"
-    args := []any{customerID}
-    argIdx := 2
+    where := "WHERE customer_id = $1 AND environment = $2"
+    args := []any{customerID, mfaEnvironment(c)}
+    argIdx := 3
     if q != "" {
         where += fmt.Sprintf(" AND (user_id ILIKE $%d OR COALESCE(account_name,'') ILIKE $%d OR COALESCE(issuer,'') ILIKE $%d)", argIdx, argIdx, argIdx)
         args = append(args, "%"+q+"%")
@@ -110,8 +136,24 @@ func ListMFAUsers(c *gin.Context) {
     case "disabled":
         where += " AND is_active = false"
     }
+    if tags := c.QueryArray("tag"); len(tags) > 0 {
+        where += fmt.Sprintf(" AND tags @> $%d", argIdx)
+        args = append(args, pq.Array(tags))
+        argIdx++
+    }
+    if metaKey := strings.TrimSpace(c.Query("meta_key")); metaKey != "" {
+        if metaValue, ok := c.GetQuery("meta_value"); ok {
+            where += fmt.Sprintf(" AND metadata->>$%d = $%d", argIdx, argIdx+1)
+            args = append(args, metaKey, metaValue)
+            argIdx += 2
+        } else {
+            where += fmt.Sprintf(" AND metadata ? $%d", argIdx)
+            args = append(args, metaKey)
+            argIdx++
+        }
+    }
 
-    query := "SELECT user_id, COALESCE(account_name,''), COALESCE(issuer,''), is_active, created_at, updated_at FROM mfa_users " + where + " ORDER BY created_at DESC LIMIT 200"
+    query := "SELECT user_id, COALESCE(account_name,''), COALESCE(issuer,''), is_active, metadata, tags, created_at, updated_at FROM mfa_users " + where + " ORDER BY created_at DESC LIMIT 200"
     rows, err := db.DB.Query(query, args...)
     if err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
@@ -122,7 +164,7 @@ func ListMFAUsers(c *gin.Context) {
     items := []mfaUserItem{}
     for rows.Next() {
         var it mfaUserItem
-        if err := rows.Scan(&it.UserID, &it.AccountName, &it.Issuer, &it.IsActive, &it.CreatedAt, &it.UpdatedAt); err != nil {
+        if err := rows.Scan(&it.UserID, &it.AccountName, &it.Issuer, &it.IsActive, &it.Metadata, pq.Array(&it.Tags), &it.CreatedAt, &it.UpdatedAt); err != nil {
             c.JSON(http.StatusInternalServerError, gin.H{"error": "Scan error"})
             return
         }
@@ -134,18 +176,19 @@ func ListMFAUsers(c *gin.Context) {
 // DisableMFA disables MFA for a given user (soft-disable).
 func DisableMFA(c *gin.Context) {
 	userID := c.Param("id")
+	c.Set("mfa_user_id", userID)
 	customerID := c.GetString("customer_id")
-	res, err := db.DB.Exec(`UPDATE mfa_users SET is_active = false, updated_at = NOW() WHERE customer_id = $1 AND user_id = $2 AND is_active = true`, customerID, userID)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+	var userMeta []byte
+	err := db.DB.QueryRow(`UPDATE mfa_users SET is_active = false, updated_at = NOW() WHERE customer_id = $1 AND environment = $2 AND user_id = $3 AND is_active = true RETURNING metadata`, customerID, mfaEnvironment(c), userID).Scan(&userMeta)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found or already disabled"})
 		return
 	}
-	n, _ := res.RowsAffected()
-	if n == 0 {
-		c.JSON(http.StatusNotFound, gin.H{"error": "User not found or already disabled"})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
 		return
 	}
-	audit.Log(c, "mfa.disable", map[string]any{"user_id": userID})
+	audit.Log(c, "mfa.disable", mfaAuditMeta(userID, userMeta, nil))
 	usage.Record(c, "mfa.disable", true)
 	c.JSON(http.StatusOK, gin.H{"status": "disabled"})
 }
@@ -153,18 +196,27 @@ func DisableMFA(c *gin.Context) {
 type resetMFARequest struct {
 	AccountName string `json:"account_name"`
 	Issuer      string `json:"issuer"`
+	Secret      string `json:"secret"` // test environment only
 }
 
 // ResetMFA regenerates the TOTP secret and backup codes, re-enables the user.
 func ResetMFA(c *gin.Context) {
 	userID := c.Param("id")
+	c.Set("mfa_user_id", userID)
 	customerID := c.GetString("customer_id")
+	env := mfaEnvironment(c)
 	var req resetMFARequest
 	_ = c.ShouldBindJSON(&req)
+	fixedSecret, err := sandboxSecret(env, req.Secret)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
 	// get current account_name/issuer to preserve if not provided
 	var accountName, issuer string
-	err := db.DB.QueryRow(`SELECT COALESCE(account_name, ''), COALESCE(issuer, '') FROM mfa_users WHERE customer_id = $1 AND user_id = $2`, customerID, userID).Scan(&accountName, &issuer)
+	var userMeta []byte
+	err = db.DB.QueryRow(`SELECT COALESCE(account_name, ''), COALESCE(issuer, ''), metadata FROM mfa_users WHERE customer_id = $1 AND environment = $2 AND user_id = $3`, customerID, env, userID).Scan(&accountName, &issuer, &userMeta)
 	if err == sql.ErrNoRows {
 		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
 		return
@@ -177,53 +229,58 @@ func ResetMFA(c *gin.Context) {
 	if strings.TrimSpace(req.Issuer) != "" { issuer = req.Issuer }
 	if strings.TrimSpace(issuer) == "" { issuer = config.Get().Issuer }
 
-	key, err := totp.Generate(totp.GenerateOpts{Issuer: issuer, AccountName: accountName, SecretSize: 32})
+	key, err := totp.Generate(totp.GenerateOpts{Issuer: issuer, AccountName: accountName, SecretSize: 32, Secret: fixedSecret})
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate TOTP secret"})
 		return
 	}
-	encSecret, err := crypto.Encrypt(key.Secret())
+	encSecret, err := crypto.EncryptFor(crypto.Binding{CustomerID: customerID, UserID: userID, Field: crypto.FieldMFASecret, Environment: env}, key.Secret())
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encrypt secret"})
 		return
 	}
 	// backup codes
-	backupCodes, err := generateBackupCodes()
+	backupCodes, codeHashes, err := newBackupCodes(customerID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate backup codes"})
 		return
 	}
-	encCodes := make([]string, len(backupCodes))
-	for i, bc := range backupCodes { encCodes[i], err = crypto.Encrypt(bc); if err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encrypt backup codes"}); return } }
 
-	_, err = db.DB.Exec(`UPDATE mfa_users SET is_active = true, secret_key_encrypted = $1, backup_codes_encrypted = $2, used_backup_codes_encrypted = '{}', account_name = $3, issuer = $4, updated_at = NOW() WHERE customer_id = $5 AND user_id = $6`, encSecret, pq.Array(encCodes), accountName, issuer, customerID, userID)
+	_, err = db.DB.Exec(`UPDATE mfa_users SET is_active = true, secret_key_encrypted = $1, backup_code_hashes = $2, backup_codes_used = 0, backup_codes_generated_at = NOW(), backup_codes_encrypted = '{}', used_backup_codes_encrypted = '{}', account_name = $3, issuer = $4, failed_attempts = 0, locked_until = NULL, updated_at = NOW() WHERE customer_id = $5 AND environment = $6 AND user_id = $7`, encSecret, pq.Array(codeHashes), accountName, issuer, customerID, env, userID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update MFA"})
 		return
 	}
-	audit.Log(c, "mfa.reset", map[string]any{"user_id": userID, "issuer": issuer, "account_name": accountName})
+	audit.Log(c, "mfa.reset", mfaAuditMeta(userID, userMeta, map[string]any{"issuer": issuer, "account_name": accountName}))
 	usage.Record(c, "mfa.reset", true)
 	qrPath := fmt.Sprintf("/api/v1/mfa/%s/qr", userID)
 	if strings.TrimSpace(c.GetString("api_key_id")) == "" {
-		qrPath = fmt.Sprintf("/api/v1/console/mfa/%s/qr", userID)
+		qrPath = fmt.Sprintf("/api/v1/console/mfa/%s/qr%s", userID, consoleEnvQuery(env))
+	}
+	resp := gin.H{"qr_code_url": qrPath, "backup_codes": backupCodes}
+	if sheetURL := storeBackupCodeSheet(c, customerID, env, userID, backupCodes); sheetURL != "" {
+		resp["backup_codes_sheet_url"] = sheetURL
 	}
-	c.JSON(http.StatusOK, gin.H{"qr_code_url": qrPath, "backup_codes": backupCodes})
+	c.JSON(http.StatusOK, resp)
 }
 
 // RegenerateBackupCodes replaces backup codes and clears used list.
 func RegenerateBackupCodes(c *gin.Context) {
 	userID := c.Param("id")
+	c.Set("mfa_user_id", userID)
 	customerID := c.GetString("customer_id")
-	backupCodes, err := generateBackupCodes()
+	env := mfaEnvironment(c)
+	backupCodes, codeHashes, err := newBackupCodes(customerID)
 	if err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate backup codes"}); return }
-	encCodes := make([]string, len(backupCodes))
-	for i, bc := range backupCodes { encCodes[i], err = crypto.Encrypt(bc); if err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encrypt backup codes"}); return } }
-	res, err := db.DB.Exec(`UPDATE mfa_users SET backup_codes_encrypted = $1, used_backup_codes_encrypted = '{}', updated_at = NOW() WHERE customer_id = $2 AND user_id = $3 AND is_active = true`, pq.Array(encCodes), customerID, userID)
+	var userMeta []byte
+	err = db.DB.QueryRow(`UPDATE mfa_users SET backup_code_hashes = $1, backup_codes_used = 0, backup_codes_generated_at = NOW(), backup_codes_encrypted = '{}', used_backup_codes_encrypted = '{}', updated_at = NOW() WHERE customer_id = $2 AND environment = $3 AND user_id = $4 AND is_active = true RETURNING metadata`, pq.Array(codeHashes), customerID, env, userID).Scan(&userMeta)
+	if err == sql.ErrNoRows { c.JSON(http.StatusNotFound, gin.H{"error": "User not found or inactive"}); return }
 	if err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"}); return }
-	n, _ := res.RowsAffected(); if n == 0 { c.JSON(http.StatusNotFound, gin.H{"error": "User not found or inactive"}); return }
-	audit.Log(c, "mfa.backup_codes.regenerate", map[string]any{"user_id": userID})
+	audit.Log(c, "mfa.backup_codes.regenerate", mfaAuditMeta(userID, userMeta, nil))
 	usage.Record(c, "mfa.backup_codes.regenerate", true)
-	c.JSON(http.StatusOK, gin.H{"backup_codes": backupCodes})
+	resp := gin.H{"backup_codes": backupCodes}
+	if sheetURL := storeBackupCodeSheet(c, customerID, env, userID, backupCodes); sheetURL != "" { resp["backup_codes_sheet_url"] = sheetURL }
+	c.JSON(http.StatusOK, resp)
 }
 
 type consumeBackupCodeRequest struct { Code string `json:"code" binding:"required"` }
@@ -231,43 +288,44 @@ type consumeBackupCodeRequest struct { Code string `json:"code" binding:"require
 // ConsumeBackupCode validates and consumes a single backup code.
 func ConsumeBackupCode(c *gin.Context) {
 	userID := c.Param("id")
+	c.Set("mfa_user_id", userID)
 	customerID := c.GetString("customer_id")
+	env := mfaEnvironment(c)
 	var req consumeBackupCodeRequest
 	if err := c.ShouldBindJSON(&req); err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
 
-	var encCodes []sql.NullString
-	var encUsed []sql.NullString
-	err := db.DB.QueryRow(`SELECT backup_codes_encrypted, COALESCE(used_backup_codes_encrypted, '{}') FROM mfa_users WHERE customer_id = $1 AND user_id = $2 AND is_active = true`, customerID, userID).Scan(pq.Array(&encCodes), pq.Array(&encUsed))
+	// rows still holding legacy encrypted codes are hashed first
+	if err := backupcodes.UpgradeUser(customerID, env, userID); err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to upgrade backup codes"}); return }
+
+	var hashes []string
+	var userMeta []byte
+	err := db.DB.QueryRow(`SELECT backup_code_hashes, metadata FROM mfa_users WHERE customer_id = $1 AND environment = $2 AND user_id = $3 AND is_active = true`, customerID, env, userID).Scan(pq.Array(&hashes), &userMeta)
 	if err == sql.ErrNoRows { c.JSON(http.StatusNotFound, gin.H{"error": "User not found or inactive"}); return }
 	if err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"}); return }
 
-	// decrypt and find match
-	foundIdx := -1
-	codesDecrypted := make([]string, 0, len(encCodes))
-	for i, ns := range encCodes {
-		if !ns.Valid { continue }
-		dec, derr := crypto.Decrypt(ns.String)
-		if derr != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decrypt backup codes"}); return }
-		codesDecrypted = append(codesDecrypted, dec)
-		if dec == req.Code { foundIdx = i }
-	}
+	pepper, err := crypto.TenantSecret(customerID, backupcodes.PepperPurpose)
+	if err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load customer key"}); return }
+	foundIdx := backupcodes.Match(req.Code, hashes, pepper)
 	if foundIdx == -1 { usage.Record(c, "mfa.backup_codes.consume", false); c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or already used backup code"}); return }
 
-	// rebuild active encrypted codes without the consumed one
-	newEncCodes := make([]string, 0, len(encCodes)-1)
-	for i, ns := range encCodes { if i != foundIdx && ns.Valid { newEncCodes = append(newEncCodes, ns.String) } }
-	usedEnc, err := crypto.Encrypt(req.Code)
-	if err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record used code"}); return }
-	// build used list
-	newUsed := make([]string, 0, len(encUsed)+1)
-	for _, ns := range encUsed { if ns.Valid { newUsed = append(newUsed, ns.String) } }
-	newUsed = append(newUsed, usedEnc)
-
-	_, err = db.DB.Exec(`UPDATE mfa_users SET backup_codes_encrypted = $1, used_backup_codes_encrypted = $2, updated_at = NOW() WHERE customer_id = $3 AND user_id = $4`, pq.Array(newEncCodes), pq.Array(newUsed), customerID, userID)
+	// Remove the matched hash only if it is still present, so concurrent requests can't both spend it.
+	var remaining int
+	err = db.DB.QueryRow(`UPDATE mfa_users SET backup_code_hashes = array_remove(backup_code_hashes, $1), backup_codes_used = backup_codes_used + 1, updated_at = NOW()
+		WHERE customer_id = $2 AND environment = $3 AND user_id = $4 AND is_active = true AND $1 = ANY(backup_code_hashes)
+		RETURNING cardinality(backup_code_hashes)`, hashes[foundIdx], customerID, env, userID).Scan(&remaining)
+	if err == sql.ErrNoRows { usage.Record(c, "mfa.backup_codes.consume", false); c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or already used backup code"}); return }
 	if err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"}); return }
-	audit.Log(c, "mfa.backup_codes.consume", map[string]any{"user_id": userID})
+	// a printed sheet must never be handed out once any of its codes has been spent
+	discardBackupCodeSheet(customerID, env, userID)
+	audit.Log(c, "mfa.backup_codes.consume", mfaAuditMeta(userID, userMeta, map[string]any{"remaining": remaining}))
 	usage.Record(c, "mfa.backup_codes.consume", true)
-	c.JSON(http.StatusOK, gin.H{"status": "consumed"})
+
+	resp := gin.H{"status": "consumed", "remaining": remaining}
+	if policy, perr := backupcodes.PolicyFor(customerID); perr == nil && policy.WarnBelow > 0 && remaining <= policy.WarnBelow {
+		audit.Log(c, "mfa.backup_codes.low", mfaAuditMeta(userID, userMeta, map[string]any{"remaining": remaining, "warn_below": policy.WarnBelow}))
+		resp["low_remaining"] = true
+	}
+	c.JSON(http.StatusOK, resp)
 }
 
 type ValidateRequest struct {
@@ -277,19 +335,30 @@ type ValidateRequest struct {
 type RegisterResponse struct {
 	QRCodeURL   string   `json:"qr_code_url"`
 	BackupCodes []string `json:"backup_codes"`
+	// One-time link to a printable PDF/text rendering of BackupCodes; omitted if sheets are disabled.
+	BackupCodesSheetURL string `json:"backup_codes_sheet_url,omitempty"`
 }
 
-// generateBackupCodes returns 8 random numeric backup codes of length 8
-func generateBackupCodes() ([]string, error) {
-	codes := make([]string, 8)
-	for i := range codes {
-		b := make([]byte, 5)
-		if _, err := rand.Read(b); err != nil {
-			return nil, err
-		}
-		codes[i] = fmt.Sprintf("%010d", uint64(b[0])<<32|uint64(b[1])<<24|uint64(b[2])<<16|uint64(b[3])<<8|uint64(b[4]))[:8]
-	}
-	return codes, nil
+// newBackupCodes generates backup codes under the customer's policy, returning the plaintext
+// codes (shown to the caller once) and the hashes to store.
+func newBackupCodes(customerID string) ([]string, []string, error) {
+	policy, err := backupcodes.PolicyFor(customerID)
+	if err != nil {
+		return nil, nil, err
+	}
+	codes, err := backupcodes.Generate(policy)
+	if err != nil {
+		return nil, nil, err
+	}
+	pepper, err := crypto.TenantSecret(customerID, backupcodes.PepperPurpose)
+	if err != nil {
+		return nil, nil, err
+	}
+	hashes, err := backupcodes.HashAll(codes, pepper)
+	if err != nil {
+		return nil, nil, err
+	}
+	return codes, hashes, nil
 }
 
 func RegisterMFA(c *gin.Context) {
@@ -301,12 +370,28 @@ func RegisterMFA(c *gin.Context) {
 
 	customerID := c.GetString("customer_id")
 	apiKeyID := c.GetString("api_key_id")
+	env := mfaEnvironment(c)
+	metaJSON, err := encodeUserMetadata(req.Metadata)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	tags, err := normalizeTags(req.Tags)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	fixedSecret, err := sandboxSecret(env, req.Secret)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
 	// Check if user already exists
 	var exists bool
-	err := db.DB.QueryRow(
-		"SELECT EXISTS(SELECT 1 FROM mfa_users WHERE customer_id = $1 AND user_id = $2)",
-		customerID, req.ID,
+	err = db.DB.QueryRow(
+		"SELECT EXISTS(SELECT 1 FROM mfa_users WHERE customer_id = $1 AND environment = $2 AND user_id = $3)",
+		customerID, env, req.ID,
 	).Scan(&exists)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
@@ -316,6 +401,11 @@ func RegisterMFA(c *gin.Context) {
 		c.JSON(http.StatusConflict, gin.H{"error": "User already registered for MFA"})
 		return
 	}
+	tx := requireMFAUserRoom(c, env)
+	if tx == nil {
+		return
+	}
+	defer tx.Rollback()
 
 	issuer := strings.TrimSpace(req.Issuer)
 	if issuer == "" {
@@ -331,60 +421,62 @@ func RegisterMFA(c *gin.Context) {
 		Issuer:      issuer,
 		AccountName: accountName,
 		SecretSize:  32,
+		Secret:      fixedSecret,
 	})
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate TOTP secret"})
 		return
 	}
 
-	encryptedSecret, err := crypto.Encrypt(key.Secret())
+	encryptedSecret, err := crypto.EncryptFor(crypto.Binding{CustomerID: customerID, UserID: req.ID, Field: crypto.FieldMFASecret, Environment: env}, key.Secret())
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encrypt secret"})
 		return
 	}
 
-	backupCodes, err := generateBackupCodes()
+	backupCodes, backupCodeHashes, err := newBackupCodes(customerID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate backup codes"})
 		return
 	}
-	encryptedBackupCodes := make([]string, len(backupCodes))
-	for i, code := range backupCodes {
-		encryptedBackupCodes[i], err = crypto.Encrypt(code)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encrypt backup codes"})
-			return
-		}
-	}
 
-	_, err = db.DB.Exec(
-		`INSERT INTO mfa_users (customer_id, api_key_id, user_id, secret_key_encrypted, backup_codes_encrypted, account_name, issuer) 
-		 VALUES ($1, $2, $3, $4, $5, $6, $7)`,
-		customerID, apiKeyID, req.ID, encryptedSecret, pq.Array(encryptedBackupCodes), accountName, issuer,
+	_, err = tx.Exec(
+		`INSERT INTO mfa_users (customer_id, api_key_id, user_id, secret_key_encrypted, backup_code_hashes, backup_codes_generated_at, account_name, issuer, metadata, tags, environment) 
+		 VALUES ($1, $2, $3, $4, $5, NOW(), $6, $7, $8::jsonb, $9, $10)`,
+		customerID, apiKeyID, req.ID, encryptedSecret, pq.Array(backupCodeHashes), accountName, issuer, metaJSON, pq.Array(tags), env,
 	)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store MFA data"})
 		return
 	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store MFA data"})
+		return
+	}
 
 	resp := RegisterResponse{
 		QRCodeURL:   fmt.Sprintf("/api/v1/mfa/%s/qr", req.ID),
 		BackupCodes: backupCodes,
 	}
-	audit.Log(c, "mfa.register", map[string]any{"user_id": req.ID, "api_key_id": apiKeyID, "issuer": issuer, "account_name": accountName})
+	resp.BackupCodesSheetURL = storeBackupCodeSheet(c, customerID, env, req.ID, backupCodes)
+	audit.Log(c, "mfa.register", mfaAuditMeta(req.ID, []byte(metaJSON), map[string]any{"api_key_id": apiKeyID, "issuer": issuer, "account_name": accountName, "tags": tags}))
+	c.Set("mfa_user_id", req.ID)
 	usage.Record(c, "mfa.register", true)
 	c.JSON(http.StatusCreated, resp)
 }
 
 func GetQRCode(c *gin.Context) {
 	userID := c.Param("id")
+	c.Set("mfa_user_id", userID)
 	customerID := c.GetString("customer_id")
+	env := mfaEnvironment(c)
 
 	var encryptedSecret, accountName, issuer string
+	var userMeta []byte
 	err := db.DB.QueryRow(
-		"SELECT secret_key_encrypted, COALESCE(account_name, ''), COALESCE(issuer, '') FROM mfa_users WHERE customer_id = $1 AND user_id = $2 AND is_active = true",
-		customerID, userID,
-	).Scan(&encryptedSecret, &accountName, &issuer)
+		"SELECT secret_key_encrypted, COALESCE(account_name, ''), COALESCE(issuer, ''), metadata FROM mfa_users WHERE customer_id = $1 AND environment = $2 AND user_id = $3 AND is_active = true",
+		customerID, env, userID,
+	).Scan(&encryptedSecret, &accountName, &issuer, &userMeta)
 	if err == sql.ErrNoRows {
 		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
 		return
@@ -394,7 +486,7 @@ func GetQRCode(c *gin.Context) {
 		return
 	}
 
-	secret, err := crypto.Decrypt(encryptedSecret)
+	secret, err := crypto.DecryptFor(crypto.Binding{CustomerID: customerID, UserID: userID, Field: crypto.FieldMFASecret, Environment: env}, encryptedSecret)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decrypt secret"})
 		return
@@ -428,24 +520,28 @@ func GetQRCode(c *gin.Context) {
 	}
 	c.Header("Content-Type", "image/png")
 	c.Status(http.StatusOK)
-	audit.Log(c, "mfa.qr_code.generated", map[string]any{"user_id": userID})
+	audit.Log(c, "mfa.qr_code.generated", mfaAuditMeta(userID, userMeta, nil))
 	_ = png.Encode(c.Writer, scaled)
 }
 
 func ValidateOTP(c *gin.Context) {
 	userID := c.Param("id")
+	c.Set("mfa_user_id", userID)
 	var req ValidateRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 	customerID := c.GetString("customer_id")
+	env := mfaEnvironment(c)
 
 	var encryptedSecret string
+	var userMeta []byte
+	var lockedUntil sql.NullTime
 	err := db.DB.QueryRow(
-		"SELECT secret_key_encrypted FROM mfa_users WHERE customer_id = $1 AND user_id = $2 AND is_active = true",
-		customerID, userID,
-	).Scan(&encryptedSecret)
+		"SELECT secret_key_encrypted, metadata, locked_until FROM mfa_users WHERE customer_id = $1 AND environment = $2 AND user_id = $3 AND is_active = true",
+		customerID, env, userID,
+	).Scan(&encryptedSecret, &userMeta, &lockedUntil)
 	if err == sql.ErrNoRows {
 		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
 		return
@@ -454,22 +550,64 @@ func ValidateOTP(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
 		return
 	}
+	if lockedUntil.Valid && time.Now().Before(lockedUntil.Time) {
+		audit.Log(c, "mfa.validate.locked", mfaAuditMeta(userID, userMeta, nil))
+		usage.Record(c, "mfa.validate", false)
+		c.JSON(http.StatusLocked, gin.H{"valid": false, "message": "User is temporarily locked", "locked_until": lockedUntil.Time})
+		return
+	}
+	if !consumeValidationQuota(c, env) {
+		return
+	}
 
-	secret, err := crypto.Decrypt(encryptedSecret)
+	secret, err := crypto.DecryptFor(crypto.Binding{CustomerID: customerID, UserID: userID, Field: crypto.FieldMFASecret, Environment: env}, encryptedSecret)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decrypt secret"})
 		return
 	}
 
-	valid := totp.Validate(req.OTP, secret)
+	valid, magic := false, false
+	if env == keys.EnvTest {
+		valid, magic = keys.SandboxOTP(req.OTP)
+	}
+	if !magic {
+		valid = totp.Validate(req.OTP, secret)
+	}
 	if valid {
-		_, _ = db.DB.Exec("UPDATE mfa_users SET updated_at = NOW() WHERE customer_id = $1 AND user_id = $2", customerID, userID)
-		audit.Log(c, "mfa.validate.success", map[string]any{"user_id": userID})
+		_, _ = db.DB.Exec("UPDATE mfa_users SET updated_at = NOW(), last_success_at = NOW(), failed_attempts = 0, locked_until = NULL WHERE customer_id = $1 AND environment = $2 AND user_id = $3", customerID, env, userID)
+		audit.Log(c, "mfa.validate.success", mfaAuditMeta(userID, userMeta, nil))
 		usage.Record(c, "mfa.validate", true)
 		c.JSON(http.StatusOK, gin.H{"valid": true, "message": "OTP is valid"})
 		return
 	}
-	audit.Log(c, "mfa.validate.failure", map[string]any{"user_id": userID})
+	recordValidationFailure(c, customerID, env, userID, userMeta)
+	audit.Log(c, "mfa.validate.failure", mfaAuditMeta(userID, userMeta, nil))
 	usage.Record(c, "mfa.validate", false)
 	c.JSON(http.StatusUnauthorized, gin.H{"valid": false, "message": "Invalid OTP"})
 }
+
+// recordValidationFailure bumps the consecutive failure counter and locks the user once the
+// configured threshold is reached (MFA_LOCKOUT_THRESHOLD, 0 disables locking).
+func recordValidationFailure(c *gin.Context, customerID, env, userID string, userMeta []byte) {
+	attempts, lockedUntil, err := countMFAFailure(customerID, env, userID)
+	if err != nil {
+		return
+	}
+	// Locked requests are rejected before reaching here, so a lock in the future is a fresh one
+	if lockedUntil.Valid && lockedUntil.Time.After(time.Now()) {
+		audit.Log(c, "mfa.lockout", mfaAuditMeta(userID, userMeta, map[string]any{"failed_attempts": attempts, "locked_until": lockedUntil.Time}))
+	}
+}
+
+// countMFAFailure records a failed code for an mfa_users row, locking it at the threshold. It
+// returns the consecutive failures and the lock, if any.
+func countMFAFailure(customerID, env, userID string) (int, sql.NullTime, error) {
+	cfg := config.Get()
+	var attempts int
+	var lockedUntil sql.NullTime
+	err := db.DB.QueryRow(`UPDATE mfa_users SET last_failure_at = NOW(), failed_attempts = failed_attempts + 1,
+		locked_until = CASE WHEN $1 > 0 AND failed_attempts + 1 >= $1 THEN NOW() + make_interval(mins => $2) ELSE locked_until END
+		WHERE customer_id = $3 AND environment = $4 AND user_id = $5 RETURNING failed_attempts, locked_until`,
+		cfg.MFALockoutThreshold, cfg.MFALockoutMinutes, customerID, env, userID).Scan(&attempts, &lockedUntil)
+	return attempts, lockedUntil, err
+}
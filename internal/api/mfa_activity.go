@@ -0,0 +1,188 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"otp/internal/db"
+)
+
+// mfaEnrollment describes how a user's TOTP secret was generated. It mirrors the
+// totp.GenerateOpts used by RegisterMFA and ResetMFA (library defaults plus a 32-byte secret).
+type mfaEnrollment struct {
+	Type       string `json:"type"`
+	Algorithm  string `json:"algorithm"`
+	Digits     int    `json:"digits"`
+	PeriodSecs int    `json:"period_seconds"`
+	SecretSize int    `json:"secret_size"`
+}
+
+var totpEnrollment = mfaEnrollment{Type: "totp", Algorithm: "SHA1", Digits: 6, PeriodSecs: 30, SecretSize: 32}
+
+type mfaUserDetail struct {
+	UserID               string          `json:"user_id"`
+	AccountName          string          `json:"account_name"`
+	Issuer               string          `json:"issuer"`
+	IsActive             bool            `json:"is_active"`
+	APIKeyID             *string         `json:"api_key_id,omitempty"`
+	Metadata             json.RawMessage `json:"metadata"`
+	Tags                 []string        `json:"tags"`
+	Enrollment           mfaEnrollment   `json:"enrollment"`
+	BackupCodesRemaining int             `json:"backup_codes_remaining"`
+	BackupCodesUsed      int             `json:"backup_codes_used"`
+	LastSuccessAt        *time.Time      `json:"last_success_at,omitempty"`
+	LastFailureAt        *time.Time      `json:"last_failure_at,omitempty"`
+	FailedAttempts       int             `json:"failed_attempts"`
+	Locked               bool            `json:"locked"`
+	LockedUntil          *time.Time      `json:"locked_until,omitempty"`
+	CreatedAt            time.Time       `json:"created_at"`
+	UpdatedAt            time.Time       `json:"updated_at"`
+}
+
+// GetMFAUser returns the current state of a single MFA user for support tooling.
+func GetMFAUser(c *gin.Context) {
+	userID := c.Param("id")
+	customerID := c.GetString("customer_id")
+
+	var d mfaUserDetail
+	var apiKeyID sql.NullString
+	var lastSuccess, lastFailure, lockedUntil sql.NullTime
+	err := db.DB.QueryRow(`SELECT user_id, COALESCE(account_name, ''), COALESCE(issuer, ''), is_active, api_key_id, metadata, tags,
+		cardinality(backup_code_hashes) + COALESCE(cardinality(backup_codes_encrypted), 0),
+		backup_codes_used + COALESCE(cardinality(used_backup_codes_encrypted), 0),
+		last_success_at, last_failure_at, failed_attempts, locked_until, created_at, updated_at
+		FROM mfa_users WHERE customer_id = $1 AND environment = $2 AND user_id = $3`, customerID, mfaEnvironment(c), userID).Scan(
+		&d.UserID, &d.AccountName, &d.Issuer, &d.IsActive, &apiKeyID, &d.Metadata, pq.Array(&d.Tags),
+		&d.BackupCodesRemaining, &d.BackupCodesUsed,
+		&lastSuccess, &lastFailure, &d.FailedAttempts, &lockedUntil, &d.CreatedAt, &d.UpdatedAt)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	d.Enrollment = totpEnrollment
+	if apiKeyID.Valid {
+		d.APIKeyID = &apiKeyID.String
+	}
+	if lastSuccess.Valid {
+		d.LastSuccessAt = &lastSuccess.Time
+	}
+	if lastFailure.Valid {
+		d.LastFailureAt = &lastFailure.Time
+	}
+	if lockedUntil.Valid {
+		d.LockedUntil = &lockedUntil.Time
+		d.Locked = time.Now().Before(lockedUntil.Time)
+	}
+	c.JSON(http.StatusOK, d)
+}
+
+type timelineItem struct {
+	ID        string          `json:"id"`
+	Source    string          `json:"source"` // audit|usage
+	Event     string          `json:"event"`
+	Success   *bool           `json:"success,omitempty"`
+	ActorType string          `json:"actor_type,omitempty"`
+	ActorID   string          `json:"actor_id,omitempty"`
+	IP        string          `json:"ip,omitempty"`
+	Metadata  json.RawMessage `json:"metadata,omitempty"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// MFAUserTimeline returns audit and usage events for one MFA user, newest first.
+// Query params: limit (default 50, max 200), cursor (next_cursor from a previous page).
+func MFAUserTimeline(c *gin.Context) {
+	userID := c.Param("id")
+	customerID := c.GetString("customer_id")
+
+	lim := 50
+	if v := c.Query("limit"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			if n < 1 {
+				n = 1
+			}
+			if n > 200 {
+				n = 200
+			}
+			lim = n
+		}
+	}
+	before := time.Now().Add(time.Hour)
+	beforeID := ""
+	if cur := c.Query("cursor"); cur != "" {
+		t, id, err := parseTimelineCursor(cur)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid cursor"})
+			return
+		}
+		before, beforeID = t, id
+	}
+
+	// Keyset pagination on (created_at, id) across both sources; each branch uses its
+	// (customer_id, user_id, created_at) index.
+	q := `SELECT id, source, event, success, actor_type, actor_id, ip, metadata, created_at FROM (
+		SELECT id::text AS id, 'audit' AS source, event, NULL::boolean AS success, COALESCE(actor_type, '') AS actor_type,
+			COALESCE(actor_id, '') AS actor_id, COALESCE(ip, '') AS ip, metadata, created_at
+		FROM audit_logs WHERE customer_id = $1 AND user_id = $2 AND (created_at, id::text) < ($3, $4)
+			AND environment = $6
+		UNION ALL
+		SELECT id::text, 'usage', endpoint, success, 'api_key', api_key_id::text, '', NULL::jsonb, created_at
+		FROM usage_events WHERE customer_id = $1 AND user_id = $2 AND (created_at, id::text) < ($3, $4) AND environment = $6
+	) t ORDER BY created_at DESC, id DESC LIMIT $5`
+	if beforeID == "" {
+		// no cursor yet: any id sorts below the sentinel
+		beforeID = "~"
+	}
+	rows, err := db.DB.Query(q, customerID, userID, before, beforeID, lim, mfaEnvironment(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer rows.Close()
+
+	items := []timelineItem{}
+	for rows.Next() {
+		var it timelineItem
+		var success sql.NullBool
+		var meta []byte
+		if err := rows.Scan(&it.ID, &it.Source, &it.Event, &success, &it.ActorType, &it.ActorID, &it.IP, &meta, &it.CreatedAt); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Scan error"})
+			return
+		}
+		if success.Valid {
+			it.Success = &success.Bool
+		}
+		if len(meta) > 0 {
+			it.Metadata = meta
+		}
+		items = append(items, it)
+	}
+	resp := gin.H{"data": items}
+	if len(items) == lim {
+		last := items[len(items)-1]
+		resp["next_cursor"] = last.CreatedAt.UTC().Format(time.RFC3339Nano) + "," + last.ID
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func parseTimelineCursor(cur string) (time.Time, string, error) {
+	ts, id, ok := strings.Cut(cur, ",")
+	if !ok || id == "" {
+		return time.Time{}, "", errors.New("malformed cursor")
+	}
+	t, err := time.Parse(time.RFC3339Nano, ts)
+	if err != nil {
+		return time.Time{}, "", err
+	}
+	return t, id, nil
+}
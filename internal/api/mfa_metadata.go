@@ -0,0 +1,136 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"otp/internal/audit"
+	"otp/internal/db"
+	"otp/internal/usage"
+)
+
+const (
+	maxUserMetadataBytes = 4096
+	maxUserTags          = 32
+	maxUserTagLength     = 64
+)
+
+// encodeUserMetadata validates and serializes custom MFA user metadata. A nil map encodes as {}.
+func encodeUserMetadata(m map[string]any) (string, error) {
+	if m == nil {
+		return "{}", nil
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return "", errors.New("metadata must be a JSON object")
+	}
+	if len(b) > maxUserMetadataBytes {
+		return "", fmt.Errorf("metadata must be at most %d bytes", maxUserMetadataBytes)
+	}
+	return string(b), nil
+}
+
+// normalizeTags trims, de-duplicates and validates a tag set, preserving first-seen order.
+func normalizeTags(tags []string) ([]string, error) {
+	out := make([]string, 0, len(tags))
+	seen := make(map[string]struct{}, len(tags))
+	for _, t := range tags {
+		t = strings.TrimSpace(t)
+		if t == "" {
+			return nil, errors.New("tags must not be empty")
+		}
+		if len(t) > maxUserTagLength {
+			return nil, fmt.Errorf("tags must be at most %d characters", maxUserTagLength)
+		}
+		if _, dup := seen[t]; dup {
+			continue
+		}
+		seen[t] = struct{}{}
+		out = append(out, t)
+	}
+	if len(out) > maxUserTags {
+		return nil, fmt.Errorf("at most %d tags are allowed", maxUserTags)
+	}
+	return out, nil
+}
+
+// mfaAuditMeta builds audit metadata for an MFA user event and attaches the user's custom
+// metadata, so audit consumers and the realtime stream can correlate users without a lookup.
+func mfaAuditMeta(userID string, userMeta []byte, extra map[string]any) map[string]any {
+	m := map[string]any{"user_id": userID}
+	if len(userMeta) > 0 && string(userMeta) != "{}" {
+		m["user_metadata"] = json.RawMessage(userMeta)
+	}
+	for k, v := range extra {
+		m[k] = v
+	}
+	return m
+}
+
+type updateMFAUserMetadataRequest struct {
+	Metadata *map[string]any `json:"metadata"`
+	Tags     *[]string       `json:"tags"`
+}
+
+// UpdateMFAUserMetadata replaces the custom metadata and/or tags of an MFA user. Fields that
+// are omitted are left unchanged; send {} or [] to clear them.
+func UpdateMFAUserMetadata(c *gin.Context) {
+	userID := c.Param("id")
+	c.Set("mfa_user_id", userID)
+	customerID := c.GetString("customer_id")
+	var req updateMFAUserMetadataRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Metadata == nil && req.Tags == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "metadata or tags is required"})
+		return
+	}
+
+	var metaJSON []byte
+	var tags []string
+	err := db.DB.QueryRow(`SELECT metadata, tags FROM mfa_users WHERE customer_id = $1 AND environment = $2 AND user_id = $3`, customerID, mfaEnvironment(c), userID).Scan(&metaJSON, pq.Array(&tags))
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if req.Metadata != nil {
+		enc, err := encodeUserMetadata(*req.Metadata)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		metaJSON = []byte(enc)
+	}
+	if req.Tags != nil {
+		t, err := normalizeTags(*req.Tags)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		tags = t
+	}
+	if tags == nil {
+		tags = []string{}
+	}
+
+	_, err = db.DB.Exec(`UPDATE mfa_users SET metadata = $1::jsonb, tags = $2, updated_at = NOW() WHERE customer_id = $3 AND environment = $4 AND user_id = $5`, string(metaJSON), pq.Array(tags), customerID, mfaEnvironment(c), userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update metadata"})
+		return
+	}
+	audit.Log(c, "mfa.user.metadata_update", mfaAuditMeta(userID, metaJSON, map[string]any{"tags": tags}))
+	usage.Record(c, "mfa.metadata.update", true)
+	c.JSON(http.StatusOK, gin.H{"user_id": userID, "metadata": json.RawMessage(metaJSON), "tags": tags})
+}
@@ -0,0 +1,312 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"otp/internal/audit"
+	"otp/internal/crypto"
+	"otp/internal/db"
+	"otp/internal/usage"
+)
+
+// maxRenameBatch bounds a single bulk rename so it fits comfortably in one transaction.
+const maxRenameBatch = 5000
+
+type renameMFAUserRequest struct {
+	NewID string `json:"new_id" binding:"required"`
+}
+
+type userIDMapping struct {
+	OldID string `json:"old_id"`
+	NewID string `json:"new_id"`
+}
+
+type bulkRenameRequest struct {
+	Mappings []userIDMapping `json:"mappings"`
+}
+
+var (
+	errRenameNotFound = errors.New("user not found")
+	errRenameConflict = errors.New("user id already in use")
+)
+
+// renameError carries the ids that made a rename batch fail so callers can report them.
+type renameError struct {
+	err error
+	ids []string
+}
+
+func (e *renameError) Error() string { return e.err.Error() }
+func (e *renameError) Unwrap() error { return e.err }
+
+// RenameMFAUser changes the external user_id of a single MFA user, keeping its secret,
+// backup codes and history.
+func RenameMFAUser(c *gin.Context) {
+	oldID := c.Param("id")
+	customerID := c.GetString("customer_id")
+	var req renameMFAUserRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	mappings := []userIDMapping{{OldID: oldID, NewID: strings.TrimSpace(req.NewID)}}
+	if err := validateRenameMappings(mappings); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !applyRenames(c, customerID, mappings) {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "renamed", "old_id": oldID, "new_id": mappings[0].NewID})
+}
+
+// BulkRenameMFAUsers atomically applies a list of old_id -> new_id mappings. The body is either
+// JSON ({"mappings":[{"old_id":"..","new_id":".."}]}) or CSV (Content-Type: text/csv) with one
+// "old_id,new_id" pair per line. Either every mapping is applied or none is.
+func BulkRenameMFAUsers(c *gin.Context) {
+	customerID := c.GetString("customer_id")
+	var mappings []userIDMapping
+	if strings.HasPrefix(c.ContentType(), "text/csv") {
+		m, err := parseRenameCSV(c.Request.Body)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		mappings = m
+	} else {
+		var req bulkRenameRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		mappings = req.Mappings
+	}
+	for i := range mappings {
+		mappings[i].OldID = strings.TrimSpace(mappings[i].OldID)
+		mappings[i].NewID = strings.TrimSpace(mappings[i].NewID)
+	}
+	if err := validateRenameMappings(mappings); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !applyRenames(c, customerID, mappings) {
+		return
+	}
+	audit.Log(c, "mfa.user.rename_bulk", map[string]any{"count": len(mappings)})
+	c.JSON(http.StatusOK, gin.H{"status": "renamed", "renamed": len(mappings)})
+}
+
+// applyRenames runs the rename transaction and writes the HTTP error response on failure.
+// It returns true when all mappings were applied.
+func applyRenames(c *gin.Context, customerID string, mappings []userIDMapping) bool {
+	entries := make([]audit.Entry, len(mappings))
+	for i, m := range mappings {
+		entries[i] = audit.Prepare(c, "mfa.user.rename", map[string]any{"user_id": m.NewID, "old_user_id": m.OldID, "new_user_id": m.NewID})
+	}
+	err := renameMFAUsers(customerID, mfaEnvironment(c), mappings, entries)
+	var re *renameError
+	switch {
+	case err == nil:
+	case errors.As(err, &re) && errors.Is(err, errRenameNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found", "user_ids": re.ids})
+		return false
+	case errors.As(err, &re) && errors.Is(err, errRenameConflict):
+		c.JSON(http.StatusConflict, gin.H{"error": "New user id already registered for MFA", "user_ids": re.ids})
+		return false
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to rename user"})
+		return false
+	}
+	audit.Publish(entries)
+	return true
+}
+
+// validateRenameMappings checks ids are present, distinct and not chained (a new id that is also
+// renamed away in the same batch), so the batch can be applied in any order.
+func validateRenameMappings(mappings []userIDMapping) error {
+	if len(mappings) == 0 {
+		return errors.New("no mappings provided")
+	}
+	if len(mappings) > maxRenameBatch {
+		return errors.New("too many mappings in one request")
+	}
+	olds := make(map[string]struct{}, len(mappings))
+	news := make(map[string]struct{}, len(mappings))
+	for _, m := range mappings {
+		if m.OldID == "" || m.NewID == "" {
+			return errors.New("old_id and new_id are required")
+		}
+		if len(m.NewID) > 255 {
+			return errors.New("new_id must be at most 255 characters")
+		}
+		if m.OldID == m.NewID {
+			return errors.New("new_id must differ from old_id: " + m.OldID)
+		}
+		if _, dup := olds[m.OldID]; dup {
+			return errors.New("duplicate old_id: " + m.OldID)
+		}
+		if _, dup := news[m.NewID]; dup {
+			return errors.New("duplicate new_id: " + m.NewID)
+		}
+		olds[m.OldID] = struct{}{}
+		news[m.NewID] = struct{}{}
+	}
+	for id := range news {
+		if _, chained := olds[id]; chained {
+			return errors.New("chained renames are not supported: " + id)
+		}
+	}
+	return nil
+}
+
+// renameMFAUsers applies all mappings for a customer's users in env inside one transaction,
+// writing the audit entries in the same transaction.
+func renameMFAUsers(customerID, env string, mappings []userIDMapping, entries []audit.Entry) error {
+	// buffered usage events still carry the old ids; write them first so they are renamed too
+	if err := usage.Flush(); err != nil {
+		return err
+	}
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var missing, taken []string
+	for _, m := range mappings {
+		var found string
+		err := tx.QueryRow(`SELECT user_id FROM mfa_users WHERE customer_id = $1 AND environment = $2 AND user_id = $3 FOR UPDATE`, customerID, env, m.OldID).Scan(&found)
+		if err == sql.ErrNoRows {
+			missing = append(missing, m.OldID)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		var exists bool
+		if err := tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM mfa_users WHERE customer_id = $1 AND environment = $2 AND user_id = $3)`, customerID, env, m.NewID).Scan(&exists); err != nil {
+			return err
+		}
+		if exists {
+			taken = append(taken, m.NewID)
+		}
+	}
+	if len(missing) > 0 {
+		return &renameError{err: errRenameNotFound, ids: missing}
+	}
+	if len(taken) > 0 {
+		return &renameError{err: errRenameConflict, ids: taken}
+	}
+
+	for _, m := range mappings {
+		if _, err := tx.Exec(`UPDATE mfa_users SET user_id = $1, updated_at = NOW() WHERE customer_id = $2 AND environment = $3 AND user_id = $4`, m.NewID, customerID, env, m.OldID); err != nil {
+			// the new id was registered concurrently, after the check above
+			var pqErr *pq.Error
+			if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+				return &renameError{err: errRenameConflict, ids: []string{m.NewID}}
+			}
+			return err
+		}
+		if err := rebindUserCiphertexts(tx, customerID, env, m.OldID, m.NewID); err != nil {
+			return err
+		}
+		// Carry the indexed activity history over; the JSON metadata keeps the id as recorded.
+		if _, err := tx.Exec(`UPDATE audit_logs SET user_id = $1 WHERE customer_id = $2 AND user_id = $3 AND environment = $4`, m.NewID, customerID, m.OldID, env); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`UPDATE usage_events SET user_id = $1 WHERE customer_id = $2 AND user_id = $3 AND environment = $4`, m.NewID, customerID, m.OldID, env); err != nil {
+			return err
+		}
+	}
+	if err := audit.InsertTx(tx, entries); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// rebindUserCiphertexts re-seals a renamed user's encrypted fields (bound to the old user id)
+// under the new id. The pending backup code sheet follows the rename via its foreign key.
+func rebindUserCiphertexts(tx *sql.Tx, customerID, env, oldID, newID string) error {
+	rebind := func(field, ct string) (string, error) {
+		return crypto.Rebind(crypto.Binding{CustomerID: customerID, UserID: oldID, Field: field, Environment: env},
+			crypto.Binding{CustomerID: customerID, UserID: newID, Field: field, Environment: env}, ct)
+	}
+	rebindAll := func(field string, cts []string) ([]string, error) {
+		out := make([]string, len(cts))
+		for i, ct := range cts {
+			v, err := rebind(field, ct)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = v
+		}
+		return out, nil
+	}
+
+	var secret string
+	var codes, used []string
+	err := tx.QueryRow(`SELECT secret_key_encrypted, COALESCE(backup_codes_encrypted, '{}'), COALESCE(used_backup_codes_encrypted, '{}')
+		FROM mfa_users WHERE customer_id = $1 AND environment = $2 AND user_id = $3`, customerID, env, newID).Scan(&secret, pq.Array(&codes), pq.Array(&used))
+	if err != nil {
+		return err
+	}
+	if secret, err = rebind(crypto.FieldMFASecret, secret); err != nil {
+		return err
+	}
+	if codes, err = rebindAll(crypto.FieldBackupCode, codes); err != nil {
+		return err
+	}
+	if used, err = rebindAll(crypto.FieldUsedBackupCode, used); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE mfa_users SET secret_key_encrypted = $1, backup_codes_encrypted = $2, used_backup_codes_encrypted = $3
+		WHERE customer_id = $4 AND environment = $5 AND user_id = $6`, secret, pq.Array(codes), pq.Array(used), customerID, env, newID); err != nil {
+		return err
+	}
+
+	var sheet string
+	err = tx.QueryRow(`SELECT codes_encrypted FROM backup_code_sheets WHERE customer_id = $1 AND environment = $2 AND user_id = $3`, customerID, env, newID).Scan(&sheet)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if sheet, err = rebind(crypto.FieldBackupCodeSheet, sheet); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`UPDATE backup_code_sheets SET codes_encrypted = $1 WHERE customer_id = $2 AND environment = $3 AND user_id = $4`, sheet, customerID, env, newID)
+	return err
+}
+
+// parseRenameCSV reads "old_id,new_id" rows; a leading header row naming the columns is skipped.
+func parseRenameCSV(r io.Reader) ([]userIDMapping, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = 2
+	cr.TrimLeadingSpace = true
+	out := []userIDMapping{}
+	for line := 0; ; line++ {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if line == 0 && strings.EqualFold(rec[0], "old_id") && strings.EqualFold(rec[1], "new_id") {
+			continue
+		}
+		out = append(out, userIDMapping{OldID: rec[0], NewID: rec[1]})
+		if len(out) > maxRenameBatch {
+			return nil, errors.New("too many mappings in one request")
+		}
+	}
+	return out, nil
+}
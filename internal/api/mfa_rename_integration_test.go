@@ -0,0 +1,138 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"otp/internal/config"
+	"otp/internal/crypto"
+	"otp/internal/db"
+	"otp/internal/tenantkeys"
+)
+
+func TestRenameMFAUsers(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	cfg := config.Load()
+	if v := os.Getenv("TEST_DATABASE_URL"); v != "" {
+		cfg.DatabaseURL = v
+	}
+	if err := db.Init(cfg.DatabaseURL); err != nil {
+		t.Skipf("skipping integration test; DB unavailable: %v (set TEST_DATABASE_URL)", err)
+	}
+	if err := crypto.LoadKeyring(cfg.EncryptionKey, cfg.EncryptionKeys, cfg.EncryptionKeyVersion, db.KeySalt); err != nil {
+		t.Fatal(err)
+	}
+	crypto.SetProvider(crypto.KeyringProvider{}, time.Minute, 16)
+	crypto.SetTenantKeyStore(tenantkeys.Store{})
+
+	stamp := time.Now().Format("150405.000")
+	custID := ensureTestCustomer(t, "rename-itest-"+stamp+"@example.com", "itestpass", "Rename ITest Co", "cus_ren_"+stamp)
+	apiKeyID := ensureTestAPIKey(t, custID)
+
+	secrets := map[string]string{}
+	enroll := func(userID string) {
+		secret := "JBSWY3DPEHPK3PXP" + userID
+		enc, err := crypto.EncryptFor(crypto.Binding{CustomerID: custID, UserID: userID, Field: crypto.FieldMFASecret, Environment: "live"}, secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.DB.Exec(`INSERT INTO mfa_users (customer_id, environment, user_id, secret_key_encrypted, account_name, issuer) VALUES ($1, 'live', $2, $3, $2, 'ITest')`, custID, userID, enc); err != nil {
+			t.Fatalf("enroll %s: %v", userID, err)
+		}
+		if _, err := db.DB.Exec(`INSERT INTO audit_logs (customer_id, actor_type, actor_id, event, metadata, user_id) VALUES ($1, 'customer', $1, 'mfa.user.register', '{}', $2)`, custID, userID); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.DB.Exec(`INSERT INTO usage_events (customer_id, api_key_id, endpoint, success, user_id) VALUES ($1, $2, '/mfa/validate', true, $3)`, custID, apiKeyID, userID); err != nil {
+			t.Fatal(err)
+		}
+		secrets[userID] = secret
+	}
+	for _, id := range []string{"alice", "bob", "carol", "dave"} {
+		enroll(id + "-" + stamp)
+	}
+	id := func(name string) string { return name + "-" + stamp }
+
+	r := gin.New()
+	r.Use(func(c *gin.Context) { c.Set("customer_id", custID); c.Next() })
+	r.POST("/mfa/rename", BulkRenameMFAUsers)
+	r.POST("/mfa/:id/rename", RenameMFAUser)
+
+	do := func(path string, body any) (int, map[string]any) {
+		b, _ := json.Marshal(body)
+		req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(b))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		var out map[string]any
+		_ = json.Unmarshal(w.Body.Bytes(), &out)
+		return w.Code, out
+	}
+	// followed checks the renamed user kept its secret, history and usage under the new id
+	followed := func(oldID, newID string) {
+		t.Helper()
+		var enc string
+		if err := db.DB.QueryRow(`SELECT secret_key_encrypted FROM mfa_users WHERE customer_id = $1 AND environment = 'live' AND user_id = $2`, custID, newID).Scan(&enc); err != nil {
+			t.Fatalf("%s not renamed: %v", newID, err)
+		}
+		secret, err := crypto.DecryptFor(crypto.Binding{CustomerID: custID, UserID: newID, Field: crypto.FieldMFASecret, Environment: "live"}, enc)
+		if err != nil || secret != secrets[oldID] {
+			t.Fatalf("secret of %s after rename: %q %v", newID, secret, err)
+		}
+		var audits, renames, usage, left int
+		db.DB.QueryRow(`SELECT COUNT(*) FILTER (WHERE event = 'mfa.user.register'), COUNT(*) FILTER (WHERE event = 'mfa.user.rename') FROM audit_logs WHERE customer_id = $1 AND user_id = $2`, custID, newID).Scan(&audits, &renames)
+		db.DB.QueryRow(`SELECT COUNT(*) FROM usage_events WHERE customer_id = $1 AND user_id = $2`, custID, newID).Scan(&usage)
+		db.DB.QueryRow(`SELECT (SELECT COUNT(*) FROM audit_logs WHERE customer_id = $1 AND user_id = $2) + (SELECT COUNT(*) FROM usage_events WHERE customer_id = $1 AND user_id = $2)`, custID, oldID).Scan(&left)
+		if audits != 1 || renames != 1 || usage != 1 || left != 0 {
+			t.Fatalf("history of %s: audit=%d rename=%d usage=%d left under old id=%d", newID, audits, renames, usage, left)
+		}
+	}
+
+	// single rename
+	if code, out := do("/mfa/"+id("alice")+"/rename", map[string]any{"new_id": id("alice2")}); code != http.StatusOK {
+		t.Fatalf("rename: %d %v", code, out)
+	}
+	followed(id("alice"), id("alice2"))
+	if code, _ := do("/mfa/"+id("alice")+"/rename", map[string]any{"new_id": id("alice3")}); code != http.StatusNotFound {
+		t.Fatalf("renaming a gone id: %d", code)
+	}
+
+	// a new id that is already registered is refused and nothing in the batch is applied
+	code, out := do("/mfa/rename", map[string]any{"mappings": []map[string]string{
+		{"old_id": id("bob"), "new_id": id("bob2")},
+		{"old_id": id("carol"), "new_id": id("dave")},
+	}})
+	if ids, _ := out["user_ids"].([]any); code != http.StatusConflict || len(ids) != 1 || ids[0] != id("dave") {
+		t.Fatalf("conflict: %d %v", code, out)
+	}
+	var exists bool
+	db.DB.QueryRow(`SELECT EXISTS(SELECT 1 FROM mfa_users WHERE customer_id = $1 AND user_id = $2)`, custID, id("bob")).Scan(&exists)
+	if !exists {
+		t.Fatal("a refused batch must not rename any user")
+	}
+
+	// chained renames are rejected up front
+	code, out = do("/mfa/rename", map[string]any{"mappings": []map[string]string{
+		{"old_id": id("bob"), "new_id": id("carol")},
+		{"old_id": id("carol"), "new_id": id("carol2")},
+	}})
+	if code != http.StatusBadRequest {
+		t.Fatalf("chained rename: %d %v", code, out)
+	}
+
+	// bulk rename
+	code, out = do("/mfa/rename", map[string]any{"mappings": []map[string]string{
+		{"old_id": id("bob"), "new_id": id("bob2")},
+		{"old_id": id("carol"), "new_id": id("carol2")},
+	}})
+	if code != http.StatusOK || out["renamed"] != float64(2) {
+		t.Fatalf("bulk rename: %d %v", code, out)
+	}
+	followed(id("bob"), id("bob2"))
+	followed(id("carol"), id("carol2"))
+}
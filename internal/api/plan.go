@@ -0,0 +1,204 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"otp/internal/audit"
+	"otp/internal/config"
+	"otp/internal/db"
+	"otp/internal/keys"
+	"otp/internal/tiers"
+)
+
+// customerTier returns the authenticated customer's subscription tier. API key auth already
+// loaded it with the key; session requests read it.
+func customerTier(c *gin.Context) (tiers.Tier, error) {
+	name, ok := c.Get("subscription_tier")
+	if !ok {
+		var tier string
+		if err := db.DB.QueryRowContext(c.Request.Context(), `SELECT COALESCE(subscription_tier, '') FROM customers WHERE id = $1`,
+			c.GetString("customer_id")).Scan(&tier); err != nil {
+			return tiers.Tier{}, err
+		}
+		c.Set("subscription_tier", tier)
+		name = tier
+	}
+	t, _ := tiers.Get(name.(string))
+	return t, nil
+}
+
+// requireFeature answers 402 and returns false when the customer's tier lacks feature.
+func requireFeature(c *gin.Context, feature string) bool {
+	t, err := customerTier(c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load subscription tier"})
+		return false
+	}
+	if !t.HasFeature(feature) {
+		c.JSON(http.StatusPaymentRequired, gin.H{"error": feature + " are not included in the " + t.Name + " plan", "code": "feature_not_in_plan", "feature": feature, "tier": t.Name})
+		return false
+	}
+	return true
+}
+
+// requirePlanRoom answers 402 and returns nil when the customer already has as many of
+// something (limit picks the tier's limit, count counts the current number) as their tier allows.
+// Otherwise it returns a transaction for the caller to add the new one on and commit. The
+// transaction holds a per-customer advisory lock on what is limited, so concurrent creates are
+// counted one after another instead of all passing on the same count.
+func requirePlanRoom(c *gin.Context, what string, limit func(tiers.Tier) int64, count func(ctx context.Context, q tiers.Querier, customerID string) (int64, error)) *sql.Tx {
+	t, err := customerTier(c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load subscription tier"})
+		return nil
+	}
+	ctx, customerID := c.Request.Context(), c.GetString("customer_id")
+	tx, err := db.DB.BeginTx(ctx, nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to check plan limits"})
+		return nil
+	}
+	allowed := limit(t)
+	if allowed == 0 {
+		return tx
+	}
+	var n int64
+	_, err = tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext($1), hashtext($2))`, what, customerID)
+	if err == nil {
+		n, err = count(ctx, tx, customerID)
+	}
+	if err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to check plan limits"})
+		return nil
+	}
+	if n >= allowed {
+		tx.Rollback()
+		c.JSON(http.StatusPaymentRequired, gin.H{"error": "the " + t.Name + " plan allows " + strconv.FormatInt(allowed, 10) + " " + what, "code": "plan_limit_reached", "limit": allowed, "tier": t.Name})
+		return nil
+	}
+	return tx
+}
+
+// requireAPIKeyRoom checks the tier's MaxAPIKeys before a key is created or re-enabled, which
+// happens on the returned transaction.
+func requireAPIKeyRoom(c *gin.Context) *sql.Tx {
+	return requirePlanRoom(c, "active API keys", func(t tiers.Tier) int64 { return t.MaxAPIKeys }, tiers.APIKeys)
+}
+
+// requireMFAUserRoom checks the tier's MaxMFAUsers before a live MFA user is registered on the
+// returned transaction. Test users are free, but still get a transaction.
+func requireMFAUserRoom(c *gin.Context, env string) *sql.Tx {
+	limit := func(t tiers.Tier) int64 { return t.MaxMFAUsers }
+	if env != keys.EnvLive {
+		limit = func(tiers.Tier) int64 { return 0 }
+	}
+	return requirePlanRoom(c, "active MFA users", limit, tiers.MFAUsers)
+}
+
+// consumeValidationQuota counts a live validation against the monthly quota and sets the
+// X-Quota-* headers. Once the quota is exhausted it answers 429 until the month ends and
+// returns false. Past the soft limit responses carry X-Quota-Warning, and the first one of the
+// month is audited.
+func consumeValidationQuota(c *gin.Context, env string) bool {
+	if env != keys.EnvLive {
+		return true
+	}
+	t, err := customerTier(c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return false
+	}
+	q, err := tiers.ConsumeValidation(c.Request.Context(), c.GetString("customer_id"), t, config.Get().QuotaSoftLimitPercent)
+	if err != nil {
+		log.Printf("quota: counting validation failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return false
+	}
+	if q.Limit == 0 {
+		return true
+	}
+	c.Header("X-Quota-Limit", strconv.FormatInt(q.Limit, 10))
+	c.Header("X-Quota-Remaining", strconv.FormatInt(q.Remaining(), 10))
+	c.Header("X-Quota-Reset", strconv.FormatInt(q.Reset.Unix(), 10))
+	if !q.Allowed {
+		c.Header("Retry-After", strconv.FormatInt(int64(time.Until(q.Reset).Seconds())+1, 10))
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Monthly validation quota of the " + t.Name + " plan exhausted", "code": "quota_exceeded", "limit": q.Limit, "reset_at": q.Reset})
+		return false
+	}
+	if q.SoftLimit {
+		c.Header("X-Quota-Warning", strconv.FormatInt(q.Used, 10)+" of "+strconv.FormatInt(q.Limit, 10)+" monthly validations used")
+	}
+	if q.FirstWarning {
+		audit.Log(c, "quota.soft_limit", map[string]any{"tier": t.Name, "limit": q.Limit, "used": q.Used, "period_start": q.Reset.AddDate(0, -1, 0).Format(time.DateOnly)})
+	}
+	return true
+}
+
+// quotaSummary is the plan section of the customer usage summary. Limits of 0 are unlimited.
+type quotaSummary struct {
+	Tier        string       `json:"tier"`
+	PeriodStart time.Time    `json:"period_start"`
+	PeriodEnd   time.Time    `json:"period_end"`
+	Validations quotaCounter `json:"validations"`
+	MFAUsers    quotaCounter `json:"mfa_users"`
+	APIKeys     quotaCounter `json:"api_keys"`
+	Features    []string     `json:"features"`
+}
+
+type quotaCounter struct {
+	Used  int64 `json:"used"`
+	Limit int64 `json:"limit"`
+	// nil when unlimited
+	Remaining *int64 `json:"remaining"`
+}
+
+func newQuotaCounter(used, limit int64) quotaCounter {
+	q := quotaCounter{Used: used, Limit: limit}
+	if limit > 0 {
+		r := max(limit-used, 0)
+		q.Remaining = &r
+	}
+	return q
+}
+
+// loadQuotaSummary reports the customer's tier and how much of it this month has used.
+func loadQuotaSummary(c *gin.Context) (*quotaSummary, error) {
+	t, err := customerTier(c)
+	if err != nil {
+		return nil, err
+	}
+	ctx, customerID := c.Request.Context(), c.GetString("customer_id")
+	validations, err := tiers.Validations(ctx, customerID)
+	if err != nil {
+		return nil, err
+	}
+	users, err := tiers.MFAUsers(ctx, db.DB, customerID)
+	if err != nil {
+		return nil, err
+	}
+	apiKeys, err := tiers.APIKeys(ctx, db.DB, customerID)
+	if err != nil {
+		return nil, err
+	}
+	start, end := tiers.Period(time.Now())
+	features := t.Features
+	if features == nil {
+		features = []string{}
+	}
+	return &quotaSummary{
+		Tier:        t.Name,
+		PeriodStart: start,
+		PeriodEnd:   end,
+		Validations: newQuotaCounter(validations, t.MonthlyValidations),
+		MFAUsers:    newQuotaCounter(users, t.MaxMFAUsers),
+		APIKeys:     newQuotaCounter(apiKeys, t.MaxAPIKeys),
+		Features:    features,
+	}, nil
+}
@@ -0,0 +1,86 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"otp/internal/config"
+	"otp/internal/db"
+	"otp/internal/tiers"
+)
+
+func TestAPIKeyPlanLimit(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	cfg := config.Load()
+	if v := os.Getenv("TEST_DATABASE_URL"); v != "" {
+		cfg.DatabaseURL = v
+	}
+	if err := db.Init(cfg.DatabaseURL); err != nil {
+		t.Skipf("skipping integration test; DB unavailable: %v (set TEST_DATABASE_URL)", err)
+	}
+
+	stamp := time.Now().Format("150405.000")
+	custID := ensureTestCustomer(t, "plan-itest-"+stamp+"@example.com", "itestpass", "Plan ITest Co", "cus_plan_"+stamp)
+	starter, _ := tiers.Get("starter")
+
+	r := gin.New()
+	r.Use(func(c *gin.Context) { c.Set("customer_id", custID); c.Next() })
+	r.POST("/keys", CreateAPIKey)
+	r.POST("/keys/:id/disable", DisableAPIKey)
+	r.POST("/keys/:id/rotate", RotateAPIKey)
+
+	do := func(path string, body any) (int, map[string]any) {
+		b, _ := json.Marshal(body)
+		req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(b))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		var out map[string]any
+		_ = json.Unmarshal(w.Body.Bytes(), &out)
+		return w.Code, out
+	}
+
+	// concurrent creates can't overshoot the limit
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	codes := map[int]int{}
+	var created []string
+	for i := 0; i < int(starter.MaxAPIKeys)*2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			code, out := do("/keys", map[string]any{"key_name": "plan-itest"})
+			mu.Lock()
+			defer mu.Unlock()
+			codes[code]++
+			if id, _ := out["id"].(string); code == http.StatusCreated {
+				created = append(created, id)
+			}
+		}()
+	}
+	wg.Wait()
+	if codes[http.StatusCreated] != int(starter.MaxAPIKeys) || codes[http.StatusPaymentRequired] != int(starter.MaxAPIKeys) {
+		t.Fatalf("concurrent creates: %v", codes)
+	}
+
+	// a disabled key frees its place and can't come back through a rotation
+	if code, out := do("/keys/"+created[0]+"/disable", nil); code != http.StatusOK {
+		t.Fatalf("disable: %d %v", code, out)
+	}
+	if code, out := do("/keys/"+created[0]+"/rotate", nil); code != http.StatusConflict {
+		t.Fatalf("rotating a disabled key: %d %v", code, out)
+	}
+	if code, out := do("/keys", map[string]any{"key_name": "plan-itest"}); code != http.StatusCreated {
+		t.Fatalf("create after disable: %d %v", code, out)
+	}
+	if code, out := do("/keys/"+created[1]+"/rotate", nil); code != http.StatusCreated {
+		t.Fatalf("rotating at the limit: %d %v", code, out)
+	}
+}
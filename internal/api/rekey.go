@@ -0,0 +1,74 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"otp/internal/audit"
+	"otp/internal/crypto"
+	"otp/internal/rekey"
+)
+
+// GetRekeyStatus reports the keys in use and the latest re-encryption job.
+func GetRekeyStatus(c *gin.Context) {
+	counts, err := rekey.KeyCounts()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed"})
+		return
+	}
+	resp := gin.H{"active_version": crypto.ActiveVersion(), "configured_versions": crypto.Versions(), "secrets_by_key": counts}
+	job, err := rekey.Latest()
+	if err == nil {
+		resp["job"] = job
+	} else if !errors.Is(err, rekey.ErrJobNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed"})
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// StartRekey starts moving stored secrets onto the current key-encryption key.
+func StartRekey(c *gin.Context) {
+	job, err := rekey.Start()
+	if errors.Is(err, rekey.ErrJobActive) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to start job"})
+		return
+	}
+	audit.Log(c, "crypto.rekey.start", map[string]any{"job_id": job.ID, "target_version": job.TargetVersion})
+	c.JSON(http.StatusAccepted, job)
+}
+
+// PauseRekey pauses a running job after its current batch.
+func PauseRekey(c *gin.Context) {
+	job, err := rekey.Pause(c.Param("id"))
+	if errors.Is(err, rekey.ErrJobNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no running job with that id"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to pause job"})
+		return
+	}
+	audit.Log(c, "crypto.rekey.pause", map[string]any{"job_id": job.ID})
+	c.JSON(http.StatusOK, job)
+}
+
+// ResumeRekey continues a paused or failed job from where it stopped.
+func ResumeRekey(c *gin.Context) {
+	job, err := rekey.Resume(c.Param("id"))
+	if errors.Is(err, rekey.ErrJobNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no paused or failed job with that id"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to resume job"})
+		return
+	}
+	audit.Log(c, "crypto.rekey.resume", map[string]any{"job_id": job.ID})
+	c.JSON(http.StatusAccepted, job)
+}
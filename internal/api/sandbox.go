@@ -0,0 +1,39 @@
+package api
+
+import (
+	"errors"
+
+	"github.com/gin-gonic/gin"
+	"otp/internal/keys"
+)
+
+var errSecretNotAllowed = errors.New("secret can only be set for test environment users")
+
+// mfaEnvironment returns the MFA user namespace a request works on: the API key's environment,
+// or the one picked with ?environment= in the console.
+func mfaEnvironment(c *gin.Context) string {
+	if env := c.GetString("environment"); env != "" {
+		return env
+	}
+	return keys.EnvLive
+}
+
+// sandboxSecret validates a caller-chosen TOTP secret. It returns nil when none was given, so
+// a random secret is generated as usual.
+func sandboxSecret(env, secret string) ([]byte, error) {
+	if secret == "" {
+		return nil, nil
+	}
+	if env != keys.EnvTest {
+		return nil, errSecretNotAllowed
+	}
+	return keys.NormalizeSandboxSecret(secret)
+}
+
+// consoleEnvQuery is the query string console links need to stay in env.
+func consoleEnvQuery(env string) string {
+	if env == keys.EnvLive {
+		return ""
+	}
+	return "?environment=" + env
+}
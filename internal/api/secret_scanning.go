@@ -0,0 +1,84 @@
+package api
+
+import (
+	"database/sql"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"otp/internal/audit"
+	"otp/internal/db"
+	"otp/internal/keys"
+	"otp/internal/middleware"
+)
+
+// maxLeakReports bounds how many keys a partner can report in one request.
+const maxLeakReports = 100
+
+// leakReport is one match from a secret-scanning partner: the key found and where it was found.
+type leakReport struct {
+	Token  string `json:"token"`
+	Type   string `json:"type"`
+	URL    string `json:"url"`
+	Source string `json:"source"`
+}
+
+type leakResult struct {
+	LastFour string `json:"key_last_four"`
+	// revoked, already_reported, unknown or invalid_format
+	Status string `json:"status"`
+}
+
+// ReportLeakedKeys revokes API keys a secret-scanning partner found in public (a commit, paste,
+// etc.). Each revoked key is marked leaked and audited, which also notifies the owning customer
+// on the realtime stream. Keys that fail the offline format check are answered without a lookup.
+func ReportLeakedKeys(c *gin.Context) {
+	var reports []leakReport
+	if err := c.ShouldBindJSON(&reports); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "body must be a JSON array of reports"})
+		return
+	}
+	if len(reports) == 0 || len(reports) > maxLeakReports {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "between 1 and 100 reports are accepted per request"})
+		return
+	}
+	results := make([]leakResult, 0, len(reports))
+	for _, r := range reports {
+		status, err := revokeLeakedKey(c, r)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to process reports"})
+			return
+		}
+		results = append(results, leakResult{LastFour: keys.LastFour(r.Token), Status: status})
+	}
+	c.JSON(http.StatusOK, gin.H{"data": results})
+}
+
+// revokeLeakedKey deactivates the reported key the first time it is reported. Disabled keys are
+// still marked, so the customer learns the key is public.
+func revokeLeakedKey(c *gin.Context, r leakReport) (string, error) {
+	if keys.CheckFormat(r.Token) != nil {
+		return "invalid_format", nil
+	}
+	var id, customerID, name string
+	var wasActive bool
+	err := db.DB.QueryRow(`SELECT id, customer_id, key_name, is_active FROM api_keys WHERE key_hash = $1`, keys.HashAPIKey(r.Token)).
+		Scan(&id, &customerID, &name, &wasActive)
+	if err == sql.ErrNoRows {
+		return "unknown", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	res, err := db.DB.Exec(`UPDATE api_keys SET is_active = false, leaked_at = NOW(), updated_at = NOW() WHERE id = $1 AND leaked_at IS NULL`, id)
+	if err != nil {
+		return "", err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return "already_reported", nil
+	}
+	middleware.ForgetAPIKey(id)
+	audit.Record(customerID, "system", "secret_scanning", "api_key.leaked", c.ClientIP(), map[string]any{
+		"api_key_id": id, "key_name": name, "was_active": wasActive, "url": r.URL, "source": r.Source,
+	})
+	return "revoked", nil
+}
@@ -8,6 +8,7 @@ import (
 	"github.com/gin-gonic/gin"
 	"otp/internal/config"
 	"otp/internal/db"
+	"otp/internal/usage"
 )
 
 // GetCustomerUsageSummary returns usage summary aggregated at the customer level with optional period filter (?period=24h|7d|30d|90d|all)
@@ -40,10 +41,10 @@ func GetCustomerUsageSummary(c *gin.Context) {
 		where += " AND created_at >= NOW() - INTERVAL '" + interval + "'"
 	}
 
-	var total, success, failed int64
+	var total, success, failed, rateLimited, billable int64
 	var first, last sql.NullTime
-	sumQ := "SELECT COUNT(*), COUNT(*) FILTER (WHERE success), COUNT(*) FILTER (WHERE NOT success), MIN(created_at), MAX(created_at) FROM usage_events " + where
-	if err := db.DB.QueryRow(sumQ, customerID).Scan(&total, &success, &failed, &first, &last); err != nil {
+	sumQ := "SELECT COUNT(*), COUNT(*) FILTER (WHERE success), COUNT(*) FILTER (WHERE NOT success), COUNT(*) FILTER (WHERE endpoint = '" + usage.RateLimitedEndpoint + "'), COUNT(*) FILTER (WHERE environment <> 'test' AND endpoint <> '" + usage.RateLimitedEndpoint + "'), MIN(created_at), MAX(created_at) FROM usage_events " + where
+	if err := db.DB.QueryRow(sumQ, customerID).Scan(&total, &success, &failed, &rateLimited, &billable, &first, &last); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "query error"})
 		return
 	}
@@ -84,11 +85,15 @@ func GetCustomerUsageSummary(c *gin.Context) {
 		byEp = append(byEp, e)
 	}
 
-	resp := usageSummary{Total: total, Success: success, Failed: failed, ByDay: byDay, ByEndpoint: byEp}
+	resp := usageSummary{Total: total, Success: success, Failed: failed, RateLimited: rateLimited, Billable: billable, ByDay: byDay, ByEndpoint: byEp}
 	if first.Valid { resp.FirstEvent = &first.Time }
 	if last.Valid { resp.LastEvent = &last.Time }
-	// estimated cost
+	// estimated cost; test key usage is free
 	price := config.Get().PricePerRequestUSD
-	resp.EstimatedCostUSD = float64(total) * price
+	resp.EstimatedCostUSD = float64(billable) * price
+	if resp.Quota, err = loadQuotaSummary(c); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "query error"})
+		return
+	}
 	c.JSON(http.StatusOK, resp)
 }
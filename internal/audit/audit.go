@@ -1,8 +1,11 @@
 package audit
 
 import (
+	"database/sql"
 	"encoding/json"
+	"fmt"
 	"log"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -10,52 +13,144 @@ import (
 	"otp/internal/realtime"
 )
 
-// Log writes an audit event. actor_type: api_key|customer|system
+// Entry is an audit event ready to be written, e.g. by InsertTx inside the caller's transaction.
+type Entry struct {
+	CustomerID string
+	ActorType  string
+	ActorID    string
+	Event      string
+	IP         string
+	// Environment is the data environment (live or test) the event concerns.
+	Environment string
+	Metadata    map[string]any
+}
+
+// Log writes an audit event. actor_type: api_key|member|customer|system; console requests are
+// attributed to the signed-in member.
 func Log(c *gin.Context, event string, metadata map[string]any) {
+	e := Prepare(c, event, metadata)
+	e.write()
+}
+
+// Prepare builds the entry Log would write for the request, without writing it.
+func Prepare(c *gin.Context, event string, metadata map[string]any) Entry {
 	actorType := "system"
 	actorID := ""
 	if v, ok := c.Get("api_key_id"); ok {
 		actorType = "api_key"
 		actorID, _ = v.(string)
+	} else if v, ok := c.Get("member_id"); ok {
+		actorType = "member"
+		actorID, _ = v.(string)
 	} else if v, ok := c.Get("customer_id"); ok {
 		actorType = "customer"
 		actorID, _ = v.(string)
 	}
-	ip := c.ClientIP()
-	var metaJSON []byte
-	if metadata != nil {
-		if b, err := json.Marshal(metadata); err == nil {
-			metaJSON = b
-		}
-	}
-	if metaJSON == nil {
-		metaJSON = []byte("{}")
-	}
 	// Attach customer_id if present in context
 	customerID := ""
 	if v, ok := c.Get("customer_id"); ok {
 		customerID, _ = v.(string)
 	}
+	// events about test environment data are tagged so per-user timelines can tell them apart
+	if c.GetString("environment") == "test" {
+		m := map[string]any{"environment": "test"}
+		for k, v := range metadata {
+			m[k] = v
+		}
+		metadata = m
+	}
+	return Entry{CustomerID: customerID, ActorType: actorType, ActorID: actorID, Event: event, IP: c.ClientIP(),
+		Environment: c.GetString("environment"), Metadata: metadata}
+}
+
+// Record writes an audit event outside a request (or on behalf of another customer, e.g. an
+// admin action), with the actor given explicitly.
+func Record(customerID, actorType, actorID, event, ip string, metadata map[string]any) {
+	Entry{CustomerID: customerID, ActorType: actorType, ActorID: actorID, Event: event, IP: ip, Metadata: metadata}.write()
+}
+
+func (e Entry) write() {
+	metaJSON := e.metadataJSON()
 	_, err := db.DB.Exec(
-		`INSERT INTO audit_logs (customer_id, actor_type, actor_id, event, ip, metadata)
-		 VALUES (NULLIF($1,'' )::uuid, $2, $3, $4, $5, $6::jsonb)`,
-		customerID, actorType, actorID, event, ip, string(metaJSON),
+		`INSERT INTO audit_logs (customer_id, actor_type, actor_id, event, ip, metadata, user_id, environment)
+		 VALUES (NULLIF($1,'' )::uuid, $2, $3, $4, $5, $6::jsonb, NULLIF($7,''), $8)`,
+		e.CustomerID, e.ActorType, e.ActorID, e.Event, e.IP, string(metaJSON), e.userID(), e.environment(),
 	)
 	if err != nil {
 		log.Printf("audit log insert failed: %v", err)
 	}
+	e.publish(metaJSON)
+}
+
+// InsertTx writes entries with a single multi-row insert on tx, so they commit or roll back with
+// the change they describe. Call Publish once tx has committed.
+func InsertTx(tx *sql.Tx, entries []Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	var sb strings.Builder
+	sb.WriteString(`INSERT INTO audit_logs (customer_id, actor_type, actor_id, event, ip, metadata, user_id, environment) VALUES `)
+	args := make([]any, 0, len(entries)*8)
+	for i, e := range entries {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		n := len(args)
+		fmt.Fprintf(&sb, "(NULLIF($%d,'')::uuid, $%d, $%d, $%d, $%d, $%d::jsonb, NULLIF($%d,''), $%d)", n+1, n+2, n+3, n+4, n+5, n+6, n+7, n+8)
+		args = append(args, e.CustomerID, e.ActorType, e.ActorID, e.Event, e.IP, string(e.metadataJSON()), e.userID(), e.environment())
+	}
+	_, err := tx.Exec(sb.String(), args...)
+	return err
+}
+
+// Publish sends entries written by InsertTx to the realtime stream.
+func Publish(entries []Entry) {
+	for _, e := range entries {
+		e.publish(e.metadataJSON())
+	}
+}
+
+func (e Entry) metadataJSON() []byte {
+	if e.Metadata != nil {
+		if b, err := json.Marshal(e.Metadata); err == nil {
+			return b
+		}
+	}
+	return []byte("{}")
+}
+
+// userID is the subject MFA user, indexed so per-user timelines don't scan JSON.
+func (e Entry) userID() string {
+	id, _ := e.Metadata["user_id"].(string)
+	return id
+}
+
+// environment defaults to live; Record callers mark test events with the metadata tag Log adds.
+func (e Entry) environment() string {
+	if e.Environment != "" {
+		return e.Environment
+	}
+	if env, _ := e.Metadata["environment"].(string); env == "test" {
+		return env
+	}
+	return "live"
+}
 
-	// Fire-and-forget realtime notification scoped to customer if available
-	if customerID != "" {
-		realtime.PublishDefault(customerID, realtime.Event{
-			Type:      "audit",
-			Timestamp: time.Now(),
-			Data: map[string]any{
-				"event":      event,
-				"actor_type": actorType,
-				"actor_id":   actorID,
-				"ip":         ip,
-			},
-		})
+// publish is a fire-and-forget realtime notification scoped to the customer if available.
+// Metadata is forwarded so subscribers can correlate events (e.g. MFA user metadata).
+func (e Entry) publish(metaJSON []byte) {
+	if e.CustomerID == "" {
+		return
 	}
+	realtime.PublishDefault(e.CustomerID, realtime.Event{
+		Type:      "audit",
+		Timestamp: time.Now(),
+		Data: map[string]any{
+			"event":      e.Event,
+			"actor_type": e.ActorType,
+			"actor_id":   e.ActorID,
+			"ip":         e.IP,
+			"metadata":   json.RawMessage(metaJSON),
+		},
+	})
 }
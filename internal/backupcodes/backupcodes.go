@@ -0,0 +1,237 @@
+package backupcodes
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	AlphabetNumeric      = "numeric"
+	AlphabetAlphanumeric = "alphanumeric"
+
+	numericChars = "0123456789"
+	// Crockford-style set without look-alikes (0/O, 1/I/L) so printed codes are easy to type.
+	alphanumericChars = "23456789ABCDEFGHJKMNPQRSTUVWXYZ"
+)
+
+// Policy controls how backup codes are generated for a tenant.
+type Policy struct {
+	Count     int    `json:"count"`
+	Length    int    `json:"length"`
+	Alphabet  string `json:"alphabet"`   // numeric|alphanumeric
+	GroupSize int    `json:"group_size"` // insert a dash every N characters (0 = no grouping)
+	WarnBelow int    `json:"warn_below"` // emit a low-remaining warning at or below this many codes (0 = off)
+}
+
+// DefaultPolicy matches the codes issued before policies existed: eight 8-digit codes.
+var DefaultPolicy = Policy{Count: 8, Length: 8, Alphabet: AlphabetNumeric, GroupSize: 0, WarnBelow: 2}
+
+// Validate checks the policy is within supported bounds.
+func (p Policy) Validate() error {
+	if p.Count < 1 || p.Count > 20 {
+		return errors.New("count must be between 1 and 20")
+	}
+	if p.Length < 6 || p.Length > 24 {
+		return errors.New("length must be between 6 and 24")
+	}
+	if p.Alphabet != AlphabetNumeric && p.Alphabet != AlphabetAlphanumeric {
+		return errors.New("alphabet must be numeric or alphanumeric")
+	}
+	if p.GroupSize < 0 || p.GroupSize >= p.Length {
+		return errors.New("group_size must be between 0 and length-1")
+	}
+	if p.WarnBelow < 0 || p.WarnBelow >= p.Count {
+		return errors.New("warn_below must be between 0 and count-1")
+	}
+	return nil
+}
+
+// Generate returns Count distinct random codes formatted per the policy.
+func Generate(p Policy) ([]string, error) {
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	chars := numericChars
+	if p.Alphabet == AlphabetAlphanumeric {
+		chars = alphanumericChars
+	}
+	codes := make([]string, 0, p.Count)
+	seen := make(map[string]struct{}, p.Count)
+	for len(codes) < p.Count {
+		raw, err := randomString(chars, p.Length)
+		if err != nil {
+			return nil, err
+		}
+		if _, dup := seen[raw]; dup {
+			continue
+		}
+		seen[raw] = struct{}{}
+		codes = append(codes, group(raw, p.GroupSize))
+	}
+	return codes, nil
+}
+
+// randomString draws n characters uniformly from chars using rejection sampling.
+func randomString(chars string, n int) (string, error) {
+	limit := 256 - 256%len(chars)
+	out := make([]byte, 0, n)
+	buf := make([]byte, n*2)
+	for len(out) < n {
+		if _, err := rand.Read(buf); err != nil {
+			return "", err
+		}
+		for _, b := range buf {
+			if int(b) >= limit {
+				continue
+			}
+			out = append(out, chars[int(b)%len(chars)])
+			if len(out) == n {
+				break
+			}
+		}
+	}
+	return string(out), nil
+}
+
+func group(s string, size int) string {
+	if size <= 0 {
+		return s
+	}
+	var b strings.Builder
+	for i, r := range s {
+		if i > 0 && i%size == 0 {
+			b.WriteByte('-')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// Normalize strips grouping dashes and whitespace and upper-cases a user-entered code.
+func Normalize(code string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '-', ' ', '\t':
+			return -1
+		}
+		if r >= 'a' && r <= 'z' {
+			return r - 'a' + 'A'
+		}
+		return r
+	}, code)
+}
+
+// Argon2id parameters for new hashes. Codes carry ~26+ bits of entropy each, so a slow hash keeps
+// offline guessing from a leaked database expensive. Variables so tests can lower the cost.
+var (
+	argonTime    uint32 = 2
+	argonMemory  uint32 = 19 * 1024
+	argonThreads uint8  = 1
+)
+
+const argonKeyLen = 32
+
+// HashAll hashes a freshly generated code set. The set shares one random salt, which is safe
+// because the codes themselves are random and lets Match derive a single hash per attempt.
+// A non-nil pepper (a per-customer secret) is mixed in with HMAC first, so the hashes can't
+// be brute-forced offline without it; such hashes carry ",pepper" in their parameters.
+func HashAll(codes []string, pepper []byte) ([]string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	params := fmt.Sprintf("m=%d,t=%d,p=%d", argonMemory, argonTime, argonThreads)
+	if pepper != nil {
+		params += ",pepper"
+	}
+	out := make([]string, len(codes))
+	for i, code := range codes {
+		sum := argon2.IDKey(hashInput(code, pepper), salt, argonTime, argonMemory, argonThreads, argonKeyLen)
+		out[i] = fmt.Sprintf("$argon2id$v=%d$%s$%s$%s", argon2.Version, params,
+			base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(sum))
+	}
+	return out, nil
+}
+
+func hashInput(code string, pepper []byte) []byte {
+	normalized := []byte(Normalize(code))
+	if pepper == nil {
+		return normalized
+	}
+	mac := hmac.New(sha256.New, pepper)
+	mac.Write(normalized)
+	return mac.Sum(nil)
+}
+
+type parsedHash struct {
+	prefix string // everything up to and including the salt; identical for hashes sharing params+salt
+	salt   []byte
+	sum    []byte
+	time   uint32
+	memory uint32
+	thread uint8
+	pepper bool
+}
+
+func parseHash(h string) (parsedHash, error) {
+	parts := strings.Split(h, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return parsedHash{}, errors.New("unsupported backup code hash")
+	}
+	var p parsedHash
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return parsedHash{}, errors.New("unsupported argon2 version")
+	}
+	params, peppered := strings.CutSuffix(parts[3], ",pepper")
+	p.pepper = peppered
+	if _, err := fmt.Sscanf(params, "m=%d,t=%d,p=%d", &p.memory, &p.time, &p.thread); err != nil {
+		return parsedHash{}, err
+	}
+	var err error
+	if p.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return parsedHash{}, err
+	}
+	if p.sum, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+		return parsedHash{}, err
+	}
+	p.prefix = strings.Join(parts[:5], "$")
+	return p, nil
+}
+
+// Match returns the index of the stored hash matching code, or -1. Every stored hash is compared
+// in constant time and the loop never exits early, so timing does not reveal which code matched.
+// pepper is used for hashes marked as peppered; unpeppered hashes predate per-customer keys.
+func Match(code string, hashes []string, pepper []byte) int {
+	derived := map[string][]byte{}
+	found := -1
+	for i, h := range hashes {
+		p, err := parseHash(h)
+		if err != nil {
+			continue
+		}
+		if p.pepper && pepper == nil {
+			continue
+		}
+		sum, ok := derived[p.prefix]
+		if !ok {
+			var key []byte
+			if p.pepper {
+				key = pepper
+			}
+			sum = argon2.IDKey(hashInput(code, key), p.salt, p.time, p.memory, p.thread, uint32(len(p.sum)))
+			derived[p.prefix] = sum
+		}
+		eq := subtle.ConstantTimeCompare(sum, p.sum)
+		found = subtle.ConstantTimeSelect(eq, i, found)
+	}
+	return found
+}
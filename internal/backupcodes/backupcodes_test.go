@@ -0,0 +1,129 @@
+package backupcodes
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func init() {
+	// keep hashing cheap in tests
+	argonTime, argonMemory = 1, 64
+}
+
+func TestGenerateFollowsPolicy(t *testing.T) {
+	p := Policy{Count: 10, Length: 12, Alphabet: AlphabetAlphanumeric, GroupSize: 4, WarnBelow: 2}
+	codes, err := Generate(p)
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	if len(codes) != 10 {
+		t.Fatalf("expected 10 codes, got %d", len(codes))
+	}
+	seen := map[string]bool{}
+	for _, c := range codes {
+		if len(c) != 14 || strings.Count(c, "-") != 2 {
+			t.Fatalf("unexpected format %q", c)
+		}
+		if strings.ContainsAny(Normalize(c), "01IOL") {
+			t.Fatalf("code %q contains ambiguous characters", c)
+		}
+		if seen[c] {
+			t.Fatalf("duplicate code %q", c)
+		}
+		seen[c] = true
+	}
+}
+
+func TestPolicyValidate(t *testing.T) {
+	bad := []Policy{
+		{Count: 0, Length: 8, Alphabet: AlphabetNumeric},
+		{Count: 8, Length: 4, Alphabet: AlphabetNumeric},
+		{Count: 8, Length: 8, Alphabet: "hex"},
+		{Count: 8, Length: 8, Alphabet: AlphabetNumeric, GroupSize: 8},
+		{Count: 8, Length: 8, Alphabet: AlphabetNumeric, WarnBelow: 8},
+	}
+	for _, p := range bad {
+		if p.Validate() == nil {
+			t.Errorf("expected %+v to be rejected", p)
+		}
+	}
+	if err := DefaultPolicy.Validate(); err != nil {
+		t.Fatalf("default policy invalid: %v", err)
+	}
+}
+
+func TestHashAndMatch(t *testing.T) {
+	codes, err := Generate(Policy{Count: 5, Length: 8, Alphabet: AlphabetAlphanumeric, GroupSize: 4})
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	hashes, err := HashAll(codes, nil)
+	if err != nil {
+		t.Fatalf("hash: %v", err)
+	}
+	for i, h := range hashes {
+		if strings.Contains(h, codes[i]) {
+			t.Fatalf("hash leaks code")
+		}
+	}
+	// user input without dashes and in lower case still matches
+	if got := Match(strings.ToLower(Normalize(codes[3])), hashes, nil); got != 3 {
+		t.Fatalf("expected match at 3, got %d", got)
+	}
+	if got := Match("ZZZZ-ZZZZ", hashes, nil); got != -1 {
+		t.Fatalf("expected no match, got %d", got)
+	}
+	if got := Match(codes[0], append([]string{"garbage"}, hashes...), nil); got != 1 {
+		t.Fatalf("expected match at 1 after garbage entry, got %d", got)
+	}
+}
+
+func TestPepperedHashes(t *testing.T) {
+	codes := []string{"12345678", "87654321"}
+	pepper := []byte("tenant-secret")
+	hashes, err := HashAll(codes, pepper)
+	if err != nil {
+		t.Fatalf("hash: %v", err)
+	}
+	if got := Match(codes[1], hashes, pepper); got != 1 {
+		t.Fatalf("expected match at 1, got %d", got)
+	}
+	// without the customer's pepper (e.g. after its data key is destroyed) nothing matches
+	for _, p := range [][]byte{nil, []byte("other")} {
+		if got := Match(codes[1], hashes, p); got != -1 {
+			t.Fatalf("matched with pepper %q", p)
+		}
+	}
+	// hashes from before peppering still match when a pepper is supplied
+	legacy, _ := HashAll(codes, nil)
+	if got := Match(codes[0], legacy, pepper); got != 0 {
+		t.Fatalf("expected legacy match at 0, got %d", got)
+	}
+}
+
+func TestSheetPDF(t *testing.T) {
+	s := Sheet{Issuer: "Acme (EU)", AccountName: "jo@example.com", GeneratedAt: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC), Codes: []string{"1234-5678", "8765-4321", "5555-0000"}}
+	pdf := string(s.PDF())
+	if !strings.HasPrefix(pdf, "%PDF-1.4\n") || !strings.HasSuffix(pdf, "%%EOF\n") {
+		t.Fatalf("missing PDF header or trailer")
+	}
+	for _, want := range []string{`(Acme \(EU\) backup codes)`, "jo@example.com", "2024-05-01 12:00 UTC", " 3. 5555-0000"} {
+		if !strings.Contains(pdf, want) {
+			t.Fatalf("PDF missing %q", want)
+		}
+	}
+	// every xref entry must point at the start of its object
+	xref := pdf[strings.Index(pdf, "xref\n"):]
+	for i, line := range strings.Split(xref, "\n")[3:10] {
+		off, _ := strconv.Atoi(line[:10])
+		if !strings.HasPrefix(pdf[off:], fmt.Sprintf("%d 0 obj", i+1)) {
+			t.Fatalf("xref entry %d points at wrong offset", i+1)
+		}
+	}
+	if txt := string(s.Text()); !strings.Contains(txt, " 1. 1234-5678") || !strings.Contains(txt, "Account: jo@example.com") {
+		t.Fatalf("unexpected text sheet: %s", txt)
+	}
+}
@@ -0,0 +1,116 @@
+package backupcodes
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Sheet is a printable rendering of a freshly generated backup code set.
+type Sheet struct {
+	Issuer      string
+	AccountName string
+	GeneratedAt time.Time
+	Codes       []string
+}
+
+var sheetInstructions = []string{
+	"Each code can be used once to sign in if you lose access to your authenticator app.",
+	"Keep this sheet somewhere safe and private, such as a password manager or a locked drawer.",
+	"Generating new backup codes invalidates every code on this sheet.",
+}
+
+// Text renders the sheet as plain text.
+func (s Sheet) Text() []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s backup codes\n", s.Issuer)
+	fmt.Fprintf(&b, "Account: %s\n", s.AccountName)
+	fmt.Fprintf(&b, "Generated: %s\n\n", s.GeneratedAt.UTC().Format("2006-01-02 15:04 MST"))
+	for i, code := range s.Codes {
+		fmt.Fprintf(&b, "%2d. %s\n", i+1, code)
+	}
+	b.WriteString("\n")
+	for _, line := range sheetInstructions {
+		fmt.Fprintf(&b, "- %s\n", line)
+	}
+	return b.Bytes()
+}
+
+// PDF renders the sheet as a single-page PDF using the standard Helvetica and Courier fonts,
+// which every reader provides, so no font data needs embedding.
+func (s Sheet) PDF() []byte {
+	var content bytes.Buffer
+	text := func(font string, size, x, y int, str string) {
+		fmt.Fprintf(&content, "BT /%s %d Tf %d %d Td (%s) Tj ET\n", font, size, x, y, pdfEscape(str))
+	}
+	y := 780
+	text("F2", 20, 56, y, s.Issuer+" backup codes")
+	y -= 28
+	text("F1", 12, 56, y, "Account: "+s.AccountName)
+	y -= 18
+	text("F1", 12, 56, y, "Generated: "+s.GeneratedAt.UTC().Format("2006-01-02 15:04 MST"))
+	y -= 40
+	// two columns of codes
+	rows := (len(s.Codes) + 1) / 2
+	for i, code := range s.Codes {
+		x := 76
+		row := i
+		if i >= rows {
+			x = 316
+			row = i - rows
+		}
+		text("F3", 16, x, y-row*28, fmt.Sprintf("%2d. %s", i+1, code))
+	}
+	y -= rows*28 + 24
+	for _, line := range sheetInstructions {
+		text("F1", 10, 56, y, line)
+		y -= 16
+	}
+
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		"<< /Type /Page /Parent 2 0 R /MediaBox [0 0 595 842] /Resources << /Font << /F1 4 0 R /F2 5 0 R /F3 6 0 R >> >> /Contents 7 0 R >>",
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>",
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>",
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Courier-Bold /Encoding /WinAnsiEncoding >>",
+		fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", content.Len(), content.String()),
+	}
+	var out bytes.Buffer
+	out.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, obj := range objects {
+		offsets[i] = out.Len()
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", i+1, obj)
+	}
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return out.Bytes()
+}
+
+// pdfEscape escapes a literal string for a PDF content stream. Characters outside Latin-1 have
+// no glyph in the standard fonts and are replaced.
+func pdfEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r < 0x20:
+			b.WriteByte(' ')
+		case r < 0x80:
+			b.WriteRune(r)
+		case r <= 0xff:
+			fmt.Fprintf(&b, "\\%03o", r)
+		default:
+			b.WriteByte('?')
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,137 @@
+package backupcodes
+
+import (
+	"database/sql"
+	"log"
+
+	"github.com/lib/pq"
+	"otp/internal/crypto"
+	"otp/internal/db"
+)
+
+// PepperPurpose names the per-customer secret (crypto.TenantSecret) backup code hashes are
+// peppered with.
+const PepperPurpose = "backup-codes"
+
+// PolicyFor returns the customer's backup code policy, or DefaultPolicy when none is configured.
+func PolicyFor(customerID string) (Policy, error) {
+	p := DefaultPolicy
+	err := db.DB.QueryRow(`SELECT code_count, code_length, alphabet, group_size, warn_below FROM backup_code_policies WHERE customer_id = $1`, customerID).
+		Scan(&p.Count, &p.Length, &p.Alphabet, &p.GroupSize, &p.WarnBelow)
+	if err == sql.ErrNoRows {
+		return DefaultPolicy, nil
+	}
+	if err != nil {
+		return Policy{}, err
+	}
+	return p, nil
+}
+
+// SavePolicy stores a validated policy for the customer.
+func SavePolicy(customerID string, p Policy) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	_, err := db.DB.Exec(`INSERT INTO backup_code_policies (customer_id, code_count, code_length, alphabet, group_size, warn_below, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, NOW())
+		ON CONFLICT (customer_id) DO UPDATE SET code_count = EXCLUDED.code_count, code_length = EXCLUDED.code_length,
+		alphabet = EXCLUDED.alphabet, group_size = EXCLUDED.group_size, warn_below = EXCLUDED.warn_below, updated_at = NOW()`,
+		customerID, p.Count, p.Length, p.Alphabet, p.GroupSize, p.WarnBelow)
+	return err
+}
+
+// UpgradeUser converts one user's legacy encrypted backup codes into hashes. It is a no-op when
+// the user has no legacy codes left, so it is safe to call on every consume.
+func UpgradeUser(customerID, env, userID string) error {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var enc []sql.NullString
+	var usedLegacy int
+	err = tx.QueryRow(`SELECT COALESCE(backup_codes_encrypted, '{}'), COALESCE(cardinality(used_backup_codes_encrypted), 0)
+		FROM mfa_users WHERE customer_id = $1 AND environment = $2 AND user_id = $3 FOR UPDATE`, customerID, env, userID).Scan(pq.Array(&enc), &usedLegacy)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(enc) == 0 && usedLegacy == 0 {
+		return nil
+	}
+	codes := make([]string, 0, len(enc))
+	for _, ns := range enc {
+		if !ns.Valid {
+			continue
+		}
+		code, err := crypto.DecryptFor(crypto.Binding{CustomerID: customerID, UserID: userID, Field: crypto.FieldBackupCode, Environment: env}, ns.String)
+		if err != nil {
+			return err
+		}
+		codes = append(codes, code)
+	}
+	pepper, err := crypto.TenantSecret(customerID, PepperPurpose)
+	if err != nil {
+		return err
+	}
+	hashes, err := HashAll(codes, pepper)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`UPDATE mfa_users SET backup_code_hashes = backup_code_hashes || $1::text[], backup_codes_used = backup_codes_used + $2,
+		backup_codes_encrypted = '{}', used_backup_codes_encrypted = '{}' WHERE customer_id = $3 AND environment = $4 AND user_id = $5`,
+		pq.Array(hashes), usedLegacy, customerID, env, userID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// PurgeExpired deletes printable sheets past their expiry. Sheets hold the plaintext codes,
+// reversibly encrypted, so unfetched ones must not outlive their window.
+func PurgeExpired() (int64, error) {
+	res, err := db.DB.Exec(`DELETE FROM backup_code_sheets WHERE expires_at < NOW()`)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// UpgradeLegacy hashes all remaining legacy encrypted backup codes. It is meant to run in the
+// background at startup; ConsumeBackupCode upgrades rows it touches first on its own.
+func UpgradeLegacy() {
+	type row struct{ customerID, env, userID string }
+	upgraded := 0
+	for {
+		rows, err := db.DB.Query(`SELECT customer_id, environment, user_id FROM mfa_users
+			WHERE cardinality(backup_codes_encrypted) > 0 OR cardinality(used_backup_codes_encrypted) > 0 LIMIT 100`)
+		if err != nil {
+			log.Printf("backup code upgrade: query failed: %v", err)
+			return
+		}
+		batch := []row{}
+		for rows.Next() {
+			var r row
+			if err := rows.Scan(&r.customerID, &r.env, &r.userID); err == nil {
+				batch = append(batch, r)
+			}
+		}
+		rows.Close()
+		if len(batch) == 0 {
+			break
+		}
+		for _, r := range batch {
+			if err := UpgradeUser(r.customerID, r.env, r.userID); err != nil {
+				log.Printf("backup code upgrade: user %s/%s failed: %v", r.customerID, r.userID, err)
+				return
+			}
+			upgraded++
+		}
+	}
+	if upgraded > 0 {
+		log.Printf("backup code upgrade: hashed legacy codes for %d users", upgraded)
+	}
+}
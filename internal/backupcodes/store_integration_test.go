@@ -0,0 +1,52 @@
+package backupcodes
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"otp/internal/config"
+	"otp/internal/db"
+)
+
+func TestPurgeExpiredSheets(t *testing.T) {
+	cfg := config.Load()
+	if v := os.Getenv("TEST_DATABASE_URL"); v != "" {
+		cfg.DatabaseURL = v
+	}
+	if err := db.Init(cfg.DatabaseURL); err != nil {
+		t.Skipf("skipping integration test; DB unavailable: %v (set TEST_DATABASE_URL)", err)
+	}
+	var customerID string
+	email := "sheet-purge-" + time.Now().Format("150405.000000") + "@example.com"
+	if err := db.DB.QueryRow(`INSERT INTO customers (company_name, email, password_hash) VALUES ('sheet-purge', $1, '-') RETURNING id`, email).Scan(&customerID); err != nil {
+		t.Fatalf("insert customer: %v", err)
+	}
+	for _, user := range []string{"expired", "fresh"} {
+		if _, err := db.DB.Exec(`INSERT INTO mfa_users (customer_id, user_id, secret_key_encrypted) VALUES ($1, $2, 'x')`, customerID, user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.DB.Exec(`INSERT INTO backup_code_sheets (customer_id, user_id, codes_encrypted, expires_at)
+		VALUES ($1, 'expired', 'x', NOW() - INTERVAL '1 minute'), ($1, 'fresh', 'x', NOW() + INTERVAL '10 minutes')`, customerID); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := PurgeExpired(); err != nil {
+		t.Fatal(err)
+	}
+	var left []string
+	rows, err := db.DB.Query(`SELECT user_id FROM backup_code_sheets WHERE customer_id = $1`, customerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var u string
+		rows.Scan(&u)
+		left = append(left, u)
+	}
+	if len(left) != 1 || left[0] != "fresh" {
+		t.Fatalf("sheets left after purge: %v", left)
+	}
+}
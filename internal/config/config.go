@@ -1,52 +1,274 @@
 package config
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"os"
 	"strconv"
 	"strings"
+
+	"otp/internal/crypto"
 )
 
+// devEncryptionKey is the key used when none is configured. It is public, so production
+// refuses to start with it.
+const devEncryptionKey = "myverysecretkey32characterslong!"
+
 type Config struct {
+	// Environment ("development" or "production"); production refuses unsafe defaults
+	Environment   string
 	DatabaseURL   string
 	EncryptionKey string
-	Port          string
-	BootstrapToken string
-	Issuer        string
+	// Additional key versions ("2:<key>,3:<key>") and the version used for new ciphertexts (0 = highest)
+	EncryptionKeys       string
+	EncryptionKeyVersion int
+	// Envelope encryption: where key-encryption keys live (env|file|vault) and data key caching
+	KeyProvider       string
+	KeystorePath      string
+	VaultAddr         string
+	VaultToken        string
+	VaultTransitMount string
+	VaultTransitKey   string
+	// Give every customer its own transit key, deleted when the customer is erased
+	VaultTenantKeys bool
+	// Directory of per-customer keys for the env and file providers, deleted at erasure
+	TenantKeyDir       string
+	DEKCacheTTLSeconds int
+	DEKCacheSize       int
+	Port               string
+	BootstrapToken     string
+	Issuer             string
 	// Security / networking
 	CORSAllowedOrigins []string
 	TrustedProxies     []string
-	// Rate limiting (per minute)
-	RateLimitPerIP      int
-	RateLimitPerAPIKey  int
+	// Rate limiting (per minute, and per hour for API keys). API key limits are ceilings: a
+	// key can only lower them, and RateLimitTiers replaces them for customers on a tier.
+	RateLimitPerIP         int
+	RateLimitPerAPIKey     int
+	RateLimitPerAPIKeyHour int
+	RateLimitTiers         map[string]KeyRateLimit
+	// How requests are counted (fixed_window, sliding_window or token_bucket) and, for the
+	// token bucket, how many can be sent at once (0 means a full window's limit)
+	RateLimitAlgorithm string
+	RateLimitBurst     int
+	// Where rate-limit counters live: memory (per instance), postgres or redis (shared)
+	RateLimitStore         string
+	RateLimitMemoryMaxKeys int
+	RateLimitRedisURL      string
+	RateLimitRedisPoolSize int
+	// Subscription tiers: a JSON file replacing the built-in catalog (empty keeps it), and the
+	// share of a monthly quota after which responses carry a warning
+	TierCatalogFile       string
+	QuotaSoftLimitPercent int
 	// Billing/Stripe
 	StripeAPIKey        string
 	StripeWebhookSecret string
 	// Pricing
-	PricePerRequestUSD  float64
+	PricePerRequestUSD float64
+	// MFA lockout: consecutive failed validations before a user is locked (0 disables)
+	MFALockoutThreshold int
+	MFALockoutMinutes   int
+	// Minutes a freshly generated printable backup code sheet stays retrievable (0 disables sheets)
+	BackupCodeSheetTTLMinutes int
+	// API key lifecycle: how long a rotated key keeps working, how early expiring keys are
+	// flagged, and how often expired keys are deactivated
+	APIKeyRotationGraceMinutes int
+	APIKeyExpiryWarningDays    int
+	APIKeySweepIntervalSeconds int
+	// How far a signed request's timestamp may drift from server time; nonces are kept this long
+	RequestSignatureMaxSkewSeconds int
+	// In-process cache of authenticated API keys (0 disables it)
+	APIKeyCacheTTLSeconds int
+	APIKeyCacheSize       int
+	// Usage events and key counters are written in batches this often, or once this many
+	// events are buffered (an interval of 0 writes each one through)
+	UsageFlushIntervalMs int
+	UsageFlushBatchSize  int
+	// Lifetime of client tokens that let a publishable key act for one MFA user
+	ClientTokenTTLSeconds int
+	// Lifetime of the interim token a console login returns when a second factor is due
+	ConsoleMFATokenTTLSeconds int
+	// Shared token secret-scanning partners send with leaked key reports (empty disables reports)
+	SecretScanningToken string
+
+	// problems found while loading, reported by Validate
+	errs []error
 }
 
 var cfg *Config
 
 // Load reads environment variables and stores a global config.
 func Load() *Config {
+	var errs []error
+	secret := func(key, def string) string {
+		v, err := getenvSecret(key, def)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		return v
+	}
 	c := &Config{
-		DatabaseURL:    getenv("DATABASE_URL", "host=localhost port=5432 user=postgres password=postgres dbname=mfa_mvp sslmode=disable"),
-		EncryptionKey:  getenv("ENCRYPTION_KEY", "myverysecretkey32characterslong!"),
-		Port:           getenv("PORT", "8080"),
-		BootstrapToken: getenv("BOOTSTRAP_TOKEN", ""),
-		Issuer:         getenv("ISSUER", "SecureAuth MVP"),
-		CORSAllowedOrigins: splitAndTrim(getenv("CORS_ALLOWED_ORIGINS", "http://localhost:3000,http://localhost:8080")),
-		TrustedProxies:     splitAndTrim(getenv("TRUSTED_PROXIES", "")),
-		RateLimitPerIP:     getenvInt("RATE_LIMIT_PER_IP", 120),
-		RateLimitPerAPIKey: getenvInt("RATE_LIMIT_PER_API_KEY", 600),
-		StripeAPIKey:        getenv("STRIPE_API_KEY", ""),
-		StripeWebhookSecret: getenv("STRIPE_WEBHOOK_SECRET", ""),
-		PricePerRequestUSD:  getenvFloat("PRICE_PER_REQUEST_USD", 0.00001),
+		Environment:                    strings.ToLower(getenv("APP_ENV", "development")),
+		DatabaseURL:                    secret("DATABASE_URL", "host=localhost port=5432 user=postgres password=postgres dbname=mfa_mvp sslmode=disable"),
+		EncryptionKey:                  secret("ENCRYPTION_KEY", ""),
+		EncryptionKeys:                 secret("ENCRYPTION_KEYS", ""),
+		EncryptionKeyVersion:           getenvInt("ENCRYPTION_KEY_VERSION", 0),
+		KeyProvider:                    strings.ToLower(getenv("KEY_PROVIDER", "env")),
+		KeystorePath:                   getenv("KEYSTORE_PATH", ""),
+		VaultAddr:                      getenv("VAULT_ADDR", ""),
+		VaultToken:                     secret("VAULT_TOKEN", ""),
+		VaultTransitMount:              getenv("VAULT_TRANSIT_MOUNT", "transit"),
+		VaultTransitKey:                getenv("VAULT_TRANSIT_KEY", "otp"),
+		VaultTenantKeys:                getenv("VAULT_TENANT_KEYS", "true") == "true",
+		TenantKeyDir:                   getenv("TENANT_KEY_DIR", ""),
+		DEKCacheTTLSeconds:             getenvInt("DEK_CACHE_TTL_SECONDS", 300),
+		DEKCacheSize:                   getenvInt("DEK_CACHE_SIZE", 1024),
+		Port:                           getenv("PORT", "8080"),
+		BootstrapToken:                 secret("BOOTSTRAP_TOKEN", ""),
+		Issuer:                         getenv("ISSUER", "SecureAuth MVP"),
+		CORSAllowedOrigins:             splitAndTrim(getenv("CORS_ALLOWED_ORIGINS", "http://localhost:3000,http://localhost:8080")),
+		TrustedProxies:                 splitAndTrim(getenv("TRUSTED_PROXIES", "")),
+		RateLimitPerIP:                 getenvInt("RATE_LIMIT_PER_IP", 120),
+		RateLimitPerAPIKey:             getenvInt("RATE_LIMIT_PER_API_KEY", 600),
+		RateLimitPerAPIKeyHour:         getenvInt("RATE_LIMIT_PER_API_KEY_HOUR", 10000),
+		RateLimitAlgorithm:             strings.ToLower(getenv("RATE_LIMIT_ALGORITHM", "sliding_window")),
+		RateLimitBurst:                 getenvInt("RATE_LIMIT_BURST", 0),
+		RateLimitStore:                 strings.ToLower(getenv("RATE_LIMIT_STORE", "memory")),
+		RateLimitMemoryMaxKeys:         getenvInt("RATE_LIMIT_MEMORY_MAX_KEYS", 100000),
+		RateLimitRedisURL:              secret("RATE_LIMIT_REDIS_URL", ""),
+		RateLimitRedisPoolSize:         getenvInt("RATE_LIMIT_REDIS_POOL_SIZE", 32),
+		TierCatalogFile:                getenv("TIER_CATALOG_FILE", ""),
+		QuotaSoftLimitPercent:          getenvInt("QUOTA_SOFT_LIMIT_PERCENT", 80),
+		StripeAPIKey:                   secret("STRIPE_API_KEY", ""),
+		StripeWebhookSecret:            secret("STRIPE_WEBHOOK_SECRET", ""),
+		PricePerRequestUSD:             getenvFloat("PRICE_PER_REQUEST_USD", 0.00001),
+		MFALockoutThreshold:            getenvInt("MFA_LOCKOUT_THRESHOLD", 0),
+		MFALockoutMinutes:              getenvInt("MFA_LOCKOUT_MINUTES", 15),
+		BackupCodeSheetTTLMinutes:      getenvInt("BACKUP_CODE_SHEET_TTL_MINUTES", 15),
+		APIKeyRotationGraceMinutes:     getenvInt("API_KEY_ROTATION_GRACE_MINUTES", 1440),
+		APIKeyExpiryWarningDays:        getenvInt("API_KEY_EXPIRY_WARNING_DAYS", 7),
+		APIKeySweepIntervalSeconds:     getenvInt("API_KEY_SWEEP_INTERVAL_SECONDS", 60),
+		RequestSignatureMaxSkewSeconds: getenvInt("REQUEST_SIGNATURE_MAX_SKEW_SECONDS", 300),
+		SecretScanningToken:            secret("SECRET_SCANNING_TOKEN", ""),
+		ClientTokenTTLSeconds:          getenvInt("CLIENT_TOKEN_TTL_SECONDS", 600),
+		ConsoleMFATokenTTLSeconds:      getenvInt("CONSOLE_MFA_TOKEN_TTL_SECONDS", 300),
+		APIKeyCacheTTLSeconds:          getenvInt("API_KEY_CACHE_TTL_SECONDS", 30),
+		APIKeyCacheSize:                getenvInt("API_KEY_CACHE_SIZE", 10000),
+		UsageFlushIntervalMs:           getenvInt("USAGE_FLUSH_INTERVAL_MS", 1000),
+		UsageFlushBatchSize:            getenvInt("USAGE_FLUSH_BATCH_SIZE", 500),
+	}
+	tiers, err := parseRateLimitTiers(getenv("RATE_LIMIT_TIERS", ""))
+	if err != nil {
+		errs = append(errs, err)
+	}
+	c.RateLimitTiers = tiers
+	c.errs = errs
+	// The development default only applies to the env provider when no key versions are
+	// configured at all, so version 1 can be retired by unsetting ENCRYPTION_KEY.
+	if c.KeyProvider == "env" && c.EncryptionKey == "" && c.EncryptionKeys == "" {
+		c.EncryptionKey = devEncryptionKey
 	}
 	cfg = c
 	return c
 }
 
+// KeyRateLimit is a pair of API key request limits. 0 means unlimited.
+type KeyRateLimit struct {
+	PerMinute int
+	PerHour   int
+}
+
+// KeyRateLimits returns the API key limits for a subscription tier: the tier's entry in
+// RATE_LIMIT_TIERS, or RATE_LIMIT_PER_API_KEY and RATE_LIMIT_PER_API_KEY_HOUR.
+func (c *Config) KeyRateLimits(tier string) KeyRateLimit {
+	if l, ok := c.RateLimitTiers[tier]; ok {
+		return l
+	}
+	return KeyRateLimit{PerMinute: c.RateLimitPerAPIKey, PerHour: c.RateLimitPerAPIKeyHour}
+}
+
+// parseRateLimitTiers parses "starter=600/10000,pro=3000/100000" (tier=per minute/per hour).
+func parseRateLimitTiers(s string) (map[string]KeyRateLimit, error) {
+	out := map[string]KeyRateLimit{}
+	for _, entry := range splitAndTrim(s) {
+		tier, limits, ok := strings.Cut(entry, "=")
+		perMin, perHour, ok2 := strings.Cut(limits, "/")
+		m, err1 := strconv.Atoi(strings.TrimSpace(perMin))
+		h, err2 := strconv.Atoi(strings.TrimSpace(perHour))
+		if !ok || !ok2 || err1 != nil || err2 != nil || m < 0 || h < 0 || strings.TrimSpace(tier) == "" {
+			return out, fmt.Errorf("RATE_LIMIT_TIERS entries must look like <tier>=<per minute>/<per hour>, got %q", entry)
+		}
+		out[strings.TrimSpace(tier)] = KeyRateLimit{PerMinute: m, PerHour: h}
+	}
+	return out, nil
+}
+
+// IsProduction reports whether APP_ENV is production.
+func (c *Config) IsProduction() bool { return c.Environment == "production" }
+
+// UsesDevEncryptionKey reports whether the public development key is configured, either as
+// the default or explicitly. Keys are decoded like the keyring does, so the development key
+// given in another form (e.g. hex: or base64:) is caught too.
+func (c *Config) UsesDevEncryptionKey() bool {
+	isDev := func(k string) bool {
+		// passphrases need the stored salts; they can't derive to the raw development key anyway
+		b, err := crypto.ParseKey(k, 0, nil)
+		return err == nil && bytes.Equal(b, []byte(devEncryptionKey))
+	}
+	if c.EncryptionKey != "" && isDev(c.EncryptionKey) {
+		return true
+	}
+	for _, entry := range strings.Split(c.EncryptionKeys, ",") {
+		if _, k, ok := strings.Cut(strings.TrimSpace(entry), ":"); ok && isDev(k) {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate reports configuration that must stop startup: unreadable *_FILE secrets and, in
+// production, the development encryption key.
+func (c *Config) Validate() error {
+	errs := append([]error{}, c.errs...)
+	if c.Environment != "development" && c.Environment != "production" {
+		errs = append(errs, fmt.Errorf("APP_ENV must be development or production, got %q", c.Environment))
+	}
+	if c.IsProduction() && c.UsesDevEncryptionKey() {
+		errs = append(errs, errors.New("refusing to start in production with the development ENCRYPTION_KEY; configure ENCRYPTION_KEY or ENCRYPTION_KEYS"))
+	}
+	if c.RequestSignatureMaxSkewSeconds < 1 {
+		errs = append(errs, errors.New("REQUEST_SIGNATURE_MAX_SKEW_SECONDS must be at least 1"))
+	}
+	if c.ClientTokenTTLSeconds < 1 {
+		errs = append(errs, errors.New("CLIENT_TOKEN_TTL_SECONDS must be at least 1"))
+	}
+	if c.ConsoleMFATokenTTLSeconds < 1 {
+		errs = append(errs, errors.New("CONSOLE_MFA_TOKEN_TTL_SECONDS must be at least 1"))
+	}
+	switch c.RateLimitAlgorithm {
+	case "fixed_window", "sliding_window", "token_bucket":
+	default:
+		errs = append(errs, fmt.Errorf("RATE_LIMIT_ALGORITHM must be fixed_window, sliding_window or token_bucket, got %q", c.RateLimitAlgorithm))
+	}
+	switch c.RateLimitStore {
+	case "memory", "postgres":
+	case "redis":
+		if c.RateLimitRedisURL == "" {
+			errs = append(errs, errors.New("RATE_LIMIT_STORE=redis requires RATE_LIMIT_REDIS_URL"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("RATE_LIMIT_STORE must be memory, postgres or redis, got %q", c.RateLimitStore))
+	}
+	if c.QuotaSoftLimitPercent < 1 || c.QuotaSoftLimitPercent > 100 {
+		errs = append(errs, errors.New("QUOTA_SOFT_LIMIT_PERCENT must be between 1 and 100"))
+	}
+	if c.UsageFlushBatchSize < 1 {
+		errs = append(errs, errors.New("USAGE_FLUSH_BATCH_SIZE must be at least 1"))
+	}
+	return errors.Join(errs...)
+}
+
 func Get() *Config { return cfg }
 
 func getenv(key, def string) string {
@@ -56,6 +278,24 @@ func getenv(key, def string) string {
 	return def
 }
 
+// getenvSecret reads a secret from key, or from the file named by key_FILE (e.g. a mounted
+// Docker or Kubernetes secret). A trailing newline in the file is ignored. Setting both is an
+// error.
+func getenvSecret(key, def string) (string, error) {
+	path := os.Getenv(key + "_FILE")
+	if path == "" {
+		return getenv(key, def), nil
+	}
+	if os.Getenv(key) != "" {
+		return def, fmt.Errorf("set only one of %s and %s_FILE", key, key)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return def, fmt.Errorf("%s_FILE: %w", key, err)
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
 func getenvInt(key string, def int) int {
 	if v := os.Getenv(key); v != "" {
 		if n, err := strconv.Atoi(v); err == nil {
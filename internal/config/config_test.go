@@ -0,0 +1,32 @@
+package config
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"testing"
+)
+
+func TestUsesDevEncryptionKey(t *testing.T) {
+	devHex := hex.EncodeToString([]byte(devEncryptionKey))
+	devBase64 := base64.StdEncoding.EncodeToString([]byte(devEncryptionKey))
+	own := "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	for _, tc := range []struct {
+		key, keys string
+		want      bool
+	}{
+		{devEncryptionKey, "", true},
+		{"hex:" + devHex, "", true},
+		{devHex, "", true},
+		{"base64:" + devBase64, "", true},
+		{own, "2:base64:" + devBase64, true},
+		{own, "2: hex:" + devHex, false}, // the keyring rejects the space too
+		{"", "2:" + own + ",3:" + devEncryptionKey, true},
+		{own, "2:hex:" + own + ",3:passphrase:a long enough passphrase", false},
+		{"", "", false},
+	} {
+		c := &Config{EncryptionKey: tc.key, EncryptionKeys: tc.keys}
+		if got := c.UsesDevEncryptionKey(); got != tc.want {
+			t.Errorf("ENCRYPTION_KEY=%q ENCRYPTION_KEYS=%q: got %v, want %v", tc.key, tc.keys, got, tc.want)
+		}
+	}
+}
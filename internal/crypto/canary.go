@@ -0,0 +1,43 @@
+package crypto
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+)
+
+// NewCanary wraps a random data key under the current KEK. Stored once, it lets later runs
+// check that they were started with a key that can read existing data (VerifyCanary).
+func NewCanary() (string, error) {
+	dek := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, dek); err != nil {
+		return "", err
+	}
+	p, _ := currentProvider()
+	ctx, cancel := context.WithTimeout(context.Background(), providerTimeout)
+	defer cancel()
+	return p.Wrap(ctx, dek)
+}
+
+// VerifyCanary unwraps a canary written by NewCanary, bypassing the data key cache. If an
+// older KEK wrapped it, it is re-wrapped under the current one so the older KEK can be
+// retired; the new value is returned with changed set.
+func VerifyCanary(wrapped string) (string, bool, error) {
+	p, _ := currentProvider()
+	ctx, cancel := context.WithTimeout(context.Background(), providerTimeout)
+	defer cancel()
+	dek, err := p.Unwrap(ctx, wrapped)
+	if err != nil {
+		return "", false, err
+	}
+	if len(dek) != 32 {
+		return "", false, errors.New("canary data key has the wrong length")
+	}
+	stale, err := p.NeedsRewrap(ctx, wrapped)
+	if err != nil || !stale {
+		return wrapped, false, err
+	}
+	out, err := p.Wrap(ctx, dek)
+	return out, err == nil, err
+}
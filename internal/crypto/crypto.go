@@ -1,61 +1,193 @@
 package crypto
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/rand"
 	"encoding/base64"
 	"errors"
-	"io"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 )
 
-var key []byte
+// Keyring of AES-256 keys by version. Keyring ciphertexts are written as "v<N>:<base64>";
+// values without a prefix predate versioning and were written with version 1 (ENCRYPTION_KEY).
+// New data is envelope-encrypted (see envelope.go) and the keyring only wraps data keys when
+// KeyringProvider is in use.
+var (
+	mu     sync.RWMutex
+	keys   = map[int][]byte{}
+	active int
+)
 
-// SetKey configures the AES-256 key (must be 32 bytes)
+// SetKey configures k (in any ParseKey form except passphrase) as the only, active, version 1
+// key.
 func SetKey(k string) error {
-	if len(k) != 32 {
-		return errors.New("ENCRYPTION_KEY must be exactly 32 characters for AES-256")
+	key, err := ParseKey(k, 1, nil)
+	if err != nil {
+		return fmt.Errorf("ENCRYPTION_KEY %w", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	keys = map[int][]byte{1: key}
+	active = 1
+	return nil
+}
+
+// AddKey registers an additional 32-byte key version without changing the active one.
+func AddKey(version int, key []byte) error {
+	if version < 1 {
+		return errors.New("key version must be >= 1")
+	}
+	if len(key) != 32 {
+		return fmt.Errorf("key version %d must be 32 bytes for AES-256", version)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	keys[version] = key
+	return nil
+}
+
+// SetActiveVersion selects the key new ciphertexts are written with.
+func SetActiveVersion(version int) error {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := keys[version]; !ok {
+		return fmt.Errorf("no key configured for version %d", version)
 	}
-	key = []byte(k)
+	active = version
 	return nil
 }
 
-func Encrypt(plaintext string) (string, error) {
-	block, err := aes.NewCipher(key)
+// ActiveVersion returns the key version new ciphertexts are written with.
+func ActiveVersion() int {
+	mu.RLock()
+	defer mu.RUnlock()
+	return active
+}
+
+// Versions lists the configured key versions in ascending order.
+func Versions() []int {
+	mu.RLock()
+	defer mu.RUnlock()
+	out := make([]int, 0, len(keys))
+	for v := range keys {
+		out = append(out, v)
+	}
+	sort.Ints(out)
+	return out
+}
+
+// LoadKeyring configures the keyring from ENCRYPTION_KEY (version 1), ENCRYPTION_KEYS
+// ("2:<key>,3:<key>") and the active version (0 selects the highest configured version).
+// Keys may take any ParseKey form; salts is only consulted for passphrases. legacyKey may be
+// empty once version 1 has been retired.
+func LoadKeyring(legacyKey, spec string, activeVersion int, salts SaltSource) error {
+	mu.Lock()
+	keys = map[int][]byte{}
+	active = 0
+	mu.Unlock()
+	if legacyKey != "" {
+		key, err := ParseKey(legacyKey, 1, salts)
+		if err != nil {
+			return fmt.Errorf("ENCRYPTION_KEY %w", err)
+		}
+		if err := AddKey(1, key); err != nil {
+			return err
+		}
+	}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		v, k, ok := strings.Cut(entry, ":")
+		version, err := strconv.Atoi(strings.TrimSpace(v))
+		if !ok || err != nil {
+			return errors.New("ENCRYPTION_KEYS entries must look like <version>:<key>")
+		}
+		key, err := ParseKey(k, version, salts)
+		if err != nil {
+			return fmt.Errorf("ENCRYPTION_KEYS version %d %w", version, err)
+		}
+		if err := AddKey(version, key); err != nil {
+			return err
+		}
+	}
+	vs := Versions()
+	if len(vs) == 0 {
+		return errors.New("no encryption key configured")
+	}
+	if activeVersion == 0 {
+		activeVersion = vs[len(vs)-1]
+	}
+	return SetActiveVersion(activeVersion)
+}
+
+// Version reports the keyring version a direct (non-envelope) ciphertext was written with.
+func Version(ciphertext string) int {
+	v, _, err := splitVersion(ciphertext)
 	if err != nil {
-		return "", err
+		return 0
+	}
+	return v
+}
+
+func splitVersion(ciphertext string) (int, string, error) {
+	if !strings.HasPrefix(ciphertext, "v") {
+		return 1, ciphertext, nil
+	}
+	// ':' is not in the base64 alphabet, so a prefix can't be confused with legacy data
+	v, body, ok := strings.Cut(ciphertext[1:], ":")
+	if !ok {
+		return 1, ciphertext, nil
 	}
-	gcm, err := cipher.NewGCM(block)
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		return 0, "", errors.New("malformed key version prefix")
+	}
+	return n, body, nil
+}
+
+func keyFor(version int) ([]byte, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+	k, ok := keys[version]
+	if !ok {
+		return nil, fmt.Errorf("no key configured for version %d", version)
+	}
+	return k, nil
+}
+
+// EncryptVersion encrypts directly with a keyring key version, without a data key. It is
+// used by KeyringProvider to wrap data keys.
+func EncryptVersion(version int, plaintext string) (string, error) {
+	k, err := keyFor(version)
 	if err != nil {
 		return "", err
 	}
-	nonce := make([]byte, gcm.NonceSize())
-	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+	ct, err := sealWith(k, []byte(plaintext))
+	if err != nil {
 		return "", err
 	}
-	ciphertext := gcm.Seal(nonce, nonce, []byte(plaintext), nil)
-	return base64.StdEncoding.EncodeToString(ciphertext), nil
+	return "v" + strconv.Itoa(version) + ":" + base64.StdEncoding.EncodeToString(ct), nil
 }
 
-func Decrypt(ciphertext string) (string, error) {
-	data, err := base64.StdEncoding.DecodeString(ciphertext)
+// decryptDirect decrypts a keyring ciphertext with whichever key version it names.
+func decryptDirect(ciphertext string) (string, error) {
+	version, body, err := splitVersion(ciphertext)
 	if err != nil {
 		return "", err
 	}
-	block, err := aes.NewCipher(key)
+	data, err := base64.StdEncoding.DecodeString(body)
 	if err != nil {
 		return "", err
 	}
-	gcm, err := cipher.NewGCM(block)
+	k, err := keyFor(version)
 	if err != nil {
 		return "", err
 	}
-	ns := gcm.NonceSize()
-	if len(data) < ns {
-		return "", errors.New("ciphertext too short")
-	}
-	nonce, cipherData := data[:ns], data[ns:]
-	pt, err := gcm.Open(nil, nonce, cipherData, nil)
+	pt, err := openWith(k, data)
 	if err != nil {
 		return "", err
 	}
@@ -0,0 +1,506 @@
+package crypto
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	key1 = "11111111111111111111111111111111"
+	key2 = "22222222222222222222222222222222"
+)
+
+var bind = Binding{CustomerID: "c1", UserID: "u1", Field: FieldMFASecret}
+
+// memKeys is an in-memory TenantKeyStore. A key set to "" has been destroyed.
+type memKeys map[string][2]string
+
+func (m memKeys) Get(customerID string) (string, string, error) {
+	k, ok := m[customerID]
+	if !ok {
+		return "", "", ErrNoTenantKey
+	}
+	if k[1] == "" {
+		return "", "", ErrTenantKeyDestroyed
+	}
+	return k[0], k[1], nil
+}
+
+func (m memKeys) Create(customerID, keyID, wrapped string) (string, string, error) {
+	if _, ok := m[customerID]; !ok {
+		m[customerID] = [2]string{keyID, wrapped}
+	}
+	return m.Get(customerID)
+}
+
+// rewrapKeys re-wraps every stored customer key, like the rekey job does.
+func rewrapKeys(t *testing.T, m memKeys) {
+	t.Helper()
+	for id, k := range m {
+		out, changed, err := RewrapTenantKey(id, k[1])
+		if err != nil || !changed {
+			t.Fatalf("rewrap key %s: %v, %v", id, changed, err)
+		}
+		m[id] = [2]string{k[0], out}
+	}
+}
+
+func TestKeyringRotation(t *testing.T) {
+	keys := memKeys{}
+	SetTenantKeyStore(keys)
+	SetProvider(KeyringProvider{}, time.Minute, 16)
+	if err := LoadKeyring(key1, "", 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	direct, err := EncryptVersion(1, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// ciphertexts written before versioning carry no prefix and belong to version 1
+	legacy := strings.TrimPrefix(direct, "v1:")
+	ct, err := EncryptFor(bind, "secret")
+	if err != nil || !strings.HasPrefix(ct, "t1.") || !strings.HasPrefix(keys["c1"][1], "v1:") {
+		t.Fatalf("encrypt: %q, %v", ct, err)
+	}
+
+	if err := LoadKeyring(key1, "2:"+key2, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	if ActiveVersion() != 2 {
+		t.Fatalf("expected active version 2, got %d", ActiveVersion())
+	}
+	if pt, err := DecryptFor(bind, ct); err != nil || pt != "secret" {
+		t.Fatalf("decrypt: %q, %v", pt, err)
+	}
+	// older formats are re-sealed with the customer key; current ciphertexts are left alone
+	for _, old := range []string{direct, legacy} {
+		out, changed, err := Rewrap(bind, old)
+		if err != nil || !changed || !strings.HasPrefix(out, "t1.") {
+			t.Fatalf("rewrap %q: %q, %v, %v", old, out, changed, err)
+		}
+	}
+	if _, changed, _ := Rewrap(bind, ct); changed {
+		t.Fatal("rewrapping a current ciphertext should be a no-op")
+	}
+	rewrapKeys(t, keys)
+	if !strings.HasPrefix(keys["c1"][1], "v2:") {
+		t.Fatalf("expected key wrapped by version 2, got %q", keys["c1"][1])
+	}
+
+	// with version 1 retired, the re-wrapped customer key still opens the ciphertext
+	SetProvider(KeyringProvider{}, time.Minute, 16)
+	SetTenantKeyStore(keys)
+	if err := LoadKeyring("", "2:"+key2, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	if pt, err := DecryptFor(bind, ct); err != nil || pt != "secret" {
+		t.Fatalf("decrypt after retiring v1: %q, %v", pt, err)
+	}
+	if _, err := decryptUnbound(direct); err == nil {
+		t.Fatal("expected retired key version to fail")
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	raw := []byte(key1)
+	salt := []byte("0123456789abcdef")
+	salts := func(int) ([]byte, error) { return salt, nil }
+	for _, k := range []string{
+		key1,
+		hex.EncodeToString(raw),
+		"hex:" + hex.EncodeToString(raw),
+		base64.StdEncoding.EncodeToString(raw),
+		"base64:" + base64.RawURLEncoding.EncodeToString(raw),
+	} {
+		got, err := ParseKey(k, 1, nil)
+		if err != nil || string(got) != key1 {
+			t.Fatalf("parse %q: %v", k, err)
+		}
+	}
+	a, err := ParseKey("passphrase:correct horse battery staple", 2, salts)
+	if err != nil || len(a) != 32 {
+		t.Fatalf("passphrase: %v", err)
+	}
+	salt = []byte("fedcba9876543210")
+	if b, _ := ParseKey("passphrase:correct horse battery staple", 2, salts); string(a) == string(b) {
+		t.Fatal("expected the salt to change the derived key")
+	}
+	for _, k := range []string{"short", "hex:abcd", "passphrase:too short", strings.Repeat("z", 64)} {
+		if _, err := ParseKey(k, 1, salts); err == nil {
+			t.Fatalf("expected %q to be rejected", k)
+		} else if strings.Contains(err.Error(), k) {
+			t.Fatalf("error leaks the key: %v", err)
+		}
+	}
+}
+
+func TestBindings(t *testing.T) {
+	SetTenantKeyStore(memKeys{})
+	SetProvider(KeyringProvider{}, time.Minute, 16)
+	if err := LoadKeyring(key1, "", 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	ct, err := EncryptFor(bind, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// copying the ciphertext to another user, customer or column must not decrypt
+	for _, other := range []Binding{
+		{CustomerID: "c1", UserID: "u2", Field: FieldMFASecret},
+		{CustomerID: "c2", UserID: "u1", Field: FieldMFASecret},
+		{CustomerID: "c1", UserID: "u1", Field: FieldBackupCodeSheet},
+		{CustomerID: "c1u", UserID: "1", Field: FieldMFASecret},
+		{CustomerID: "c1", UserID: "u1", Field: FieldMFASecret, Environment: "test"},
+	} {
+		if _, err := DecryptFor(other, ct); err == nil {
+			t.Fatalf("ciphertext decrypted under %+v", other)
+		}
+	}
+	// live is the default environment
+	if pt, err := DecryptFor(Binding{CustomerID: "c1", UserID: "u1", Field: FieldMFASecret, Environment: "live"}, ct); err != nil || pt != "secret" {
+		t.Fatalf("decrypt with explicit live environment: %q, %v", pt, err)
+	}
+	renamed := Binding{CustomerID: "c1", UserID: "u9", Field: FieldMFASecret}
+	moved, err := Rebind(bind, renamed, ct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pt, err := DecryptFor(renamed, moved); err != nil || pt != "secret" {
+		t.Fatalf("decrypt rebound: %q, %v", pt, err)
+	}
+	if _, err := DecryptFor(bind, moved); err == nil {
+		t.Fatal("rebound ciphertext still decrypts under the old binding")
+	}
+	// unbound ciphertexts are only readable through Rewrap
+	direct, _ := EncryptVersion(1, "secret")
+	if _, err := DecryptFor(bind, direct); err != ErrUnbound {
+		t.Fatalf("expected ErrUnbound, got %v", err)
+	}
+}
+
+func TestErasure(t *testing.T) {
+	keys := memKeys{}
+	SetTenantKeyStore(keys)
+	SetProvider(KeyringProvider{}, time.Minute, 16)
+	if err := LoadKeyring(key1, "", 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	ct, err := EncryptFor(bind, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := Binding{CustomerID: "c2", UserID: "u1", Field: FieldMFASecret}
+	otherCT, err := EncryptFor(other, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys["c1"][0] == keys["c2"][0] {
+		t.Fatal("customers share a data key")
+	}
+
+	keys["c1"] = [2]string{keys["c1"][0], ""}
+	ForgetTenantKey("c1")
+	if _, err := DecryptFor(bind, ct); err != ErrTenantKeyDestroyed {
+		t.Fatalf("expected ErrTenantKeyDestroyed, got %v", err)
+	}
+	if _, err := EncryptFor(bind, "secret"); err != ErrTenantKeyDestroyed {
+		t.Fatalf("expected no new key after erasure, got %v", err)
+	}
+	if _, err := TenantSecret("c1", "backup-codes"); err == nil {
+		t.Fatal("expected tenant secret to be gone")
+	}
+	if pt, err := DecryptFor(other, otherCT); err != nil || pt != "secret" {
+		t.Fatalf("other customer: %q, %v", pt, err)
+	}
+}
+
+func TestFileProvider(t *testing.T) {
+	k := func(b byte) string { return base64.StdEncoding.EncodeToString([]byte(strings.Repeat(string(b), 32))) }
+	path := filepath.Join(t.TempDir(), "keystore.json")
+	write := func(active string) {
+		b, _ := json.Marshal(map[string]any{"active": active, "keys": map[string]string{"k1": k('a'), "k2": k('b')}})
+		if err := os.WriteFile(path, b, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("k1")
+	p, err := NewFileProvider(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := memKeys{}
+	SetTenantKeyStore(keys)
+	SetProvider(p, time.Minute, 16)
+	ct, err := EncryptFor(bind, "secret")
+	if err != nil || !strings.HasPrefix(keys["c1"][1], "k1:") {
+		t.Fatalf("encrypt: %q, %v", ct, err)
+	}
+
+	write("k2")
+	p2, err := NewFileProvider(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetProvider(p2, time.Minute, 16)
+	rewrapKeys(t, keys)
+	if !strings.HasPrefix(keys["c1"][1], "k2:") {
+		t.Fatalf("rewrap: %q", keys["c1"][1])
+	}
+	SetTenantKeyStore(keys)
+	if pt, err := DecryptFor(bind, ct); err != nil || pt != "secret" {
+		t.Fatalf("decrypt: %q, %v", pt, err)
+	}
+}
+
+// vaultStub is a minimal stand-in for Vault's transit engine. "Encryption" is base64 with the
+// key version prepended, which is enough to exercise the HTTP contract.
+func vaultStub(t *testing.T, latest *int, decrypts *int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "test-token" {
+			w.WriteHeader(http.StatusForbidden)
+			_ = json.NewEncoder(w).Encode(map[string]any{"errors": []string{"permission denied"}})
+			return
+		}
+		var body map[string]string
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		var data map[string]any
+		switch r.URL.Path {
+		case "/v1/transit/encrypt/otp":
+			data = map[string]any{"ciphertext": "vault:v" + string(rune('0'+*latest)) + ":" + body["plaintext"]}
+		case "/v1/transit/decrypt/otp":
+			*decrypts++
+			parts := strings.SplitN(body["ciphertext"], ":", 3)
+			data = map[string]any{"plaintext": parts[2]}
+		case "/v1/transit/keys/otp":
+			data = map[string]any{"latest_version": *latest}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"data": data})
+	}))
+}
+
+func TestVaultTransitProvider(t *testing.T) {
+	latest, decrypts := 1, 0
+	srv := vaultStub(t, &latest, &decrypts)
+	defer srv.Close()
+
+	keys := memKeys{}
+	SetTenantKeyStore(keys)
+	SetProvider(NewVaultTransitProvider(srv.URL, "test-token", "", "otp"), time.Minute, 16)
+	ct, err := EncryptFor(bind, "secret")
+	if err != nil || !strings.HasPrefix(keys["c1"][1], "vault:v1:") {
+		t.Fatalf("encrypt: %q, %v", ct, err)
+	}
+
+	// fresh caches force an unwrap; the second decrypt is served from the cache
+	SetProvider(NewVaultTransitProvider(srv.URL, "test-token", "", "otp"), time.Minute, 16)
+	SetTenantKeyStore(keys)
+	for i := 0; i < 2; i++ {
+		if pt, err := DecryptFor(bind, ct); err != nil || pt != "secret" {
+			t.Fatalf("decrypt: %q, %v", pt, err)
+		}
+	}
+	if decrypts != 1 {
+		t.Fatalf("expected 1 vault decrypt, got %d", decrypts)
+	}
+
+	latest = 2
+	SetProvider(NewVaultTransitProvider(srv.URL, "test-token", "", "otp"), 0, 0)
+	rewrapKeys(t, keys)
+	if !strings.HasPrefix(keys["c1"][1], "vault:v2:") {
+		t.Fatalf("rewrap: %q", keys["c1"][1])
+	}
+
+	SetProvider(NewVaultTransitProvider(srv.URL, "wrong", "", "otp"), 0, 0)
+	SetTenantKeyStore(keys)
+	if _, err := DecryptFor(bind, ct); err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Fatalf("expected vault error, got %v", err)
+	}
+}
+
+// vaultTenantStub is a transit engine holding named keys, created on first encrypt (as Vault
+// does) and deletable once deletion_allowed is set.
+func vaultTenantStub(t *testing.T) (*httptest.Server, map[string]bool) {
+	keys := map[string]bool{} // name -> deletion allowed
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		op, name, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/v1/transit/"), "/")
+		name, sub, _ := strings.Cut(name, "/")
+		allowed, exists := keys[name]
+		var data map[string]any
+		switch {
+		case op == "encrypt":
+			if !exists {
+				keys[name] = false
+			}
+			data = map[string]any{"ciphertext": "vault:v1:" + body["plaintext"].(string)}
+		case op == "decrypt" && exists:
+			data = map[string]any{"plaintext": strings.SplitN(body["ciphertext"].(string), ":", 3)[2]}
+		case op == "keys" && exists && r.Method == http.MethodGet:
+			data = map[string]any{"latest_version": 1}
+		case op == "keys" && exists && sub == "config":
+			keys[name] = body["deletion_allowed"] == true
+		case op == "keys" && exists && r.Method == http.MethodDelete && allowed:
+			delete(keys, name)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"data": data})
+	}))
+	return srv, keys
+}
+
+func TestVaultTenantKeys(t *testing.T) {
+	srv, vaultKeys := vaultTenantStub(t)
+	defer srv.Close()
+	keys := memKeys{}
+
+	// c2's data key predates per-customer keys and is wrapped with the shared transit key
+	SetTenantKeyStore(keys)
+	SetProvider(NewVaultTransitProvider(srv.URL, "test-token", "", "otp"), 0, 0)
+	bind2 := Binding{CustomerID: "c2", UserID: "u1", Field: FieldMFASecret}
+	ct2, err := EncryptFor(bind2, "secret2")
+	if err != nil || !strings.HasPrefix(keys["c2"][1], "vault:v1:") {
+		t.Fatalf("encrypt c2: %q, %v", keys["c2"][1], err)
+	}
+
+	SetProvider(NewVaultTenantProvider(srv.URL, "test-token", "", "otp"), 0, 0)
+	SetTenantKeyStore(keys)
+	ct, err := EncryptFor(bind, "secret")
+	if err != nil || !strings.HasPrefix(keys["c1"][1], "tk:vault:v1:") {
+		t.Fatalf("encrypt: %q, %v", keys["c1"][1], err)
+	}
+	if _, ok := vaultKeys["otp-tenant-c1"]; !ok {
+		t.Fatalf("expected a transit key for c1, got %v", vaultKeys)
+	}
+
+	// re-encryption moves c2 onto its own key and leaves c1 alone
+	for id, k := range keys {
+		out, changed, err := RewrapTenantKey(id, k[1])
+		if err != nil || changed != (id == "c2") {
+			t.Fatalf("rewrap %s: %v, %v", id, changed, err)
+		}
+		keys[id] = [2]string{k[0], out}
+	}
+	SetTenantKeyStore(keys)
+	if pt, err := DecryptFor(bind2, ct2); err != nil || pt != "secret2" || !strings.HasPrefix(keys["c2"][1], "tk:") {
+		t.Fatalf("decrypt c2 after rewrap: %q, %v (%q)", pt, err, keys["c2"][1])
+	}
+
+	// erasure deletes c1's transit key: a backup still holding the wrapped key is useless
+	backup := memKeys{"c1": keys["c1"]}
+	for i := 0; i < 2; i++ {
+		if err := DestroyTenantKey("c1", keys["c1"][1]); err != nil {
+			t.Fatalf("destroy (attempt %d): %v", i+1, err)
+		}
+	}
+	if _, ok := vaultKeys["otp-tenant-c1"]; ok {
+		t.Fatal("expected c1's transit key to be deleted")
+	}
+	SetProvider(NewVaultTenantProvider(srv.URL, "test-token", "", "otp"), 0, 0)
+	SetTenantKeyStore(backup)
+	if _, err := DecryptFor(bind, ct); err == nil {
+		t.Fatal("expected decrypting from a backup to fail after erasure")
+	}
+	// shared-KEK keys have no per-customer key to destroy, so they aren't erased
+	if err := DestroyTenantKey("c3", "vault:v1:abc"); !errors.Is(err, ErrTenantKeyShared) {
+		t.Fatalf("destroy shared-KEK key: %v", err)
+	}
+}
+
+func TestDirTenantKeys(t *testing.T) {
+	if err := LoadKeyring(key1, "", 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	keys := memKeys{}
+	SetTenantKeyStore(keys)
+	SetProvider(KeyringProvider{}, 0, 0)
+	bind2 := Binding{CustomerID: "c2", UserID: "u1", Field: FieldMFASecret}
+	ct2, err := EncryptFor(bind2, "secret2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	p, err := NewDirTenantProvider(KeyringProvider{}, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetProvider(p, 0, 0)
+	SetTenantKeyStore(keys)
+	ct, err := EncryptFor(bind, "secret")
+	if err != nil || !strings.HasPrefix(keys["c1"][1], "tk:") {
+		t.Fatalf("encrypt: %q, %v", keys["c1"][1], err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "c1.key")); err != nil {
+		t.Fatalf("expected a key file for c1: %v", err)
+	}
+
+	// rotating the KEK rewraps c1's key file and moves c2 onto a key of its own
+	if err := LoadKeyring(key1, "2:"+key2, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	rewrapKeys(t, keys)
+	// retire version 1
+	if err := LoadKeyring("", "2:"+key2, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	SetTenantKeyStore(keys)
+	if pt, err := DecryptFor(bind, ct); err != nil || pt != "secret" {
+		t.Fatalf("decrypt c1 after rotation: %q, %v", pt, err)
+	}
+	if pt, err := DecryptFor(bind2, ct2); err != nil || pt != "secret2" || !strings.HasPrefix(keys["c2"][1], "tk:") {
+		t.Fatalf("decrypt c2 after rewrap: %q, %v (%q)", pt, err, keys["c2"][1])
+	}
+
+	// erasure deletes c1's key file: a backup still holding the wrapped key is useless
+	backup := memKeys{"c1": keys["c1"]}
+	for i := 0; i < 2; i++ {
+		if err := DestroyTenantKey("c1", keys["c1"][1]); err != nil {
+			t.Fatalf("destroy (attempt %d): %v", i+1, err)
+		}
+	}
+	SetProvider(p, 0, 0)
+	SetTenantKeyStore(backup)
+	if _, err := DecryptFor(bind, ct); err == nil {
+		t.Fatal("expected decrypting from a backup to fail after erasure")
+	}
+	if _, err := p.WrapFor(context.Background(), "../c1", []byte("k")); err == nil {
+		t.Fatal("expected a customer id naming another path to be refused")
+	}
+}
+
+func TestKeyCacheBounds(t *testing.T) {
+	c := newKeyCache(time.Minute, 2)
+	c.put("a", []byte("a"))
+	c.put("b", []byte("b"))
+	c.put("c", []byte("c"))
+	if len(c.entries) != 2 {
+		t.Fatalf("expected cache bounded to 2 entries, got %d", len(c.entries))
+	}
+	if _, ok := c.get("a"); ok {
+		t.Fatal("expected the oldest entry to be evicted")
+	}
+	c = newKeyCache(time.Nanosecond, 2)
+	c.put("a", []byte("a"))
+	time.Sleep(time.Millisecond)
+	if _, ok := c.get("a"); ok {
+		t.Fatal("expected entry to expire")
+	}
+}
@@ -0,0 +1,251 @@
+package crypto
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Ciphertext formats, newest first:
+//
+//   - "t1.<key id>.<payload>": sealed with the customer's data key (see tenant.go) and the
+//     record's Binding as associated data. This is what EncryptFor writes.
+//   - "e2.<wrapped data key>.<payload>": a per-record data key wrapped by the KEK provider,
+//     with the Binding as associated data. Still readable; re-sealed at startup.
+//   - "e1.<wrapped data key>.<payload>", "v<N>:<payload>" or bare base64: written before
+//     bindings existed. Only Rewrap reads them, to re-seal them.
+//
+// Payloads are base64 nonce||AES-256-GCM ciphertext. Because of the Binding, a ciphertext
+// copied to another row, customer or column fails to decrypt.
+const (
+	boundPrefix     = "e2."
+	unboundPrefix   = "e1."
+	providerTimeout = 10 * time.Second // bounds a single wrap/unwrap round trip to a remote KMS
+)
+
+// Well-known encrypted fields, named after the columns that hold them.
+const (
+	FieldMFASecret       = "mfa_users.secret_key_encrypted"
+	FieldBackupCode      = "mfa_users.backup_codes_encrypted"
+	FieldUsedBackupCode  = "mfa_users.used_backup_codes_encrypted"
+	FieldBackupCodeSheet = "backup_code_sheets.codes_encrypted"
+	FieldSigningSecret   = "api_keys.signing_secret_encrypted" // UserID holds the API key id
+)
+
+// Binding identifies where a ciphertext lives. It is authenticated (not encrypted) alongside
+// the payload.
+type Binding struct {
+	CustomerID string
+	UserID     string
+	Field      string
+	// Environment of the row ("" or "live" for live data), so a test user's ciphertext can't be
+	// moved to the live user with the same id
+	Environment string
+}
+
+func (b Binding) aad() []byte {
+	// length-prefixed so no two distinct bindings encode the same
+	aad := fmt.Sprintf("otp-aad-v1|%d:%s|%d:%s|%d:%s", len(b.CustomerID), b.CustomerID, len(b.UserID), b.UserID, len(b.Field), b.Field)
+	if b.Environment != "" && b.Environment != "live" {
+		// live bindings keep the original encoding, so existing ciphertexts still open
+		aad += fmt.Sprintf("|%d:%s", len(b.Environment), b.Environment)
+	}
+	return []byte(aad)
+}
+
+// ErrUnbound is returned by DecryptFor for ciphertexts written before bindings existed.
+var ErrUnbound = errors.New("ciphertext is not bound to its row")
+
+var (
+	providerMu sync.RWMutex
+	provider   KeyProvider = KeyringProvider{}
+	dekCache               = newKeyCache(5*time.Minute, 1024)
+)
+
+// SetProvider selects the KEK provider and the cache bounds for unwrapped data keys.
+// A ttl or size of 0 disables caching.
+func SetProvider(p KeyProvider, ttl time.Duration, size int) {
+	providerMu.Lock()
+	defer providerMu.Unlock()
+	provider = p
+	dekCache = newKeyCache(ttl, size)
+}
+
+func currentProvider() (KeyProvider, *keyCache) {
+	providerMu.RLock()
+	defer providerMu.RUnlock()
+	return provider, dekCache
+}
+
+// EncryptFor encrypts plaintext with the binding's customer data key, bound to b.
+func EncryptFor(b Binding, plaintext string) (string, error) {
+	return sealTenant(b, plaintext)
+}
+
+// DecryptFor decrypts a ciphertext written by EncryptFor with the same binding.
+func DecryptFor(b Binding, ciphertext string) (string, error) {
+	switch {
+	case strings.HasPrefix(ciphertext, tenantPrefix):
+		return openTenant(b, ciphertext)
+	case strings.HasPrefix(ciphertext, boundPrefix):
+		_, dek, data, err := openEnvelope(ciphertext)
+		if err != nil {
+			return "", err
+		}
+		pt, err := openAAD(dek, data, b.aad())
+		if err != nil {
+			return "", err
+		}
+		return string(pt), nil
+	}
+	return "", ErrUnbound
+}
+
+func openEnvelope(ciphertext string) (string, []byte, []byte, error) {
+	rest := ciphertext[len(boundPrefix):] // both envelope prefixes have the same length
+	wrapped, body, ok := strings.Cut(rest, ".")
+	if !ok || wrapped == "" {
+		return "", nil, nil, errors.New("malformed envelope ciphertext")
+	}
+	data, err := base64.StdEncoding.DecodeString(body)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	dek, err := unwrap(wrapped)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	return wrapped, dek, data, nil
+}
+
+// decryptUnbound reads ciphertexts written before bindings existed.
+func decryptUnbound(ciphertext string) (string, error) {
+	if !strings.HasPrefix(ciphertext, unboundPrefix) {
+		return decryptDirect(ciphertext)
+	}
+	_, dek, data, err := openEnvelope(ciphertext)
+	if err != nil {
+		return "", err
+	}
+	pt, err := openWith(dek, data)
+	if err != nil {
+		return "", err
+	}
+	return string(pt), nil
+}
+
+// IsCurrent reports whether a ciphertext is in the format EncryptFor writes.
+func IsCurrent(ciphertext string) bool {
+	return strings.HasPrefix(ciphertext, tenantPrefix)
+}
+
+// Rewrap re-seals a ciphertext in an older format with the customer's data key, bound to b.
+// It reports whether anything changed. Current ciphertexts are left alone: rotating the KEK
+// only requires re-wrapping customer data keys (RewrapTenantKey).
+func Rewrap(b Binding, ciphertext string) (string, bool, error) {
+	if IsCurrent(ciphertext) {
+		return ciphertext, false, nil
+	}
+	var pt string
+	var err error
+	if strings.HasPrefix(ciphertext, boundPrefix) {
+		pt, err = DecryptFor(b, ciphertext)
+	} else {
+		pt, err = decryptUnbound(ciphertext)
+	}
+	if err != nil {
+		return "", false, err
+	}
+	out, err := EncryptFor(b, pt)
+	return out, err == nil, err
+}
+
+// Rebind moves a ciphertext to a new binding (e.g. after an MFA user is renamed).
+func Rebind(from, to Binding, ciphertext string) (string, error) {
+	pt, err := DecryptFor(from, ciphertext)
+	if err != nil {
+		return "", err
+	}
+	return EncryptFor(to, pt)
+}
+
+func unwrap(wrapped string) ([]byte, error) {
+	p, cache := currentProvider()
+	if dek, ok := cache.get(wrapped); ok {
+		return dek, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), providerTimeout)
+	defer cancel()
+	dek, err := p.Unwrap(ctx, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	if len(dek) != 32 {
+		return nil, errors.New("unwrapped data key has the wrong length")
+	}
+	cache.put(wrapped, dek)
+	return dek, nil
+}
+
+// keyCache holds unwrapped data keys for a bounded time and count, so hot records (e.g. a
+// user validating OTPs) don't hit the KMS on every request.
+type keyCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	size    int
+	entries map[string]cachedKey
+}
+
+type cachedKey struct {
+	dek     []byte
+	expires time.Time
+}
+
+func newKeyCache(ttl time.Duration, size int) *keyCache {
+	return &keyCache{ttl: ttl, size: size, entries: map[string]cachedKey{}}
+}
+
+func (c *keyCache) get(wrapped string) ([]byte, bool) {
+	if c.ttl <= 0 || c.size <= 0 {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[wrapped]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(e.expires) {
+		delete(c.entries, wrapped)
+		return nil, false
+	}
+	return e.dek, true
+}
+
+func (c *keyCache) put(wrapped string, dek []byte) {
+	if c.ttl <= 0 || c.size <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if _, ok := c.entries[wrapped]; !ok && len(c.entries) >= c.size {
+		// drop expired entries, then the one closest to expiry if still full
+		oldest := ""
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			} else if oldest == "" || e.expires.Before(c.entries[oldest].expires) {
+				oldest = k
+			}
+		}
+		if len(c.entries) >= c.size {
+			delete(c.entries, oldest)
+		}
+	}
+	c.entries[wrapped] = cachedKey{dek: dek, expires: now.Add(c.ttl)}
+}
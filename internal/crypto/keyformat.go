@@ -0,0 +1,89 @@
+package crypto
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Argon2id parameters for passphrase-derived keys. Changing them changes every derived key,
+// so they are fixed; the salt is stored per key version (see SaltSource).
+const (
+	passphraseTime    = 3
+	passphraseMemory  = 64 * 1024
+	passphraseThreads = 4
+	minPassphraseLen  = 16
+)
+
+// SaltSource returns the stored salt for a key version, creating it on first use.
+type SaltSource func(version int) ([]byte, error)
+
+var errKeyFormat = errors.New("must be 32 bytes given as hex (64 digits), base64 or 32 characters, or passphrase:<text>")
+
+// ParseKey decodes a configured key into AES-256 key material. Accepted forms:
+//
+//	hex:<64 hex digits>
+//	base64:<base64 of 32 bytes>
+//	passphrase:<at least 16 characters>   (Argon2id with the version's stored salt)
+//	<64 hex digits>, <base64 of 32 bytes> or <32 characters>
+//
+// The bare 32-character form is what ENCRYPTION_KEY always accepted; its bytes are used as is.
+// Errors never include the key.
+func ParseKey(k string, version int, salts SaltSource) ([]byte, error) {
+	kind, body, ok := strings.Cut(k, ":")
+	if ok {
+		switch kind {
+		case "hex":
+			return decodeHexKey(body)
+		case "base64":
+			return decodeBase64Key(body)
+		case "passphrase":
+			return derivePassphraseKey(body, version, salts)
+		}
+	}
+	switch {
+	case len(k) == 32:
+		return []byte(k), nil
+	case len(k) == 64:
+		return decodeHexKey(k)
+	}
+	return decodeBase64Key(k)
+}
+
+func decodeHexKey(s string) ([]byte, error) {
+	b, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(b) != 32 {
+		return nil, errKeyFormat
+	}
+	return b, nil
+}
+
+func decodeBase64Key(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.URLEncoding, base64.RawStdEncoding, base64.RawURLEncoding} {
+		if b, err := enc.DecodeString(s); err == nil && len(b) == 32 {
+			return b, nil
+		}
+	}
+	return nil, errKeyFormat
+}
+
+func derivePassphraseKey(passphrase string, version int, salts SaltSource) ([]byte, error) {
+	if len(passphrase) < minPassphraseLen {
+		return nil, errors.New("passphrase must be at least 16 characters")
+	}
+	if salts == nil {
+		return nil, errors.New("passphrase keys need a salt store")
+	}
+	salt, err := salts(version)
+	if err != nil {
+		return nil, err
+	}
+	if len(salt) < 16 {
+		return nil, errors.New("stored key salt is too short")
+	}
+	return argon2.IDKey([]byte(passphrase), salt, passphraseTime, passphraseMemory, passphraseThreads, 32), nil
+}
@@ -0,0 +1,158 @@
+package crypto
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// KeyProvider wraps and unwraps data keys with a key-encryption key (KEK) that the provider
+// holds. Wrapped keys must not contain '.', which separates envelope fields.
+type KeyProvider interface {
+	// Wrap encrypts a data key under the provider's current KEK.
+	Wrap(ctx context.Context, dek []byte) (string, error)
+	// Unwrap recovers a data key produced by Wrap with any KEK the provider still has.
+	Unwrap(ctx context.Context, wrapped string) ([]byte, error)
+	// NeedsRewrap reports whether wrapped was produced by a KEK other than the current one.
+	NeedsRewrap(ctx context.Context, wrapped string) (bool, error)
+}
+
+// KeyringProvider uses the versioned ENCRYPTION_KEY/ENCRYPTION_KEYS keyring as KEKs.
+type KeyringProvider struct{}
+
+func (KeyringProvider) Wrap(_ context.Context, dek []byte) (string, error) {
+	return EncryptVersion(ActiveVersion(), base64.StdEncoding.EncodeToString(dek))
+}
+
+func (KeyringProvider) Unwrap(_ context.Context, wrapped string) ([]byte, error) {
+	s, err := decryptDirect(wrapped)
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(s)
+}
+
+func (KeyringProvider) NeedsRewrap(_ context.Context, wrapped string) (bool, error) {
+	return Version(wrapped) != ActiveVersion(), nil
+}
+
+// FileProvider keeps KEKs in a local JSON keystore:
+//
+//	{"active": "k2", "keys": {"k1": "<base64 32 bytes>", "k2": "<base64 32 bytes>"}}
+//
+// Wrapped keys look like "k2:<base64>".
+type FileProvider struct {
+	active string
+	keys   map[string][]byte
+}
+
+var keyIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// NewFileProvider loads a keystore file.
+func NewFileProvider(path string) (*FileProvider, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var ks struct {
+		Active string            `json:"active"`
+		Keys   map[string]string `json:"keys"`
+	}
+	if err := json.Unmarshal(raw, &ks); err != nil {
+		return nil, fmt.Errorf("parse keystore: %w", err)
+	}
+	p := &FileProvider{active: ks.Active, keys: map[string][]byte{}}
+	for id, enc := range ks.Keys {
+		if !keyIDPattern.MatchString(id) {
+			return nil, fmt.Errorf("keystore key id %q must match %s", id, keyIDPattern)
+		}
+		k, err := base64.StdEncoding.DecodeString(enc)
+		if err != nil || len(k) != 32 {
+			return nil, fmt.Errorf("keystore key %q must be 32 base64-encoded bytes", id)
+		}
+		p.keys[id] = k
+	}
+	if _, ok := p.keys[p.active]; !ok {
+		return nil, fmt.Errorf("keystore active key %q not found", p.active)
+	}
+	return p, nil
+}
+
+func (p *FileProvider) Wrap(_ context.Context, dek []byte) (string, error) {
+	ct, err := sealWith(p.keys[p.active], dek)
+	if err != nil {
+		return "", err
+	}
+	return p.active + ":" + base64.StdEncoding.EncodeToString(ct), nil
+}
+
+func (p *FileProvider) Unwrap(_ context.Context, wrapped string) ([]byte, error) {
+	id, body, ok := strings.Cut(wrapped, ":")
+	if !ok {
+		return nil, errors.New("malformed wrapped key")
+	}
+	k, ok := p.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("keystore has no key %q", id)
+	}
+	ct, err := base64.StdEncoding.DecodeString(body)
+	if err != nil {
+		return nil, err
+	}
+	return openWith(k, ct)
+}
+
+func (p *FileProvider) NeedsRewrap(_ context.Context, wrapped string) (bool, error) {
+	id, _, _ := strings.Cut(wrapped, ":")
+	return id != p.active, nil
+}
+
+// sealWith encrypts with AES-256-GCM, returning nonce||ciphertext.
+func sealWith(key, plaintext []byte) ([]byte, error) {
+	return sealAAD(key, plaintext, nil)
+}
+
+func openWith(key, data []byte) ([]byte, error) {
+	return openAAD(key, data, nil)
+}
+
+func sealAAD(key, plaintext, aad []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+func openAAD(key, data, aad []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	ns := gcm.NonceSize()
+	if len(data) < ns {
+		return nil, errors.New("ciphertext too short")
+	}
+	return gcm.Open(nil, data[:ns], data[ns:], aad)
+}
@@ -0,0 +1,297 @@
+package crypto
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tenant ciphertexts are "t1.<key id>.<base64 nonce||ciphertext>", sealed with the customer's
+// data key and the record's Binding as associated data. Each customer's data key is stored
+// wrapped by the KEK provider; destroying it makes every ciphertext of that customer (and
+// every backup code hash peppered with it) unrecoverable.
+const tenantPrefix = "t1."
+
+// tenantWrapPrefix marks stored data keys wrapped with the customer's own key of a
+// TenantKeyProvider rather than the shared KEK.
+const tenantWrapPrefix = "tk:"
+
+// TenantKeyProvider is a KeyProvider that also holds a wrapping key per customer outside the
+// database (see VaultTenantProvider and DirTenantProvider). Customer data keys are wrapped with
+// it, so destroying it makes the data key unrecoverable even from database backups that still
+// hold the wrapped key.
+type TenantKeyProvider interface {
+	KeyProvider
+	WrapFor(ctx context.Context, customerID string, dek []byte) (string, error)
+	UnwrapFor(ctx context.Context, customerID, wrapped string) ([]byte, error)
+	NeedsRewrapFor(ctx context.Context, customerID, wrapped string) (bool, error)
+	// DestroyTenantKey deletes the customer's key; it is idempotent.
+	DestroyTenantKey(ctx context.Context, customerID string) error
+}
+
+var (
+	ErrNoTenantKey        = errors.New("customer has no data key")
+	ErrTenantKeyDestroyed = errors.New("customer data key has been destroyed")
+	// ErrTenantKeyShared refuses to destroy a data key wrapped with the shared KEK: database
+	// backups would still hold a copy that KEK unwraps.
+	ErrTenantKeyShared = errors.New("customer data key is wrapped with the shared KEK")
+)
+
+// TenantKeyStore persists wrapped customer data keys.
+type TenantKeyStore interface {
+	// Get returns the customer's key id and wrapped key, ErrNoTenantKey if none was created
+	// yet, or ErrTenantKeyDestroyed after erasure.
+	Get(customerID string) (keyID, wrapped string, err error)
+	// Create stores a new wrapped key unless one already exists, and returns whichever key is
+	// stored (so concurrent first writes converge on one key).
+	Create(customerID, keyID, wrapped string) (string, string, error)
+}
+
+type tenantKey struct {
+	id      string
+	key     []byte
+	expires time.Time
+}
+
+var (
+	tenantMu    sync.Mutex
+	tenantStore TenantKeyStore
+	tenantCache = map[string]tenantKey{}
+)
+
+// SetTenantKeyStore installs the store for customer data keys. Until one is set, EncryptFor
+// fails for every binding, so it must be configured at startup.
+func SetTenantKeyStore(s TenantKeyStore) {
+	tenantMu.Lock()
+	defer tenantMu.Unlock()
+	tenantStore = s
+	tenantCache = map[string]tenantKey{}
+}
+
+// ForgetTenantKey drops a customer's cached data key, e.g. right after it was destroyed.
+// Other instances drop it when their cache entry expires (DEK_CACHE_TTL_SECONDS).
+func ForgetTenantKey(customerID string) {
+	tenantMu.Lock()
+	defer tenantMu.Unlock()
+	delete(tenantCache, customerID)
+}
+
+// KeyFingerprint identifies a wrapped key in erasure proofs without revealing it.
+func KeyFingerprint(wrapped string) string {
+	sum := sha256.Sum256([]byte(wrapped))
+	return hex.EncodeToString(sum[:])
+}
+
+// tenantKeyFor returns the customer's data key, creating one on first use when create is set.
+func tenantKeyFor(customerID string, create bool) (tenantKey, error) {
+	if customerID == "" {
+		return tenantKey{}, errors.New("binding has no customer id")
+	}
+	tenantMu.Lock()
+	store := tenantStore
+	cached, ok := tenantCache[customerID]
+	tenantMu.Unlock()
+	if store == nil {
+		return tenantKey{}, errors.New("no tenant key store configured")
+	}
+	if ok && time.Now().Before(cached.expires) {
+		return cached, nil
+	}
+
+	id, wrapped, err := store.Get(customerID)
+	if errors.Is(err, ErrNoTenantKey) && create {
+		id, wrapped, err = newTenantKey(store, customerID)
+	}
+	if err != nil {
+		return tenantKey{}, err
+	}
+	key, err := unwrapTenant(customerID, wrapped)
+	if err != nil {
+		return tenantKey{}, err
+	}
+
+	_, cache := currentProvider()
+	tk := tenantKey{id: id, key: key, expires: time.Now().Add(cache.ttl)}
+	if cache.ttl > 0 {
+		tenantMu.Lock()
+		tenantCache[customerID] = tk
+		tenantMu.Unlock()
+	}
+	return tk, nil
+}
+
+func newTenantKey(store TenantKeyStore, customerID string) (string, string, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return "", "", err
+	}
+	idBytes := make([]byte, 8)
+	if _, err := io.ReadFull(rand.Reader, idBytes); err != nil {
+		return "", "", err
+	}
+	wrapped, err := wrapTenant(customerID, key)
+	if err != nil {
+		return "", "", err
+	}
+	return store.Create(customerID, hex.EncodeToString(idBytes), wrapped)
+}
+
+// wrapTenant wraps a customer's data key with the customer's own key when the provider has
+// them, or the shared KEK otherwise.
+func wrapTenant(customerID string, key []byte) (string, error) {
+	p, cache := currentProvider()
+	ctx, cancel := context.WithTimeout(context.Background(), providerTimeout)
+	defer cancel()
+	var wrapped string
+	var err error
+	if tp, ok := p.(TenantKeyProvider); ok {
+		wrapped, err = tp.WrapFor(ctx, customerID, key)
+		wrapped = tenantWrapPrefix + wrapped
+	} else {
+		wrapped, err = p.Wrap(ctx, key)
+	}
+	if err != nil {
+		return "", err
+	}
+	// seed the cache so the first write doesn't unwrap the key it just wrapped
+	cache.put(wrapped, key)
+	return wrapped, nil
+}
+
+// unwrapTenant recovers a customer's data key wrapped by wrapTenant.
+func unwrapTenant(customerID, wrapped string) ([]byte, error) {
+	inner, ok := strings.CutPrefix(wrapped, tenantWrapPrefix)
+	if !ok {
+		return unwrap(wrapped)
+	}
+	p, cache := currentProvider()
+	if dek, ok := cache.get(wrapped); ok {
+		return dek, nil
+	}
+	tp, ok := p.(TenantKeyProvider)
+	if !ok {
+		return nil, errors.New("customer data key is wrapped with a per-customer key the KEK provider doesn't support")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), providerTimeout)
+	defer cancel()
+	dek, err := tp.UnwrapFor(ctx, customerID, inner)
+	if err != nil {
+		return nil, err
+	}
+	if len(dek) != 32 {
+		return nil, errors.New("unwrapped data key has the wrong length")
+	}
+	cache.put(wrapped, dek)
+	return dek, nil
+}
+
+// DestroyTenantKey deletes the customer's own wrapping key, with which wrapped (its stored
+// data key) must have been wrapped, so backups holding wrapped can't recover the data key. A
+// key wrapped with the shared KEK gives ErrTenantKeyShared.
+func DestroyTenantKey(customerID, wrapped string) error {
+	if !strings.HasPrefix(wrapped, tenantWrapPrefix) {
+		return ErrTenantKeyShared
+	}
+	p, _ := currentProvider()
+	tp, ok := p.(TenantKeyProvider)
+	if !ok {
+		return errors.New("customer data key is wrapped with a per-customer key the KEK provider doesn't support")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), providerTimeout)
+	defer cancel()
+	return tp.DestroyTenantKey(ctx, customerID)
+}
+
+// HasTenantKeys reports whether the configured provider keeps a key per customer, which
+// erasure needs.
+func HasTenantKeys() bool {
+	p, _ := currentProvider()
+	_, ok := p.(TenantKeyProvider)
+	return ok
+}
+
+func sealTenant(b Binding, plaintext string) (string, error) {
+	tk, err := tenantKeyFor(b.CustomerID, true)
+	if err != nil {
+		return "", err
+	}
+	ct, err := sealAAD(tk.key, []byte(plaintext), b.aad())
+	if err != nil {
+		return "", err
+	}
+	return tenantPrefix + tk.id + "." + base64.StdEncoding.EncodeToString(ct), nil
+}
+
+func openTenant(b Binding, ciphertext string) (string, error) {
+	id, body, ok := strings.Cut(strings.TrimPrefix(ciphertext, tenantPrefix), ".")
+	if !ok {
+		return "", errors.New("malformed tenant ciphertext")
+	}
+	tk, err := tenantKeyFor(b.CustomerID, false)
+	if err != nil {
+		return "", err
+	}
+	if tk.id != id {
+		return "", errors.New("ciphertext was sealed with a different customer data key")
+	}
+	data, err := base64.StdEncoding.DecodeString(body)
+	if err != nil {
+		return "", err
+	}
+	pt, err := openAAD(tk.key, data, b.aad())
+	if err != nil {
+		return "", err
+	}
+	return string(pt), nil
+}
+
+// TenantSecret derives a per-customer secret for purpose (e.g. peppering backup code hashes).
+// It stops being derivable once the customer's data key is destroyed.
+func TenantSecret(customerID, purpose string) ([]byte, error) {
+	tk, err := tenantKeyFor(customerID, true)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, tk.key)
+	mac.Write([]byte("otp-tenant-secret|" + purpose))
+	return mac.Sum(nil), nil
+}
+
+// RewrapTenantKey re-wraps a stored customer data key under the provider's current KEK, or
+// the current version of the customer's own key when the provider has them. Keys wrapped with
+// the shared KEK move to the customer's own key. It reports whether anything changed.
+func RewrapTenantKey(customerID, wrapped string) (string, bool, error) {
+	p, _ := currentProvider()
+	ctx, cancel := context.WithTimeout(context.Background(), providerTimeout)
+	defer cancel()
+	tp, perCustomer := p.(TenantKeyProvider)
+	inner, isTenant := strings.CutPrefix(wrapped, tenantWrapPrefix)
+	stale := true
+	var err error
+	switch {
+	case isTenant && perCustomer:
+		stale, err = tp.NeedsRewrapFor(ctx, customerID, inner)
+	case !isTenant && !perCustomer:
+		stale, err = p.NeedsRewrap(ctx, wrapped)
+	}
+	if err != nil || !stale {
+		return wrapped, false, err
+	}
+	key, err := unwrapTenant(customerID, wrapped)
+	if err != nil {
+		return "", false, err
+	}
+	out, err := wrapTenant(customerID, key)
+	if err != nil {
+		return "", false, err
+	}
+	return out, true, nil
+}
@@ -0,0 +1,194 @@
+package crypto
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DirTenantProvider gives every customer a key-encryption key of its own for the env and file
+// providers. Each one is a file in a directory outside the database (TENANT_KEY_DIR), wrapped
+// there with the underlying provider's KEK. Customer data keys are wrapped with it, so deleting
+// the file at erasure leaves the data key unrecoverable from any copy of the database,
+// including backups taken before the erasure. Every instance must see the same directory.
+type DirTenantProvider struct {
+	KeyProvider
+	dir string
+}
+
+// NewDirTenantProvider keeps per-customer keys in dir, creating it if needed.
+func NewDirTenantProvider(p KeyProvider, dir string) (*DirTenantProvider, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &DirTenantProvider{KeyProvider: p, dir: dir}, nil
+}
+
+func (d *DirTenantProvider) path(customerID string) (string, error) {
+	if !keyIDPattern.MatchString(customerID) {
+		return "", fmt.Errorf("customer id %q can't name a key file", customerID)
+	}
+	return filepath.Join(d.dir, customerID+".key"), nil
+}
+
+// kek returns the customer's key and its stored (wrapped) form, creating it when create is set.
+func (d *DirTenantProvider) kek(ctx context.Context, customerID string, create bool) ([]byte, string, error) {
+	path, err := d.path(customerID)
+	if err != nil {
+		return nil, "", err
+	}
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) && create {
+		raw, err = d.create(ctx, path)
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, "", ErrTenantKeyDestroyed
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	stored := strings.TrimSpace(string(raw))
+	kek, err := d.Unwrap(ctx, stored)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(kek) != 32 {
+		return nil, "", errors.New("customer key-encryption key has the wrong length")
+	}
+	return kek, stored, nil
+}
+
+// create writes a new key file. Instances racing to create it converge on the first one
+// written: the file is linked into place, which fails if it already exists.
+func (d *DirTenantProvider) create(ctx context.Context, path string) ([]byte, error) {
+	kek := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, kek); err != nil {
+		return nil, err
+	}
+	stored, err := d.Wrap(ctx, kek)
+	if err != nil {
+		return nil, err
+	}
+	tmp, err := d.writeTemp(stored)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp)
+	if err := os.Link(tmp, path); err != nil && !errors.Is(err, os.ErrExist) {
+		return nil, err
+	}
+	return os.ReadFile(path)
+}
+
+// writeTemp writes content to a synced temporary file in the key directory.
+func (d *DirTenantProvider) writeTemp(content string) (string, error) {
+	f, err := os.CreateTemp(d.dir, ".tmp-")
+	if err != nil {
+		return "", err
+	}
+	_, err = f.WriteString(content + "\n")
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// WrapFor wraps a data key with the customer's key. A key file still wrapped with a retired KEK
+// is rewritten under the current one first.
+func (d *DirTenantProvider) WrapFor(ctx context.Context, customerID string, dek []byte) (string, error) {
+	kek, stored, err := d.kek(ctx, customerID, true)
+	if err != nil {
+		return "", err
+	}
+	stale, err := d.NeedsRewrap(ctx, stored)
+	if err != nil {
+		return "", err
+	}
+	if stale {
+		if err := d.rewrite(ctx, customerID, kek); err != nil {
+			return "", err
+		}
+	}
+	ct, err := sealWith(kek, dek)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(ct), nil
+}
+
+func (d *DirTenantProvider) rewrite(ctx context.Context, customerID string, kek []byte) error {
+	path, err := d.path(customerID)
+	if err != nil {
+		return err
+	}
+	stored, err := d.Wrap(ctx, kek)
+	if err != nil {
+		return err
+	}
+	tmp, err := d.writeTemp(stored)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+func (d *DirTenantProvider) UnwrapFor(ctx context.Context, customerID, wrapped string) ([]byte, error) {
+	kek, _, err := d.kek(ctx, customerID, false)
+	if err != nil {
+		return nil, err
+	}
+	ct, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil {
+		return nil, err
+	}
+	return openWith(kek, ct)
+}
+
+// NeedsRewrapFor reports whether the customer's key file is wrapped with a KEK other than the
+// current one; re-wrapping the data key rewrites it.
+func (d *DirTenantProvider) NeedsRewrapFor(ctx context.Context, customerID, _ string) (bool, error) {
+	path, err := d.path(customerID)
+	if err != nil {
+		return false, err
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	return d.NeedsRewrap(ctx, strings.TrimSpace(string(raw)))
+}
+
+// DestroyTenantKey deletes the customer's key file. A file that is already gone is not an error.
+func (d *DirTenantProvider) DestroyTenantKey(_ context.Context, customerID string) error {
+	path, err := d.path(customerID)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	// make the removal durable before the erasure commits
+	dir, err := os.Open(d.dir)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
@@ -0,0 +1,227 @@
+package crypto
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// VaultTransitProvider wraps data keys with a HashiCorp Vault (or compatible) transit key.
+// Wrapped keys are Vault ciphertexts such as "vault:v3:<base64>".
+type VaultTransitProvider struct {
+	Addr   string // e.g. https://vault.internal:8200
+	Token  string
+	Mount  string // transit mount path, default "transit"
+	Key    string // transit key name
+	Client *http.Client
+
+	mu     sync.Mutex
+	latest map[string]keyVersion // per transit key
+}
+
+type keyVersion struct {
+	version int
+	at      time.Time
+}
+
+// errVaultNotFound is returned for a 404, e.g. a transit key that doesn't exist (any more).
+var errVaultNotFound = errors.New("not found")
+
+// NewVaultTransitProvider returns a provider for the given transit key.
+func NewVaultTransitProvider(addr, token, mount, key string) *VaultTransitProvider {
+	if mount == "" {
+		mount = "transit"
+	}
+	return &VaultTransitProvider{
+		Addr:   strings.TrimRight(addr, "/"),
+		Token:  token,
+		Mount:  strings.Trim(mount, "/"),
+		Key:    key,
+		Client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (v *VaultTransitProvider) Wrap(ctx context.Context, dek []byte) (string, error) {
+	return v.encrypt(ctx, v.Key, dek)
+}
+
+func (v *VaultTransitProvider) Unwrap(ctx context.Context, wrapped string) ([]byte, error) {
+	return v.decrypt(ctx, v.Key, wrapped)
+}
+
+func (v *VaultTransitProvider) NeedsRewrap(ctx context.Context, wrapped string) (bool, error) {
+	return v.needsRewrap(ctx, v.Key, wrapped)
+}
+
+func (v *VaultTransitProvider) encrypt(ctx context.Context, key string, dek []byte) (string, error) {
+	var out struct {
+		Data struct {
+			Ciphertext string `json:"ciphertext"`
+		} `json:"data"`
+	}
+	err := v.do(ctx, http.MethodPost, "encrypt/"+key, map[string]string{"plaintext": base64.StdEncoding.EncodeToString(dek)}, &out)
+	if err != nil {
+		return "", err
+	}
+	if out.Data.Ciphertext == "" {
+		return "", fmt.Errorf("vault encrypt: empty ciphertext")
+	}
+	return out.Data.Ciphertext, nil
+}
+
+func (v *VaultTransitProvider) decrypt(ctx context.Context, key, wrapped string) ([]byte, error) {
+	var out struct {
+		Data struct {
+			Plaintext string `json:"plaintext"`
+		} `json:"data"`
+	}
+	if err := v.do(ctx, http.MethodPost, "decrypt/"+key, map[string]string{"ciphertext": wrapped}, &out); err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(out.Data.Plaintext)
+}
+
+func (v *VaultTransitProvider) needsRewrap(ctx context.Context, key, wrapped string) (bool, error) {
+	// "vault:v<N>:..."
+	parts := strings.SplitN(wrapped, ":", 3)
+	if len(parts) != 3 || !strings.HasPrefix(parts[1], "v") {
+		return false, fmt.Errorf("malformed vault ciphertext")
+	}
+	version, err := strconv.Atoi(parts[1][1:])
+	if err != nil {
+		return false, fmt.Errorf("malformed vault ciphertext")
+	}
+	latest, err := v.latestVersion(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	return version < latest, nil
+}
+
+// latestVersion reads a transit key's latest version, cached for a minute since a
+// re-encryption job asks once per record.
+func (v *VaultTransitProvider) latestVersion(ctx context.Context, key string) (int, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if kv, ok := v.latest[key]; ok && time.Since(kv.at) < time.Minute {
+		return kv.version, nil
+	}
+	var out struct {
+		Data struct {
+			LatestVersion int `json:"latest_version"`
+		} `json:"data"`
+	}
+	if err := v.do(ctx, http.MethodGet, "keys/"+key, nil, &out); err != nil {
+		return 0, err
+	}
+	if v.latest == nil {
+		v.latest = map[string]keyVersion{}
+	}
+	v.latest[key] = keyVersion{out.Data.LatestVersion, time.Now()}
+	return out.Data.LatestVersion, nil
+}
+
+// VaultTenantProvider is a VaultTransitProvider that also gives every customer a transit key
+// of its own, "<key>-tenant-<customer id>", to wrap that customer's data key. The key exists
+// only in Vault, so deleting it at erasure leaves the data key unrecoverable from any copy of
+// the database, including backups taken before the erasure. Vault creates the key on the
+// first encrypt, so the token needs create and update on transit/encrypt/<key>-tenant-*,
+// update on transit/decrypt/<key>-tenant-* and read, update and delete on
+// transit/keys/<key>-tenant-*.
+type VaultTenantProvider struct {
+	*VaultTransitProvider
+}
+
+// NewVaultTenantProvider returns a provider for the given transit key and per-customer keys
+// derived from its name.
+func NewVaultTenantProvider(addr, token, mount, key string) *VaultTenantProvider {
+	return &VaultTenantProvider{NewVaultTransitProvider(addr, token, mount, key)}
+}
+
+func (v *VaultTenantProvider) tenantKey(customerID string) string {
+	return v.Key + "-tenant-" + customerID
+}
+
+func (v *VaultTenantProvider) WrapFor(ctx context.Context, customerID string, dek []byte) (string, error) {
+	return v.encrypt(ctx, v.tenantKey(customerID), dek)
+}
+
+func (v *VaultTenantProvider) UnwrapFor(ctx context.Context, customerID, wrapped string) ([]byte, error) {
+	return v.decrypt(ctx, v.tenantKey(customerID), wrapped)
+}
+
+func (v *VaultTenantProvider) NeedsRewrapFor(ctx context.Context, customerID, wrapped string) (bool, error) {
+	return v.needsRewrap(ctx, v.tenantKey(customerID), wrapped)
+}
+
+// DestroyTenantKey deletes the customer's transit key. Transit keys refuse deletion until
+// deletion_allowed is set, so it is set first. A key that is already gone is not an error.
+func (v *VaultTenantProvider) DestroyTenantKey(ctx context.Context, customerID string) error {
+	name := v.tenantKey(customerID)
+	err := v.do(ctx, http.MethodGet, "keys/"+name, nil, nil)
+	if errors.Is(err, errVaultNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := v.do(ctx, http.MethodPost, "keys/"+name+"/config", map[string]any{"deletion_allowed": true}, nil); err != nil {
+		return err
+	}
+	err = v.do(ctx, http.MethodDelete, "keys/"+name, nil, nil)
+	if errors.Is(err, errVaultNotFound) {
+		return nil
+	}
+	if err == nil {
+		v.mu.Lock()
+		delete(v.latest, name)
+		v.mu.Unlock()
+	}
+	return err
+}
+
+func (v *VaultTransitProvider) do(ctx context.Context, method, path string, body any, out any) error {
+	var rdr *bytes.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		rdr = bytes.NewReader(b)
+	} else {
+		rdr = bytes.NewReader(nil)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, v.Addr+"/v1/"+v.Mount+"/"+path, rdr)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", v.Token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := v.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("vault %s: %w", path, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("vault %s: %w", path, errVaultNotFound)
+	}
+	if resp.StatusCode/100 != 2 {
+		var e struct {
+			Errors []string `json:"errors"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&e)
+		return fmt.Errorf("vault %s: status %d: %s", path, resp.StatusCode, strings.Join(e.Errors, "; "))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,22 @@
+package db
+
+import (
+	"crypto/rand"
+	"io"
+)
+
+// KeySalt returns the salt for a passphrase-derived encryption key version, creating a random
+// one on first use. Concurrent first calls converge on a single salt.
+func KeySalt(version int) ([]byte, error) {
+	salt := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	if _, err := DB.Exec(`INSERT INTO encryption_key_salts (key_version, salt) VALUES ($1, $2)
+		ON CONFLICT (key_version) DO NOTHING`, version, salt); err != nil {
+		return nil, err
+	}
+	var stored []byte
+	err := DB.QueryRow(`SELECT salt FROM encryption_key_salts WHERE key_version = $1`, version).Scan(&stored)
+	return stored, err
+}
@@ -0,0 +1,7 @@
+-- Custom metadata and tags on MFA users
+ALTER TABLE mfa_users
+  ADD COLUMN IF NOT EXISTS metadata JSONB NOT NULL DEFAULT '{}',
+  ADD COLUMN IF NOT EXISTS tags TEXT[] NOT NULL DEFAULT '{}';
+
+CREATE INDEX IF NOT EXISTS idx_mfa_users_tags ON mfa_users USING GIN (tags);
+CREATE INDEX IF NOT EXISTS idx_mfa_users_metadata ON mfa_users USING GIN (metadata);
@@ -0,0 +1,14 @@
+-- Per-user activity: indexed subject column on audit and usage events
+ALTER TABLE audit_logs ADD COLUMN IF NOT EXISTS user_id VARCHAR(255);
+UPDATE audit_logs SET user_id = metadata->>'user_id' WHERE user_id IS NULL AND metadata ? 'user_id';
+CREATE INDEX IF NOT EXISTS idx_audit_logs_customer_user ON audit_logs(customer_id, user_id, created_at DESC) WHERE user_id IS NOT NULL;
+
+ALTER TABLE usage_events ADD COLUMN IF NOT EXISTS user_id VARCHAR(255);
+CREATE INDEX IF NOT EXISTS idx_usage_events_customer_user ON usage_events(customer_id, user_id, created_at DESC) WHERE user_id IS NOT NULL;
+
+-- Validation state and lockout tracking on MFA users
+ALTER TABLE mfa_users
+  ADD COLUMN IF NOT EXISTS last_success_at TIMESTAMPTZ,
+  ADD COLUMN IF NOT EXISTS last_failure_at TIMESTAMPTZ,
+  ADD COLUMN IF NOT EXISTS failed_attempts INTEGER NOT NULL DEFAULT 0,
+  ADD COLUMN IF NOT EXISTS locked_until TIMESTAMPTZ;
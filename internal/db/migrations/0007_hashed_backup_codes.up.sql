@@ -0,0 +1,16 @@
+-- Backup codes stored as salted argon2id hashes; legacy encrypted columns are drained at startup
+ALTER TABLE mfa_users
+  ADD COLUMN IF NOT EXISTS backup_code_hashes TEXT[] NOT NULL DEFAULT '{}',
+  ADD COLUMN IF NOT EXISTS backup_codes_used INTEGER NOT NULL DEFAULT 0,
+  ADD COLUMN IF NOT EXISTS backup_codes_generated_at TIMESTAMPTZ;
+
+-- Per-tenant backup code policy
+CREATE TABLE IF NOT EXISTS backup_code_policies (
+    customer_id UUID PRIMARY KEY REFERENCES customers(id) ON DELETE CASCADE,
+    code_count INTEGER NOT NULL DEFAULT 8,
+    code_length INTEGER NOT NULL DEFAULT 8,
+    alphabet VARCHAR(16) NOT NULL DEFAULT 'numeric',
+    group_size INTEGER NOT NULL DEFAULT 0,
+    warn_below INTEGER NOT NULL DEFAULT 2,
+    updated_at TIMESTAMPTZ DEFAULT NOW()
+);
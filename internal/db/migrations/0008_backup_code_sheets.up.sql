@@ -0,0 +1,12 @@
+-- Short-lived, one-time printable copies of freshly generated backup codes
+CREATE TABLE IF NOT EXISTS backup_code_sheets (
+    customer_id UUID NOT NULL,
+    user_id VARCHAR(255) NOT NULL,
+    codes_encrypted TEXT NOT NULL,
+    generated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (customer_id, user_id),
+    FOREIGN KEY (customer_id, user_id) REFERENCES mfa_users(customer_id, user_id) ON UPDATE CASCADE ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_backup_code_sheets_expires ON backup_code_sheets(expires_at);
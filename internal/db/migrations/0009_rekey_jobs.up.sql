@@ -0,0 +1,17 @@
+-- Resumable re-encryption of stored secrets onto a new key version
+CREATE TABLE IF NOT EXISTS rekey_jobs (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    target_version INTEGER NOT NULL,
+    status VARCHAR(16) NOT NULL DEFAULT 'running',
+    cursor_customer_id UUID,
+    cursor_user_id VARCHAR(255),
+    total INTEGER NOT NULL DEFAULT 0,
+    scanned INTEGER NOT NULL DEFAULT 0,
+    rewritten INTEGER NOT NULL DEFAULT 0,
+    error TEXT,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    updated_at TIMESTAMPTZ DEFAULT NOW(),
+    completed_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS idx_rekey_jobs_status ON rekey_jobs(status);
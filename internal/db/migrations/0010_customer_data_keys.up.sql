@@ -0,0 +1,9 @@
+-- Per-customer data keys, wrapped by the key-encryption key. Erasure clears wrapped_key and
+-- keeps the row as a tombstone so no new key is created for an erased customer.
+CREATE TABLE IF NOT EXISTS customer_data_keys (
+    customer_id UUID PRIMARY KEY REFERENCES customers(id) ON DELETE CASCADE,
+    key_id VARCHAR(32) NOT NULL,
+    wrapped_key TEXT,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    destroyed_at TIMESTAMPTZ
+);
@@ -0,0 +1,14 @@
+-- Salts for passphrase-derived encryption keys, one per key version
+CREATE TABLE IF NOT EXISTS encryption_key_salts (
+    key_version INTEGER PRIMARY KEY,
+    salt BYTEA NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+-- A data key wrapped by the key-encryption key, unwrapped at startup as a self-test
+CREATE TABLE IF NOT EXISTS crypto_canary (
+    id SMALLINT PRIMARY KEY DEFAULT 1 CHECK (id = 1),
+    wrapped_key TEXT NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    verified_at TIMESTAMPTZ
+);
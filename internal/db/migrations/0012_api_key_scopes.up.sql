@@ -0,0 +1,14 @@
+-- Scopes enforced per route. New keys default to enrolling and validating MFA users. Existing
+-- keys get the scopes their permissions JSONB granted ({"mfa": {"register": true}} becomes
+-- mfa:register); keys without a permissions object get the default. The permissions column is
+-- no longer read.
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS scopes TEXT[] NOT NULL DEFAULT '{mfa:register,mfa:validate}';
+
+UPDATE api_keys k SET scopes = COALESCE((
+    SELECT array_agg(DISTINCT r.key || ':' || a.key ORDER BY r.key || ':' || a.key)
+    FROM jsonb_each(k.permissions) r,
+         jsonb_each(CASE WHEN jsonb_typeof(r.value) = 'object' THEN r.value ELSE '{}' END) a
+    WHERE a.value = 'true'::jsonb
+      AND r.key || ':' || a.key IN ('keys:manage', 'mfa:manage', 'mfa:register', 'mfa:validate', 'usage:read')
+), '{}')
+WHERE jsonb_typeof(k.permissions) = 'object';
@@ -0,0 +1,7 @@
+-- Per-key request limits. NULL means the subscription tier's limit applies, and explicit
+-- values can only lower it. The old 10000/hour default was never enforced, so it is cleared.
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS rate_limit_per_minute INTEGER;
+
+ALTER TABLE api_keys ALTER COLUMN rate_limit_per_hour DROP DEFAULT;
+
+UPDATE api_keys SET rate_limit_per_hour = NULL WHERE rate_limit_per_hour = 10000;
@@ -0,0 +1,6 @@
+-- Optional key expiry, the key that replaced a rotated one, and when the expiry warning was sent
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS expires_at TIMESTAMPTZ;
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS replaced_by UUID REFERENCES api_keys(id) ON DELETE SET NULL;
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS expiry_warned_at TIMESTAMPTZ;
+
+CREATE INDEX IF NOT EXISTS idx_api_keys_active_expiry ON api_keys(expires_at) WHERE is_active = true AND expires_at IS NOT NULL;
@@ -0,0 +1,2 @@
+-- Optional per-key IP allowlist. Empty allows every address.
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS allowed_cidrs CIDR[] NOT NULL DEFAULT '{}';
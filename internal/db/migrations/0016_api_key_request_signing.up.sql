@@ -0,0 +1,13 @@
+-- Per-key authentication mode (bearer|signed) and the encrypted HMAC signing secret
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS auth_mode VARCHAR(16) NOT NULL DEFAULT 'bearer';
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS signing_secret_encrypted TEXT;
+
+-- Nonces of signed requests, kept until their timestamp can no longer be accepted
+CREATE TABLE IF NOT EXISTS request_nonces (
+    api_key_id UUID NOT NULL REFERENCES api_keys(id) ON DELETE CASCADE,
+    nonce VARCHAR(128) NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (api_key_id, nonce)
+);
+
+CREATE INDEX IF NOT EXISTS idx_request_nonces_expires ON request_nonces(expires_at);
@@ -0,0 +1,22 @@
+-- MFA users registered with test API keys live in their own namespace, so the same user id can
+-- exist once per environment. Existing users stay live.
+ALTER TABLE mfa_users ADD COLUMN IF NOT EXISTS environment VARCHAR(20) NOT NULL DEFAULT 'live';
+ALTER TABLE backup_code_sheets ADD COLUMN IF NOT EXISTS environment VARCHAR(20) NOT NULL DEFAULT 'live';
+
+ALTER TABLE backup_code_sheets DROP CONSTRAINT IF EXISTS backup_code_sheets_customer_id_user_id_fkey;
+ALTER TABLE backup_code_sheets DROP CONSTRAINT IF EXISTS backup_code_sheets_pkey;
+ALTER TABLE mfa_users DROP CONSTRAINT IF EXISTS mfa_users_pkey;
+ALTER TABLE mfa_users ADD CONSTRAINT mfa_users_pkey PRIMARY KEY (customer_id, environment, user_id);
+ALTER TABLE backup_code_sheets ADD CONSTRAINT backup_code_sheets_pkey PRIMARY KEY (customer_id, environment, user_id);
+ALTER TABLE backup_code_sheets ADD CONSTRAINT backup_code_sheets_user_fkey FOREIGN KEY (customer_id, environment, user_id)
+    REFERENCES mfa_users(customer_id, environment, user_id) ON UPDATE CASCADE ON DELETE CASCADE;
+
+-- Usage of test keys is recorded but not billed
+ALTER TABLE usage_events ADD COLUMN IF NOT EXISTS environment VARCHAR(20) NOT NULL DEFAULT 'live';
+UPDATE usage_events e SET environment = 'test' FROM api_keys k WHERE k.id = e.api_key_id AND k.environment = 'test';
+
+-- Only test and live keys exist from now on
+UPDATE api_keys SET environment = 'test' WHERE environment IS NULL OR environment NOT IN ('test', 'live');
+
+-- Re-encryption jobs page through MFA users by primary key
+ALTER TABLE rekey_jobs ADD COLUMN IF NOT EXISTS cursor_environment VARCHAR(20);
@@ -0,0 +1,2 @@
+-- Keys revoked because a secret-scanning partner found them in public
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS leaked_at TIMESTAMPTZ;
@@ -0,0 +1,16 @@
+-- Publishable keys are embedded in web pages and only reach the browser enrollment routes
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS kind VARCHAR(20) NOT NULL DEFAULT 'secret';
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS allowed_origins TEXT[] NOT NULL DEFAULT '{}';
+
+-- Short-lived tokens minted with a secret key so a publishable key can act for one MFA user
+CREATE TABLE IF NOT EXISTS client_tokens (
+    token_hash VARCHAR(64) PRIMARY KEY,
+    customer_id UUID NOT NULL,
+    environment VARCHAR(20) NOT NULL,
+    user_id VARCHAR(255) NOT NULL,
+    api_key_id UUID REFERENCES api_keys(id) ON DELETE SET NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    FOREIGN KEY (customer_id, environment, user_id) REFERENCES mfa_users(customer_id, environment, user_id) ON UPDATE CASCADE ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS idx_client_tokens_expires_at ON client_tokens(expires_at);
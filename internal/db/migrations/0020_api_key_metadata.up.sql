@@ -0,0 +1,6 @@
+-- Editable API key details and where a key was last used from
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS description TEXT NOT NULL DEFAULT '';
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS owner_email VARCHAR(255) NOT NULL DEFAULT '';
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS labels TEXT[] NOT NULL DEFAULT '{}';
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS last_used_ip VARCHAR(64);
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS last_used_user_agent VARCHAR(512);
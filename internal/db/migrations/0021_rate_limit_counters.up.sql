@@ -0,0 +1,8 @@
+-- Rate-limit counters shared by every instance (RATE_LIMIT_STORE=postgres). UNLOGGED: a crash
+-- only resets the current windows.
+CREATE UNLOGGED TABLE IF NOT EXISTS rate_limit_counters (
+    key TEXT PRIMARY KEY,
+    count BIGINT NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_rate_limit_counters_expires_at ON rate_limit_counters(expires_at);
@@ -0,0 +1,9 @@
+-- Monthly quota consumption per customer, counted as validations are admitted
+CREATE TABLE IF NOT EXISTS quota_usage (
+    customer_id UUID NOT NULL REFERENCES customers(id) ON DELETE CASCADE,
+    period_start DATE NOT NULL,
+    validations BIGINT NOT NULL DEFAULT 0,
+    -- set when the soft limit warning for the period was first raised
+    soft_limit_warned_at TIMESTAMPTZ,
+    PRIMARY KEY (customer_id, period_start)
+);
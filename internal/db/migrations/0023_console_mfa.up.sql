@@ -0,0 +1,17 @@
+-- Console login MFA. The TOTP secret and backup codes of a customer's own login are an
+-- mfa_users row in the 'console' environment; operators can make MFA mandatory per customer.
+ALTER TABLE customers ADD COLUMN IF NOT EXISTS mfa_required BOOLEAN NOT NULL DEFAULT false;
+
+-- Set on sessions issued after a second factor was checked
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS mfa_at TIMESTAMPTZ;
+
+-- Interim tokens returned by a password login, exchanged for a session with a code
+CREATE TABLE IF NOT EXISTS login_challenges (
+    token_hash VARCHAR(128) PRIMARY KEY,
+    customer_id UUID NOT NULL REFERENCES customers(id) ON DELETE CASCADE,
+    attempts INT NOT NULL DEFAULT 0,
+    expires_at TIMESTAMPTZ NOT NULL,
+    used_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS idx_login_challenges_customer ON login_challenges(customer_id);
@@ -0,0 +1,42 @@
+-- Organization members: each customer (organization) has people with their own login and role.
+CREATE TABLE IF NOT EXISTS members (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    customer_id UUID NOT NULL REFERENCES customers(id) ON DELETE CASCADE,
+    email VARCHAR(255) NOT NULL UNIQUE,
+    name VARCHAR(255) NOT NULL DEFAULT '',
+    password_hash VARCHAR(255) NOT NULL,
+    role VARCHAR(20) NOT NULL,
+    is_active BOOLEAN NOT NULL DEFAULT true,
+    last_login_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    updated_at TIMESTAMPTZ DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS idx_members_customer ON members(customer_id);
+
+-- Every existing account becomes its organization's owner. The owner keeps the customer's id, so
+-- console MFA enrolled before members existed (stored under that id) stays bound to it.
+INSERT INTO members (id, customer_id, email, password_hash, role, is_active)
+SELECT id, id, email, password_hash, 'owner', COALESCE(is_active, true) FROM customers
+ON CONFLICT DO NOTHING;
+
+CREATE TABLE IF NOT EXISTS member_invitations (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    customer_id UUID NOT NULL REFERENCES customers(id) ON DELETE CASCADE,
+    email VARCHAR(255) NOT NULL,
+    role VARCHAR(20) NOT NULL,
+    token_hash VARCHAR(128) NOT NULL UNIQUE,
+    invited_by UUID REFERENCES members(id) ON DELETE SET NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    accepted_at TIMESTAMPTZ,
+    revoked_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS idx_member_invitations_customer ON member_invitations(customer_id);
+
+-- Sessions, interim login tokens and password resets belong to a member
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS member_id UUID REFERENCES members(id) ON DELETE CASCADE;
+UPDATE sessions SET member_id = customer_id WHERE member_id IS NULL;
+ALTER TABLE login_challenges ADD COLUMN IF NOT EXISTS member_id UUID REFERENCES members(id) ON DELETE CASCADE;
+UPDATE login_challenges SET member_id = customer_id WHERE member_id IS NULL;
+ALTER TABLE password_reset_tokens ADD COLUMN IF NOT EXISTS member_id UUID REFERENCES members(id) ON DELETE CASCADE;
+UPDATE password_reset_tokens SET member_id = customer_id WHERE member_id IS NULL;
@@ -0,0 +1,7 @@
+-- Per-user timelines filter audit events by environment; a column lets the index serve the filter
+-- instead of reading it from the JSON metadata. Test events were tagged in metadata until now.
+ALTER TABLE audit_logs ADD COLUMN IF NOT EXISTS environment VARCHAR(20) NOT NULL DEFAULT 'live';
+UPDATE audit_logs SET environment = 'test' WHERE metadata->>'environment' = 'test';
+
+DROP INDEX IF EXISTS idx_audit_logs_customer_user;
+CREATE INDEX IF NOT EXISTS idx_audit_logs_customer_user ON audit_logs(customer_id, user_id, environment, created_at DESC) WHERE user_id IS NOT NULL;
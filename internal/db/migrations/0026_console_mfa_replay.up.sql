@@ -0,0 +1,2 @@
+-- The TOTP time step of the last accepted console login code, so the same code can't be used twice
+ALTER TABLE mfa_users ADD COLUMN IF NOT EXISTS last_totp_step BIGINT;
@@ -0,0 +1,68 @@
+package keys
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// MaxAllowedCIDRs bounds the allowlist of a single key.
+const MaxAllowedCIDRs = 100
+
+// NormalizeCIDRs validates an IP allowlist. Bare addresses become single-host ranges, and
+// host bits are masked off ("10.0.0.7/8" becomes "10.0.0.0/8").
+func NormalizeCIDRs(in []string) ([]string, error) {
+	if len(in) > MaxAllowedCIDRs {
+		return nil, fmt.Errorf("at most %d allowed CIDR ranges", MaxAllowedCIDRs)
+	}
+	seen := map[string]bool{}
+	out := []string{}
+	for _, s := range in {
+		p, err := parseCIDR(strings.TrimSpace(s))
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP or CIDR %q", s)
+		}
+		if k := p.String(); !seen[k] {
+			seen[k] = true
+			out = append(out, k)
+		}
+	}
+	return out, nil
+}
+
+// IPAllowed reports whether ip falls in one of cidrs. An empty allowlist allows every address.
+func IPAllowed(ip string, cidrs []string) bool {
+	if len(cidrs) == 0 {
+		return true
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap() // IPv4-mapped IPv6 addresses match IPv4 ranges
+	for _, s := range cidrs {
+		if p, err := parseCIDR(s); err == nil && p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseCIDR(s string) (netip.Prefix, error) {
+	if !strings.Contains(s, "/") {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		addr = addr.Unmap()
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	p, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	if p.Addr().Is4In6() && p.Bits() >= 96 {
+		p = netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96)
+	}
+	return p.Masked(), nil
+}
@@ -0,0 +1,128 @@
+package keys
+
+import (
+	"crypto/rand"
+	"errors"
+	"hash/crc32"
+	"math/big"
+	"strings"
+)
+
+// API keys look like otpk_<env>_<30 base62 random chars><6 base62 chars of CRC32>. The fixed
+// otpk_ identifier lets secret scanners match them with a plain regex
+// (otpk_(test|live)_[0-9A-Za-z]{36}), and the checksum lets typos be rejected without a
+// database lookup. Keys issued before this format (sk_<env>_ + 48 hex chars) have no checksum
+// and are still accepted. Publishable keys use the same layout with a pk_ identifier.
+const (
+	KeyIdentifier         = "otpk_"
+	PublishableIdentifier = "pk_"
+
+	keyRandomLen   = 30
+	keyChecksumLen = 6
+	legacyHexLen   = 48
+)
+
+const base62 = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+var (
+	ErrKeyFormat   = errors.New("not an API key")
+	ErrKeyChecksum = errors.New("API key checksum mismatch")
+)
+
+// KeyPrefix is the non-secret leading part of keys of kind issued for env, stored as key_prefix.
+func KeyPrefix(kind, env string) string {
+	if kind == KindPublishable {
+		return PublishableIdentifier + env + "_"
+	}
+	return KeyIdentifier + env + "_"
+}
+
+// NewAPIKey generates a checksummed key of kind for env. It returns the plaintext key, shown
+// once, and its prefix.
+func NewAPIKey(kind, env string) (plain, prefix string, err error) {
+	prefix = KeyPrefix(kind, env)
+	random, err := randomBase62(keyRandomLen)
+	if err != nil {
+		return "", "", err
+	}
+	body := prefix + random
+	return body + keyChecksum(body), prefix, nil
+}
+
+// LastFour is the key suffix shown in listings to tell keys apart.
+func LastFour(key string) string {
+	if len(key) < 4 {
+		return key
+	}
+	return key[len(key)-4:]
+}
+
+// CheckFormat validates a presented key offline: ErrKeyFormat when it isn't shaped like one of
+// our keys at all, ErrKeyChecksum when it is but has been mistyped or truncated.
+func CheckFormat(key string) error {
+	for _, id := range []string{KeyIdentifier, PublishableIdentifier} {
+		rest, ok := strings.CutPrefix(key, id)
+		if !ok {
+			continue
+		}
+		env, tail, ok := strings.Cut(rest, "_")
+		if !ok || !ValidEnvironment(env) || len(tail) != keyRandomLen+keyChecksumLen || !isBase62(tail) {
+			return ErrKeyFormat
+		}
+		body := key[:len(key)-keyChecksumLen]
+		if keyChecksum(body) != key[len(body):] {
+			return ErrKeyChecksum
+		}
+		return nil
+	}
+	if rest, ok := strings.CutPrefix(key, "sk_"); ok {
+		env, tail, ok := strings.Cut(rest, "_")
+		if !ok || env == "" || len(tail) != legacyHexLen || !isHex(tail) {
+			return ErrKeyFormat
+		}
+		return nil
+	}
+	return ErrKeyFormat
+}
+
+// keyChecksum encodes the CRC32 of body as a fixed-width base62 string.
+func keyChecksum(body string) string {
+	n := crc32.ChecksumIEEE([]byte(body))
+	out := make([]byte, keyChecksumLen)
+	for i := keyChecksumLen - 1; i >= 0; i-- {
+		out[i] = base62[n%62]
+		n /= 62
+	}
+	return string(out)
+}
+
+func randomBase62(n int) (string, error) {
+	out := make([]byte, n)
+	max := big.NewInt(int64(len(base62)))
+	for i := range out {
+		v, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		out[i] = base62[v.Int64()]
+	}
+	return string(out), nil
+}
+
+func isBase62(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if strings.IndexByte(base62, s[i]) < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func isHex(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if strings.IndexByte("0123456789abcdef", s[i]) < 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,177 @@
+package keys
+
+import (
+	"testing"
+	"time"
+
+	"otp/internal/config"
+)
+
+func TestScopes(t *testing.T) {
+	got, err := NormalizeScopes([]string{" MFA:Validate", "keys:manage", "mfa:validate"})
+	if err != nil || len(got) != 2 || got[0] != ScopeKeysManage || got[1] != ScopeMFAValidate {
+		t.Fatalf("normalize: %v, %v", got, err)
+	}
+	if _, err := NormalizeScopes([]string{"mfa:*"}); err == nil {
+		t.Fatal("expected unknown scope to be rejected")
+	}
+	if !HasScope([]string{ScopeMFAManage}, ScopeMFARegister) {
+		t.Fatal("mfa:manage should include mfa:register")
+	}
+	if HasScope([]string{ScopeMFAManage}, ScopeMFAValidate) || HasScope(nil, ScopeUsageRead) {
+		t.Fatal("unexpected scope granted")
+	}
+}
+
+func TestAllowedCIDRs(t *testing.T) {
+	cidrs, err := NormalizeCIDRs([]string{"10.1.2.3/8", "203.0.113.7", "2001:db8::/32", "203.0.113.7/32"})
+	if err != nil || len(cidrs) != 3 || cidrs[0] != "10.0.0.0/8" || cidrs[1] != "203.0.113.7/32" {
+		t.Fatalf("normalize: %v, %v", cidrs, err)
+	}
+	if _, err := NormalizeCIDRs([]string{"10.0.0.0/33"}); err == nil {
+		t.Fatal("expected invalid prefix to be rejected")
+	}
+	for ip, want := range map[string]bool{
+		"10.200.0.1":      true,
+		"::ffff:10.0.0.1": true,
+		"203.0.113.7":     true,
+		"203.0.113.8":     false,
+		"2001:db8:1::1":   true,
+		"2001:db9::1":     false,
+		"not an ip":       false,
+	} {
+		if got := IPAllowed(ip, cidrs); got != want {
+			t.Errorf("IPAllowed(%q) = %v, want %v", ip, got, want)
+		}
+	}
+	if !IPAllowed("198.51.100.1", nil) {
+		t.Fatal("an empty allowlist should allow every address")
+	}
+}
+
+func TestRequestSignature(t *testing.T) {
+	a := StringToSign("post", "/api/v1/mfa/validate", "b=2&a=1", "1700000000", "nonce-123", []byte(`{"code":"123456"}`))
+	b := StringToSign("POST", "/api/v1/mfa/validate", "a=1&b=2", "1700000000", "nonce-123", []byte(`{"code":"123456"}`))
+	if a != b {
+		t.Fatalf("method case and query order changed the string to sign:\n%s\n%s", a, b)
+	}
+	sig := Sign("ss_secret", a)
+	if !VerifySignature("ss_secret", a, sig) {
+		t.Fatal("valid signature rejected")
+	}
+	if VerifySignature("ss_other", a, sig) || VerifySignature("ss_secret", a+"x", sig) || VerifySignature("ss_secret", a, "zz") {
+		t.Fatal("invalid signature accepted")
+	}
+
+	id, got, err := ParseSignatureHeader(SignatureScheme + " KeyId=abc, Signature=" + sig)
+	if err != nil || id != "abc" || got != sig {
+		t.Fatalf("parse: %q %q %v", id, got, err)
+	}
+	for _, h := range []string{"Bearer x", SignatureScheme + " KeyId=abc", SignatureScheme + " KeyId"} {
+		if _, _, err := ParseSignatureHeader(h); err == nil {
+			t.Fatalf("expected %q to be rejected", h)
+		}
+	}
+	if ValidNonce("short") || ValidNonce("has space x") || !ValidNonce("0123456789abcdef") {
+		t.Fatal("nonce validation")
+	}
+}
+
+func TestSandbox(t *testing.T) {
+	if v, magic := SandboxOTP(SandboxValidOTP); !v || !magic {
+		t.Fatal("valid magic OTP")
+	}
+	if v, magic := SandboxOTP(SandboxInvalidOTP); v || !magic {
+		t.Fatal("invalid magic OTP")
+	}
+	if _, magic := SandboxOTP("123456"); magic {
+		t.Fatal("ordinary OTP treated as magic")
+	}
+	b, err := NormalizeSandboxSecret(" jbswy3dpehpk3pxpjbswy3dpehpk3pxp== ")
+	if err != nil || len(b) != 20 {
+		t.Fatalf("secret: %v, %v", b, err)
+	}
+	for _, s := range []string{"JBSWY3DP", "not base32!", ""} {
+		if _, err := NormalizeSandboxSecret(s); err == nil {
+			t.Fatalf("expected %q to be rejected", s)
+		}
+	}
+}
+
+func TestKeyFormat(t *testing.T) {
+	key, prefix, err := NewAPIKey(KindSecret, EnvLive)
+	if err != nil || prefix != "otpk_live_" || len(key) != len(prefix)+36 {
+		t.Fatalf("key %q prefix %q: %v", key, prefix, err)
+	}
+	if err := CheckFormat(key); err != nil {
+		t.Fatal(err)
+	}
+	typo := []byte(key)
+	if typo[len(prefix)+3] = 'a'; key[len(prefix)+3] == 'a' {
+		typo[len(prefix)+3] = 'b'
+	}
+	if err := CheckFormat(string(typo)); err != ErrKeyChecksum {
+		t.Fatalf("typo: %v", err)
+	}
+	if err := CheckFormat("sk_test_" + "0123456789abcdef0123456789abcdef0123456789abcdef"); err != nil {
+		t.Fatalf("legacy key: %v", err)
+	}
+	for _, k := range []string{"", "hunter2", key[:len(key)-1], "otpk_prod_" + key[len(prefix):], "sk_test_0123"} {
+		if err := CheckFormat(k); err != ErrKeyFormat {
+			t.Fatalf("%q: %v", k, err)
+		}
+	}
+}
+
+func TestPublishableKeys(t *testing.T) {
+	key, prefix, err := NewAPIKey(KindPublishable, EnvTest)
+	if err != nil || prefix != "pk_test_" || CheckFormat(key) != nil {
+		t.Fatalf("key %q prefix %q: %v", key, prefix, err)
+	}
+	origins, err := NormalizeOrigins([]string{"https://App.Example.com/", "http://localhost:3000", "https://app.example.com"})
+	if err != nil || len(origins) != 2 || origins[0] != "https://app.example.com" {
+		t.Fatalf("origins %v: %v", origins, err)
+	}
+	if !OriginAllowed("https://app.example.com", origins) || OriginAllowed("https://evil.example.com", origins) || OriginAllowed("", origins) {
+		t.Fatal("origin matching")
+	}
+	for _, o := range []string{"app.example.com", "ftp://example.com", "https://example.com/path", "https://user@example.com"} {
+		if _, err := NormalizeOrigins([]string{o}); err == nil {
+			t.Fatalf("expected %q to be rejected", o)
+		}
+	}
+}
+
+func TestKeyMetadata(t *testing.T) {
+	labels, err := NormalizeLabels([]string{" billing ", "prod", "billing"})
+	if err != nil || len(labels) != 2 || labels[0] != "billing" {
+		t.Fatalf("labels %v: %v", labels, err)
+	}
+	if _, err := NormalizeLabels([]string{" "}); err == nil {
+		t.Fatal("expected an empty label to be rejected")
+	}
+	if email, err := NormalizeOwnerEmail(" ops@example.com "); err != nil || email != "ops@example.com" {
+		t.Fatalf("email %q: %v", email, err)
+	}
+	for _, e := range []string{"ops", "Ops <ops@example.com>"} {
+		if _, err := NormalizeOwnerEmail(e); err == nil {
+			t.Fatalf("expected %q to be rejected", e)
+		}
+	}
+}
+
+func TestExpiringSoon(t *testing.T) {
+	cfg := config.Load()
+	defer func(prev int) { cfg.APIKeyExpiryWarningDays = prev }(cfg.APIKeyExpiryWarningDays)
+	cfg.APIKeyExpiryWarningDays = 7
+	if !ExpiringSoon(time.Now().Add(24 * time.Hour)) {
+		t.Fatal("a key expiring tomorrow should warn")
+	}
+	if ExpiringSoon(time.Now().Add(8 * 24 * time.Hour)) {
+		t.Fatal("a key expiring past the warning window shouldn't warn")
+	}
+	cfg.APIKeyExpiryWarningDays = 0
+	if ExpiringSoon(time.Now().Add(time.Hour)) {
+		t.Fatal("0 days disables the warning")
+	}
+}
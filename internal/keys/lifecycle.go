@@ -0,0 +1,92 @@
+package keys
+
+import (
+	"log"
+	"time"
+
+	"otp/internal/audit"
+	"otp/internal/config"
+	"otp/internal/db"
+)
+
+// ExpiringSoon reports whether a key expiring at t falls within API_KEY_EXPIRY_WARNING_DAYS.
+func ExpiringSoon(t time.Time) bool {
+	days := config.Get().APIKeyExpiryWarningDays
+	return days > 0 && time.Until(t) < time.Duration(days)*24*time.Hour
+}
+
+// StartSweeper periodically deactivates expired API keys and warns, once per key, about keys
+// nearing expiry. Both are written to the audit log, which also pushes them to the realtime
+// stream.
+func StartSweeper() {
+	interval := time.Duration(config.Get().APIKeySweepIntervalSeconds) * time.Second
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		for {
+			if err := Sweep(); err != nil {
+				log.Printf("api key sweep failed: %v", err)
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// Sweep runs one pass of the sweeper: it drops expired request nonces and client tokens, then
+// deactivates expired keys and flags expiring ones. Both key steps use conditional UPDATEs, so
+// concurrent sweepers on several instances audit each key once.
+func Sweep() error {
+	// nonces only need to outlive the window in which their timestamp is accepted
+	if _, err := db.DB.Exec(`DELETE FROM request_nonces WHERE expires_at < NOW()`); err != nil {
+		return err
+	}
+	if _, err := db.DB.Exec(`DELETE FROM client_tokens WHERE expires_at < NOW()`); err != nil {
+		return err
+	}
+	err := updateAndAudit("api_key.expired", `UPDATE api_keys SET is_active = false, updated_at = NOW()
+		WHERE is_active = true AND expires_at <= NOW()
+		RETURNING id, customer_id, key_name, expires_at, replaced_by IS NOT NULL`)
+	if err != nil {
+		return err
+	}
+	days := config.Get().APIKeyExpiryWarningDays
+	if days <= 0 {
+		return nil
+	}
+	return updateAndAudit("api_key.expiring", `UPDATE api_keys SET expiry_warned_at = NOW()
+		WHERE is_active = true AND expiry_warned_at IS NULL AND expires_at <= NOW() + make_interval(days => $1)
+		RETURNING id, customer_id, key_name, expires_at, replaced_by IS NOT NULL`, days)
+}
+
+// updateAndAudit runs an UPDATE ... RETURNING over api_keys and audits each returned key.
+func updateAndAudit(event, query string, args ...any) error {
+	rows, err := db.DB.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	type keyRow struct {
+		id, customerID, name string
+		expiresAt            time.Time
+		rotated              bool
+	}
+	var out []keyRow
+	for rows.Next() {
+		var k keyRow
+		if err := rows.Scan(&k.id, &k.customerID, &k.name, &k.expiresAt, &k.rotated); err != nil {
+			rows.Close()
+			return err
+		}
+		out = append(out, k)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, k := range out {
+		audit.Record(k.customerID, "system", "", event, "", map[string]any{
+			"api_key_id": k.id, "key_name": k.name, "expires_at": k.expiresAt, "rotated": k.rotated,
+		})
+	}
+	return nil
+}
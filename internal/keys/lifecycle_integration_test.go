@@ -0,0 +1,94 @@
+package keys
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"otp/internal/config"
+	"otp/internal/db"
+)
+
+// initTestDB connects to TEST_DATABASE_URL (or DATABASE_URL), skipping the test without one.
+func initTestDB(t *testing.T) {
+	t.Helper()
+	cfg := config.Load()
+	if v := os.Getenv("TEST_DATABASE_URL"); v != "" {
+		cfg.DatabaseURL = v
+	}
+	if err := db.Init(cfg.DatabaseURL); err != nil {
+		t.Skipf("skipping integration test; DB unavailable: %v (set TEST_DATABASE_URL)", err)
+	}
+}
+
+// insertTestCustomer creates a throwaway customer for a sweep test.
+func insertTestCustomer(t *testing.T, name string) string {
+	t.Helper()
+	var id string
+	email := name + "-" + time.Now().Format("150405.000000") + "@example.com"
+	if err := db.DB.QueryRow(`INSERT INTO customers (company_name, email, password_hash) VALUES ($1, $2, '-') RETURNING id`, name, email).Scan(&id); err != nil {
+		t.Fatalf("insert customer: %v", err)
+	}
+	return id
+}
+
+func TestSweepAuditsKeysOnce(t *testing.T) {
+	initTestDB(t)
+	cfg := config.Get()
+	defer func(prev int) { cfg.APIKeyExpiryWarningDays = prev }(cfg.APIKeyExpiryWarningDays)
+	cfg.APIKeyExpiryWarningDays = 7
+	customerID := insertTestCustomer(t, "key-sweep")
+	ids := map[string]string{}
+	for name, expires := range map[string]time.Duration{"expired": -time.Minute, "expiring": 2 * 24 * time.Hour, "later": 30 * 24 * time.Hour} {
+		secret, _ := RandomHex(16)
+		var id string
+		if err := db.DB.QueryRow(`INSERT INTO api_keys (customer_id, key_name, key_prefix, key_hash, key_last_four, environment, expires_at)
+			VALUES ($1, $2, 'otpk_test_', $3, 'beef', 'test', $4) RETURNING id`, customerID, name, HashAPIKey(secret), time.Now().Add(expires)).Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		ids[name] = id
+	}
+
+	// sweepers on several instances, then a later pass, still audit each key once
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := Sweep(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if err := Sweep(); err != nil {
+		t.Fatal(err)
+	}
+
+	audits := func(event, keyID string) int {
+		var n int
+		if err := db.DB.QueryRow(`SELECT COUNT(*) FROM audit_logs WHERE customer_id = $1 AND event = $2 AND metadata->>'api_key_id' = $3`, customerID, event, keyID).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	for _, tc := range []struct {
+		event, key string
+		want       int
+	}{
+		{"api_key.expired", "expired", 1},
+		{"api_key.expiring", "expired", 0},
+		{"api_key.expiring", "expiring", 1},
+		{"api_key.expired", "expiring", 0},
+		{"api_key.expiring", "later", 0},
+	} {
+		if got := audits(tc.event, ids[tc.key]); got != tc.want {
+			t.Errorf("%s for %s key: %d audit events, want %d", tc.event, tc.key, got, tc.want)
+		}
+	}
+	var active bool
+	if err := db.DB.QueryRow(`SELECT is_active FROM api_keys WHERE id = $1`, ids["expired"]).Scan(&active); err != nil || active {
+		t.Fatalf("expired key still active: %v %v", active, err)
+	}
+}
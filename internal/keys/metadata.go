@@ -0,0 +1,48 @@
+package keys
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+)
+
+// Bounds on the descriptive fields of a key.
+const (
+	MaxKeyNameLength     = 100
+	MaxDescriptionLength = 500
+	MaxLabels            = 20
+	MaxLabelLength       = 50
+)
+
+// NormalizeLabels trims and de-duplicates a key's labels, preserving first-seen order.
+func NormalizeLabels(in []string) ([]string, error) {
+	if len(in) > MaxLabels {
+		return nil, fmt.Errorf("at most %d labels", MaxLabels)
+	}
+	seen := map[string]bool{}
+	out := []string{}
+	for _, l := range in {
+		l = strings.TrimSpace(l)
+		if l == "" || len(l) > MaxLabelLength {
+			return nil, fmt.Errorf("labels must be 1 to %d characters", MaxLabelLength)
+		}
+		if !seen[l] {
+			seen[l] = true
+			out = append(out, l)
+		}
+	}
+	return out, nil
+}
+
+// NormalizeOwnerEmail validates a key owner's email address. Empty clears the owner.
+func NormalizeOwnerEmail(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return "", nil
+	}
+	a, err := mail.ParseAddress(s)
+	if err != nil || a.Address != s || len(s) > 255 {
+		return "", fmt.Errorf("invalid owner_email %q", s)
+	}
+	return s, nil
+}
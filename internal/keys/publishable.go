@@ -0,0 +1,77 @@
+package keys
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Key kinds. Secret keys authenticate backend calls. Publishable keys can be embedded in a web
+// page: they only reach the browser enrollment routes, from their allowed origins, and each call
+// also needs a client token minted for the user with a secret key.
+const (
+	KindSecret      = "secret"
+	KindPublishable = "publishable"
+)
+
+// MaxAllowedOrigins bounds the origin list of a single publishable key.
+const MaxAllowedOrigins = 20
+
+// ClientTokenHeader carries the short-lived user token on publishable key requests.
+const ClientTokenHeader = "X-Client-Token"
+
+// ValidKind reports whether kind is a key kind.
+func ValidKind(kind string) bool { return kind == KindSecret || kind == KindPublishable }
+
+// NormalizeOrigins validates a publishable key's origin list. Each entry must be a bare
+// http(s) origin such as "https://app.example.com" or "http://localhost:3000".
+func NormalizeOrigins(in []string) ([]string, error) {
+	if len(in) > MaxAllowedOrigins {
+		return nil, fmt.Errorf("at most %d allowed origins", MaxAllowedOrigins)
+	}
+	seen := map[string]bool{}
+	out := []string{}
+	for _, s := range in {
+		o, ok := normalizeOrigin(strings.TrimSpace(s))
+		if !ok {
+			return nil, fmt.Errorf("invalid origin %q", s)
+		}
+		if !seen[o] {
+			seen[o] = true
+			out = append(out, o)
+		}
+	}
+	return out, nil
+}
+
+// OriginAllowed reports whether a request's Origin header matches one of origins.
+func OriginAllowed(origin string, origins []string) bool {
+	o, ok := normalizeOrigin(origin)
+	if !ok {
+		return false
+	}
+	for _, a := range origins {
+		if a == o {
+			return true
+		}
+	}
+	return false
+}
+
+func normalizeOrigin(s string) (string, bool) {
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" ||
+		u.User != nil || (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" {
+		return "", false
+	}
+	return u.Scheme + "://" + strings.ToLower(u.Host), true
+}
+
+// NewClientToken generates a user token for publishable key requests.
+func NewClientToken() (string, error) {
+	t, err := RandomHex(24)
+	if err != nil {
+		return "", err
+	}
+	return "ct_" + t, nil
+}
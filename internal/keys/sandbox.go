@@ -0,0 +1,50 @@
+package keys
+
+import (
+	"encoding/base32"
+	"errors"
+	"strings"
+)
+
+// Environments of an API key. Test keys work on a separate namespace of MFA users and their
+// usage is not billed.
+const (
+	EnvTest = "test"
+	EnvLive = "live"
+)
+
+// Magic OTPs accepted for MFA users in the test environment: SandboxValidOTP always validates
+// and SandboxInvalidOTP always fails, whatever the user's secret.
+const (
+	SandboxValidOTP   = "000000"
+	SandboxInvalidOTP = "999999"
+)
+
+// ValidEnvironment reports whether env names an environment.
+func ValidEnvironment(env string) bool {
+	return env == EnvTest || env == EnvLive
+}
+
+// SandboxOTP reports whether otp is a magic OTP, and if so whether it validates.
+func SandboxOTP(otp string) (valid, magic bool) {
+	switch otp {
+	case SandboxValidOTP:
+		return true, true
+	case SandboxInvalidOTP:
+		return false, true
+	}
+	return false, false
+}
+
+var errSandboxSecret = errors.New("secret must be base32 encoding 16 to 64 bytes")
+
+// NormalizeSandboxSecret validates a caller-chosen TOTP secret (test environment only, so CI can
+// compute codes) and returns its raw bytes.
+func NormalizeSandboxSecret(s string) ([]byte, error) {
+	s = strings.ToUpper(strings.TrimRight(strings.TrimSpace(s), "="))
+	b, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(s)
+	if err != nil || len(b) < 16 || len(b) > 64 {
+		return nil, errSandboxSecret
+	}
+	return b, nil
+}
@@ -0,0 +1,69 @@
+package keys
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// API key scopes. Each route reachable with an API key requires one of them.
+const (
+	ScopeMFAValidate = "mfa:validate" // validate OTPs and consume backup codes
+	ScopeMFARegister = "mfa:register" // enroll users and fetch their QR code and backup code sheet
+	ScopeMFAManage   = "mfa:manage"   // rename, reset, disable, edit metadata, regenerate backup codes
+	ScopeKeysManage  = "keys:manage"  // create, list, rotate, disable and re-scope API keys
+	ScopeUsageRead   = "usage:read"   // read API key usage
+)
+
+// AllScopes lists every scope, in display order.
+var AllScopes = []string{ScopeMFAValidate, ScopeMFARegister, ScopeMFAManage, ScopeKeysManage, ScopeUsageRead}
+
+// DefaultScopes are granted to keys created without an explicit scope list.
+var DefaultScopes = []string{ScopeMFARegister, ScopeMFAValidate}
+
+// implied lists scopes granted along with another: managing users includes enrolling them.
+var implied = map[string][]string{
+	ScopeMFAManage: {ScopeMFARegister},
+}
+
+// NormalizeScopes validates, de-duplicates and sorts a requested scope list.
+func NormalizeScopes(in []string) ([]string, error) {
+	seen := map[string]bool{}
+	out := []string{}
+	for _, s := range in {
+		s = strings.ToLower(strings.TrimSpace(s))
+		if !isScope(s) {
+			return nil, fmt.Errorf("unknown scope %q", s)
+		}
+		if !seen[s] {
+			seen[s] = true
+			out = append(out, s)
+		}
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+// HasScope reports whether granted includes want, directly or by implication.
+func HasScope(granted []string, want string) bool {
+	for _, g := range granted {
+		if g == want {
+			return true
+		}
+		for _, i := range implied[g] {
+			if i == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isScope(s string) bool {
+	for _, a := range AllScopes {
+		if a == s {
+			return true
+		}
+	}
+	return false
+}
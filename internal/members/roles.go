@@ -0,0 +1,66 @@
+// Package members defines the roles of an organization's console members and what each
+// one may do.
+package members
+
+// Roles a member can have.
+const (
+	RoleOwner     = "owner"
+	RoleAdmin     = "admin"
+	RoleDeveloper = "developer"
+	RoleSupport   = "support"
+	RoleBilling   = "billing"
+)
+
+// Roles lists every role, most privileged first.
+var Roles = []string{RoleOwner, RoleAdmin, RoleDeveloper, RoleSupport, RoleBilling}
+
+// Permissions gate the console routes. A member's own login (password, console MFA) needs
+// none.
+const (
+	PermKeys          = "keys"            // API keys
+	PermMFAUsersRead  = "mfa_users:read"  // list and inspect MFA users and their timelines
+	PermMFAUsersWrite = "mfa_users:write" // disable, reset, rename MFA users, QR codes and backup codes
+	PermUsage         = "usage"           // usage summary and the analytics stream
+	PermBilling       = "billing"         // billing events and summary
+	PermSettings      = "settings"        // organization settings, e.g. the backup code policy
+	PermMembers       = "members"         // invite, remove and change the role of members
+	PermAccount       = "account"         // erase the organization
+)
+
+var grants = map[string][]string{
+	RoleOwner:     {PermKeys, PermMFAUsersRead, PermMFAUsersWrite, PermUsage, PermBilling, PermSettings, PermMembers, PermAccount},
+	RoleAdmin:     {PermKeys, PermMFAUsersRead, PermMFAUsersWrite, PermUsage, PermBilling, PermSettings, PermMembers},
+	RoleDeveloper: {PermKeys, PermMFAUsersRead, PermMFAUsersWrite, PermUsage, PermSettings},
+	RoleSupport:   {PermMFAUsersRead, PermMFAUsersWrite, PermUsage},
+	RoleBilling:   {PermBilling, PermUsage},
+}
+
+// ValidRole reports whether role is one of Roles.
+func ValidRole(role string) bool {
+	_, ok := grants[role]
+	return ok
+}
+
+// Can reports whether role grants perm.
+func Can(role, perm string) bool {
+	for _, p := range grants[role] {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// Permissions returns what role grants.
+func Permissions(role string) []string {
+	return append([]string{}, grants[role]...)
+}
+
+// CanManage reports whether a member with role actor may invite, remove or change the role of
+// a member holding (or being given) role target. Only owners touch owners.
+func CanManage(actor, target string) bool {
+	if !Can(actor, PermMembers) {
+		return false
+	}
+	return target != RoleOwner || actor == RoleOwner
+}
@@ -0,0 +1,31 @@
+package members
+
+import "testing"
+
+func TestRoles(t *testing.T) {
+	for _, tc := range []struct {
+		role, perm string
+		want       bool
+	}{
+		{RoleOwner, PermAccount, true},
+		{RoleAdmin, PermAccount, false},
+		{RoleAdmin, PermMembers, true},
+		{RoleDeveloper, PermKeys, true},
+		{RoleDeveloper, PermBilling, false},
+		{RoleSupport, PermMFAUsersWrite, true},
+		{RoleSupport, PermKeys, false},
+		{RoleBilling, PermBilling, true},
+		{RoleBilling, PermMFAUsersRead, false},
+		{"viewer", PermUsage, false},
+	} {
+		if got := Can(tc.role, tc.perm); got != tc.want {
+			t.Errorf("Can(%q, %q) = %v", tc.role, tc.perm, got)
+		}
+	}
+	if !CanManage(RoleOwner, RoleOwner) || CanManage(RoleAdmin, RoleOwner) || !CanManage(RoleAdmin, RoleDeveloper) || CanManage(RoleDeveloper, RoleSupport) {
+		t.Fatal("unexpected CanManage result")
+	}
+	if ValidRole("viewer") || !ValidRole(RoleSupport) {
+		t.Fatal("unexpected ValidRole result")
+	}
+}
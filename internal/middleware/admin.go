@@ -1,6 +1,7 @@
 package middleware
 
 import (
+	"crypto/subtle"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
@@ -18,3 +19,17 @@ func AdminTokenAuth() gin.HandlerFunc {
 		c.Next()
 	}
 }
+
+// SecretScanningAuth authorizes leaked key reports using the X-Secret-Scanning-Token header.
+// Reports are refused while SECRET_SCANNING_TOKEN is unset.
+func SecretScanningAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		want := config.Get().SecretScanningToken
+		token := c.GetHeader("X-Secret-Scanning-Token")
+		if want == "" || subtle.ConstantTimeCompare([]byte(token), []byte(want)) != 1 {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "forbidden"})
+			return
+		}
+		c.Next()
+	}
+}
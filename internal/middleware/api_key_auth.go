@@ -1,50 +1,214 @@
 package middleware
 
 import (
+	"bytes"
 	"database/sql"
+	"io"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"otp/internal/audit"
+	"otp/internal/config"
+	"otp/internal/crypto"
 	"otp/internal/db"
 	"otp/internal/keys"
+	"otp/internal/usage"
 )
 
-// APIKeyAuth returns a Gin middleware that authenticates requests using a Bearer API key.
+// maxSignedBodyBytes bounds how much of a signed request's body is buffered to hash it.
+const maxSignedBodyBytes = 1 << 20
+
+type apiKeyRecord struct {
+	id, customerID, tier, authMode string
+	environment, kind              string
+	scopes, allowedCIDRs           []string
+	allowedOrigins                 []string
+	perMinute, perHour             sql.NullInt64
+	expiresAt                      sql.NullTime
+	signingSecret                  sql.NullString
+}
+
+// loadAPIKey fetches an active key matching where (with a single $1 argument), through the
+// auth cache.
+func loadAPIKey(where, arg string) (apiKeyRecord, error) {
+	lookup := where + "\x00" + arg
+	if k, ok := keyCache.get(lookup); ok {
+		return k, nil
+	}
+	var k apiKeyRecord
+	err := db.DB.QueryRow(
+		`SELECT k.id, k.customer_id, k.scopes, k.rate_limit_per_minute, k.rate_limit_per_hour, COALESCE(c.subscription_tier, ''), k.expires_at, k.allowed_cidrs,
+			k.auth_mode, k.signing_secret_encrypted, COALESCE(k.environment, 'test'), k.kind, k.allowed_origins
+		 FROM api_keys k JOIN customers c ON c.id = k.customer_id WHERE `+where+` AND k.is_active = true`,
+		arg,
+	).Scan(&k.id, &k.customerID, pq.Array(&k.scopes), &k.perMinute, &k.perHour, &k.tier, &k.expiresAt, pq.Array(&k.allowedCIDRs),
+		&k.authMode, &k.signingSecret, &k.environment, &k.kind, pq.Array(&k.allowedOrigins))
+	if err == nil {
+		keyCache.put(lookup, k)
+	}
+	return k, err
+}
+
+// APIKeyAuth returns a Gin middleware that authenticates requests using a Bearer API key, or a
+// request signature for keys in signed mode.
 func APIKeyAuth() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		auth := c.GetHeader("Authorization")
-		if !strings.HasPrefix(auth, "Bearer ") {
+		var key apiKeyRecord
+		switch {
+		case strings.HasPrefix(auth, keys.SignatureScheme+" "):
+			var ok bool
+			if key, ok = verifySignedRequest(c, auth); !ok {
+				return
+			}
+		case strings.HasPrefix(auth, "Bearer "):
+			token := strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+			if token == "" {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid API key"})
+				return
+			}
+			// malformed and mistyped keys are turned away without a database lookup
+			if err := keys.CheckFormat(token); err != nil {
+				code := "malformed_api_key"
+				if err == keys.ErrKeyChecksum {
+					code = "api_key_checksum_mismatch"
+				}
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid API key", "code": code})
+				return
+			}
+			var err error
+			key, err = loadAPIKey("k.key_hash = $1", keys.HashAPIKey(token))
+			if err == sql.ErrNoRows {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid or inactive API key"})
+				return
+			}
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Auth database error"})
+				return
+			}
+			if key.kind == keys.KindPublishable {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Publishable keys only work on client routes", "code": "publishable_key_not_allowed"})
+				return
+			}
+			if key.authMode == keys.AuthModeSigned {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "This API key requires signed requests", "code": "bearer_not_allowed"})
+				return
+			}
+		default:
 			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Missing Authorization bearer token"})
 			return
 		}
-		token := strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
-		if token == "" {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid API key"})
-			return
+		if admitKey(c, key) {
+			c.Next()
 		}
+	}
+}
 
-		keyHash := keys.HashAPIKey(token)
+// admitKey applies the checks shared by every kind of key once it is identified, then records
+// the use and sets the request context. It aborts the request and returns false on rejection.
+func admitKey(c *gin.Context, key apiKeyRecord) bool {
+	// the sweeper deactivates expired keys periodically; until then, reject them here
+	if key.expiresAt.Valid && !time.Now().Before(key.expiresAt.Time) {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "API key has expired"})
+		return false
+	}
+	// ClientIP honors the trusted proxy configuration
+	if ip := c.ClientIP(); !keys.IPAllowed(ip, key.allowedCIDRs) {
+		audit.Record(key.customerID, "api_key", key.id, "api_key.ip_blocked", ip, map[string]any{
+			"api_key_id": key.id, "ip": ip, "method": c.Request.Method, "path": c.FullPath(),
+		})
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "IP address not allowed for this API key"})
+		return false
+	}
 
-		var apiKeyID, customerID string
-		err := db.DB.QueryRow(
-			"SELECT id, customer_id FROM api_keys WHERE key_hash = $1 AND is_active = true",
-			keyHash,
-		).Scan(&apiKeyID, &customerID)
-		if err == sql.ErrNoRows {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid or inactive API key"})
-			return
-		}
-		if err != nil {
-			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Auth database error"})
-			return
-		}
+	// usage_count and the last use are updated in the next usage batch
+	usage.TouchKey(key.id, c.ClientIP(), c.Request.UserAgent())
+
+	c.Set("api_key_id", key.id)
+	c.Set("customer_id", key.customerID)
+	c.Set("api_key_scopes", key.scopes)
+	c.Set("environment", key.environment)
+	c.Set("subscription_tier", key.tier)
+	c.Set("api_key_rate_limit", EffectiveKeyRateLimit(key.tier, key.perMinute, key.perHour))
+	return true
+}
 
-		// best-effort usage update
-		_, _ = db.DB.Exec("UPDATE api_keys SET last_used_at = NOW(), usage_count = usage_count + 1 WHERE id = $1", apiKeyID)
+func signatureError(c *gin.Context, status int, code, msg string) {
+	c.AbortWithStatusJSON(status, gin.H{"error": msg, "code": code})
+}
 
-		c.Set("api_key_id", apiKeyID)
-		c.Set("customer_id", customerID)
-		c.Next()
+// verifySignedRequest checks a request signed with a key's signing secret. The nonce is only
+// recorded once the signature is valid, so unauthenticated clients can't fill the nonce table.
+func verifySignedRequest(c *gin.Context, auth string) (apiKeyRecord, bool) {
+	keyID, signature, err := keys.ParseSignatureHeader(auth)
+	if err != nil {
+		signatureError(c, http.StatusUnauthorized, "signature_malformed", "Malformed signature header: "+err.Error())
+		return apiKeyRecord{}, false
+	}
+	ts, nonce := c.GetHeader(keys.TimestampHeader), c.GetHeader(keys.NonceHeader)
+	if ts == "" || nonce == "" {
+		signatureError(c, http.StatusUnauthorized, "signature_missing_header", "Signed requests need "+keys.TimestampHeader+" and "+keys.NonceHeader+" headers")
+		return apiKeyRecord{}, false
+	}
+	if !keys.ValidNonce(nonce) {
+		signatureError(c, http.StatusUnauthorized, "signature_invalid_nonce", "Nonce must be 8-128 printable characters")
+		return apiKeyRecord{}, false
+	}
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		signatureError(c, http.StatusUnauthorized, "signature_malformed", "Timestamp must be Unix seconds")
+		return apiKeyRecord{}, false
+	}
+	skew := time.Duration(config.Get().RequestSignatureMaxSkewSeconds) * time.Second
+	if d := time.Since(time.Unix(unix, 0)); d > skew || d < -skew {
+		signatureError(c, http.StatusUnauthorized, "signature_stale_timestamp", "Request timestamp is outside the allowed window")
+		return apiKeyRecord{}, false
+	}
+
+	key, err := loadAPIKey("k.id::text = $1", keyID)
+	if err == sql.ErrNoRows {
+		signatureError(c, http.StatusUnauthorized, "signature_unknown_key", "Unknown or inactive API key")
+		return apiKeyRecord{}, false
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Auth database error"})
+		return apiKeyRecord{}, false
+	}
+	if key.authMode != keys.AuthModeSigned || !key.signingSecret.Valid {
+		signatureError(c, http.StatusUnauthorized, "signature_not_enabled", "This API key does not accept signed requests")
+		return apiKeyRecord{}, false
+	}
+	secret, err := crypto.DecryptFor(crypto.Binding{CustomerID: key.customerID, UserID: key.id, Field: crypto.FieldSigningSecret}, key.signingSecret.String)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to read signing secret"})
+		return apiKeyRecord{}, false
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxSignedBodyBytes))
+	if err != nil {
+		signatureError(c, http.StatusRequestEntityTooLarge, "signature_body_too_large", "Signed request body is too large")
+		return apiKeyRecord{}, false
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	sts := keys.StringToSign(c.Request.Method, c.Request.URL.EscapedPath(), c.Request.URL.RawQuery, ts, nonce, body)
+	if !keys.VerifySignature(secret, sts, signature) {
+		signatureError(c, http.StatusUnauthorized, "signature_mismatch", "Signature does not match the request")
+		return apiKeyRecord{}, false
+	}
+
+	res, err := db.DB.Exec(`INSERT INTO request_nonces (api_key_id, nonce, expires_at) VALUES ($1, $2, $3)
+		ON CONFLICT (api_key_id, nonce) DO NOTHING`, key.id, nonce, time.Unix(unix, 0).Add(skew))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Auth database error"})
+		return apiKeyRecord{}, false
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		signatureError(c, http.StatusUnauthorized, "signature_replayed_nonce", "Nonce was already used")
+		return apiKeyRecord{}, false
 	}
+	return key, true
 }
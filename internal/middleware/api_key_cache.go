@@ -0,0 +1,143 @@
+package middleware
+
+import (
+	"sync"
+	"time"
+)
+
+// apiKeyCache keeps recently authenticated keys in memory so hot paths (a customer validating
+// OTPs) don't query api_keys on every request. Handlers that change or disable a key forget it
+// here; other instances pick the change up once the entry expires (API_KEY_CACHE_TTL_SECONDS).
+type apiKeyCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	size    int
+	entries map[string]cachedAPIKey
+}
+
+type cachedAPIKey struct {
+	key     apiKeyRecord
+	expires time.Time
+}
+
+var keyCache = &apiKeyCache{entries: map[string]cachedAPIKey{}}
+
+// originCache holds the origins allowed by any active publishable key, so CORS checks and
+// preflights on client routes don't query api_keys each time. It shares the auth cache's ttl
+// and is dropped whenever a key is forgotten.
+var originCache struct {
+	mu      sync.Mutex
+	origins map[string]bool
+	expires time.Time
+	// gen counts drops, so a load that raced one isn't stored
+	gen int
+}
+
+// SetAPIKeyCache sets the auth cache bounds. A zero ttl or size disables caching.
+func SetAPIKeyCache(ttl time.Duration, size int) {
+	keyCache.mu.Lock()
+	defer keyCache.mu.Unlock()
+	keyCache.ttl, keyCache.size = ttl, size
+	keyCache.entries = map[string]cachedAPIKey{}
+	ForgetPublishableOrigins()
+}
+
+// ForgetAPIKey drops a key from the auth cache after it was changed, disabled or rotated.
+func ForgetAPIKey(id string) {
+	keyCache.forget(func(k apiKeyRecord) bool { return k.id == id })
+	ForgetPublishableOrigins()
+}
+
+// ForgetCustomerAPIKeys drops all of a customer's keys, e.g. after a tier change or erasure.
+func ForgetCustomerAPIKeys(customerID string) {
+	keyCache.forget(func(k apiKeyRecord) bool { return k.customerID == customerID })
+	ForgetPublishableOrigins()
+}
+
+// ForgetPublishableOrigins drops the cached origins of publishable keys, e.g. after one was
+// created.
+func ForgetPublishableOrigins() {
+	originCache.mu.Lock()
+	defer originCache.mu.Unlock()
+	originCache.origins = nil
+	originCache.gen++
+}
+
+// publishableOrigins returns the origins allowed by any active publishable key, from the cache
+// while it is fresh.
+func publishableOrigins() (map[string]bool, error) {
+	keyCache.mu.Lock()
+	ttl := keyCache.ttl
+	keyCache.mu.Unlock()
+	originCache.mu.Lock()
+	origins, gen := originCache.origins, originCache.gen
+	fresh := origins != nil && time.Now().Before(originCache.expires)
+	originCache.mu.Unlock()
+	if fresh {
+		return origins, nil
+	}
+
+	origins, err := loadPublishableOrigins()
+	if err != nil {
+		return nil, err
+	}
+	if ttl > 0 {
+		originCache.mu.Lock()
+		if originCache.gen == gen {
+			originCache.origins, originCache.expires = origins, time.Now().Add(ttl)
+		}
+		originCache.mu.Unlock()
+	}
+	return origins, nil
+}
+
+func (c *apiKeyCache) get(lookup string) (apiKeyRecord, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ttl <= 0 || c.size <= 0 {
+		return apiKeyRecord{}, false
+	}
+	e, ok := c.entries[lookup]
+	if !ok {
+		return apiKeyRecord{}, false
+	}
+	if time.Now().After(e.expires) {
+		delete(c.entries, lookup)
+		return apiKeyRecord{}, false
+	}
+	return e.key, true
+}
+
+func (c *apiKeyCache) put(lookup string, key apiKeyRecord) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ttl <= 0 || c.size <= 0 {
+		return
+	}
+	now := time.Now()
+	if _, ok := c.entries[lookup]; !ok && len(c.entries) >= c.size {
+		// drop expired entries, then the one closest to expiry if still full
+		oldest := ""
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			} else if oldest == "" || e.expires.Before(c.entries[oldest].expires) {
+				oldest = k
+			}
+		}
+		if len(c.entries) >= c.size {
+			delete(c.entries, oldest)
+		}
+	}
+	c.entries[lookup] = cachedAPIKey{key: key, expires: now.Add(c.ttl)}
+}
+
+func (c *apiKeyCache) forget(match func(apiKeyRecord) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, e := range c.entries {
+		if match(e.key) {
+			delete(c.entries, k)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package middleware
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAPIKeyCache(t *testing.T) {
+	SetAPIKeyCache(time.Minute, 2)
+	defer SetAPIKeyCache(0, 0)
+
+	keyCache.put("a", apiKeyRecord{id: "k1", customerID: "c1"})
+	keyCache.put("b", apiKeyRecord{id: "k2", customerID: "c1"})
+	if k, ok := keyCache.get("a"); !ok || k.id != "k1" {
+		t.Fatal("cached key not found")
+	}
+	keyCache.put("c", apiKeyRecord{id: "k3", customerID: "c2"})
+	if len(keyCache.entries) != 2 {
+		t.Fatalf("cache grew past its size: %d", len(keyCache.entries))
+	}
+
+	ForgetAPIKey("k3")
+	if _, ok := keyCache.get("c"); ok {
+		t.Fatal("forgotten key still cached")
+	}
+	keyCache.put("a", apiKeyRecord{id: "k1", customerID: "c1"})
+	ForgetCustomerAPIKeys("c1")
+	if len(keyCache.entries) != 0 {
+		t.Fatal("customer keys still cached")
+	}
+
+	SetAPIKeyCache(0, 0)
+	keyCache.put("a", apiKeyRecord{id: "k1"})
+	if _, ok := keyCache.get("a"); ok {
+		t.Fatal("disabled cache returned a key")
+	}
+}
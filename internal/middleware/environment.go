@@ -0,0 +1,22 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"otp/internal/keys"
+)
+
+// ConsoleEnvironment selects the MFA user namespace for console requests from ?environment=
+// (live by default), the way a test or live API key does for API requests.
+func ConsoleEnvironment() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		env := c.DefaultQuery("environment", keys.EnvLive)
+		if !keys.ValidEnvironment(env) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "environment must be test or live"})
+			return
+		}
+		c.Set("environment", env)
+		c.Next()
+	}
+}
@@ -0,0 +1,57 @@
+package middleware
+
+import (
+	"database/sql"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"otp/internal/config"
+	"otp/internal/ratelimit"
+	"otp/internal/usage"
+)
+
+// EffectiveKeyRateLimit applies a key's own limits (unset when NULL) under the ceiling of the
+// customer's subscription tier. Keys can lower their limits but not raise them.
+func EffectiveKeyRateLimit(tier string, perMinute, perHour sql.NullInt64) config.KeyRateLimit {
+	ceiling := config.Get().KeyRateLimits(tier)
+	return config.KeyRateLimit{
+		PerMinute: lowerLimit(ceiling.PerMinute, perMinute),
+		PerHour:   lowerLimit(ceiling.PerHour, perHour),
+	}
+}
+
+func lowerLimit(ceiling int, own sql.NullInt64) int {
+	if !own.Valid || own.Int64 <= 0 {
+		return ceiling
+	}
+	if ceiling > 0 && int(own.Int64) > ceiling {
+		return ceiling
+	}
+	return int(own.Int64)
+}
+
+// APIKeyRateLimiter enforces the per-minute and per-hour limits APIKeyAuth resolved for the
+// key, with the algorithm and store set with SetRateLimiter. Every response carries
+// RateLimit-Limit/-Remaining/-Reset for the window closest to its limit; rejections add
+// Retry-After and are recorded as usage.
+func APIKeyRateLimiter() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		apiKeyID := c.GetString("api_key_id")
+		v, ok := c.Get("api_key_rate_limit")
+		if apiKeyID == "" || !ok {
+			c.Next()
+			return
+		}
+		limit := v.(config.KeyRateLimit)
+		exceeded := checkRateLimits(c, "api_key", "key:"+apiKeyID,
+			rateLimitWindow{"minute", ratelimit.Rule{Limit: limit.PerMinute, Window: time.Minute}},
+			rateLimitWindow{"hour", ratelimit.Rule{Limit: limit.PerHour, Window: time.Hour}})
+		if exceeded != nil {
+			usage.RecordRateLimited(c)
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "rate limit exceeded (api key, per " + exceeded.name + ")", "limit": exceeded.rule.Limit})
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,60 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"otp/internal/config"
+)
+
+func TestAPIKeyRateLimiter(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		c.Set("api_key_id", "k1")
+		c.Set("api_key_rate_limit", config.KeyRateLimit{PerMinute: 5, PerHour: 2})
+	}, APIKeyRateLimiter())
+	r.GET("/", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	codes := []int{}
+	var last *httptest.ResponseRecorder
+	for i := 0; i < 3; i++ {
+		last = httptest.NewRecorder()
+		r.ServeHTTP(last, httptest.NewRequest(http.MethodGet, "/", nil))
+		codes = append(codes, last.Code)
+	}
+	if codes[0] != 200 || codes[1] != 200 || codes[2] != 429 {
+		t.Fatalf("unexpected status codes %v", codes)
+	}
+	// the hourly window is the tighter one, so it is the one reported
+	h := last.Header()
+	if h.Get("RateLimit-Limit") != "2" || h.Get("RateLimit-Remaining") != "0" || h.Get("Retry-After") == "" {
+		t.Fatalf("unexpected headers %v", h)
+	}
+	if h.Get("RateLimit-Policy") != "5;w=60, 2;w=3600" {
+		t.Fatalf("unexpected policy %q", h.Get("RateLimit-Policy"))
+	}
+}
+
+func TestRateLimiterHeaders(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(RateLimiter(2, 0))
+	r.GET("/", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	var last *httptest.ResponseRecorder
+	for i := 0; i < 3; i++ {
+		last = httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "198.51.100.7:1234"
+		r.ServeHTTP(last, req)
+		if i == 0 && (last.Code != http.StatusOK || last.Header().Get("RateLimit-Remaining") != "1") {
+			t.Fatalf("first request: %d %v", last.Code, last.Header())
+		}
+	}
+	if last.Code != http.StatusTooManyRequests || last.Header().Get("Retry-After") == "" || last.Header().Get("RateLimit-Policy") != "2;w=60" {
+		t.Fatalf("third request: %d %v", last.Code, last.Header())
+	}
+}
@@ -0,0 +1,27 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"otp/internal/audit"
+	"otp/internal/members"
+)
+
+// RequirePermission rejects console requests whose member's role lacks perm. Requests
+// authenticated otherwise (e.g. API keys, gated by RequireScope) pass through.
+func RequirePermission(perm string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.GetString("member_id") == "" {
+			c.Next()
+			return
+		}
+		role := c.GetString("member_role")
+		if !members.Can(role, perm) {
+			audit.Log(c, "member.permission_denied", map[string]any{"required_permission": perm, "role": role, "method": c.Request.Method, "path": c.FullPath()})
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "your role does not allow this", "code": "permission_denied", "required_permission": perm, "role": role})
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,115 @@
+package middleware
+
+import (
+	"database/sql"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"otp/internal/db"
+	"otp/internal/keys"
+)
+
+// ClientRoutePrefix is where the browser enrollment routes reachable with publishable keys live.
+const ClientRoutePrefix = "/api/v1/client/"
+
+// PublishableKeyAuth authenticates browser enrollment requests. They carry a publishable key as
+// a Bearer token, come from one of the key's allowed origins, and send a client token minted
+// with a secret key for the MFA user in the :id route parameter.
+func PublishableKeyAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := strings.TrimSpace(strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer "))
+		if !strings.HasPrefix(token, keys.PublishableIdentifier) || keys.CheckFormat(token) != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid publishable key", "code": "malformed_api_key"})
+			return
+		}
+		key, err := loadAPIKey("k.key_hash = $1", keys.HashAPIKey(token))
+		if err == sql.ErrNoRows || (err == nil && key.kind != keys.KindPublishable) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid or inactive API key"})
+			return
+		}
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Auth database error"})
+			return
+		}
+		if !keys.OriginAllowed(c.GetHeader("Origin"), key.allowedOrigins) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Origin not allowed for this publishable key", "code": "origin_not_allowed"})
+			return
+		}
+
+		clientToken := c.GetHeader(keys.ClientTokenHeader)
+		if clientToken == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Missing " + keys.ClientTokenHeader + " header", "code": "invalid_client_token"})
+			return
+		}
+		var userID string
+		err = db.DB.QueryRow(`SELECT user_id FROM client_tokens WHERE token_hash = $1 AND customer_id = $2 AND environment = $3 AND expires_at > NOW()`,
+			keys.HashAPIKey(clientToken), key.customerID, key.environment).Scan(&userID)
+		if err == sql.ErrNoRows {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired client token", "code": "invalid_client_token"})
+			return
+		}
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Auth database error"})
+			return
+		}
+		if userID != c.Param("id") {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Client token was issued for another user", "code": "client_token_user_mismatch"})
+			return
+		}
+		if admitKey(c, key) {
+			c.Next()
+		}
+	}
+}
+
+// RequirePendingEnrollment limits client routes to users who haven't confirmed a code yet, so a
+// publishable key can't read a user's QR code, or probe codes, once enrollment is done.
+func RequirePendingEnrollment() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var confirmed bool
+		err := db.DB.QueryRow(`SELECT last_success_at IS NOT NULL FROM mfa_users WHERE customer_id = $1 AND environment = $2 AND user_id = $3 AND is_active = true`,
+			c.GetString("customer_id"), c.GetString("environment"), c.Param("id")).Scan(&confirmed)
+		if err == sql.ErrNoRows {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		if confirmed {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "MFA enrollment is already confirmed"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// PublishableKeyOrigin lets CORS accept, on client routes, origins allowed by some active
+// publishable key. A preflight carries no key, so the per-key check is left to
+// PublishableKeyAuth. The origins come from a cache refreshed every API_KEY_CACHE_TTL_SECONDS.
+func PublishableKeyOrigin(c *gin.Context, origin string) bool {
+	if !strings.HasPrefix(c.Request.URL.Path, ClientRoutePrefix) {
+		return false
+	}
+	origins, err := publishableOrigins()
+	return err == nil && origins[origin]
+}
+
+func loadPublishableOrigins() (map[string]bool, error) {
+	rows, err := db.DB.Query(`SELECT DISTINCT unnest(allowed_origins) FROM api_keys WHERE kind = 'publishable' AND is_active = true`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	origins := map[string]bool{}
+	for rows.Next() {
+		var o string
+		if err := rows.Scan(&o); err != nil {
+			return nil, err
+		}
+		origins[o] = true
+	}
+	return origins, rows.Err()
+}
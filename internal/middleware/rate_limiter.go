@@ -1,44 +1,120 @@
 package middleware
 
 import (
+	"context"
+	"log"
+	"math"
 	"net/http"
-	"sync"
+	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"otp/internal/ratelimit"
+	"otp/internal/usage"
 )
 
-// RateLimiter returns a middleware that limits requests per IP and per API key (if available in context).
-// Limits are per-minute windows.
-func RateLimiter(perIP int, perAPIKey int) gin.HandlerFunc {
-	var mu sync.Mutex
-	type counter struct {
-		window int64
-		count  int
+// rateLimitStoreTimeout bounds a counter update; past it the request is let through.
+const rateLimitStoreTimeout = 500 * time.Millisecond
+
+var (
+	rateLimiter = &ratelimit.Limiter{Store: ratelimit.NewMemoryStore(100000), Algorithm: ratelimit.SlidingWindow}
+	// unix time of the last logged store failure, so an outage logs once a minute
+	rateLimitErrLogged atomic.Int64
+
+	rateLimitRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rate_limit_rejections_total",
+		Help: "Requests rejected with 429 by a rate limit, by limiter (ip or api_key) and window.",
+	}, []string{"limiter", "window"})
+	rateLimitStoreErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "rate_limit_store_errors_total",
+		Help: "Rate-limit store failures; the requests involved were not limited.",
+	})
+)
+
+// SetRateLimiter selects the algorithm and the store rate-limit counters live in. A store
+// shared by all instances (Postgres or Redis) makes limits hold across replicas; the default
+// in-memory one does not.
+func SetRateLimiter(l *ratelimit.Limiter) {
+	rateLimiter = l
+}
+
+// rateLimitWindow is one limit checked by a limiter, named for messages and metrics.
+type rateLimitWindow struct {
+	name string
+	rule ratelimit.Rule
+}
+
+// checkRateLimits counts the request under key against each window with a positive limit and
+// reports the tightest one in the RateLimit headers. If a window is exceeded it sets
+// Retry-After and returns that window; the caller responds with 429. When the store fails the
+// window is skipped: an unavailable store shouldn't take the API down with it.
+func checkRateLimits(c *gin.Context, limiter, key string, windows ...rateLimitWindow) *rateLimitWindow {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), rateLimitStoreTimeout)
+	defer cancel()
+	var exceeded *rateLimitWindow
+	var retryAfter time.Duration
+	for i, w := range windows {
+		if w.rule.Limit <= 0 {
+			continue
+		}
+		res, err := rateLimiter.Allow(ctx, key+":"+w.name, w.rule)
+		if err != nil {
+			rateLimitStoreErrors.Inc()
+			now := time.Now().Unix()
+			if last := rateLimitErrLogged.Load(); now-last >= 60 && rateLimitErrLogged.CompareAndSwap(last, now) {
+				log.Printf("rate limit store failed, not limiting: %v", err)
+			}
+			continue
+		}
+		reportRateLimit(c, rateLimiter.Policy(w.rule), res)
+		if !res.Allowed && res.RetryAfter >= retryAfter {
+			exceeded, retryAfter = &windows[i], res.RetryAfter
+		}
+	}
+	if exceeded != nil {
+		rateLimitRejections.WithLabelValues(limiter, exceeded.name).Inc()
+		c.Header("Retry-After", strconv.FormatInt(ceilSeconds(retryAfter), 10))
+	}
+	return exceeded
+}
+
+// reportRateLimit adds a window to RateLimit-Policy and, if it has fewer requests left than
+// any window reported so far on this request (by this or an earlier limiter), shows it in
+// RateLimit-Limit/-Remaining/-Reset.
+func reportRateLimit(c *gin.Context, policy string, res ratelimit.Result) {
+	h := c.Writer.Header()
+	if p := h.Get("RateLimit-Policy"); p != "" {
+		policy = p + ", " + policy
 	}
-	ipCounts := map[string]*counter{}
-	keyCounts := map[string]*counter{}
-
-	getBucket := func(m map[string]*counter, k string, limit int) (int, bool) {
-		now := time.Now().Unix() / 60 // minute window
-		c, ok := m[k]
-		if !ok || c.window != now {
-			c = &counter{window: now, count: 0}
-			m[k] = c
+	h.Set("RateLimit-Policy", policy)
+	if v, ok := c.Get("rate_limit_reported"); ok {
+		best := v.(ratelimit.Result)
+		if res.Remaining > best.Remaining || (res.Remaining == best.Remaining && res.Reset <= best.Reset) {
+			return
 		}
-		c.count++
-		return c.count, c.count <= limit
 	}
+	c.Set("rate_limit_reported", res)
+	h.Set("RateLimit-Limit", strconv.Itoa(res.Limit))
+	h.Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	h.Set("RateLimit-Reset", strconv.FormatInt(ceilSeconds(res.Reset), 10))
+}
+
+// ceilSeconds rounds up to whole seconds, at least 1, as the headers count in seconds.
+func ceilSeconds(d time.Duration) int64 {
+	return max(int64(math.Ceil(d.Seconds())), 1)
+}
 
+// RateLimiter returns a middleware that limits requests per IP and per API key (if available in context).
+// Limits are per minute, counted with the algorithm and store set with SetRateLimiter.
+func RateLimiter(perIP int, perAPIKey int) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		// Always enforce per-IP if > 0
 		if perIP > 0 {
-			ip := c.ClientIP()
-			mu.Lock()
-			cnt, ok := getBucket(ipCounts, ip, perIP)
-			mu.Unlock()
-			if !ok {
-				c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "rate limit exceeded (ip)", "limit": perIP, "count": cnt})
+			if checkRateLimits(c, "ip", "ip:"+c.ClientIP(), rateLimitWindow{"minute", ratelimit.Rule{Limit: perIP, Window: time.Minute}}) != nil {
+				c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "rate limit exceeded (ip)", "limit": perIP})
 				return
 			}
 		}
@@ -47,11 +123,9 @@ func RateLimiter(perIP int, perAPIKey int) gin.HandlerFunc {
 		if perAPIKey > 0 {
 			apiKeyID := c.GetString("api_key_id")
 			if apiKeyID != "" {
-				mu.Lock()
-				cnt, ok := getBucket(keyCounts, apiKeyID, perAPIKey)
-				mu.Unlock()
-				if !ok {
-					c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "rate limit exceeded (api key)", "limit": perAPIKey, "count": cnt})
+				if checkRateLimits(c, "api_key", "apikey:"+apiKeyID, rateLimitWindow{"minute", ratelimit.Rule{Limit: perAPIKey, Window: time.Minute}}) != nil {
+					usage.RecordRateLimited(c)
+					c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "rate limit exceeded (api key)", "limit": perAPIKey})
 					return
 				}
 			}
@@ -0,0 +1,26 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"otp/internal/audit"
+	"otp/internal/keys"
+)
+
+// RequireScope rejects API key requests whose key lacks scope. Requests authenticated
+// otherwise (e.g. console sessions) pass through, so handlers can be shared.
+func RequireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.GetString("api_key_id") == "" {
+			c.Next()
+			return
+		}
+		if !keys.HasScope(c.GetStringSlice("api_key_scopes"), scope) {
+			audit.Log(c, "api_key.scope_denied", map[string]any{"required_scope": scope, "method": c.Request.Method, "path": c.FullPath()})
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "API key lacks the required scope", "required_scope": scope})
+			return
+		}
+		c.Next()
+	}
+}
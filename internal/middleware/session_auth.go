@@ -12,28 +12,9 @@ import (
 // SessionAuth authenticates a console/customer request using X-Session-Token header.
 func SessionAuth() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		tok := c.GetHeader("X-Session-Token")
-		if tok == "" {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "missing session token"})
-			return
-		}
-		var customerID string
-		var expiresAt time.Time
-		err := db.DB.QueryRow(`SELECT customer_id, expires_at FROM sessions WHERE token = $1 AND revoked_at IS NULL`, tok).Scan(&customerID, &expiresAt)
-		if err == sql.ErrNoRows {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid session"})
-			return
-		}
-		if err != nil {
-			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "auth db error"})
-			return
+		if admitSession(c, c.GetHeader("X-Session-Token")) {
+			c.Next()
 		}
-		if time.Now().After(expiresAt) {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "session expired"})
-			return
-		}
-		c.Set("customer_id", customerID)
-		c.Next()
 	}
 }
 
@@ -45,26 +26,44 @@ func SessionAuthQS() gin.HandlerFunc {
 		if tok == "" {
 			tok = c.Query("token")
 		}
-		if tok == "" {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "missing session token"})
-			return
-		}
-		var customerID string
-		var expiresAt time.Time
-		err := db.DB.QueryRow(`SELECT customer_id, expires_at FROM sessions WHERE token = $1 AND revoked_at IS NULL`, tok).Scan(&customerID, &expiresAt)
-		if err == sql.ErrNoRows {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid session"})
-			return
-		}
-		if err != nil {
-			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "auth db error"})
-			return
+		if admitSession(c, tok) {
+			c.Next()
 		}
-		if time.Now().After(expiresAt) {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "session expired"})
-			return
-		}
-		c.Set("customer_id", customerID)
-		c.Next()
 	}
 }
+
+// admitSession checks a session token and sets customer_id and the session's member
+// (member_id, member_role), or aborts. Once an operator requires MFA for a customer, sessions
+// issued without a second factor stop working; so do those of removed members.
+func admitSession(c *gin.Context, tok string) bool {
+	if tok == "" {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "missing session token"})
+		return false
+	}
+	var customerID, memberID, role string
+	var expiresAt time.Time
+	var mfaMissing bool
+	err := db.DB.QueryRow(`SELECT s.customer_id, m.id, m.role, s.expires_at, c.mfa_required AND s.mfa_at IS NULL
+		FROM sessions s JOIN customers c ON c.id = s.customer_id JOIN members m ON m.id = s.member_id AND m.is_active
+		WHERE s.token = $1 AND s.revoked_at IS NULL`, tok).Scan(&customerID, &memberID, &role, &expiresAt, &mfaMissing)
+	if err == sql.ErrNoRows {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid session"})
+		return false
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "auth db error"})
+		return false
+	}
+	if time.Now().After(expiresAt) {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "session expired"})
+		return false
+	}
+	if mfaMissing {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "multi-factor authentication is required, log in again", "code": "mfa_required"})
+		return false
+	}
+	c.Set("customer_id", customerID)
+	c.Set("member_id", memberID)
+	c.Set("member_role", role)
+	return true
+}
@@ -0,0 +1,169 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+// Algorithm selects how requests are counted against a Rule.
+type Algorithm string
+
+const (
+	// FixedWindow counts requests per calendar window. Cheap, but a client can send a full
+	// limit at the end of one window and another at the start of the next.
+	FixedWindow Algorithm = "fixed_window"
+	// SlidingWindow weighs the previous window's count by how much of it still overlaps the
+	// last Window, which smooths the boundary burst at the cost of one extra read.
+	SlidingWindow Algorithm = "sliding_window"
+	// TokenBucket refills Limit tokens per Window, up to Burst saved up. It is kept as the
+	// time at which the bucket will be full again (GCRA), so it needs one value per key.
+	TokenBucket Algorithm = "token_bucket"
+)
+
+// ValidAlgorithm reports whether a is a known algorithm.
+func ValidAlgorithm(a Algorithm) bool {
+	return a == FixedWindow || a == SlidingWindow || a == TokenBucket
+}
+
+// Rule is a limit of Limit requests per Window. Burst applies to TokenBucket only: how many
+// requests can be sent at once after a quiet spell (0 means Limit).
+type Rule struct {
+	Limit  int
+	Window time.Duration
+	Burst  int
+}
+
+// Result is the outcome of counting one request.
+type Result struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// Reset is when the counter is back to its full limit, RetryAfter when a rejected
+	// request may be retried
+	Reset      time.Duration
+	RetryAfter time.Duration
+}
+
+// Limiter applies Rules with one algorithm, keeping its state in Store.
+type Limiter struct {
+	Store     Store
+	Algorithm Algorithm
+	// Burst is the default Rule.Burst for TokenBucket
+	Burst int
+}
+
+// Policy describes a rule for the RateLimit-Policy header, e.g. "600;w=60" or
+// "600;w=60;burst=50".
+func (l *Limiter) Policy(r Rule) string {
+	p := fmt.Sprintf("%d;w=%d", r.Limit, int64(r.Window/time.Second))
+	if l.Algorithm == TokenBucket {
+		p += ";burst=" + strconv.Itoa(l.burst(r))
+	}
+	return p
+}
+
+// Allow counts a request under key against r.
+func (l *Limiter) Allow(ctx context.Context, key string, r Rule) (Result, error) {
+	now := time.Now()
+	switch l.Algorithm {
+	case SlidingWindow:
+		return l.slidingWindow(ctx, key, r, now)
+	case TokenBucket:
+		return l.tokenBucket(ctx, key, r, now)
+	}
+	return l.fixedWindow(ctx, key, r, now)
+}
+
+func (l *Limiter) burst(r Rule) int {
+	b := r.Burst
+	if b <= 0 {
+		b = l.Burst
+	}
+	if b <= 0 || b > r.Limit {
+		b = r.Limit
+	}
+	return b
+}
+
+func windowKey(key string, window int64) string {
+	return key + ":" + strconv.FormatInt(window, 10)
+}
+
+func (l *Limiter) fixedWindow(ctx context.Context, key string, r Rule, now time.Time) (Result, error) {
+	w := int64(r.Window)
+	window := now.UnixNano() / w
+	count, err := l.Store.Incr(ctx, windowKey(key, window), r.Window)
+	if err != nil {
+		return Result{}, err
+	}
+	reset := time.Duration((window+1)*w - now.UnixNano())
+	res := Result{Allowed: count <= int64(r.Limit), Limit: r.Limit, Remaining: max(r.Limit-int(count), 0), Reset: reset}
+	if !res.Allowed {
+		res.RetryAfter = reset
+	}
+	return res, nil
+}
+
+func (l *Limiter) slidingWindow(ctx context.Context, key string, r Rule, now time.Time) (Result, error) {
+	w := int64(r.Window)
+	window := now.UnixNano() / w
+	// the current window's counter is read again as the previous one, so it lives two windows
+	cur, err := l.Store.Incr(ctx, windowKey(key, window), 2*r.Window)
+	if err != nil {
+		return Result{}, err
+	}
+	prev, err := l.Store.Get(ctx, windowKey(key, window-1))
+	if err != nil {
+		return Result{}, err
+	}
+	elapsed := float64(now.UnixNano()-window*w) / float64(w)
+	estimate := float64(prev)*(1-elapsed) + float64(cur)
+	limit := float64(r.Limit)
+	toWindowEnd := time.Duration((window+1)*w - now.UnixNano())
+	res := Result{
+		Allowed:   estimate <= limit,
+		Limit:     r.Limit,
+		Remaining: max(r.Limit-int(math.Ceil(estimate)), 0),
+		// by the end of the next window this window's requests have slid out too
+		Reset: toWindowEnd + r.Window,
+	}
+	if !res.Allowed {
+		// the previous window's weight falls until the estimate is back under the limit; if
+		// this window alone is over, wait for it to become the previous one
+		res.RetryAfter = toWindowEnd
+		if float64(cur) < limit && prev > 0 {
+			at := 1 - (limit-float64(cur))/float64(prev)
+			res.RetryAfter = time.Duration((at - elapsed) * float64(w))
+		}
+	}
+	return res, nil
+}
+
+func (l *Limiter) tokenBucket(ctx context.Context, key string, r Rule, now time.Time) (Result, error) {
+	// GCRA: each request moves the theoretical arrival time (tat) on by one emission interval;
+	// a request is allowed while tat stays within burst intervals of now
+	interval := r.Window / time.Duration(r.Limit)
+	capacity := time.Duration(l.burst(r)) * interval
+	var res Result
+	err := l.Store.Update(ctx, key+":tb", func(cur int64) (int64, time.Duration, bool) {
+		nowUs := now.UnixMicro()
+		tat := max(cur, nowUs)
+		next := tat + interval.Microseconds()
+		ahead := time.Duration(next-nowUs) * time.Microsecond
+		res = Result{Limit: l.burst(r)}
+		if ahead > capacity {
+			backlog := time.Duration(tat-nowUs) * time.Microsecond
+			res.Reset = backlog
+			res.RetryAfter = ahead - capacity
+			return 0, 0, false
+		}
+		res.Allowed = true
+		res.Remaining = int((capacity - ahead) / interval)
+		res.Reset = ahead
+		return next, ahead, true
+	})
+	return res, err
+}
@@ -0,0 +1,54 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestAlgorithms(t *testing.T) {
+	ctx := context.Background()
+	allow := func(l *Limiter, key string, r Rule, n int) []bool {
+		out := make([]bool, n)
+		for i := range out {
+			res, err := l.Allow(ctx, key, r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out[i] = res.Allowed
+		}
+		return out
+	}
+
+	// the token bucket lets a burst through, then refills one token per interval
+	tb := &Limiter{Store: NewMemoryStore(0), Algorithm: TokenBucket, Burst: 3}
+	rule := Rule{Limit: 10, Window: time.Second}
+	if got := allow(tb, "tb", rule, 4); !got[0] || !got[2] || got[3] {
+		t.Fatalf("token bucket burst: %v", got)
+	}
+	res, _ := tb.Allow(ctx, "tb", rule)
+	if res.Allowed || res.RetryAfter <= 0 || res.RetryAfter > 100*time.Millisecond {
+		t.Fatalf("token bucket rejection: %+v", res)
+	}
+	time.Sleep(110 * time.Millisecond)
+	if res, _ := tb.Allow(ctx, "tb", rule); !res.Allowed || res.Remaining != 0 {
+		t.Fatalf("token bucket refill: %+v", res)
+	}
+	if p := tb.Policy(rule); p != "10;w=1;burst=3" {
+		t.Fatalf("policy %q", p)
+	}
+
+	// the sliding window still counts the previous window's requests after the boundary,
+	// where a fixed window would allow a second full limit
+	sw := &Limiter{Store: NewMemoryStore(0), Algorithm: SlidingWindow}
+	rule = Rule{Limit: 4, Window: 200 * time.Millisecond}
+	time.Sleep(time.Until(time.Now().Truncate(rule.Window).Add(rule.Window - 20*time.Millisecond)))
+	if got := allow(sw, "sw", rule, 4); !got[3] {
+		t.Fatalf("sliding window within limit: %v", got)
+	}
+	time.Sleep(30 * time.Millisecond)
+	res, _ = sw.Allow(ctx, "sw", rule)
+	if res.Allowed || res.RetryAfter <= 0 || res.RetryAfter > rule.Window {
+		t.Fatalf("sliding window after the boundary: %+v", res)
+	}
+}
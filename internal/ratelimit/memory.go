@@ -0,0 +1,136 @@
+package ratelimit
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps counters in the local process, in a heap ordered by expiry. Writes drop the
+// expired counters at its top, and when maxKeys counters are live the one closest to expiry is
+// evicted to make room, both in O(log n).
+type MemoryStore struct {
+	mu       sync.Mutex
+	maxKeys  int
+	counters map[string]*memoryCounter
+	expiry   expiryHeap
+}
+
+type memoryCounter struct {
+	key     string
+	count   int64
+	expires time.Time
+	index   int // position in the expiry heap
+}
+
+// NewMemoryStore returns a store holding at most maxKeys counters (0 means unbounded).
+func NewMemoryStore(maxKeys int) *MemoryStore {
+	return &MemoryStore{maxKeys: maxKeys, counters: map[string]*memoryCounter{}}
+}
+
+func (s *MemoryStore) Incr(_ context.Context, key string, ttl time.Duration) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.dropExpired(now)
+	c, ok := s.counters[key]
+	if !ok {
+		c = s.add(key)
+	}
+	if !now.Before(c.expires) {
+		c.count = 0
+		c.expires = now.Add(ttl)
+		heap.Fix(&s.expiry, c.index)
+	}
+	c.count++
+	return c.count, nil
+}
+
+func (s *MemoryStore) Get(_ context.Context, key string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.counters[key]
+	if !ok || !time.Now().Before(c.expires) {
+		return 0, nil
+	}
+	return c.count, nil
+}
+
+func (s *MemoryStore) Update(_ context.Context, key string, fn func(int64) (int64, time.Duration, bool)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.dropExpired(now)
+	var cur int64
+	c, ok := s.counters[key]
+	if ok {
+		cur = c.count
+	}
+	next, ttl, write := fn(cur)
+	if !write {
+		return nil
+	}
+	if !ok {
+		c = s.add(key)
+	}
+	c.count = next
+	c.expires = now.Add(ttl)
+	heap.Fix(&s.expiry, c.index)
+	return nil
+}
+
+// Len returns the number of counters held, expired or not.
+func (s *MemoryStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.counters)
+}
+
+// add inserts an empty counter for key, evicting the one closest to expiry when the store is
+// full. The caller sets its count and expiry.
+func (s *MemoryStore) add(key string) *memoryCounter {
+	if s.maxKeys > 0 && len(s.counters) >= s.maxKeys {
+		s.remove(s.expiry[0])
+	}
+	c := &memoryCounter{key: key}
+	s.counters[key] = c
+	heap.Push(&s.expiry, c)
+	return c
+}
+
+func (s *MemoryStore) dropExpired(now time.Time) {
+	for len(s.expiry) > 0 && !now.Before(s.expiry[0].expires) {
+		s.remove(s.expiry[0])
+	}
+}
+
+func (s *MemoryStore) remove(c *memoryCounter) {
+	heap.Remove(&s.expiry, c.index)
+	delete(s.counters, c.key)
+}
+
+// expiryHeap orders counters by expiry, the soonest first.
+type expiryHeap []*memoryCounter
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].expires.Before(h[j].expires) }
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *expiryHeap) Push(x any) {
+	c := x.(*memoryCounter)
+	c.index = len(*h)
+	*h = append(*h, c)
+}
+
+func (h *expiryHeap) Pop() any {
+	old := *h
+	c := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return c
+}
@@ -0,0 +1,101 @@
+package ratelimit
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// postgresSweepInterval is how often one Incr also deletes expired counters.
+const postgresSweepInterval = time.Minute
+
+// PostgresStore keeps counters in the rate_limit_counters table, shared by every instance on
+// the same database. The table is UNLOGGED: counters are lost on a database crash, which only
+// resets the current windows.
+type PostgresStore struct {
+	db        *sql.DB
+	nextSweep atomic.Int64
+}
+
+// NewPostgresStore returns a store using db.
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+func (s *PostgresStore) Incr(ctx context.Context, key string, ttl time.Duration) (int64, error) {
+	s.maybeSweep()
+	var n int64
+	// a counter past its expiry is restarted in place, so the sweep is only housekeeping
+	err := s.db.QueryRowContext(ctx, `INSERT INTO rate_limit_counters (key, count, expires_at)
+		VALUES ($1, 1, NOW() + make_interval(secs => $2))
+		ON CONFLICT (key) DO UPDATE SET
+			count = CASE WHEN rate_limit_counters.expires_at <= NOW() THEN 1 ELSE rate_limit_counters.count + 1 END,
+			expires_at = CASE WHEN rate_limit_counters.expires_at <= NOW() THEN EXCLUDED.expires_at ELSE rate_limit_counters.expires_at END
+		RETURNING count`, key, ttl.Seconds()).Scan(&n)
+	return n, err
+}
+
+func (s *PostgresStore) Get(ctx context.Context, key string) (int64, error) {
+	var n int64
+	err := s.db.QueryRowContext(ctx, `SELECT count FROM rate_limit_counters WHERE key = $1 AND expires_at > NOW()`, key).Scan(&n)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return n, err
+}
+
+// Update reads the row and writes it back only if its xmin (the id of the transaction that
+// last wrote it) is unchanged, retrying when another instance got there first.
+func (s *PostgresStore) Update(ctx context.Context, key string, fn func(int64) (int64, time.Duration, bool)) error {
+	s.maybeSweep()
+	for i := 0; i < maxUpdateAttempts; i++ {
+		var cur int64
+		var live bool
+		var version sql.NullString
+		err := s.db.QueryRowContext(ctx, `SELECT count, expires_at > NOW(), xmin::text FROM rate_limit_counters WHERE key = $1`, key).
+			Scan(&cur, &live, &version)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		if !live {
+			cur = 0
+		}
+		next, ttl, write := fn(cur)
+		if !write {
+			return nil
+		}
+		var res sql.Result
+		if version.Valid {
+			res, err = s.db.ExecContext(ctx, `UPDATE rate_limit_counters SET count = $1, expires_at = NOW() + make_interval(secs => $2)
+				WHERE key = $3 AND xmin::text = $4`, next, ttl.Seconds(), key, version.String)
+		} else {
+			res, err = s.db.ExecContext(ctx, `INSERT INTO rate_limit_counters (key, count, expires_at) VALUES ($1, $2, NOW() + make_interval(secs => $3))
+				ON CONFLICT (key) DO NOTHING`, key, next, ttl.Seconds())
+		}
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 1 {
+			return nil
+		}
+		if err := backoff(ctx, i); err != nil {
+			return err
+		}
+	}
+	return ErrContention
+}
+
+func (s *PostgresStore) maybeSweep() {
+	now := time.Now().UnixNano()
+	next := s.nextSweep.Load()
+	if now < next || !s.nextSweep.CompareAndSwap(next, now+int64(postgresSweepInterval)) {
+		return
+	}
+	go func() {
+		if _, err := s.db.Exec(`DELETE FROM rate_limit_counters WHERE expires_at < NOW()`); err != nil {
+			log.Printf("rate limit counter sweep failed: %v", err)
+		}
+	}()
+}
@@ -0,0 +1,313 @@
+package ratelimit
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// redisTimeout bounds dialing and each command when the context has no earlier deadline.
+const redisTimeout = time.Second
+
+// RedisStore keeps counters in Redis, or anything speaking its protocol (Valkey, KeyDB, ...).
+// It needs only GET, SET, INCR and WATCH/MULTI/EXEC, so no scripting or cluster support is
+// assumed.
+type RedisStore struct {
+	addr     string
+	username string
+	password string
+	db       int
+	tls      *tls.Config
+	idle     chan *redisConn
+}
+
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// NewRedisStore parses a URL such as redis://:password@host:6379/0 (rediss:// for TLS) and
+// returns a store keeping up to poolSize idle connections. Connections are opened on demand.
+func NewRedisStore(rawURL string, poolSize int) (*RedisStore, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis url: %w", err)
+	}
+	s := &RedisStore{addr: u.Host, idle: make(chan *redisConn, max(poolSize, 1))}
+	switch u.Scheme {
+	case "redis":
+	case "rediss":
+		s.tls = &tls.Config{ServerName: u.Hostname()}
+	default:
+		return nil, fmt.Errorf("redis url scheme must be redis or rediss, got %q", u.Scheme)
+	}
+	if u.Port() == "" {
+		s.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		s.username = u.User.Username()
+		s.password, _ = u.User.Password()
+	}
+	if p := strings.Trim(u.Path, "/"); p != "" {
+		if s.db, err = strconv.Atoi(p); err != nil || s.db < 0 {
+			return nil, fmt.Errorf("redis url database must be a number, got %q", p)
+		}
+	}
+	return s, nil
+}
+
+func (s *RedisStore) Incr(ctx context.Context, key string, ttl time.Duration) (int64, error) {
+	ms := strconv.FormatInt(max(ttl.Milliseconds(), 1), 10)
+	// SET ... NX creates the counter with its expiry only if it is missing; INCR keeps the expiry
+	replies, err := s.pipeline(ctx, []string{"SET", key, "0", "PX", ms, "NX"}, []string{"INCR", key})
+	if err != nil {
+		return 0, err
+	}
+	n, ok := replies[1].(int64)
+	if !ok {
+		return 0, fmt.Errorf("redis INCR: unexpected reply %v", replies[1])
+	}
+	return n, nil
+}
+
+func (s *RedisStore) Get(ctx context.Context, key string) (int64, error) {
+	replies, err := s.pipeline(ctx, []string{"GET", key})
+	if err != nil {
+		return 0, err
+	}
+	return redisInt(replies[0])
+}
+
+// Update watches the key, so the transaction writing fn's result fails if another client
+// changed the key after it was read.
+func (s *RedisStore) Update(ctx context.Context, key string, fn func(int64) (int64, time.Duration, bool)) error {
+	return s.withConn(ctx, func(c *redisConn) error {
+		for i := 0; i < maxUpdateAttempts; i++ {
+			replies, err := c.do(ctx, []string{"WATCH", key}, []string{"GET", key})
+			if err != nil {
+				return err
+			}
+			cur, err := redisInt(replies[1])
+			if err != nil {
+				return err
+			}
+			next, ttl, write := fn(cur)
+			if !write {
+				_, err := c.do(ctx, []string{"UNWATCH"})
+				return err
+			}
+			ms := strconv.FormatInt(max(ttl.Milliseconds(), 1), 10)
+			replies, err = c.do(ctx, []string{"MULTI"}, []string{"SET", key, strconv.FormatInt(next, 10), "PX", ms}, []string{"EXEC"})
+			if err != nil {
+				return err
+			}
+			// EXEC replies with a null array when a watched key changed
+			if replies[2] != nil {
+				return nil
+			}
+			if err := backoff(ctx, i); err != nil {
+				return err
+			}
+		}
+		return ErrContention
+	})
+}
+
+// redisInt parses a counter read with GET; a missing key is 0.
+func redisInt(v any) (int64, error) {
+	switch v := v.(type) {
+	case nil:
+		return 0, nil
+	case int64:
+		return v, nil
+	case string:
+		return strconv.ParseInt(v, 10, 64)
+	}
+	return 0, fmt.Errorf("redis: unexpected reply %v", v)
+}
+
+// Close closes the idle connections.
+func (s *RedisStore) Close() {
+	for {
+		select {
+		case c := <-s.idle:
+			c.Close()
+		default:
+			return
+		}
+	}
+}
+
+// pipeline sends the commands in one write and reads one reply per command. Redis error
+// replies are returned as errors.
+func (s *RedisStore) pipeline(ctx context.Context, cmds ...[]string) ([]any, error) {
+	var replies []any
+	err := s.withConn(ctx, func(c *redisConn) error {
+		var err error
+		replies, err = c.do(ctx, cmds...)
+		return err
+	})
+	return replies, err
+}
+
+// withConn runs fn on a pooled connection. The connection goes back to the pool unless fn
+// failed with something other than a Redis error reply, which may leave it mid-reply.
+func (s *RedisStore) withConn(ctx context.Context, fn func(c *redisConn) error) error {
+	c, err := s.conn(ctx)
+	if err != nil {
+		return err
+	}
+	err = fn(c)
+	var redisErr redisError
+	if err != nil && !errors.As(err, &redisErr) {
+		c.Close()
+		return err
+	}
+	select {
+	case s.idle <- c:
+	default:
+		c.Close()
+	}
+	return err
+}
+
+func (s *RedisStore) conn(ctx context.Context) (*redisConn, error) {
+	select {
+	case c := <-s.idle:
+		return c, nil
+	default:
+	}
+	d := net.Dialer{Timeout: redisTimeout}
+	var nc net.Conn
+	var err error
+	if s.tls != nil {
+		nc, err = (&tls.Dialer{NetDialer: &d, Config: s.tls}).DialContext(ctx, "tcp", s.addr)
+	} else {
+		nc, err = d.DialContext(ctx, "tcp", s.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{Conn: nc, r: bufio.NewReader(nc)}
+	var setup [][]string
+	if s.password != "" {
+		if s.username != "" {
+			setup = append(setup, []string{"AUTH", s.username, s.password})
+		} else {
+			setup = append(setup, []string{"AUTH", s.password})
+		}
+	}
+	if s.db != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(s.db)})
+	}
+	if len(setup) > 0 {
+		if _, err := c.do(ctx, setup...); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+func (c *redisConn) do(ctx context.Context, cmds ...[]string) ([]any, error) {
+	deadline := time.Now().Add(redisTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err := c.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+	var b strings.Builder
+	for _, args := range cmds {
+		fmt.Fprintf(&b, "*%d\r\n", len(args))
+		for _, a := range args {
+			fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+		}
+	}
+	if _, err := io.WriteString(c, b.String()); err != nil {
+		return nil, err
+	}
+	// read every reply even after an error reply, so the connection stays in sync
+	replies := make([]any, len(cmds))
+	var firstErr error
+	for i := range cmds {
+		v, err := readReply(c.r)
+		var redisErr redisError
+		if err != nil && !errors.As(err, &redisErr) {
+			return nil, err
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		replies[i] = v
+	}
+	return replies, firstErr
+}
+
+// readReply reads one RESP2 reply: a string, int64, nil, []any or a redisError.
+func readReply(r *bufio.Reader) (any, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	kind, body := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, redisError(body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, fmt.Errorf("redis: malformed bulk length %q", body)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, fmt.Errorf("redis: malformed array length %q", body)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		// an error inside an array (e.g. one command of an EXEC) becomes that item, so the
+		// rest of the array is still read
+		items := make([]any, n)
+		for i := range items {
+			v, err := readReply(r)
+			var redisErr redisError
+			if errors.As(err, &redisErr) {
+				v = redisErr
+			} else if err != nil {
+				return nil, err
+			}
+			items[i] = v
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply type %q", kind)
+}
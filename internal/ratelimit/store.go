@@ -0,0 +1,44 @@
+// Package ratelimit holds the counters behind the rate-limit middleware. A Store shared by
+// every replica (Postgres or Redis) makes limits hold across instances; the in-memory store
+// only counts requests the local process sees.
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"time"
+)
+
+// Store counts requests under a key. Callers put the window in the key (e.g. "ip:203.0.113.7:29012345"),
+// so a counter only needs to live as long as its window.
+type Store interface {
+	// Incr adds one to the counter and returns the new count. A counter that doesn't exist, or
+	// whose ttl has passed, starts again from zero and expires ttl from now.
+	Incr(ctx context.Context, key string, ttl time.Duration) (int64, error)
+	// Get returns the counter, or 0 if it doesn't exist or has expired.
+	Get(ctx context.Context, key string) (int64, error)
+	// Update replaces the value with fn's result as one atomic step: if another instance
+	// changes the key in between, fn runs again on the new value. fn gets 0 for a missing or
+	// expired key; when it returns write=false the key is left alone.
+	Update(ctx context.Context, key string, fn func(cur int64) (next int64, ttl time.Duration, write bool)) error
+}
+
+// maxUpdateAttempts bounds how often Update retries under contention on one key.
+const maxUpdateAttempts = 50
+
+// ErrContention is returned by Update when the key kept changing under it.
+var ErrContention = errors.New("rate limit store: too much contention on key")
+
+// backoff waits a little, more with every attempt, before an Update retries, so concurrent
+// writers of one key don't keep colliding.
+func backoff(ctx context.Context, attempt int) error {
+	t := time.NewTimer(time.Duration(rand.Int64N(int64(attempt+1) * int64(time.Millisecond))))
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,282 @@
+package ratelimit
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"otp/internal/db"
+)
+
+// testStore checks that two handles on the same backing store (two replicas) share counters.
+func testStore(t *testing.T, a, b Store) {
+	t.Helper()
+	ctx := context.Background()
+	key := fmt.Sprintf("test:%d", time.Now().UnixNano())
+	for i, s := range []Store{a, b, a} {
+		n, err := s.Incr(ctx, key, time.Minute)
+		if err != nil || n != int64(i+1) {
+			t.Fatalf("incr %d: got %d, %v", i, n, err)
+		}
+	}
+	if n, err := b.Get(ctx, key); err != nil || n != 3 {
+		t.Fatalf("get: got %d, %v", n, err)
+	}
+	double := func(cur int64) (int64, time.Duration, bool) { return cur * 2, time.Minute, true }
+	if err := a.Update(ctx, key, double); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Update(ctx, key+":new", func(cur int64) (int64, time.Duration, bool) { return cur + 7, time.Minute, true }); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Update(ctx, key, func(int64) (int64, time.Duration, bool) { return 0, 0, false }); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := a.Get(ctx, key); n != 6 {
+		t.Fatalf("update: got %d, want 6", n)
+	}
+	if n, _ := a.Get(ctx, key+":new"); n != 7 {
+		t.Fatalf("update of a missing key: got %d, want 7", n)
+	}
+	// an expired counter starts over
+	short := key + ":short"
+	if _, err := a.Incr(ctx, short, 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if n, err := b.Incr(ctx, short, time.Minute); err != nil || n != 1 {
+		t.Fatalf("expired counter: got %d, %v", n, err)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	s := NewMemoryStore(3)
+	testStore(t, s, s)
+	for i := 0; i < 10; i++ {
+		if _, err := s.Incr(context.Background(), strconv.Itoa(i), time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s.Len() != 3 {
+		t.Fatalf("store holds %d counters, want 3", s.Len())
+	}
+
+	// a full store evicts the counter closest to expiry
+	s = NewMemoryStore(2)
+	ctx := context.Background()
+	s.Incr(ctx, "long", time.Hour)
+	s.Incr(ctx, "short", time.Minute)
+	s.Incr(ctx, "new", time.Minute)
+	if n, _ := s.Get(ctx, "long"); n != 1 {
+		t.Fatal("evicted the counter furthest from expiry")
+	}
+	if n, _ := s.Get(ctx, "short"); n != 0 {
+		t.Fatal("kept the counter closest to expiry")
+	}
+
+	// expired counters are dropped on the next write
+	s = NewMemoryStore(0)
+	s.Incr(ctx, "brief", time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	s.Incr(ctx, "long", time.Hour)
+	if s.Len() != 1 {
+		t.Fatalf("store holds %d counters after expiry, want 1", s.Len())
+	}
+}
+
+func TestPostgresStore(t *testing.T) {
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("set TEST_DATABASE_URL to run against Postgres")
+	}
+	if err := db.Init(url); err != nil {
+		t.Skipf("DB unavailable: %v", err)
+	}
+	testStore(t, NewPostgresStore(db.DB), NewPostgresStore(db.DB))
+}
+
+func TestRedisStore(t *testing.T) {
+	addr := fakeRedis(t, "s3cret")
+	a, err := NewRedisStore("redis://:s3cret@"+addr+"/2", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, _ := NewRedisStore("redis://:s3cret@"+addr+"/2", 2)
+	defer b.Close()
+	testStore(t, a, b)
+
+	// concurrent updates from several clients all land
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(s *RedisStore) {
+			defer wg.Done()
+			if err := s.Update(context.Background(), "shared", func(cur int64) (int64, time.Duration, bool) { return cur + 1, time.Minute, true }); err != nil {
+				t.Error(err)
+			}
+		}([]*RedisStore{a, b}[i%2])
+	}
+	wg.Wait()
+	if n, _ := a.Get(context.Background(), "shared"); n != 20 {
+		t.Fatalf("concurrent updates: got %d, want 20", n)
+	}
+
+	bad, _ := NewRedisStore("redis://:wrong@"+addr, 1)
+	if _, err := bad.Incr(context.Background(), "k", time.Minute); err == nil {
+		t.Fatal("expected a wrong password to be rejected")
+	}
+}
+
+// fakeRedis serves the few Redis commands RedisStore uses, in process, and returns its address.
+func fakeRedis(t *testing.T, password string) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	type entry struct {
+		val     string
+		expires time.Time
+	}
+	var mu sync.Mutex
+	data := map[string]entry{}
+	// bumped on every write, for WATCH
+	versions := map[string]int{}
+	get := func(k string) (entry, bool) {
+		e, ok := data[k]
+		if ok && !e.expires.IsZero() && !time.Now().Before(e.expires) {
+			delete(data, k)
+			return entry{}, false
+		}
+		return e, ok
+	}
+	type session struct {
+		authed  bool
+		watched map[string]int
+		queue   [][]string
+		multi   bool
+	}
+	var run func(args []string, s *session) string
+	handle := func(args []string, s *session) string {
+		mu.Lock()
+		defer mu.Unlock()
+		return run(args, s)
+	}
+	run = func(args []string, s *session) string {
+		cmd := strings.ToUpper(args[0])
+		if s.multi && cmd != "EXEC" {
+			s.queue = append(s.queue, args)
+			return "+QUEUED\r\n"
+		}
+		authed := &s.authed
+		if cmd == "AUTH" {
+			if args[len(args)-1] != password {
+				return "-WRONGPASS invalid password\r\n"
+			}
+			*authed = true
+			return "+OK\r\n"
+		}
+		if !*authed {
+			return "-NOAUTH Authentication required.\r\n"
+		}
+		switch cmd {
+		case "SELECT", "PING":
+			return "+OK\r\n"
+		case "WATCH":
+			s.watched[args[1]] = versions[args[1]]
+			return "+OK\r\n"
+		case "UNWATCH":
+			s.watched = map[string]int{}
+			return "+OK\r\n"
+		case "MULTI":
+			s.multi = true
+			return "+OK\r\n"
+		case "EXEC":
+			queue, watched := s.queue, s.watched
+			s.multi, s.queue, s.watched = false, nil, map[string]int{}
+			for k, v := range watched {
+				if versions[k] != v {
+					return "*-1\r\n"
+				}
+			}
+			out := fmt.Sprintf("*%d\r\n", len(queue))
+			for _, q := range queue {
+				out += run(q, s)
+			}
+			return out
+		case "GET":
+			e, ok := get(args[1])
+			if !ok {
+				return "$-1\r\n"
+			}
+			return fmt.Sprintf("$%d\r\n%s\r\n", len(e.val), e.val)
+		case "SET":
+			e := entry{val: args[2]}
+			nx := false
+			for i := 3; i < len(args); i++ {
+				switch strings.ToUpper(args[i]) {
+				case "NX":
+					nx = true
+				case "PX":
+					ms, _ := strconv.Atoi(args[i+1])
+					e.expires = time.Now().Add(time.Duration(ms) * time.Millisecond)
+					i++
+				}
+			}
+			if _, ok := get(args[1]); ok && nx {
+				return "$-1\r\n"
+			}
+			data[args[1]] = e
+			versions[args[1]]++
+			return "+OK\r\n"
+		case "INCR":
+			e, _ := get(args[1])
+			n, _ := strconv.ParseInt(e.val, 10, 64)
+			e.val = strconv.FormatInt(n+1, 10)
+			data[args[1]] = e
+			versions[args[1]]++
+			return ":" + e.val + "\r\n"
+		}
+		return "-ERR unknown command '" + args[0] + "'\r\n"
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				s := &session{authed: password == "", watched: map[string]int{}}
+				for {
+					v, err := readReply(r)
+					if err != nil {
+						return
+					}
+					items, _ := v.([]any)
+					args := make([]string, len(items))
+					for i, it := range items {
+						args[i], _ = it.(string)
+					}
+					if len(args) == 0 {
+						return
+					}
+					if _, err := conn.Write([]byte(handle(args, s))); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
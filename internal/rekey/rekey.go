@@ -0,0 +1,381 @@
+// Package rekey moves stored ciphertexts onto the current key-encryption key so old keys can be
+// retired: ciphertexts in older formats are re-sealed with their customer's data key, and
+// customer data keys wrapped by an older KEK are re-wrapped. Jobs keep a keyset cursor in
+// rekey_jobs and resume where they stopped after a restart.
+package rekey
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+	"otp/internal/crypto"
+	"otp/internal/db"
+)
+
+const (
+	StatusRunning   = "running"
+	StatusPaused    = "paused"
+	StatusCompleted = "completed"
+	StatusFailed    = "failed"
+
+	batchSize = 100
+)
+
+var (
+	ErrJobActive   = errors.New("a re-encryption job is already running or paused")
+	ErrJobNotFound = errors.New("job not found")
+)
+
+// Job is the persisted state of a re-encryption run.
+type Job struct {
+	ID            string     `json:"id"`
+	TargetVersion int        `json:"target_version"`
+	Status        string     `json:"status"`
+	Total         int        `json:"total"`
+	Scanned       int        `json:"scanned"`
+	Rewritten     int        `json:"rewritten"`
+	Error         string     `json:"error,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+	CompletedAt   *time.Time `json:"completed_at,omitempty"`
+}
+
+const jobColumns = `id, target_version, status, total, scanned, rewritten, COALESCE(error, ''), created_at, updated_at, completed_at`
+
+func scanJob(row interface{ Scan(...any) error }) (Job, error) {
+	var j Job
+	var completed sql.NullTime
+	err := row.Scan(&j.ID, &j.TargetVersion, &j.Status, &j.Total, &j.Scanned, &j.Rewritten, &j.Error, &j.CreatedAt, &j.UpdatedAt, &completed)
+	if completed.Valid {
+		j.CompletedAt = &completed.Time
+	}
+	return j, err
+}
+
+// Start creates a job and runs it in the background. target_version records the active keyring
+// version for reference; the job always targets the provider's current KEK.
+func Start() (Job, error) {
+	var active bool
+	if err := db.DB.QueryRow(`SELECT EXISTS(SELECT 1 FROM rekey_jobs WHERE status IN ('running', 'paused'))`).Scan(&active); err != nil {
+		return Job{}, err
+	}
+	if active {
+		return Job{}, ErrJobActive
+	}
+	j, err := scanJob(db.DB.QueryRow(`INSERT INTO rekey_jobs (target_version, total) VALUES ($1, (SELECT COUNT(*) FROM mfa_users))
+		RETURNING `+jobColumns, crypto.ActiveVersion()))
+	if err != nil {
+		return Job{}, err
+	}
+	go Run(j.ID)
+	return j, nil
+}
+
+// Get returns a job by id.
+func Get(id string) (Job, error) {
+	j, err := scanJob(db.DB.QueryRow(`SELECT `+jobColumns+` FROM rekey_jobs WHERE id = $1`, id))
+	if err == sql.ErrNoRows {
+		return Job{}, ErrJobNotFound
+	}
+	return j, err
+}
+
+// Latest returns the most recently created job.
+func Latest() (Job, error) {
+	j, err := scanJob(db.DB.QueryRow(`SELECT ` + jobColumns + ` FROM rekey_jobs ORDER BY created_at DESC LIMIT 1`))
+	if err == sql.ErrNoRows {
+		return Job{}, ErrJobNotFound
+	}
+	return j, err
+}
+
+// Pause stops a running job after its current batch.
+func Pause(id string) (Job, error) {
+	j, err := scanJob(db.DB.QueryRow(`UPDATE rekey_jobs SET status = 'paused', updated_at = NOW() WHERE id = $1 AND status = 'running'
+		RETURNING `+jobColumns, id))
+	if err == sql.ErrNoRows {
+		return Job{}, ErrJobNotFound
+	}
+	return j, err
+}
+
+// Resume restarts a paused or failed job from its saved cursor.
+func Resume(id string) (Job, error) {
+	j, err := scanJob(db.DB.QueryRow(`UPDATE rekey_jobs SET status = 'running', error = NULL, updated_at = NOW() WHERE id = $1 AND status IN ('paused', 'failed')
+		RETURNING `+jobColumns, id))
+	if err == sql.ErrNoRows {
+		return Job{}, ErrJobNotFound
+	}
+	if err != nil {
+		return Job{}, err
+	}
+	go Run(j.ID)
+	return j, nil
+}
+
+// ResumeRunning continues jobs that were running when the process last stopped.
+func ResumeRunning() {
+	rows, err := db.DB.Query(`SELECT id FROM rekey_jobs WHERE status = 'running'`)
+	if err != nil {
+		log.Printf("rekey: resume query failed: %v", err)
+		return
+	}
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	rows.Close()
+	for _, id := range ids {
+		go Run(id)
+	}
+}
+
+// Run processes batches until the job completes, is paused or fails. Each batch holds the job
+// row lock, so concurrent runners (e.g. several instances resuming) serialize on the cursor.
+func Run(id string) {
+	for {
+		done, err := runBatch(id)
+		if err != nil {
+			log.Printf("rekey: job %s failed: %v", id, err)
+			_, _ = db.DB.Exec(`UPDATE rekey_jobs SET status = 'failed', error = $1, updated_at = NOW() WHERE id = $2`, err.Error(), id)
+			return
+		}
+		if done {
+			return
+		}
+	}
+}
+
+func runBatch(id string) (bool, error) {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var status string
+	var curCustomer, curEnv, curUser sql.NullString
+	err = tx.QueryRow(`SELECT status, cursor_customer_id, cursor_environment, cursor_user_id FROM rekey_jobs WHERE id = $1 FOR UPDATE`, id).
+		Scan(&status, &curCustomer, &curEnv, &curUser)
+	if err != nil {
+		return false, err
+	}
+	if status != StatusRunning {
+		return true, nil
+	}
+
+	// jobs saved before environments existed have no cursor_environment; "" sorts before both
+	rows, err := tx.Query(`SELECT `+userColumns+` FROM mfa_users WHERE $1::uuid IS NULL OR (customer_id, environment, user_id) > ($1::uuid, $2, $3)
+		ORDER BY customer_id, environment, user_id LIMIT $4 FOR UPDATE`, curCustomer, curEnv.String, curUser.String, batchSize)
+	if err != nil {
+		return false, err
+	}
+	batch, err := scanUserRows(rows)
+	if err != nil {
+		return false, err
+	}
+	rewritten := 0
+	for _, r := range batch {
+		changed, err := rewrapUser(tx, r)
+		if err != nil {
+			return false, err
+		}
+		if changed {
+			rewritten++
+		}
+	}
+
+	if len(batch) < batchSize {
+		// Sheets are short-lived, and there is one data key per customer, so one pass at the
+		// end is enough for both.
+		n, err := rewrapSheets(tx, "")
+		if err != nil {
+			return false, err
+		}
+		k, err := rewrapTenantKeys(tx)
+		if err != nil {
+			return false, err
+		}
+		n += k
+		_, err = tx.Exec(`UPDATE rekey_jobs SET status = 'completed', scanned = scanned + $1, rewritten = rewritten + $2,
+			updated_at = NOW(), completed_at = NOW() WHERE id = $3`, len(batch), rewritten+n, id)
+		if err != nil {
+			return false, err
+		}
+		return true, tx.Commit()
+	}
+	last := batch[len(batch)-1]
+	_, err = tx.Exec(`UPDATE rekey_jobs SET cursor_customer_id = $1, cursor_environment = $2, cursor_user_id = $3, scanned = scanned + $4, rewritten = rewritten + $5,
+		updated_at = NOW() WHERE id = $6`, last.customerID, last.env, last.userID, len(batch), rewritten, id)
+	if err != nil {
+		return false, err
+	}
+	return false, tx.Commit()
+}
+
+const userColumns = `customer_id, environment, user_id, secret_key_encrypted, COALESCE(backup_codes_encrypted, '{}'), COALESCE(used_backup_codes_encrypted, '{}')`
+
+type userRow struct {
+	customerID, env, userID string
+	secret                  string
+	codes, used             []string
+}
+
+func scanUserRows(rows *sql.Rows) ([]userRow, error) {
+	defer rows.Close()
+	out := []userRow{}
+	for rows.Next() {
+		var r userRow
+		if err := rows.Scan(&r.customerID, &r.env, &r.userID, &r.secret, pq.Array(&r.codes), pq.Array(&r.used)); err != nil {
+			return nil, err
+		}
+		out = append(out, r)
+	}
+	return out, rows.Err()
+}
+
+// rewrapUser brings every ciphertext on an mfa_users row up to date, binding it to the row.
+func rewrapUser(tx *sql.Tx, r userRow) (bool, error) {
+	bind := func(field string) crypto.Binding {
+		return crypto.Binding{CustomerID: r.customerID, UserID: r.userID, Field: field, Environment: r.env}
+	}
+	secret, changed, err := crypto.Rewrap(bind(crypto.FieldMFASecret), r.secret)
+	if err != nil {
+		return false, err
+	}
+	codes, codesChanged, err := rewrapAll(bind(crypto.FieldBackupCode), r.codes)
+	if err != nil {
+		return false, err
+	}
+	used, usedChanged, err := rewrapAll(bind(crypto.FieldUsedBackupCode), r.used)
+	if err != nil {
+		return false, err
+	}
+	if !changed && !codesChanged && !usedChanged {
+		return false, nil
+	}
+	_, err = tx.Exec(`UPDATE mfa_users SET secret_key_encrypted = $1, backup_codes_encrypted = $2, used_backup_codes_encrypted = $3
+		WHERE customer_id = $4 AND environment = $5 AND user_id = $6`, secret, pq.Array(codes), pq.Array(used), r.customerID, r.env, r.userID)
+	return err == nil, err
+}
+
+func rewrapAll(b crypto.Binding, values []string) ([]string, bool, error) {
+	out := make([]string, len(values))
+	changed := false
+	for i, v := range values {
+		nv, ch, err := crypto.Rewrap(b, v)
+		if err != nil {
+			return nil, false, err
+		}
+		out[i] = nv
+		changed = changed || ch
+	}
+	return out, changed, nil
+}
+
+func rewrapSheets(tx *sql.Tx, where string) (int, error) {
+	rows, err := tx.Query(`SELECT customer_id, environment, user_id, codes_encrypted FROM backup_code_sheets ` + where + ` FOR UPDATE`)
+	if err != nil {
+		return 0, err
+	}
+	type sheet struct{ customerID, env, userID, enc string }
+	sheets := []sheet{}
+	for rows.Next() {
+		var s sheet
+		if err := rows.Scan(&s.customerID, &s.env, &s.userID, &s.enc); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		sheets = append(sheets, s)
+	}
+	rows.Close()
+	n := 0
+	for _, s := range sheets {
+		b := crypto.Binding{CustomerID: s.customerID, UserID: s.userID, Field: crypto.FieldBackupCodeSheet, Environment: s.env}
+		enc, changed, err := crypto.Rewrap(b, s.enc)
+		if err != nil {
+			return 0, err
+		}
+		if !changed {
+			continue
+		}
+		if _, err := tx.Exec(`UPDATE backup_code_sheets SET codes_encrypted = $1 WHERE customer_id = $2 AND environment = $3 AND user_id = $4`, enc, s.customerID, s.env, s.userID); err != nil {
+			return 0, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// rewrapTenantKeys re-wraps customer data keys that an older KEK wrapped. Destroyed keys
+// have nothing left to re-wrap.
+func rewrapTenantKeys(tx *sql.Tx) (int, error) {
+	rows, err := tx.Query(`SELECT customer_id, wrapped_key FROM customer_data_keys WHERE wrapped_key IS NOT NULL FOR UPDATE`)
+	if err != nil {
+		return 0, err
+	}
+	type key struct{ customerID, wrapped string }
+	keys := []key{}
+	for rows.Next() {
+		var k key
+		if err := rows.Scan(&k.customerID, &k.wrapped); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		keys = append(keys, k)
+	}
+	rows.Close()
+	n := 0
+	for _, k := range keys {
+		wrapped, changed, err := crypto.RewrapTenantKey(k.customerID, k.wrapped)
+		if err != nil {
+			return 0, err
+		}
+		if !changed {
+			continue
+		}
+		if _, err := tx.Exec(`UPDATE customer_data_keys SET wrapped_key = $1 WHERE customer_id = $2`, wrapped, k.customerID); err != nil {
+			return 0, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// KeyCounts reports how many MFA secrets are stored under each key: "tenant" for secrets
+// sealed with a customer data key, "direct:v<N>" for keyring ciphertexts and "envelope:<kek>"
+// for envelopes (e.g. "envelope:v2", "envelope:k2", "envelope:vault:v3"). Customer data keys
+// are counted by the KEK that wraps them as "kek:<kek>". A KEK with nothing left under it
+// (and no running job) can be retired.
+func KeyCounts() (map[string]int, error) {
+	rows, err := db.DB.Query(`SELECT CASE
+			WHEN secret_key_encrypted LIKE 't1.%' THEN 'tenant'
+			WHEN secret_key_encrypted ~ '^e[0-9]+[.]' THEN 'envelope:' || regexp_replace(split_part(secret_key_encrypted, '.', 2), ':[^:]*$', '')
+			ELSE 'direct:v' || COALESCE(substring(secret_key_encrypted from '^v([0-9]+):'), '1')
+		END AS key, COUNT(*)
+		FROM mfa_users GROUP BY 1
+		UNION ALL
+		SELECT 'kek:' || regexp_replace(wrapped_key, ':[^:]*$', ''), COUNT(*)
+		FROM customer_data_keys WHERE wrapped_key IS NOT NULL GROUP BY 1
+		ORDER BY 1`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := map[string]int{}
+	for rows.Next() {
+		var k string
+		var n int
+		if err := rows.Scan(&k, &n); err != nil {
+			return nil, err
+		}
+		out[k] = n
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,72 @@
+package rekey
+
+import (
+	"log"
+
+	"otp/internal/db"
+)
+
+// SealUnbound re-seals every ciphertext in an older format with its customer's data key,
+// bound to its customer, user and column. It must finish before requests are served, since
+// DecryptFor rejects unbound ciphertexts and erasure only covers customer-key ciphertexts.
+// Rows are claimed with SKIP LOCKED so several instances starting together share the work,
+// then a blocking pass waits for rows other instances still hold. It is a no-op once
+// everything is bound.
+func SealUnbound() error {
+	sealed := 0
+	for _, lock := range []string{"FOR UPDATE SKIP LOCKED", "FOR UPDATE"} {
+		for {
+			n, err := sealBatch(lock)
+			if err != nil {
+				return err
+			}
+			if n == 0 {
+				break
+			}
+			sealed += n
+		}
+	}
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	n, err := rewrapSheets(tx, `WHERE codes_encrypted NOT LIKE 't1.%'`)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if sealed+n > 0 {
+		log.Printf("crypto: re-sealed %d MFA users and %d backup code sheets with customer data keys", sealed, n)
+	}
+	return nil
+}
+
+// sealBatch re-seals up to 100 unbound users, claimed with lock.
+func sealBatch(lock string) (int, error) {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	rows, err := tx.Query(`SELECT ` + userColumns + ` FROM mfa_users
+		WHERE secret_key_encrypted NOT LIKE 't1.%'
+			OR EXISTS (SELECT 1 FROM unnest(backup_codes_encrypted) v WHERE v NOT LIKE 't1.%')
+			OR EXISTS (SELECT 1 FROM unnest(used_backup_codes_encrypted) v WHERE v NOT LIKE 't1.%')
+		LIMIT 100 ` + lock)
+	if err != nil {
+		return 0, err
+	}
+	batch, err := scanUserRows(rows)
+	if err != nil {
+		return 0, err
+	}
+	for _, r := range batch {
+		if _, err := rewrapUser(tx, r); err != nil {
+			return 0, err
+		}
+	}
+	return len(batch), tx.Commit()
+}
@@ -0,0 +1,38 @@
+package rekey
+
+import (
+	"database/sql"
+	"fmt"
+
+	"otp/internal/crypto"
+	"otp/internal/db"
+)
+
+// SelfTest unwraps the canary data key stored by an earlier run, so a wrong or missing
+// key-encryption key stops startup instead of failing every request that touches a secret.
+// The first run writes the canary; later runs move it onto the current KEK.
+func SelfTest() error {
+	var wrapped string
+	err := db.DB.QueryRow(`SELECT wrapped_key FROM crypto_canary WHERE id = 1`).Scan(&wrapped)
+	if err == sql.ErrNoRows {
+		if wrapped, err = crypto.NewCanary(); err != nil {
+			return err
+		}
+		_, err = db.DB.Exec(`INSERT INTO crypto_canary (id, wrapped_key, verified_at) VALUES (1, $1, NOW())
+			ON CONFLICT (id) DO NOTHING`, wrapped)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	out, changed, err := crypto.VerifyCanary(wrapped)
+	if err != nil {
+		return fmt.Errorf("the configured key cannot decrypt data written by an earlier run: %w", err)
+	}
+	if changed {
+		_, err = db.DB.Exec(`UPDATE crypto_canary SET wrapped_key = $1, verified_at = NOW() WHERE id = 1 AND wrapped_key = $2`, out, wrapped)
+	} else {
+		_, err = db.DB.Exec(`UPDATE crypto_canary SET verified_at = NOW() WHERE id = 1`)
+	}
+	return err
+}
@@ -0,0 +1,145 @@
+// Package tenantkeys stores customer data keys in Postgres and implements crypto-shredding:
+// erasing a customer destroys its data key, after which none of its ciphertexts or peppered
+// backup code hashes can be recovered. Data keys are wrapped with a key per customer that the
+// provider keeps outside the database (crypto.TenantKeyProvider), and erasure deletes it too, so
+// database backups taken before the erasure can't recover the data either. A data key still
+// wrapped with the shared KEK is not erased (crypto.ErrTenantKeyShared) until a re-encryption
+// job moves it onto the customer's own key.
+package tenantkeys
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"otp/internal/crypto"
+	"otp/internal/db"
+)
+
+var ErrCustomerNotFound = errors.New("customer not found")
+
+// Store implements crypto.TenantKeyStore on the customer_data_keys table.
+type Store struct{}
+
+func (Store) Get(customerID string) (string, string, error) {
+	var keyID string
+	var wrapped sql.NullString
+	err := db.DB.QueryRow(`SELECT key_id, wrapped_key FROM customer_data_keys WHERE customer_id = $1`, customerID).Scan(&keyID, &wrapped)
+	if err == sql.ErrNoRows {
+		return "", "", crypto.ErrNoTenantKey
+	}
+	if err != nil {
+		return "", "", err
+	}
+	if !wrapped.Valid {
+		return "", "", crypto.ErrTenantKeyDestroyed
+	}
+	return keyID, wrapped.String, nil
+}
+
+func (s Store) Create(customerID, keyID, wrapped string) (string, string, error) {
+	_, err := db.DB.Exec(`INSERT INTO customer_data_keys (customer_id, key_id, wrapped_key) VALUES ($1, $2, $3)
+		ON CONFLICT (customer_id) DO NOTHING`, customerID, keyID, wrapped)
+	if err != nil {
+		return "", "", err
+	}
+	return s.Get(customerID)
+}
+
+// ErasureProof records what an erasure destroyed. It is written to the audit log.
+type ErasureProof struct {
+	CustomerID      string `json:"customer_id"`
+	KeyID           string `json:"key_id,omitempty"`
+	KeyFingerprint  string `json:"key_fingerprint,omitempty"` // SHA-256 of the destroyed wrapped key
+	AlreadyErased   bool   `json:"already_erased"`
+	MFAUsersDeleted int64  `json:"mfa_users_deleted"`
+	APIKeysDisabled int64  `json:"api_keys_disabled"`
+	SessionsRevoked int64  `json:"sessions_revoked"`
+	// Members can no longer sign in; pending invitations are revoked
+	MembersDeactivated int64 `json:"members_deactivated"`
+	// The customer's own wrapping key was deleted from the provider, so backups taken before
+	// the erasure can't recover the data key either. False when no data key existed.
+	TenantKeyDestroyed bool      `json:"tenant_key_destroyed"`
+	DestroyedAt        time.Time `json:"destroyed_at"`
+}
+
+// Erase destroys the customer's data key, deletes its MFA users (and their backup code
+// sheets), disables its API keys, deactivates its members, revokes console sessions and
+// pending invitations and deactivates the account.
+func Erase(customerID string) (ErasureProof, error) {
+	proof := ErasureProof{CustomerID: customerID}
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return proof, err
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	if err := tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM customers WHERE id = $1)`, customerID).Scan(&exists); err != nil {
+		return proof, err
+	}
+	if !exists {
+		return proof, ErrCustomerNotFound
+	}
+
+	var keyID string
+	var wrapped sql.NullString
+	err = tx.QueryRow(`SELECT key_id, wrapped_key FROM customer_data_keys WHERE customer_id = $1 FOR UPDATE`, customerID).Scan(&keyID, &wrapped)
+	switch {
+	case err == sql.ErrNoRows:
+		// no key was ever created; leave a tombstone so none will be
+		_, err = tx.Exec(`INSERT INTO customer_data_keys (customer_id, key_id, wrapped_key, destroyed_at) VALUES ($1, '', NULL, NOW())`, customerID)
+	case err != nil:
+	case !wrapped.Valid:
+		proof.AlreadyErased = true
+		proof.KeyID = keyID
+	default:
+		proof.KeyID = keyID
+		proof.KeyFingerprint = crypto.KeyFingerprint(wrapped.String)
+		// destroyed before the commit: if it fails nothing is erased and the erasure can be
+		// retried, and a retry after a failed commit finds the key already gone
+		if err := crypto.DestroyTenantKey(customerID, wrapped.String); err != nil {
+			return proof, err
+		}
+		proof.TenantKeyDestroyed = true
+		_, err = tx.Exec(`UPDATE customer_data_keys SET wrapped_key = NULL, destroyed_at = NOW() WHERE customer_id = $1`, customerID)
+	}
+	if err != nil {
+		return proof, err
+	}
+
+	res, err := tx.Exec(`DELETE FROM mfa_users WHERE customer_id = $1`, customerID)
+	if err != nil {
+		return proof, err
+	}
+	proof.MFAUsersDeleted, _ = res.RowsAffected()
+	res, err = tx.Exec(`UPDATE api_keys SET is_active = false, updated_at = NOW() WHERE customer_id = $1 AND is_active = true`, customerID)
+	if err != nil {
+		return proof, err
+	}
+	proof.APIKeysDisabled, _ = res.RowsAffected()
+	res, err = tx.Exec(`UPDATE sessions SET revoked_at = NOW() WHERE customer_id = $1 AND revoked_at IS NULL`, customerID)
+	if err != nil {
+		return proof, err
+	}
+	proof.SessionsRevoked, _ = res.RowsAffected()
+	res, err = tx.Exec(`UPDATE members SET is_active = false, updated_at = NOW() WHERE customer_id = $1 AND is_active`, customerID)
+	if err != nil {
+		return proof, err
+	}
+	proof.MembersDeactivated, _ = res.RowsAffected()
+	if _, err := tx.Exec(`UPDATE member_invitations SET revoked_at = NOW() WHERE customer_id = $1 AND accepted_at IS NULL AND revoked_at IS NULL`, customerID); err != nil {
+		return proof, err
+	}
+	if _, err := tx.Exec(`UPDATE customers SET is_active = false, updated_at = NOW() WHERE id = $1`, customerID); err != nil {
+		return proof, err
+	}
+	if err := tx.QueryRow(`SELECT COALESCE(destroyed_at, NOW()) FROM customer_data_keys WHERE customer_id = $1`, customerID).Scan(&proof.DestroyedAt); err != nil {
+		return proof, err
+	}
+	if err := tx.Commit(); err != nil {
+		return proof, err
+	}
+	crypto.ForgetTenantKey(customerID)
+	return proof, nil
+}
@@ -0,0 +1,109 @@
+package tiers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"otp/internal/db"
+)
+
+// Period returns the calendar month (UTC) t falls in, as its first day and the first day of
+// the next month. Monthly quotas reset at the end.
+func Period(t time.Time) (start, end time.Time) {
+	t = t.UTC()
+	start = time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	return start, start.AddDate(0, 1, 0)
+}
+
+// Quota is the state of a customer's monthly validation quota after a request.
+type Quota struct {
+	// Limit is 0 for an unlimited tier
+	Limit int64
+	Used  int64
+	Reset time.Time
+	// Allowed is false once the quota is exhausted; the request was not counted
+	Allowed bool
+	// SoftLimit is set at or above the soft limit, and FirstWarning only on the request that
+	// crossed it first this period
+	SoftLimit    bool
+	FirstWarning bool
+}
+
+// Remaining returns how many validations are left, or -1 for an unlimited tier.
+func (q Quota) Remaining() int64 {
+	if q.Limit == 0 {
+		return -1
+	}
+	return max(q.Limit-q.Used, 0)
+}
+
+// softLimit returns the count at which warnings start, for a soft limit of percent.
+func softLimit(limit int64, percent int) int64 {
+	return (limit*int64(percent) + 99) / 100
+}
+
+// ConsumeValidation counts one validation against the customer's quota for the current month,
+// unless it is already exhausted. Validations are counted on unlimited tiers too, so usage
+// summaries can show them.
+func ConsumeValidation(ctx context.Context, customerID string, t Tier, softPercent int) (Quota, error) {
+	start, end := Period(time.Now())
+	q := Quota{Limit: t.MonthlyValidations, Reset: end}
+	// the conditional update leaves an exhausted counter alone, and then returns no row
+	err := db.DB.QueryRowContext(ctx, `INSERT INTO quota_usage (customer_id, period_start, validations) VALUES ($1, $2, 1)
+		ON CONFLICT (customer_id, period_start) DO UPDATE SET validations = quota_usage.validations + 1
+		WHERE $3 = 0 OR quota_usage.validations < $3
+		RETURNING validations`, customerID, start, q.Limit).Scan(&q.Used)
+	switch {
+	case err == nil:
+		q.Allowed = true
+	case errors.Is(err, sql.ErrNoRows):
+		q.Used = q.Limit
+	default:
+		return q, err
+	}
+	if q.Limit == 0 || q.Used < softLimit(q.Limit, softPercent) {
+		return q, nil
+	}
+	q.SoftLimit = true
+	res, err := db.DB.ExecContext(ctx, `UPDATE quota_usage SET soft_limit_warned_at = NOW()
+		WHERE customer_id = $1 AND period_start = $2 AND soft_limit_warned_at IS NULL`, customerID, start)
+	if err != nil {
+		return q, err
+	}
+	n, _ := res.RowsAffected()
+	q.FirstWarning = n == 1
+	return q, nil
+}
+
+// Validations returns the validations counted for the customer this month.
+func Validations(ctx context.Context, customerID string) (int64, error) {
+	start, _ := Period(time.Now())
+	var n int64
+	err := db.DB.QueryRowContext(ctx, `SELECT COALESCE((SELECT validations FROM quota_usage WHERE customer_id = $1 AND period_start = $2), 0)`,
+		customerID, start).Scan(&n)
+	return n, err
+}
+
+// Querier runs the counts, on db.DB or inside the transaction that adds what they count.
+type Querier interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// MFAUsers counts the customer's active live MFA users, which MaxMFAUsers limits.
+func MFAUsers(ctx context.Context, q Querier, customerID string) (int64, error) {
+	var n int64
+	err := q.QueryRowContext(ctx, `SELECT COUNT(*) FROM mfa_users WHERE customer_id = $1 AND environment = 'live' AND is_active = true`,
+		customerID).Scan(&n)
+	return n, err
+}
+
+// APIKeys counts the customer's active keys, which MaxAPIKeys limits. A rotated key still
+// working through its grace period isn't counted against its replacement.
+func APIKeys(ctx context.Context, q Querier, customerID string) (int64, error) {
+	var n int64
+	err := q.QueryRowContext(ctx, `SELECT COUNT(*) FROM api_keys WHERE customer_id = $1 AND is_active = true AND replaced_by IS NULL`,
+		customerID).Scan(&n)
+	return n, err
+}
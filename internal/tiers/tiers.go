@@ -0,0 +1,138 @@
+// Package tiers is the catalog of subscription tiers: what each one allows (monthly OTP
+// validations, MFA users, API keys and features) and how much of it a customer has used.
+package tiers
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+)
+
+// Features a tier can include. Keys already using a feature keep working after a downgrade;
+// only turning it on is refused.
+const (
+	FeaturePublishableKeys = "publishable_keys"
+	FeatureSignedRequests  = "signed_requests"
+	FeatureIPAllowlists    = "ip_allowlists"
+)
+
+// Features lists every feature a tier can include.
+var Features = []string{FeaturePublishableKeys, FeatureSignedRequests, FeatureIPAllowlists}
+
+// Tier is one entry of the catalog. A zero limit means unlimited. Validations and MFA users
+// only count in the live environment; test keys count towards MaxAPIKeys like live ones.
+type Tier struct {
+	Name               string   `json:"name"`
+	MonthlyValidations int64    `json:"monthly_validations"`
+	MaxMFAUsers        int64    `json:"max_mfa_users"`
+	MaxAPIKeys         int64    `json:"max_api_keys"`
+	Features           []string `json:"features"`
+}
+
+// HasFeature reports whether the tier includes feature.
+func (t Tier) HasFeature(feature string) bool {
+	for _, f := range t.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// DefaultCatalog is used unless TIER_CATALOG_FILE replaces it.
+var DefaultCatalog = []Tier{
+	{Name: "starter", MonthlyValidations: 10000, MaxMFAUsers: 1000, MaxAPIKeys: 5, Features: []string{FeaturePublishableKeys}},
+	{Name: "pro", MonthlyValidations: 250000, MaxMFAUsers: 50000, MaxAPIKeys: 25, Features: Features},
+	{Name: "enterprise", Features: Features},
+}
+
+var (
+	mu      sync.RWMutex
+	catalog = index(DefaultCatalog)
+)
+
+func index(ts []Tier) map[string]Tier {
+	m := make(map[string]Tier, len(ts))
+	for _, t := range ts {
+		m[t.Name] = t
+	}
+	return m
+}
+
+// LoadFile replaces the catalog with a JSON array of tiers, e.g.
+//
+//	[{"name": "starter", "monthly_validations": 10000, "max_mfa_users": 1000, "max_api_keys": 5, "features": ["publishable_keys"]}]
+func LoadFile(path string) error {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var ts []Tier
+	if err := json.Unmarshal(raw, &ts); err != nil {
+		return fmt.Errorf("parse tier catalog: %w", err)
+	}
+	if err := validate(ts); err != nil {
+		return err
+	}
+	Set(ts)
+	return nil
+}
+
+func validate(ts []Tier) error {
+	if len(ts) == 0 {
+		return fmt.Errorf("tier catalog is empty")
+	}
+	known := map[string]bool{}
+	for _, f := range Features {
+		known[f] = true
+	}
+	seen := map[string]bool{}
+	for _, t := range ts {
+		if t.Name == "" || seen[t.Name] {
+			return fmt.Errorf("tier catalog: names must be unique and non-empty, got %q", t.Name)
+		}
+		seen[t.Name] = true
+		if t.MonthlyValidations < 0 || t.MaxMFAUsers < 0 || t.MaxAPIKeys < 0 {
+			return fmt.Errorf("tier %q: limits can't be negative", t.Name)
+		}
+		for _, f := range t.Features {
+			if !known[f] {
+				return fmt.Errorf("tier %q: unknown feature %q", t.Name, f)
+			}
+		}
+	}
+	return nil
+}
+
+// Set replaces the catalog.
+func Set(ts []Tier) {
+	mu.Lock()
+	defer mu.Unlock()
+	catalog = index(ts)
+}
+
+// Get returns a tier of the catalog. Customers on a tier missing from it (e.g. a custom
+// name set before the catalog existed) get an unlimited tier with every feature.
+func Get(name string) (Tier, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	t, ok := catalog[name]
+	if !ok {
+		return Tier{Name: name, Features: Features}, false
+	}
+	return t, true
+}
+
+// Names returns the catalog's tier names, sorted.
+func Names() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	names := make([]string, 0, len(catalog))
+	for n := range catalog {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,52 @@
+package tiers
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCatalog(t *testing.T) {
+	defer Set(DefaultCatalog)
+
+	starter, ok := Get("starter")
+	if !ok || starter.MaxAPIKeys == 0 || starter.HasFeature(FeatureSignedRequests) || !starter.HasFeature(FeaturePublishableKeys) {
+		t.Fatalf("starter: %+v", starter)
+	}
+	// a tier missing from the catalog is unlimited
+	if custom, ok := Get("legacy"); ok || custom.MonthlyValidations != 0 || !custom.HasFeature(FeatureIPAllowlists) {
+		t.Fatalf("unknown tier: %+v, %v", custom, ok)
+	}
+
+	path := filepath.Join(t.TempDir(), "tiers.json")
+	os.WriteFile(path, []byte(`[{"name": "free", "monthly_validations": 100}, {"name": "team", "features": ["signed_requests"]}]`), 0o600)
+	if err := LoadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if names := Names(); len(names) != 2 || names[0] != "free" || names[1] != "team" {
+		t.Fatalf("names: %v", names)
+	}
+	for _, bad := range []string{`[]`, `[{"name": "a"}, {"name": "a"}]`, `[{"name": "a", "max_api_keys": -1}]`, `[{"name": "a", "features": ["sso"]}]`} {
+		os.WriteFile(path, []byte(bad), 0o600)
+		if err := LoadFile(path); err == nil {
+			t.Fatalf("expected %s to be rejected", bad)
+		}
+	}
+	if _, ok := Get("free"); !ok {
+		t.Fatal("a rejected file must leave the catalog alone")
+	}
+}
+
+func TestPeriod(t *testing.T) {
+	start, end := Period(time.Date(2026, 12, 31, 23, 59, 0, 0, time.FixedZone("", -5*3600)))
+	if !start.Equal(time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)) || !end.Equal(time.Date(2027, 2, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("period: %v - %v", start, end)
+	}
+	if softLimit(10000, 80) != 8000 || softLimit(3, 80) != 3 {
+		t.Fatal("soft limit")
+	}
+	if (Quota{Limit: 5, Used: 7}).Remaining() != 0 || (Quota{}).Remaining() != -1 {
+		t.Fatal("remaining")
+	}
+}
@@ -0,0 +1,225 @@
+package usage
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"otp/internal/db"
+)
+
+// Usage events and API key counters (usage_count and the last use) are buffered in memory and
+// written in batches: events with COPY, counters with a single UPDATE. Until Start is called
+// (tools, tests, or a zero USAGE_FLUSH_INTERVAL_MS) every call writes through.
+
+// maxBuffered bounds the events kept for retry while the database is failing.
+const maxBuffered = 100000
+
+// maxUserAgentLength matches api_keys.last_used_user_agent (in bytes, which bounds characters).
+const maxUserAgentLength = 512
+
+type event struct {
+	customerID, apiKeyID, endpoint, userID, env string
+	success                                     bool
+	at                                          time.Time
+}
+
+type keyUse struct {
+	n             int64
+	last          time.Time
+	ip, userAgent string
+}
+
+var (
+	mu        sync.Mutex
+	events    []event
+	keyUses   = map[string]keyUse{}
+	batchSize int
+	running   bool
+	kick      = make(chan struct{}, 1)
+	stop      chan struct{}
+	done      chan struct{}
+
+	// serializes flushes so a retry can't reorder batches
+	flushMu sync.Mutex
+)
+
+// TouchKey counts a request authenticated with an API key and remembers the client it came
+// from.
+func TouchKey(id, ip, userAgent string) {
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = userAgent[:maxUserAgentLength]
+	}
+	// invalid UTF-8, from the client or a cut inside a character, would fail the whole batch
+	userAgent = strings.ToValidUTF8(userAgent, "")
+	mu.Lock()
+	u := keyUses[id]
+	u.n++
+	u.last, u.ip, u.userAgent = time.Now(), ip, userAgent
+	keyUses[id] = u
+	buffered := running
+	mu.Unlock()
+	if !buffered {
+		flushOrLog()
+	}
+}
+
+func enqueue(e event) {
+	mu.Lock()
+	events = append(events, e)
+	full := len(events) >= batchSize
+	buffered := running
+	mu.Unlock()
+	if !buffered {
+		flushOrLog()
+		return
+	}
+	if full {
+		select {
+		case kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Start flushes buffered usage every interval, or as soon as size events are waiting.
+func Start(interval time.Duration, size int) {
+	mu.Lock()
+	if running {
+		mu.Unlock()
+		return
+	}
+	running, batchSize = true, size
+	stop, done = make(chan struct{}), make(chan struct{})
+	mu.Unlock()
+	go func() {
+		defer close(done)
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+			case <-kick:
+			case <-stop:
+				return
+			}
+			flushOrLog()
+		}
+	}()
+}
+
+// Stop ends the flusher and writes everything still buffered. Call it on shutdown once the
+// HTTP server no longer accepts requests; usage recorded afterwards is written through.
+func Stop() error {
+	mu.Lock()
+	wasRunning := running
+	running = false
+	mu.Unlock()
+	if wasRunning {
+		close(stop)
+		<-done
+	}
+	return Flush()
+}
+
+// Flush writes buffered events and key counters now. On failure they are kept for the next
+// attempt.
+func Flush() error {
+	flushMu.Lock()
+	defer flushMu.Unlock()
+	mu.Lock()
+	evs, uses := events, keyUses
+	events, keyUses = nil, map[string]keyUse{}
+	mu.Unlock()
+	if len(evs) == 0 && len(uses) == 0 {
+		return nil
+	}
+	if err := write(evs, uses); err != nil {
+		requeue(evs, uses)
+		return err
+	}
+	return nil
+}
+
+func flushOrLog() {
+	if err := Flush(); err != nil {
+		log.Printf("usage flush failed: %v", err)
+	}
+}
+
+func requeue(evs []event, uses map[string]keyUse) {
+	mu.Lock()
+	defer mu.Unlock()
+	events = append(evs, events...)
+	if over := len(events) - maxBuffered; over > 0 {
+		log.Printf("usage buffer full, dropping %d oldest events", over)
+		events = events[over:]
+	}
+	for id, u := range uses {
+		cur := keyUses[id]
+		cur.n += u.n
+		if u.last.After(cur.last) {
+			cur.last, cur.ip, cur.userAgent = u.last, u.ip, u.userAgent
+		}
+		keyUses[id] = cur
+	}
+}
+
+func write(evs []event, uses map[string]keyUse) error {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if len(evs) > 0 {
+		stmt, err := tx.Prepare(pq.CopyIn("usage_events", "customer_id", "api_key_id", "endpoint", "success", "user_id", "environment", "created_at"))
+		if err != nil {
+			return err
+		}
+		for _, e := range evs {
+			var userID any
+			if e.userID != "" {
+				userID = e.userID
+			}
+			if _, err := stmt.Exec(e.customerID, e.apiKeyID, e.endpoint, e.success, userID, e.env, e.at); err != nil {
+				stmt.Close()
+				return err
+			}
+		}
+		if _, err := stmt.Exec(); err != nil {
+			stmt.Close()
+			return err
+		}
+		if err := stmt.Close(); err != nil {
+			return err
+		}
+	}
+
+	if len(uses) > 0 {
+		ids := make([]string, 0, len(uses))
+		counts := make([]int64, 0, len(uses))
+		lasts := make([]string, 0, len(uses))
+		ips := make([]string, 0, len(uses))
+		agents := make([]string, 0, len(uses))
+		for id, u := range uses {
+			ids = append(ids, id)
+			counts = append(counts, u.n)
+			lasts = append(lasts, u.last.Format(time.RFC3339Nano))
+			ips = append(ips, u.ip)
+			agents = append(agents, u.userAgent)
+		}
+		// another instance may have written a later use already
+		_, err := tx.Exec(`UPDATE api_keys k SET usage_count = k.usage_count + v.n, last_used_at = GREATEST(k.last_used_at, v.last_used_at),
+			last_used_ip = CASE WHEN k.last_used_at IS NULL OR v.last_used_at >= k.last_used_at THEN v.ip ELSE k.last_used_ip END,
+			last_used_user_agent = CASE WHEN k.last_used_at IS NULL OR v.last_used_at >= k.last_used_at THEN v.user_agent ELSE k.last_used_user_agent END
+			FROM unnest($1::uuid[], $2::bigint[], $3::timestamptz[], $4::text[], $5::text[]) AS v(id, n, last_used_at, ip, user_agent) WHERE k.id = v.id`,
+			pq.Array(ids), pq.Array(counts), pq.Array(lasts), pq.Array(ips), pq.Array(agents))
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
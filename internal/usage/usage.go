@@ -3,11 +3,12 @@ package usage
 import (
 	"time"
 	"github.com/gin-gonic/gin"
-	"otp/internal/db"
 	"otp/internal/realtime"
 )
 
-// Record inserts a usage event if api_key_id and customer_id are present in context.
+// Record buffers a usage event if api_key_id and customer_id are present in context; the
+// flusher writes it in the next batch.
+// The subject MFA user is taken from mfa_user_id in context when a handler has set it.
 // endpoint examples: "mfa.validate", "mfa.backup_codes.consume", "mfa.register"
 func Record(c *gin.Context, endpoint string, success bool) {
 	apiKeyID := c.GetString("api_key_id")
@@ -15,7 +16,13 @@ func Record(c *gin.Context, endpoint string, success bool) {
 	if apiKeyID == "" || customerID == "" {
 		return
 	}
-	_, _ = db.DB.Exec(`INSERT INTO usage_events (customer_id, api_key_id, endpoint, success) VALUES ($1, $2, $3, $4)`, customerID, apiKeyID, endpoint, success)
+	userID := c.GetString("mfa_user_id")
+	// test key usage is kept apart so it isn't billed
+	env := c.GetString("environment")
+	if env == "" {
+		env = "live"
+	}
+	enqueue(event{customerID: customerID, apiKeyID: apiKeyID, endpoint: endpoint, success: success, userID: userID, env: env, at: time.Now()})
 
 	// Fire-and-forget realtime notification
 	realtime.PublishDefault(customerID, realtime.Event{
@@ -24,6 +31,26 @@ func Record(c *gin.Context, endpoint string, success bool) {
 		Data: map[string]any{
 			"endpoint": endpoint,
 			"success":  success,
+			"environment": env,
 		},
 	})
 }
+
+// RateLimitedEndpoint is the endpoint recorded for requests rejected by a rate limit. They are
+// failed events but not billable.
+const RateLimitedEndpoint = "rate_limited"
+
+// RecordRateLimited records a request an API key rate limit rejected. Unlike Record it doesn't
+// publish a realtime event, so a client hammering the API doesn't flood the customer's stream.
+func RecordRateLimited(c *gin.Context) {
+	apiKeyID := c.GetString("api_key_id")
+	customerID := c.GetString("customer_id")
+	if apiKeyID == "" || customerID == "" {
+		return
+	}
+	env := c.GetString("environment")
+	if env == "" {
+		env = "live"
+	}
+	enqueue(event{customerID: customerID, apiKeyID: apiKeyID, endpoint: RateLimitedEndpoint, success: false, env: env, at: time.Now()})
+}
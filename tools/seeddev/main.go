@@ -67,6 +67,8 @@ func ensureCustomer(email, password, company, stripeID string) (string, error) {
 	}
 	// ensure stripe id
 	_, _ = db.DB.Exec(`UPDATE customers SET stripe_customer_id = $1, updated_at = NOW() WHERE id = $2`, stripeID, id)
+	// the owner member logs in with the customer's email and password
+	_, _ = db.DB.Exec(`INSERT INTO members (id, customer_id, email, password_hash, role) SELECT id, id, email, password_hash, 'owner' FROM customers WHERE id = $1 ON CONFLICT DO NOTHING`, id)
 	return id, nil
 }
 
@@ -82,7 +84,7 @@ func ensureSession(customerID string) (string, error) {
 	t, err := keys.RandomHex(32)
 	if err != nil { return "", err }
 	exp := time.Now().Add(30 * 24 * time.Hour)
-	if _, err := db.DB.Exec(`INSERT INTO sessions (customer_id, token, expires_at) VALUES ($1,$2,$3)`, customerID, t, exp); err != nil {
+	if _, err := db.DB.Exec(`INSERT INTO sessions (customer_id, member_id, token, expires_at) VALUES ($1,$1,$2,$3)`, customerID, t, exp); err != nil {
 		return "", err
 	}
 	return t, nil